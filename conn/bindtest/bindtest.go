@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package bindtest provides Binds that carry datagrams between each
+// other in memory, for tests and simulations that should not depend on
+// the network.
+package bindtest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+var errClosed = errors.New("bind closed")
+
+// A ChannelBind is one end of a pair made by NewChannelBinds. It only
+// carries IPv4.
+type ChannelBind struct {
+	rx, tx    chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+	source    ChannelEndpoint // where datagrams from the other end come from
+	target    ChannelEndpoint // the only endpoint Send accepts
+	mark      uint32
+	flowLabel uint32 // accessed atomically; see LastFlowLabel
+}
+
+var _ conn.FlowLabelBind = (*ChannelBind)(nil)
+
+// QueueSize is how many datagrams a ChannelBind holds for its reader
+// before Send drops them.
+const QueueSize = 1024
+
+// NewChannelBinds returns two Binds connected to each other. Each is
+// reachable from the other at the endpoint returned for it, which
+// ParseEndpoint, suitable for DeviceOptions.CreateEndpoint, also
+// accepts in its string form.
+func NewChannelBinds() (binds [2]*ChannelBind, endpoints [2]ChannelEndpoint) {
+	a, b := make(chan []byte, QueueSize), make(chan []byte, QueueSize)
+	endpoints = [2]ChannelEndpoint{1, 2}
+	binds[0] = &ChannelBind{rx: a, tx: b, closed: make(chan struct{}), source: endpoints[1], target: endpoints[1]}
+	binds[1] = &ChannelBind{rx: b, tx: a, closed: make(chan struct{}), source: endpoints[0], target: endpoints[0]}
+	return binds, endpoints
+}
+
+// Reopen returns a new Bind at the same end of the pair as b, as a
+// socket bound again to the same port would be, for when b is closed.
+func (b *ChannelBind) Reopen() *ChannelBind {
+	return &ChannelBind{rx: b.rx, tx: b.tx, closed: make(chan struct{}), source: b.source, target: b.target}
+}
+
+func (b *ChannelBind) LastMark() uint32 { return b.mark }
+
+func (b *ChannelBind) SetMark(mark uint32) error {
+	b.mark = mark
+	return nil
+}
+
+func (b *ChannelBind) ReceiveIPv4(buf []byte) (int, conn.Endpoint, error) {
+	select {
+	case <-b.closed:
+		return 0, nil, errClosed
+	case pkt := <-b.rx:
+		return copy(buf, pkt), b.source, nil
+	}
+}
+
+func (b *ChannelBind) ReceiveIPv6(buf []byte) (int, conn.Endpoint, error) {
+	<-b.closed
+	return 0, nil, errClosed
+}
+
+// Send delivers a copy of pkt to the other end, dropping it if the other
+// end's queue is full.
+func (b *ChannelBind) Send(pkt []byte, ep conn.Endpoint) error {
+	select {
+	case <-b.closed:
+		return errClosed
+	default:
+	}
+	if ep, ok := ep.(ChannelEndpoint); !ok || ep != b.target {
+		return fmt.Errorf("no route to %v", ep)
+	}
+	select {
+	case b.tx <- append([]byte(nil), pkt...):
+	default:
+	}
+	return nil
+}
+
+// SendWithFlowLabel is Send. A ChannelBind only carries IPv4, which has
+// no flow label, but records label for LastFlowLabel.
+func (b *ChannelBind) SendWithFlowLabel(pkt []byte, ep conn.Endpoint, label uint32) error {
+	atomic.StoreUint32(&b.flowLabel, label)
+	return b.Send(pkt, ep)
+}
+
+// LastFlowLabel returns the label of the last SendWithFlowLabel.
+func (b *ChannelBind) LastFlowLabel() uint32 {
+	return atomic.LoadUint32(&b.flowLabel)
+}
+
+func (b *ChannelBind) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+// A ChannelEndpoint is an end of a pair of ChannelBinds. It reads as a
+// port on 127.0.0.1.
+type ChannelEndpoint uint16
+
+var _ conn.Endpoint = ChannelEndpoint(0)
+
+// ParseEndpoint parses the string form of a ChannelEndpoint.
+func ParseEndpoint(s string) (conn.Endpoint, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || host != "127.0.0.1" {
+		return nil, fmt.Errorf("invalid channel endpoint %q", s)
+	}
+	return ChannelEndpoint(n), nil
+}
+
+func (ChannelEndpoint) ClearSrc() {}
+
+func (ChannelEndpoint) SrcToString() string { return "" }
+
+func (e ChannelEndpoint) DstToString() string {
+	return fmt.Sprintf("127.0.0.1:%d", e)
+}
+
+func (e ChannelEndpoint) DstToBytes() []byte {
+	return []byte{byte(e >> 8), byte(e)}
+}
+
+func (ChannelEndpoint) DstIP() net.IP { return net.IPv4(127, 0, 0, 1) }
+
+func (ChannelEndpoint) SrcIP() net.IP { return nil }
+
+func (e ChannelEndpoint) Addrs() string { return e.DstToString() }
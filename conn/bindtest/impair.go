@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+// Impairments are what an ImpairedBind does to the datagrams sent through
+// it, as a poor network path would. The zero value does nothing.
+type Impairments struct {
+	Loss      float64 // fraction of datagrams dropped
+	Duplicate float64 // fraction of datagrams sent twice
+	Reorder   float64 // fraction of datagrams held back by ReorderDelay, for later ones to overtake
+
+	// ReorderDelay is how long reordered datagrams are held back, on top
+	// of Delay. If zero, a millisecond.
+	ReorderDelay time.Duration
+
+	// Delay is how long every datagram takes to be sent, and Jitter the
+	// most by which a random further delay lengthens it.
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// MTU, if positive, is the largest datagram carried. Larger ones are
+	// dropped without notice, as by a path that blocks ICMP.
+	MTU int
+
+	// Seed seeds the choice of datagrams impaired, so that a test
+	// impairs the same ones each run.
+	Seed int64
+}
+
+// ImpairStats counts what an ImpairedBind did to the datagrams sent
+// through it.
+type ImpairStats struct {
+	Sent       uint64 // passed to the underlying Bind, counting duplicates
+	Lost       uint64 // dropped for Loss
+	TooBig     uint64 // dropped for exceeding MTU
+	Duplicated uint64
+	Reordered  uint64
+}
+
+// An ImpairedBind is a Bind that impairs the datagrams sent through it
+// before passing them to another. Datagrams it receives are untouched;
+// impair both ends for a path that is poor in both directions.
+type ImpairedBind struct {
+	conn.Bind
+
+	mu    sync.Mutex
+	imp   Impairments
+	rand  *rand.Rand
+	stats ImpairStats
+}
+
+// Impair returns b impaired by imp.
+func Impair(b conn.Bind, imp Impairments) *ImpairedBind {
+	return &ImpairedBind{
+		Bind: b,
+		imp:  imp,
+		rand: rand.New(rand.NewSource(imp.Seed)),
+	}
+}
+
+// SetImpairments replaces the impairments of b, for datagrams sent from
+// then on. The random source is reseeded from imp.Seed.
+func (b *ImpairedBind) SetImpairments(imp Impairments) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.imp = imp
+	b.rand = rand.New(rand.NewSource(imp.Seed))
+}
+
+// Stats returns what b has done to the datagrams sent through it.
+func (b *ImpairedBind) Stats() ImpairStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// Send impairs pkt, then sends it, its copies or nothing to ep through
+// the underlying Bind. Delayed datagrams are sent in the background, and
+// any error sending them is lost, as on a network.
+func (b *ImpairedBind) Send(pkt []byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	imp := &b.imp
+	if imp.MTU > 0 && len(pkt) > imp.MTU {
+		b.stats.TooBig++
+		b.mu.Unlock()
+		return nil
+	}
+	if imp.Loss > 0 && b.rand.Float64() < imp.Loss {
+		b.stats.Lost++
+		b.mu.Unlock()
+		return nil
+	}
+	copies := 1
+	if imp.Duplicate > 0 && b.rand.Float64() < imp.Duplicate {
+		copies = 2
+		b.stats.Duplicated++
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = imp.Delay
+		if imp.Jitter > 0 {
+			delays[i] += time.Duration(b.rand.Int63n(int64(imp.Jitter)))
+		}
+	}
+	if imp.Reorder > 0 && b.rand.Float64() < imp.Reorder {
+		held := imp.ReorderDelay
+		if held == 0 {
+			held = time.Millisecond
+		}
+		delays[0] += held
+		b.stats.Reordered++
+	}
+	b.stats.Sent += uint64(copies)
+	b.mu.Unlock()
+
+	var err error
+	for _, d := range delays {
+		if d == 0 {
+			if e := b.Bind.Send(pkt, ep); err == nil {
+				err = e
+			}
+			continue
+		}
+		delayed := append([]byte(nil), pkt...)
+		time.AfterFunc(d, func() { b.Bind.Send(delayed, ep) })
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+// A Network carries datagrams in memory between any number of Binds made
+// by NewBind, each reachable from the others at its own endpoint, for
+// tests and benchmarks of more than two devices.
+type Network struct {
+	mu    sync.RWMutex
+	binds map[ChannelEndpoint]*NetworkBind
+	next  ChannelEndpoint
+}
+
+// NewNetwork returns an empty Network.
+func NewNetwork() *Network {
+	return &Network{binds: make(map[ChannelEndpoint]*NetworkBind), next: 1}
+}
+
+// NewBind returns a new Bind on n, and the endpoint it is reachable at.
+// Like a ChannelBind, it only carries IPv4.
+func (n *Network) NewBind() (*NetworkBind, ChannelEndpoint) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ep := n.next
+	n.next++
+	b := &NetworkBind{
+		network: n,
+		self:    ep,
+		rx:      make(chan datagram, QueueSize),
+		closed:  make(chan struct{}),
+	}
+	n.binds[ep] = b
+	return b, ep
+}
+
+type datagram struct {
+	pkt []byte
+	src ChannelEndpoint
+}
+
+// A NetworkBind is a Bind on a Network.
+type NetworkBind struct {
+	network   *Network
+	self      ChannelEndpoint
+	rx        chan datagram
+	closeOnce sync.Once
+	closed    chan struct{}
+	mark      uint32
+}
+
+var _ conn.Bind = (*NetworkBind)(nil)
+
+func (b *NetworkBind) LastMark() uint32 { return b.mark }
+
+func (b *NetworkBind) SetMark(mark uint32) error {
+	b.mark = mark
+	return nil
+}
+
+func (b *NetworkBind) ReceiveIPv4(buf []byte) (int, conn.Endpoint, error) {
+	select {
+	case <-b.closed:
+		return 0, nil, errClosed
+	case d := <-b.rx:
+		return copy(buf, d.pkt), d.src, nil
+	}
+}
+
+func (b *NetworkBind) ReceiveIPv6(buf []byte) (int, conn.Endpoint, error) {
+	<-b.closed
+	return 0, nil, errClosed
+}
+
+// Send delivers a copy of pkt to the Bind at ep, dropping it if that
+// Bind's queue is full.
+func (b *NetworkBind) Send(pkt []byte, ep conn.Endpoint) error {
+	select {
+	case <-b.closed:
+		return errClosed
+	default:
+	}
+	dst, ok := ep.(ChannelEndpoint)
+	if ok {
+		b.network.mu.RLock()
+		to := b.network.binds[dst]
+		b.network.mu.RUnlock()
+		if to != nil {
+			select {
+			case to.rx <- datagram{append([]byte(nil), pkt...), b.self}:
+			default:
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no route to %v", ep)
+}
+
+// Close closes b. Datagrams sent to its endpoint wait, up to QueueSize,
+// for the Bind Reopen returns.
+func (b *NetworkBind) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+// Reopen returns a new Bind at b's endpoint, as a socket bound again to
+// the same port would be, for when b is closed.
+func (b *NetworkBind) Reopen() *NetworkBind {
+	nb := &NetworkBind{
+		network: b.network,
+		self:    b.self,
+		rx:      b.rx,
+		closed:  make(chan struct{}),
+	}
+	b.network.mu.Lock()
+	b.network.binds[b.self] = nb
+	b.network.mu.Unlock()
+	return nb
+}
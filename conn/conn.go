@@ -9,6 +9,7 @@ package conn
 import (
 	"errors"
 	"net"
+	"os"
 	"strings"
 )
 
@@ -50,7 +51,52 @@ type Bind interface {
 // The value actualPort reports the actual port number the Bind
 // object gets bound to.
 func CreateBind(port uint16) (b Bind, actualPort uint16, err error) {
-	return createBind(port)
+	return createBind(port, BindOptions{})
+}
+
+// BindOptions restricts where a Bind created by CreateBindWithOptions
+// listens.
+type BindOptions struct {
+	// Addr, if non-nil, is the local address to listen on, instead of
+	// the unspecified address. Only its address family is opened.
+	Addr net.IP
+
+	// Interface, if non-empty, names the network interface to tie the
+	// sockets to, as SO_BINDTODEVICE does. It is only supported on Linux.
+	Interface string
+
+	// ReceiveBuffer and SendBuffer, if positive, size the sockets'
+	// buffers in bytes, as SO_RCVBUF and SO_SNDBUF do. The system's
+	// defaults are too small to take bursts at gigabit rates without
+	// dropping datagrams. The system may cap the sizes; on Linux, the
+	// Bind goes past net.core.rmem_max and wmem_max if it has
+	// CAP_NET_ADMIN.
+	ReceiveBuffer int
+	SendBuffer    int
+
+	// Control, if non-nil, is called with each of the Bind's sockets,
+	// "udp4" or "udp6", as soon as it is created, before it is bound or
+	// sends anything. An error fails the Bind. Android apps call
+	// VpnService.protect from it, so that the tunnel's own datagrams do
+	// not loop back into the tunnel; as each new Bind calls it, the
+	// device's rebinds are covered too.
+	Control func(network string, fd uintptr) error
+}
+
+// families reports which address families a Bind with opts listens on.
+func (opts BindOptions) families() (v4, v6 bool) {
+	if opts.Addr == nil {
+		return true, true
+	}
+	if opts.Addr.To4() != nil {
+		return true, false
+	}
+	return false, true
+}
+
+// CreateBindWithOptions is like CreateBind, but binds as opts specifies.
+func CreateBindWithOptions(port uint16, opts BindOptions) (b Bind, actualPort uint16, err error) {
+	return createBind(port, opts)
 }
 
 // BindSocketToInterface is implemented by Bind objects that support being
@@ -67,6 +113,54 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// FileBind is implemented by Bind objects whose sockets can be passed to
+// another process, which recreates the Bind with CreateBindFromFiles.
+type FileBind interface {
+	// Files returns copies of the Bind's IPv4 and IPv6 sockets, nil
+	// for a family it does not listen on. The caller must close them.
+	Files() (ipv4, ipv6 *os.File, err error)
+}
+
+// FlowLabelBind is implemented by Bind objects that can set the IPv6 flow
+// label of the datagrams they send, so that equal-cost multipath routers
+// hashing on it keep a session on one path.
+type FlowLabelBind interface {
+	Bind
+
+	// SendWithFlowLabel is like Send, but labels the datagram with the
+	// low 20 bits of label if it goes over IPv6. A label of zero, or one
+	// the system refuses, sends the datagram unlabelled.
+	SendWithFlowLabel(b []byte, ep Endpoint, label uint32) error
+}
+
+// SocketBufferBind is implemented by Bind objects whose socket buffers
+// can be resized and watched for overflow.
+type SocketBufferBind interface {
+	Bind
+
+	// SetSocketBuffers sizes the buffers as BindOptions.ReceiveBuffer
+	// and SendBuffer do. A size of zero leaves that buffer alone.
+	SetSocketBuffers(receive, send int) error
+
+	// SocketStats reports on the Bind's socket buffers.
+	SocketStats() (SocketStats, error)
+}
+
+// SocketStats reports on the buffers of a Bind's sockets.
+type SocketStats struct {
+	// ReceiveBuffer and SendBuffer are the buffer sizes the system
+	// gave the sockets, the smallest if there are two, in the terms of
+	// BindOptions: Linux sets aside twice the size asked for, to account
+	// for its bookkeeping, but they are reported halved.
+	ReceiveBuffer int
+	SendBuffer    int
+
+	// Drops is how many datagrams the system dropped on receipt since
+	// the sockets were opened, mostly for want of room in the receive
+	// buffer.
+	Drops uint64
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst : the remote address of a peer ("endpoint" in uapi terminology)
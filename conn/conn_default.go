@@ -8,6 +8,8 @@
 package conn
 
 import (
+	"context"
+	"errors"
 	"net"
 	"os"
 	"strconv"
@@ -33,7 +35,7 @@ type NativeEndpoint net.UDPAddr
 var _ Bind = (*nativeBind)(nil)
 var _ Endpoint = (*NativeEndpoint)(nil)
 
-func CreateEndpoint(s string) (Endpoint, error) {
+func createEndpoint(s string) (Endpoint, error) {
 	addr, err := parseEndpoint(s)
 	return (*NativeEndpoint)(addr), err
 }
@@ -68,14 +70,31 @@ func (e *NativeEndpoint) SrcToString() string {
 }
 
 func (e *NativeEndpoint) Addrs() string {
-	return net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port))
+	host := e.IP.String()
+	if e.Zone != "" {
+		host += "%" + e.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(e.Port))
 }
 
-func listenNet(network string, port int) (*net.UDPConn, int, error) {
-	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+func listenNet(network string, ip net.IP, port int, control func(network string, fd uintptr) error) (*net.UDPConn, int, error) {
+	var lc net.ListenConfig
+	if control != nil {
+		lc.Control = func(network, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = control(network, fd)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, (&net.UDPAddr{IP: ip, Port: port}).String())
 	if err != nil {
 		return nil, 0, err
 	}
+	conn := pc.(*net.UDPConn)
 
 	// Retrieve port.
 	laddr := conn.LocalAddr()
@@ -101,27 +120,66 @@ func extractErrno(err error) error {
 	return syscallErr.Err
 }
 
-func createBind(uport uint16) (Bind, uint16, error) {
+func createBind(uport uint16, opts BindOptions) (Bind, uint16, error) {
 	var err error
 	var bind nativeBind
 
+	if opts.Interface != "" {
+		return nil, 0, errors.New("binding to an interface is not supported on this platform")
+	}
+	want4, want6 := opts.families()
+
 	port := int(uport)
 
-	bind.ipv4, port, err = listenNet("udp4", port)
-	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
-		return nil, 0, err
+	if want4 {
+		bind.ipv4, port, err = listenNet("udp4", opts.Addr, port, opts.Control)
+		if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
+			return nil, 0, err
+		}
 	}
 
-	bind.ipv6, port, err = listenNet("udp6", port)
-	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
-		bind.ipv4.Close()
-		bind.ipv4 = nil
-		return nil, 0, err
+	if want6 {
+		bind.ipv6, port, err = listenNet("udp6", opts.Addr, port, opts.Control)
+		if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
+			if bind.ipv4 != nil {
+				bind.ipv4.Close()
+				bind.ipv4 = nil
+			}
+			return nil, 0, err
+		}
+	}
+
+	for _, conn := range []*net.UDPConn{bind.ipv4, bind.ipv6} {
+		if conn == nil {
+			continue
+		}
+		if err := setSocketBuffers(conn, opts.ReceiveBuffer, opts.SendBuffer); err != nil {
+			bind.Close()
+			return nil, 0, err
+		}
 	}
 
 	return &bind, uint16(port), nil
 }
 
+func setSocketBuffers(conn *net.UDPConn, receive, send int) error {
+	if receive > 0 {
+		if err := conn.SetReadBuffer(receive); err != nil {
+			return err
+		}
+	}
+	if send > 0 {
+		return conn.SetWriteBuffer(send)
+	}
+	return nil
+}
+
+// CreateBindFromFiles creates a Bind from the sockets of one returned
+// by FileBind.Files. It is only supported on Linux.
+func CreateBindFromFiles(ipv4, ipv6 *os.File) (Bind, uint16, error) {
+	return nil, 0, errors.New("creating a bind from files is not supported on this platform")
+}
+
 func (bind *nativeBind) Close() error {
 	var err1, err2 error
 	if bind.ipv4 != nil {
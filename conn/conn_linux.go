@@ -10,6 +10,7 @@ package conn
 import (
 	"errors"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"syscall"
@@ -66,19 +67,42 @@ func (e *NativeEndpoint) Addrs() string {
 	} else {
 		port = e.dst4().Port
 	}
-	return net.JoinHostPort(e.DstIP().String(), strconv.Itoa(port))
+	host := e.DstIP().String()
+	if zone := e.dstZone(); zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// dstZone returns the zone of a link-local IPv6 destination, or "". The
+// receive path sets ZoneId to the arriving interface for every IPv6
+// destination, to send back out of it, but only link-local addresses
+// need it to be told apart.
+func (e *NativeEndpoint) dstZone() string {
+	if !e.isV6 || e.dst6().ZoneId == 0 {
+		return ""
+	}
+	ip := e.DstIP()
+	if !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() {
+		return ""
+	}
+	return zoneToString(e.dst6().ZoneId)
 }
 
 type nativeBind struct {
-	sock4    int
-	sock6    int
-	lastMark uint32
+	sock4      int
+	sock6      int
+	lastMark   uint32
+	flowLabels flowLabelLeases
 }
 
 var _ Endpoint = (*NativeEndpoint)(nil)
 var _ Bind = (*nativeBind)(nil)
+var _ FileBind = (*nativeBind)(nil)
+var _ FlowLabelBind = (*nativeBind)(nil)
+var _ SocketBufferBind = (*nativeBind)(nil)
 
-func CreateEndpoint(s string) (Endpoint, error) {
+func createEndpoint(s string) (Endpoint, error) {
 	var end NativeEndpoint
 	addr, err := parseEndpoint(s)
 	if err != nil {
@@ -113,30 +137,40 @@ func CreateEndpoint(s string) (Endpoint, error) {
 	return nil, errors.New("Invalid IP address")
 }
 
-func createBind(port uint16) (Bind, uint16, error) {
+func createBind(port uint16, opts BindOptions) (Bind, uint16, error) {
 	var err error
 	var bind nativeBind
 	var newPort uint16
 
+	bind.sock4 = FD_ERR
+	bind.sock6 = FD_ERR
+	want4, want6 := opts.families()
+
 	// Attempt ipv6 bind, update port if successful.
-	bind.sock6, newPort, err = create6(port)
-	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
-			return nil, 0, err
+	if want6 {
+		bind.sock6, newPort, err = create6(port, opts)
+		if err != nil {
+			if err != syscall.EAFNOSUPPORT {
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
 		}
-	} else {
-		port = newPort
 	}
 
 	// Attempt ipv4 bind, update port if successful.
-	bind.sock4, newPort, err = create4(port)
-	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
-			unix.Close(bind.sock6)
-			return nil, 0, err
+	if want4 {
+		bind.sock4, newPort, err = create4(port, opts)
+		if err != nil {
+			if err != syscall.EAFNOSUPPORT {
+				if bind.sock6 != FD_ERR {
+					unix.Close(bind.sock6)
+				}
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
 		}
-	} else {
-		port = newPort
 	}
 
 	if bind.sock4 == FD_ERR && bind.sock6 == FD_ERR {
@@ -146,6 +180,79 @@ func createBind(port uint16) (Bind, uint16, error) {
 	return &bind, port, nil
 }
 
+// CreateBindFromFiles creates a Bind from the sockets of one returned
+// by FileBind.Files, typically received from another process. Either
+// may be nil. The Bind uses copies of the sockets; the caller must
+// close the files.
+func CreateBindFromFiles(ipv4, ipv6 *os.File) (Bind, uint16, error) {
+	bind := nativeBind{sock4: FD_ERR, sock6: FD_ERR}
+	var port int
+	for _, f := range []struct {
+		file *os.File
+		sock *int
+	}{
+		{ipv4, &bind.sock4},
+		{ipv6, &bind.sock6},
+	} {
+		if f.file == nil {
+			continue
+		}
+		sa, err := unix.Getsockname(int(f.file.Fd()))
+		if err != nil {
+			bind.Close()
+			return nil, 0, err
+		}
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			port = sa.Port
+		case *unix.SockaddrInet6:
+			port = sa.Port
+		default:
+			bind.Close()
+			return nil, 0, errors.New("not a UDP socket")
+		}
+		if *f.sock, err = dupCloexec(int(f.file.Fd())); err != nil {
+			bind.Close()
+			return nil, 0, err
+		}
+	}
+	if bind.sock4 == FD_ERR && bind.sock6 == FD_ERR {
+		return nil, 0, errors.New("no sockets")
+	}
+	return &bind, uint16(port), nil
+}
+
+func dupCloexec(fd int) (int, error) {
+	fd, err := unix.Dup(fd)
+	if err != nil {
+		return FD_ERR, err
+	}
+	unix.CloseOnExec(fd)
+	return fd, nil
+}
+
+// Files implements FileBind.
+func (bind *nativeBind) Files() (ipv4, ipv6 *os.File, err error) {
+	if bind.sock4 != FD_ERR {
+		fd, err := dupCloexec(bind.sock4)
+		if err != nil {
+			return nil, nil, err
+		}
+		ipv4 = os.NewFile(uintptr(fd), "udp4")
+	}
+	if bind.sock6 != FD_ERR {
+		fd, err := dupCloexec(bind.sock6)
+		if err != nil {
+			if ipv4 != nil {
+				ipv4.Close()
+			}
+			return nil, nil, err
+		}
+		ipv6 = os.NewFile(uintptr(fd), "udp6")
+	}
+	return ipv4, ipv6, nil
+}
+
 func (bind *nativeBind) LastMark() uint32 {
 	return bind.lastMark
 }
@@ -288,6 +395,7 @@ func (end *NativeEndpoint) DstToString() string {
 		udpAddr.Port = end.dst4().Port
 	} else {
 		udpAddr.Port = end.dst6().Port
+		udpAddr.Zone = end.dstZone()
 	}
 	return udpAddr.String()
 }
@@ -315,7 +423,16 @@ func zoneToUint32(zone string) (uint32, error) {
 	return uint32(n), err
 }
 
-func create4(port uint16) (int, uint16, error) {
+// zoneToString returns the name of the interface with index zone, or the
+// index itself if there is none.
+func zoneToString(zone uint32) string {
+	if intr, err := net.InterfaceByIndex(int(zone)); err == nil {
+		return intr.Name
+	}
+	return strconv.FormatUint(uint64(zone), 10)
+}
+
+func create4(port uint16, opts BindOptions) (int, uint16, error) {
 
 	// create socket
 
@@ -332,10 +449,19 @@ func create4(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet4{
 		Port: int(port),
 	}
+	if opts.Addr != nil {
+		copy(addr.Addr[:], opts.Addr.To4())
+	}
 
 	// set sockopts and bind
 
 	if err := func() error {
+		if opts.Control != nil {
+			if err := opts.Control("udp4", uintptr(fd)); err != nil {
+				return err
+			}
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IP,
@@ -345,6 +471,16 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if err := setSocketBuffers(fd, opts.ReceiveBuffer, opts.SendBuffer); err != nil {
+			return err
+		}
+
+		if opts.Interface != "" {
+			if err := unix.BindToDevice(fd, opts.Interface); err != nil {
+				return err
+			}
+		}
+
 		return unix.Bind(fd, &addr)
 	}(); err != nil {
 		unix.Close(fd)
@@ -359,7 +495,7 @@ func create4(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func create6(port uint16) (int, uint16, error) {
+func create6(port uint16, opts BindOptions) (int, uint16, error) {
 
 	// create socket
 
@@ -378,8 +514,17 @@ func create6(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet6{
 		Port: int(port),
 	}
+	if opts.Addr != nil {
+		copy(addr.Addr[:], opts.Addr.To16())
+	}
 
 	if err := func() error {
+		if opts.Control != nil {
+			if err := opts.Control("udp6", uintptr(fd)); err != nil {
+				return err
+			}
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IPV6,
@@ -398,6 +543,16 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if err := setSocketBuffers(fd, opts.ReceiveBuffer, opts.SendBuffer); err != nil {
+			return err
+		}
+
+		if opts.Interface != "" {
+			if err := unix.BindToDevice(fd, opts.Interface); err != nil {
+				return err
+			}
+		}
+
 		return unix.Bind(fd, &addr)
 
 	}(); err != nil {
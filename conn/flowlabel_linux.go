@@ -0,0 +1,172 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Linux only sends a flow label a socket holds a lease on for the
+ * destination, taken with IPV6_FLOWLABEL_MGR, and only once
+ * IPV6_FLOWINFO_SEND is enabled. The labels with the top bit set may be
+ * reserved for those the kernel picks itself, and an unprivileged socket
+ * may hold only a few dozen leases, so labels that cannot be leased are
+ * sent without.
+ */
+
+const (
+	flowLabelMask = 0x7ffff
+
+	// From linux/in6.h; golang.org/x/sys/unix has none of these.
+	ipv6FlowlabelMgr    = 32  // IPV6_FLOWLABEL_MGR
+	ipv6FlowinfoSend    = 33  // IPV6_FLOWINFO_SEND
+	ipv6FlowLabelGet    = 0   // IPV6_FL_A_GET
+	ipv6FlowLabelCreate = 1   // IPV6_FL_F_CREATE
+	ipv6FlowLabelShare  = 255 // IPV6_FL_S_ANY
+)
+
+// in6FlowLabelReq is struct in6_flowlabel_req.
+type in6FlowLabelReq struct {
+	dst     [16]byte
+	label   [4]byte // big endian
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+type flowLabelLease struct {
+	label uint32
+	dst   [16]byte
+}
+
+type flowLabelLeases struct {
+	sync.Mutex
+	sendEnabled bool
+	leased      map[flowLabelLease]bool // false if the lease was refused
+}
+
+// lease reports whether sock6 may send to dst with label, leasing it if
+// need be.
+func (leases *flowLabelLeases) lease(sock6 int, label uint32, dst [16]byte) bool {
+	leases.Lock()
+	defer leases.Unlock()
+	key := flowLabelLease{label, dst}
+	if ok, tried := leases.leased[key]; tried {
+		return ok
+	}
+	if !leases.sendEnabled {
+		if err := unix.SetsockoptInt(sock6, unix.IPPROTO_IPV6, ipv6FlowinfoSend, 1); err != nil {
+			return false
+		}
+		leases.sendEnabled = true
+	}
+	req := in6FlowLabelReq{
+		dst:    dst,
+		action: ipv6FlowLabelGet,
+		share:  ipv6FlowLabelShare,
+		flags:  ipv6FlowLabelCreate,
+	}
+	binary.BigEndian.PutUint32(req.label[:], label)
+	err := unix.SetsockoptString(sock6, unix.IPPROTO_IPV6, ipv6FlowlabelMgr,
+		string((*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:]))
+	if leases.leased == nil {
+		leases.leased = make(map[flowLabelLease]bool)
+	}
+	leases.leased[key] = err == nil
+	return err == nil
+}
+
+// SendWithFlowLabel implements FlowLabelBind.
+func (bind *nativeBind) SendWithFlowLabel(buff []byte, end Endpoint, label uint32) error {
+	nend := end.(*NativeEndpoint)
+	label &= flowLabelMask
+	if !nend.isV6 || label == 0 {
+		return bind.Send(buff, end)
+	}
+	if bind.sock6 == -1 {
+		return syscall.EAFNOSUPPORT
+	}
+	nend.Lock()
+	dst := nend.dst6().Addr
+	nend.Unlock()
+	if !bind.flowLabels.lease(bind.sock6, label, dst) {
+		return send6(bind.sock6, nend, buff)
+	}
+	return send6WithFlowLabel(bind.sock6, nend, buff, label)
+}
+
+// send6WithFlowLabel is send6 with a flow label, which SockaddrInet6 has
+// no room for.
+func send6WithFlowLabel(sock int, end *NativeEndpoint, buff []byte, label uint32) error {
+	cmsg := struct {
+		cmsghdr unix.Cmsghdr
+		pktinfo unix.Inet6Pktinfo
+	}{
+		unix.Cmsghdr{
+			Level: unix.IPPROTO_IPV6,
+			Type:  unix.IPV6_PKTINFO,
+			Len:   unix.SizeofInet6Pktinfo + unix.SizeofCmsghdr,
+		},
+		unix.Inet6Pktinfo{
+			Addr:    end.src6().src,
+			Ifindex: end.dst6().ZoneId,
+		},
+	}
+
+	if cmsg.pktinfo.Addr == [16]byte{} {
+		cmsg.pktinfo.Ifindex = 0
+	}
+
+	end.Lock()
+	dst := end.dst6()
+	var sa unix.RawSockaddrInet6
+	sa.Family = unix.AF_INET6
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], uint16(dst.Port))
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&sa.Flowinfo))[:], label)
+	sa.Addr = dst.Addr
+	sa.Scope_id = dst.ZoneId
+	end.Unlock()
+
+	err := sendmsgRaw(sock, buff, &sa, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:])
+	if err == unix.EINVAL {
+		end.ClearSrc()
+		err = sendmsgRaw(sock, buff, &sa, nil)
+	}
+	return err
+}
+
+func sendmsgRaw(sock int, buff []byte, sa *unix.RawSockaddrInet6, oob []byte) error {
+	var iov unix.Iovec
+	if len(buff) > 0 {
+		iov.Base = &buff[0]
+		iov.SetLen(len(buff))
+	}
+	msg := unix.Msghdr{
+		Name:    (*byte)(unsafe.Pointer(sa)),
+		Namelen: uint32(unsafe.Sizeof(*sa)),
+		Iov:     &iov,
+	}
+	msg.SetIovlen(1)
+	if len(oob) > 0 {
+		msg.Control = &oob[0]
+		msg.SetControllen(len(oob))
+	}
+	_, _, errno := unix.Syscall(unix.SYS_SENDMSG, uintptr(sock), uintptr(unsafe.Pointer(&msg)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
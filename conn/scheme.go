@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var endpointSchemes struct {
+	sync.RWMutex
+	m map[string]func(string) (Endpoint, error)
+}
+
+func init() {
+	RegisterEndpointScheme("udp", createEndpoint)
+}
+
+// RegisterEndpointScheme makes CreateEndpoint parse endpoints beginning
+// with scheme followed by "://", such as "tcp://192.0.2.1:443", with
+// parse, which is given the rest of the endpoint. A transport other than
+// UDP registers its scheme, typically from an init function, so that
+// configurations can name its endpoints; the device sends to them with
+// the transport's Bind, given as its CreateBind. A later registration of
+// a scheme replaces an earlier one.
+//
+// The "udp" scheme, for the native Bind's endpoints, and "unix", for
+// CreateUnixBind's, are registered from the start. Others, such as "tcp"
+// and "ws", are left to the transports that implement them.
+func RegisterEndpointScheme(scheme string, parse func(s string) (Endpoint, error)) {
+	endpointSchemes.Lock()
+	defer endpointSchemes.Unlock()
+	if endpointSchemes.m == nil {
+		endpointSchemes.m = make(map[string]func(string) (Endpoint, error))
+	}
+	endpointSchemes.m[strings.ToLower(scheme)] = parse
+}
+
+// splitScheme splits s into its scheme and the rest, reporting whether it
+// has a scheme: letters, digits, '+', '-' and '.', beginning with a
+// letter, followed by "://".
+func splitScheme(s string) (scheme, rest string, ok bool) {
+	i := strings.Index(s, "://")
+	if i < 1 {
+		return "", s, false
+	}
+	for j, c := range s[:i] {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case j > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return "", s, false
+		}
+	}
+	return strings.ToLower(s[:i]), s[i+len("://"):], true
+}
+
+// CreateEndpoint parses s, a UDP "host:port" or an endpoint of a
+// registered scheme, such as "udp://192.0.2.1:51820" or
+// "unix:///run/wireguard/peer.sock"; see RegisterEndpointScheme.
+func CreateEndpoint(s string) (Endpoint, error) {
+	scheme, rest, ok := splitScheme(s)
+	if !ok {
+		return createEndpoint(s)
+	}
+	endpointSchemes.RLock()
+	parse := endpointSchemes.m[scheme]
+	endpointSchemes.RUnlock()
+	if parse == nil {
+		return nil, fmt.Errorf("no transport registered for endpoint scheme %q", scheme)
+	}
+	return parse(rest)
+}
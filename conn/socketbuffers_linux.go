@@ -0,0 +1,93 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* SO_MEMINFO returns the sk_meminfo array that sock_diag reports over
+ * netlink as INET_DIAG_SKMEMINFO, without needing a netlink socket.
+ */
+const (
+	skMeminfoRcvbuf = 1
+	skMeminfoSndbuf = 3
+	skMeminfoDrops  = 8
+	skMeminfoVars   = 9
+)
+
+func setSocketBuffer(fd, opt, forceOpt, size int) error {
+	if size <= 0 {
+		return nil
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, forceOpt, size); err == nil {
+		return nil
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, size)
+}
+
+func setSocketBuffers(fd, receive, send int) error {
+	if err := setSocketBuffer(fd, unix.SO_RCVBUF, unix.SO_RCVBUFFORCE, receive); err != nil {
+		return err
+	}
+	return setSocketBuffer(fd, unix.SO_SNDBUF, unix.SO_SNDBUFFORCE, send)
+}
+
+func socketMeminfo(fd int) (meminfo [skMeminfoVars]uint32, err error) {
+	size := uint32(unsafe.Sizeof(meminfo))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_MEMINFO,
+		uintptr(unsafe.Pointer(&meminfo)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return meminfo, errno
+	}
+	return meminfo, nil
+}
+
+// SetSocketBuffers implements SocketBufferBind.
+func (bind *nativeBind) SetSocketBuffers(receive, send int) error {
+	for _, fd := range []int{bind.sock4, bind.sock6} {
+		if fd == FD_ERR {
+			continue
+		}
+		if err := setSocketBuffers(fd, receive, send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SocketStats implements SocketBufferBind.
+func (bind *nativeBind) SocketStats() (SocketStats, error) {
+	var stats SocketStats
+	first := true
+	for _, fd := range []int{bind.sock4, bind.sock6} {
+		if fd == FD_ERR {
+			continue
+		}
+		meminfo, err := socketMeminfo(fd)
+		if err != nil {
+			return SocketStats{}, err
+		}
+		rcvbuf, sndbuf := int(meminfo[skMeminfoRcvbuf])/2, int(meminfo[skMeminfoSndbuf])/2
+		if first || rcvbuf < stats.ReceiveBuffer {
+			stats.ReceiveBuffer = rcvbuf
+		}
+		if first || sndbuf < stats.SendBuffer {
+			stats.SendBuffer = sndbuf
+		}
+		stats.Drops += uint64(meminfo[skMeminfoDrops])
+		first = false
+	}
+	if first {
+		return SocketStats{}, syscall.EBADF
+	}
+	return stats, nil
+}
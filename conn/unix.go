@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// UnixEndpointPrefix begins the endpoints of Binds created by
+// CreateUnixBind: "unix:///run/wireguard/peer.sock".
+const UnixEndpointPrefix = "unix://"
+
+// A UnixEndpoint is the socket of a Bind created by CreateUnixBind.
+type UnixEndpoint struct {
+	Path string // absolute
+}
+
+var _ Endpoint = (*UnixEndpoint)(nil)
+
+func init() {
+	RegisterEndpointScheme("unix", createUnixEndpoint)
+}
+
+// createUnixEndpoint parses path, an endpoint without UnixEndpointPrefix.
+func createUnixEndpoint(path string) (Endpoint, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("Unix endpoint must have an absolute path: " + path)
+	}
+	return &UnixEndpoint{Path: path}, nil
+}
+
+func (e *UnixEndpoint) ClearSrc()           {}
+func (e *UnixEndpoint) SrcToString() string { return "" }
+func (e *UnixEndpoint) DstToString() string { return UnixEndpointPrefix + e.Path }
+func (e *UnixEndpoint) DstToBytes() []byte  { return []byte(e.Path) }
+func (e *UnixEndpoint) DstIP() net.IP       { return nil }
+func (e *UnixEndpoint) SrcIP() net.IP       { return nil }
+func (e *UnixEndpoint) Addrs() string       { return e.DstToString() }
+
+type unixBind struct {
+	conn *net.UnixConn
+	path string
+}
+
+var _ Bind = (*unixBind)(nil)
+
+// CreateUnixBind creates a Bind over an AF_UNIX datagram socket bound to
+// path, for tunnels between processes or containers on one host. It
+// sends only to UnixEndpoints, and receives everything with ReceiveIPv4;
+// ReceiveIPv6 fails with EAFNOSUPPORT, as for a Bind with no IPv6 socket.
+// Closing the Bind removes the socket file. AF_UNIX datagram sockets are
+// not supported on Windows.
+func CreateUnixBind(path string) (Bind, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &unixBind{conn: conn, path: path}, nil
+}
+
+func (bind *unixBind) LastMark() uint32          { return 0 }
+func (bind *unixBind) SetMark(mark uint32) error { return nil }
+
+func (bind *unixBind) ReceiveIPv4(b []byte) (int, Endpoint, error) {
+	n, addr, err := bind.conn.ReadFromUnix(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	end := &UnixEndpoint{}
+	if addr != nil {
+		end.Path = addr.Name
+	}
+	return n, end, nil
+}
+
+func (bind *unixBind) ReceiveIPv6(b []byte) (int, Endpoint, error) {
+	return 0, nil, syscall.EAFNOSUPPORT
+}
+
+func (bind *unixBind) Send(b []byte, ep Endpoint) error {
+	end, ok := ep.(*UnixEndpoint)
+	if !ok {
+		return errors.New("not a unix endpoint: " + ep.DstToString())
+	}
+	if end.Path == "" {
+		return errors.New("unix endpoint has no path: the peer's socket is unbound")
+	}
+	_, err := bind.conn.WriteToUnix(b, &net.UnixAddr{Name: end.Path, Net: "unixgram"})
+	return err
+}
+
+func (bind *unixBind) Close() error {
+	err := bind.conn.Close()
+	if rerr := os.Remove(bind.path); err == nil && !os.IsNotExist(rerr) {
+		err = rerr
+	}
+	return err
+}
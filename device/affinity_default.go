@@ -0,0 +1,16 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+)
+
+func setAffinity(cpu int) error {
+	return errors.New("CPU affinity is not supported on this platform")
+}
@@ -6,11 +6,16 @@
 package device
 
 import (
+	"bytes"
 	"errors"
 	"math/bits"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"unsafe"
+
+	"inet.af/netaddr"
 )
 
 type trieEntry struct {
@@ -69,6 +74,9 @@ func commonBits(ip1 net.IP, ip2 net.IP) uint {
 	}
 }
 
+// removeByPeer returns node with the entries of p removed. Nodes are
+// copied rather than modified, so that the trie rooted at node is left as
+// it was for the readers still walking it.
 func (node *trieEntry) removeByPeer(p *Peer) *trieEntry {
 	if node == nil {
 		return node
@@ -76,26 +84,42 @@ func (node *trieEntry) removeByPeer(p *Peer) *trieEntry {
 
 	// walk recursively
 
-	node.child[0] = node.child[0].removeByPeer(p)
-	node.child[1] = node.child[1].removeByPeer(p)
+	child0 := node.child[0].removeByPeer(p)
+	child1 := node.child[1].removeByPeer(p)
 
-	if node.peer != p {
-		return node
+	if node.peer != p && node.peer != nil {
+		if child0 == node.child[0] && child1 == node.child[1] {
+			return node
+		}
+		copied := *node
+		copied.child = [2]*trieEntry{child0, child1}
+		return &copied
 	}
 
-	// remove peer & merge
+	// remove peer & merge, dropping nodes left with no peer and a
+	// single child
 
-	node.peer = nil
-	if node.child[0] == nil {
-		return node.child[1]
+	if child0 == nil {
+		return child1
+	}
+	if child1 == nil {
+		return child0
 	}
-	return node.child[0]
+	if node.peer == nil && child0 == node.child[0] && child1 == node.child[1] {
+		return node
+	}
+	copied := *node
+	copied.peer = nil
+	copied.child = [2]*trieEntry{child0, child1}
+	return &copied
 }
 
 func (node *trieEntry) choose(ip net.IP) byte {
 	return (ip[node.bit_at_byte] >> node.bit_at_shift) & 1
 }
 
+// insert returns node with ip/cidr routed to peer. Like removeByPeer, it
+// copies the nodes on the path to the entry instead of modifying them.
 func (node *trieEntry) insert(ip net.IP, cidr uint, peer *Peer) *trieEntry {
 
 	// at leaf
@@ -114,13 +138,14 @@ func (node *trieEntry) insert(ip net.IP, cidr uint, peer *Peer) *trieEntry {
 
 	common := commonBits(node.bits, ip)
 	if node.cidr <= cidr && common >= node.cidr {
+		copied := *node
 		if node.cidr == cidr {
-			node.peer = peer
-			return node
+			copied.peer = peer
+			return &copied
 		}
 		bit := node.choose(ip)
-		node.child[bit] = node.child[bit].insert(ip, cidr, peer)
-		return node
+		copied.child[bit] = node.child[bit].insert(ip, cidr, peer)
+		return &copied
 	}
 
 	// split node
@@ -192,60 +217,519 @@ func (node *trieEntry) entriesForPeer(p *Peer, results []net.IPNet) []net.IPNet
 	return results
 }
 
+func (node *trieEntry) prefix() netaddr.IPPrefix {
+	mask := net.CIDRMask(int(node.cidr), len(node.bits)*8)
+	ip, _ := netaddr.FromStdIP(node.bits.Mask(mask))
+	return netaddr.IPPrefix{IP: ip, Bits: uint8(node.cidr)}
+}
+
+func (node *trieEntry) walkByPeer(p *Peer, cb func(netaddr.IPPrefix) bool) bool {
+	if node == nil {
+		return true
+	}
+	if node.peer == p {
+		if !cb(node.prefix()) {
+			return false
+		}
+	}
+	return node.child[0].walkByPeer(p, cb) && node.child[1].walkByPeer(p, cb)
+}
+
+func (node *trieEntry) walk(cb func(netaddr.IPPrefix, *Peer) bool) bool {
+	if node == nil {
+		return true
+	}
+	if node.peer != nil {
+		if !cb(node.prefix(), node.peer) {
+			return false
+		}
+	}
+	return node.child[0].walk(cb) && node.child[1].walk(cb)
+}
+
+// owner returns the peer that ip/cidr itself, rather than a shorter prefix
+// containing it, is routed to.
+func (node *trieEntry) owner(ip net.IP, cidr uint) *Peer {
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, ip) >= node.cidr {
+		if node.cidr == cidr {
+			return node.peer
+		}
+		node = node.child[node.choose(ip)]
+	}
+	return nil
+}
+
+// overlaps appends to results every entry below node whose prefix lies
+// inside one of outer, the entries above it, that routes to another peer.
+func (node *trieEntry) overlaps(outer []*trieEntry, results []AllowedIPOverlap) []AllowedIPOverlap {
+	if node == nil {
+		return results
+	}
+	if node.peer != nil {
+		for _, o := range outer {
+			if o.peer != node.peer {
+				results = append(results, AllowedIPOverlap{
+					Outer:     o.prefix(),
+					OuterPeer: o.peer,
+					Inner:     node.prefix(),
+					InnerPeer: node.peer,
+				})
+			}
+		}
+		outer = append(outer, node)
+	}
+	results = node.child[0].overlaps(outer, results)
+	results = node.child[1].overlaps(outer, results)
+	return results
+}
+
+// AllowedIPConflict describes an allowed IP given to a peer while it was
+// already routed to another.
+type AllowedIPConflict struct {
+	Prefix   netaddr.IPPrefix
+	Owner    *Peer // the peer the prefix is routed to
+	Claimant *Peer // the peer the prefix was given to
+}
+
+// AllowedIPOverlap is a pair of allowed IPs of different peers, one
+// contained in the other. Packets for Inner go to InnerPeer; those for
+// the rest of Outer go to OuterPeer.
+type AllowedIPOverlap struct {
+	Outer     netaddr.IPPrefix
+	OuterPeer *Peer
+	Inner     netaddr.IPPrefix
+	InnerPeer *Peer
+}
+
+// AllowedIPs maps allowed IPs to peers. The tries it holds are never
+// modified once published: a change builds new tries, sharing the nodes
+// it does not touch, and swaps them in atomically, so that lookups on
+// the data path take no locks. Writers are serialized by mutex.
 type AllowedIPs struct {
-	IPv4  *trieEntry
-	IPv6  *trieEntry
-	mutex sync.RWMutex
+	roots *allowedIPsRoots
+	mutex sync.Mutex
 }
 
-func (table *AllowedIPs) EntriesForPeer(peer *Peer) []net.IPNet {
-	table.mutex.RLock()
-	defer table.mutex.RUnlock()
+// allowedIPsRoots is a version of the table.
+type allowedIPsRoots struct {
+	IPv4 *trieEntry
+	IPv6 *trieEntry
+}
+
+var emptyAllowedIPsRoots = &allowedIPsRoots{}
+
+func (table *AllowedIPs) load() *allowedIPsRoots {
+	roots := (*allowedIPsRoots)(atomic.LoadPointer((*unsafe.Pointer)((unsafe.Pointer)(&table.roots))))
+	if roots == nil {
+		return emptyAllowedIPsRoots
+	}
+	return roots
+}
+
+func (table *AllowedIPs) store(roots *allowedIPsRoots) {
+	atomic.StorePointer((*unsafe.Pointer)((unsafe.Pointer)(&table.roots)), (unsafe.Pointer)(roots))
+}
 
+func (table *AllowedIPs) EntriesForPeer(peer *Peer) []net.IPNet {
+	roots := table.load()
 	allowed := make([]net.IPNet, 0, 10)
-	allowed = table.IPv4.entriesForPeer(peer, allowed)
-	allowed = table.IPv6.entriesForPeer(peer, allowed)
+	allowed = roots.IPv4.entriesForPeer(peer, allowed)
+	allowed = roots.IPv6.entriesForPeer(peer, allowed)
 	return allowed
 }
 
+// EntriesForPeerFunc calls cb for each prefix routed to peer, IPv4 first,
+// stopping early if cb returns false. The walk is over the table as it
+// was when it began: cb may modify the table, but does not see its
+// changes.
+func (table *AllowedIPs) EntriesForPeerFunc(peer *Peer, cb func(prefix netaddr.IPPrefix) bool) {
+	roots := table.load()
+	if roots.IPv4.walkByPeer(peer, cb) {
+		roots.IPv6.walkByPeer(peer, cb)
+	}
+}
+
+// walk calls cb for each prefix in this version of the table and the
+// peer it is routed to, IPv4 first, stopping early if cb returns false.
+func (roots *allowedIPsRoots) walk(cb func(netaddr.IPPrefix, *Peer) bool) {
+	if roots.IPv4.walk(cb) {
+		roots.IPv6.walk(cb)
+	}
+}
+
+func (roots *allowedIPsRoots) isEmpty() bool {
+	return roots.IPv4 == nil && roots.IPv6 == nil
+}
+
+func (table *AllowedIPs) isEmpty() bool {
+	return table.load().isEmpty()
+}
+
 func (table *AllowedIPs) Reset() {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
-	table.IPv4 = nil
-	table.IPv6 = nil
+	table.store(emptyAllowedIPsRoots)
 }
 
 func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
-	table.IPv4 = table.IPv4.removeByPeer(peer)
-	table.IPv6 = table.IPv6.removeByPeer(peer)
+	roots := table.load()
+	table.store(&allowedIPsRoots{
+		IPv4: roots.IPv4.removeByPeer(peer),
+		IPv6: roots.IPv6.removeByPeer(peer),
+	})
 }
 
 func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
+	roots := *table.load()
 	switch len(ip) {
 	case net.IPv6len:
-		table.IPv6 = table.IPv6.insert(ip, cidr, peer)
+		roots.IPv6 = roots.IPv6.insert(ip, cidr, peer)
 	case net.IPv4len:
-		table.IPv4 = table.IPv4.insert(ip, cidr, peer)
+		roots.IPv4 = roots.IPv4.insert(ip, cidr, peer)
 	default:
 		panic(errors.New("inserting unknown address type"))
 	}
+	table.store(&roots)
+}
+
+// Owner returns the peer that prefix is routed to, or nil if prefix
+// itself is not in the table. A peer owning a shorter prefix that
+// contains it does not count.
+func (table *AllowedIPs) Owner(prefix netaddr.IPPrefix) *Peer {
+	roots := table.load()
+	ip := prefix.IP.As16()
+	if prefix.IP.Is4() {
+		return roots.IPv4.owner(net.IP(ip[12:]), uint(prefix.Bits))
+	}
+	return roots.IPv6.owner(net.IP(ip[:]), uint(prefix.Bits))
+}
+
+// Overlaps returns every pair of allowed IPs that belong to different
+// peers where one prefix contains the other. Such overlaps are legal,
+// the longest prefix wins, but are often a misconfiguration.
+func (table *AllowedIPs) Overlaps() []AllowedIPOverlap {
+	roots := table.load()
+	var results []AllowedIPOverlap
+	results = roots.IPv4.overlaps(nil, results)
+	results = roots.IPv6.overlaps(nil, results)
+	return results
+}
+
+// ReplaceForPeer routes exactly prefixes to peer, replacing whatever was
+// routed to it before. Lookups see either the old or the new set, never a
+// mixture or neither.
+func (table *AllowedIPs) ReplaceForPeer(peer *Peer, prefixes []netaddr.IPPrefix) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	old := table.load()
+	roots := &allowedIPsRoots{
+		IPv4: old.IPv4.removeByPeer(peer),
+		IPv6: old.IPv6.removeByPeer(peer),
+	}
+	for _, prefix := range prefixes {
+		ip := prefix.IP.As16()
+		if prefix.IP.Is4() {
+			roots.IPv4 = roots.IPv4.insert(net.IP(ip[12:]), uint(prefix.Bits), peer)
+		} else {
+			roots.IPv6 = roots.IPv6.insert(net.IP(ip[:]), uint(prefix.Bits), peer)
+		}
+	}
+	table.store(roots)
+}
+
+// AllowedIPEntry is a prefix routed to a peer, for InsertBulk.
+type AllowedIPEntry struct {
+	Prefix netaddr.IPPrefix
+	Peer   *Peer
+}
+
+// InsertBulk routes each entry's prefix to its peer, as Insert does,
+// with a later entry winning over an earlier one for the same prefix.
+// Into an empty table, such as when loading the initial configuration,
+// the tries are built from the sorted entries in one pass without the
+// writers' lock held, and swapped in at the end, which is much faster for
+// large numbers of prefixes than inserting them one at a time. Entries
+// sorted by address, shorter prefixes first, are not sorted again.
+func (table *AllowedIPs) InsertBulk(entries []AllowedIPEntry) {
+	n4 := 0
+	for _, e := range entries {
+		if e.Prefix.IP.Is4() {
+			n4++
+		}
+	}
+	v4 := make(bulkEntries, 0, n4)
+	v6 := make(bulkEntries, 0, len(entries)-n4)
+	for i, e := range entries {
+		if e.Prefix.IP.Is4() {
+			v4 = append(v4, newBulkEntry(e, i))
+		} else {
+			v6 = append(v6, newBulkEntry(e, i))
+		}
+	}
+
+	if table.isEmpty() {
+		built := &allowedIPsRoots{
+			IPv4: buildTrie(v4, entries),
+			IPv6: buildTrie(v6, entries),
+		}
+		table.mutex.Lock()
+		if table.isEmpty() {
+			table.store(built)
+			table.mutex.Unlock()
+			return
+		}
+		table.mutex.Unlock()
+	}
+
+	// Not empty, or no longer: insert one at a time, under one lock.
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	roots := *table.load()
+	for _, e := range v4 {
+		roots.IPv4 = roots.IPv4.insert(e.ip(), e.cidr, entries[e.order].Peer)
+	}
+	for _, e := range v6 {
+		roots.IPv6 = roots.IPv6.insert(e.ip(), e.cidr, entries[e.order].Peer)
+	}
+	table.store(&roots)
+}
+
+// A bulkEntry is an AllowedIPEntry prepared for sorting. It holds no
+// pointers, so that sorting many of them is cheap.
+type bulkEntry struct {
+	addr  [16]byte // the address, IPv4 in the first four bytes
+	key   [16]byte // addr with the bits past cidr cleared, for sorting
+	size  int
+	cidr  uint
+	order int // index in InsertBulk's entries; the last of equal prefixes wins
+}
+
+func newBulkEntry(e AllowedIPEntry, order int) bulkEntry {
+	b := bulkEntry{
+		size:  net.IPv6len,
+		cidr:  uint(e.Prefix.Bits),
+		order: order,
+	}
+	ip := e.Prefix.IP.As16()
+	if e.Prefix.IP.Is4() {
+		b.size = net.IPv4len
+		copy(b.addr[:], ip[12:])
+	} else {
+		b.addr = ip
+	}
+	b.key = b.addr
+	for i := range b.key {
+		if bit := uint(i * 8); bit+8 > b.cidr {
+			if bit >= b.cidr {
+				b.key[i] = 0
+			} else {
+				b.key[i] &= 0xff << (bit + 8 - b.cidr)
+			}
+		}
+	}
+	return b
+}
+
+// ip returns a new copy of the entry's address, for the trie to keep.
+func (b *bulkEntry) ip() net.IP {
+	return append(net.IP(nil), b.addr[:b.size]...)
+}
+
+type bulkEntries []bulkEntry
+
+func (s bulkEntries) Len() int      { return len(s) }
+func (s bulkEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bulkEntries) Less(i, j int) bool {
+	if c := bytes.Compare(s[i].key[:], s[j].key[:]); c != 0 {
+		return c < 0
+	}
+	if s[i].cidr != s[j].cidr {
+		return s[i].cidr < s[j].cidr
+	}
+	return s[i].order < s[j].order
+}
+
+// buildTrie builds a trie of entries of one address family. Sorted by
+// address, and shorter prefixes first, each entry lands at the end of
+// the path to the one before, so it is inserted from the deepest node
+// of that path containing it rather than from the root.
+func buildTrie(entries bulkEntries, orig []AllowedIPEntry) *trieEntry {
+	if !sort.IsSorted(entries) {
+		sort.Sort(entries)
+	}
+
+	var root *trieEntry
+	var path []*trieEntry // from the root to the last entry inserted
+	for i := range entries {
+		e := &entries[i]
+		ip := e.ip()
+		peer := orig[e.order].Peer
+		for len(path) > 0 {
+			top := path[len(path)-1]
+			if top.cidr <= e.cidr && commonBits(top.bits, ip) >= top.cidr {
+				break
+			}
+			path = path[:len(path)-1]
+		}
+
+		var node *trieEntry
+		if len(path) == 0 {
+			root = root.insert(ip, e.cidr, peer)
+			node = root
+		} else {
+			top := path[len(path)-1]
+			if top.cidr == e.cidr {
+				top.peer = peer
+				continue
+			}
+			bit := top.choose(ip)
+			top.child[bit] = top.child[bit].insert(ip, e.cidr, peer)
+			node = top.child[bit]
+		}
+
+		// Walk down to the entry's node, recording the path.
+		for {
+			path = append(path, node)
+			if node.cidr == e.cidr {
+				break
+			}
+			node = node.child[node.choose(ip)]
+		}
+	}
+	return root
 }
 
 func (table *AllowedIPs) LookupIPv4(address []byte) *Peer {
-	table.mutex.RLock()
-	defer table.mutex.RUnlock()
-	return table.IPv4.lookup(address)
+	return table.load().IPv4.lookup(address)
 }
 
 func (table *AllowedIPs) LookupIPv6(address []byte) *Peer {
-	table.mutex.RLock()
-	defer table.mutex.RUnlock()
-	return table.IPv6.lookup(address)
+	return table.load().IPv6.lookup(address)
+}
+
+// Lookup returns the peer whose allowed IPs contain ip, or nil if there is
+// none.
+func (table *AllowedIPs) Lookup(ip netaddr.IP) *Peer {
+	addr := ip.As16()
+	switch {
+	case ip.Is4():
+		return table.LookupIPv4(addr[12:])
+	case ip.Is6():
+		return table.LookupIPv6(addr[:])
+	}
+	return nil
+}
+
+// TrieStats describes the trie of one address family of an AllowedIPs.
+type TrieStats struct {
+	Prefixes int // nodes routing a prefix to a peer
+	Nodes    int // all nodes, including those only joining others
+
+	// Bytes estimates the memory the nodes take, not counting the
+	// peers they point to.
+	Bytes int
+
+	// Depths[d] is the number of prefixes d nodes below the root.
+	Depths []int
+}
+
+// AllowedIPsStats describes the size and shape of an AllowedIPs.
+type AllowedIPsStats struct {
+	IPv4 TrieStats
+	IPv6 TrieStats
+}
+
+var trieEntrySize = int(unsafe.Sizeof(trieEntry{}))
+
+func (node *trieEntry) stats(depth int, st *TrieStats) {
+	if node == nil {
+		return
+	}
+	st.Nodes++
+	st.Bytes += trieEntrySize + cap(node.bits)
+	if node.peer != nil {
+		st.Prefixes++
+		for len(st.Depths) <= depth {
+			st.Depths = append(st.Depths, 0)
+		}
+		st.Depths[depth]++
+	}
+	node.child[0].stats(depth+1, st)
+	node.child[1].stats(depth+1, st)
+}
+
+// Stats returns the size and shape of the table.
+func (table *AllowedIPs) Stats() AllowedIPsStats {
+	roots := table.load()
+	var st AllowedIPsStats
+	roots.IPv4.stats(0, &st.IPv4)
+	roots.IPv6.stats(0, &st.IPv6)
+	return st
+}
+
+// Compact rebuilds the table with its nodes and their addresses laid out
+// together in memory, rather than in an allocation each scattered over
+// the heap by the copies that changes make. Lookups are unaffected,
+// except in speed.
+func (table *AllowedIPs) Compact() {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	roots := table.load()
+	table.store(&allowedIPsRoots{
+		IPv4: compactTrie(roots.IPv4),
+		IPv6: compactTrie(roots.IPv6),
+	})
+}
+
+func compactTrie(root *trieEntry) *trieEntry {
+	var st TrieStats
+	root.stats(0, &st)
+	if st.Nodes == 0 {
+		return nil
+	}
+	c := &trieCompactor{
+		nodes: make([]trieEntry, 0, st.Nodes),
+		bits:  make([]byte, 0, st.Nodes*len(root.bits)),
+	}
+	return c.copy(root)
+}
+
+type trieCompactor struct {
+	nodes []trieEntry
+	bits  []byte
+}
+
+// copy copies node and those below it into the compactor's arrays, which
+// are large enough for them all. Nodes routing no prefix and joining
+// fewer than two others, which removeByPeer does not leave but which
+// serve no purpose, are skipped.
+func (c *trieCompactor) copy(node *trieEntry) *trieEntry {
+	if node == nil {
+		return nil
+	}
+	if node.peer == nil {
+		if node.child[0] == nil {
+			return c.copy(node.child[1])
+		}
+		if node.child[1] == nil {
+			return c.copy(node.child[0])
+		}
+	}
+	c.nodes = append(c.nodes, *node)
+	copied := &c.nodes[len(c.nodes)-1]
+	start := len(c.bits)
+	c.bits = append(c.bits, node.bits...)
+	copied.bits = c.bits[start:len(c.bits):len(c.bits)]
+	copied.child[0] = c.copy(node.child[0])
+	copied.child[1] = c.copy(node.child[1])
+	return copied
 }
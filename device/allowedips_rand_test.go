@@ -7,8 +7,11 @@ package device
 
 import (
 	"math/rand"
+	"net"
 	"sort"
 	"testing"
+
+	"inet.af/netaddr"
 )
 
 const (
@@ -129,3 +132,174 @@ func TestTrieRandomIPv6(t *testing.T) {
 		}
 	}
 }
+
+func randomAllowedIPEntries(n int, peers []*Peer) []AllowedIPEntry {
+	entries := make([]AllowedIPEntry, n)
+	for i := range entries {
+		size := net.IPv4len
+		if rand.Intn(2) == 0 {
+			size = net.IPv6len
+		}
+		addr := make(net.IP, size)
+		rand.Read(addr)
+		ip, _ := netaddr.FromStdIP(addr)
+		entries[i] = AllowedIPEntry{
+			Prefix: netaddr.IPPrefix{IP: ip, Bits: uint8(rand.Intn(size*8 + 1))},
+			Peer:   peers[rand.Intn(len(peers))],
+		}
+		if i > 0 && rand.Intn(10) == 0 {
+			// Same prefix again, to another peer.
+			entries[i].Prefix = entries[rand.Intn(i)].Prefix
+		}
+	}
+	return entries
+}
+
+func TestInsertBulkRandom(t *testing.T) {
+	var peers []*Peer
+	rand.Seed(1)
+	for n := 0; n < NumberOfPeers; n++ {
+		peers = append(peers, &Peer{})
+	}
+
+	for _, preloaded := range []bool{false, true} {
+		entries := randomAllowedIPEntries(NumberOfAddresses*4, peers)
+		var bulk, single AllowedIPs
+		if preloaded {
+			for _, e := range entries[:NumberOfAddresses] {
+				bulk.ReplaceForPeer(e.Peer, []netaddr.IPPrefix{e.Prefix})
+				single.ReplaceForPeer(e.Peer, []netaddr.IPPrefix{e.Prefix})
+			}
+			entries = entries[NumberOfAddresses:]
+		}
+		bulk.InsertBulk(entries)
+		for _, e := range entries {
+			ip := e.Prefix.IP.As16()
+			if e.Prefix.IP.Is4() {
+				single.Insert(net.IP(ip[12:]), uint(e.Prefix.Bits), e.Peer)
+			} else {
+				single.Insert(net.IP(ip[:]), uint(e.Prefix.Bits), e.Peer)
+			}
+		}
+
+		for n := 0; n < NumberOfTests; n++ {
+			var addr [net.IPv6len]byte
+			rand.Read(addr[:])
+			if got, want := bulk.LookupIPv4(addr[:4]), single.LookupIPv4(addr[:4]); got != want {
+				t.Fatalf("preloaded=%v: IPv4 lookup of %v differs", preloaded, addr[:4])
+			}
+			if got, want := bulk.LookupIPv6(addr[:]), single.LookupIPv6(addr[:]); got != want {
+				t.Fatalf("preloaded=%v: IPv6 lookup of %v differs", preloaded, addr)
+			}
+		}
+		for _, peer := range peers {
+			got, want := bulk.EntriesForPeer(peer), single.EntriesForPeer(peer)
+			if len(got) != len(want) {
+				t.Fatalf("preloaded=%v: peer has %d entries, want %d", preloaded, len(got), len(want))
+			}
+			for i := range got {
+				if got[i].String() != want[i].String() {
+					t.Fatalf("preloaded=%v: entry %v, want %v", preloaded, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+// benchmarkAllowedIPsLoad loads a table as a large network's initial
+// configuration would: host routes, one IPv4 and one IPv6 per peer,
+// out of a shared range.
+func benchmarkAllowedIPsLoad(b *testing.B, load func(table *AllowedIPs, entries []AllowedIPEntry)) {
+	const n = 100000
+	peer := &Peer{}
+	var entries []AllowedIPEntry
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		ip4, _ := netaddr.FromStdIP(net.IPv4(100, 64+byte(i>>16), byte(i>>8), byte(i)))
+		ip6, _ := netaddr.FromStdIP(net.IP{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 12: byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
+		entries = append(entries,
+			AllowedIPEntry{Prefix: netaddr.IPPrefix{IP: ip4, Bits: 32}, Peer: peer},
+			AllowedIPEntry{Prefix: netaddr.IPPrefix{IP: ip6, Bits: 128}, Peer: peer},
+		)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var table AllowedIPs
+		load(&table, entries)
+	}
+}
+
+func BenchmarkAllowedIPsInsert(b *testing.B) {
+	benchmarkAllowedIPsLoad(b, func(table *AllowedIPs, entries []AllowedIPEntry) {
+		for _, e := range entries {
+			ip := e.Prefix.IP.As16()
+			if e.Prefix.IP.Is4() {
+				table.Insert(net.IP(ip[12:]), uint(e.Prefix.Bits), e.Peer)
+			} else {
+				table.Insert(net.IP(ip[:]), uint(e.Prefix.Bits), e.Peer)
+			}
+		}
+	})
+}
+
+func BenchmarkAllowedIPsInsertBulk(b *testing.B) {
+	benchmarkAllowedIPsLoad(b, func(table *AllowedIPs, entries []AllowedIPEntry) {
+		table.InsertBulk(entries)
+	})
+}
+
+func TestAllowedIPsStatsAndCompact(t *testing.T) {
+	rand.Seed(1)
+	peers := make([]*Peer, 50)
+	for i := range peers {
+		peers[i] = &Peer{}
+	}
+	entries := randomAllowedIPEntries(5000, peers)
+
+	var table AllowedIPs
+	table.InsertBulk(entries)
+	for _, peer := range peers[:25] {
+		table.RemoveByPeer(peer)
+	}
+	want := make(map[netaddr.IP]*Peer)
+	for _, e := range entries {
+		want[e.Prefix.IP] = table.Lookup(e.Prefix.IP)
+	}
+
+	before := table.Stats()
+	if before.IPv4.Prefixes == 0 || before.IPv6.Prefixes == 0 {
+		t.Fatalf("no prefixes left: %+v", before)
+	}
+	for _, st := range []TrieStats{before.IPv4, before.IPv6} {
+		depthSum := 0
+		for _, n := range st.Depths {
+			depthSum += n
+		}
+		if depthSum != st.Prefixes {
+			t.Errorf("depths %v add up to %d, want %d prefixes", st.Depths, depthSum, st.Prefixes)
+		}
+		if st.Nodes < st.Prefixes || st.Bytes < st.Nodes*trieEntrySize {
+			t.Errorf("implausible stats %+v", st)
+		}
+	}
+
+	table.Compact()
+	after := table.Stats()
+	for i, pair := range [][2]TrieStats{{before.IPv4, after.IPv4}, {before.IPv6, after.IPv6}} {
+		b, a := pair[0], pair[1]
+		if a.Prefixes != b.Prefixes || a.Nodes != b.Nodes || a.Bytes > b.Bytes {
+			t.Errorf("family %d: compacted %+v from %+v", i, a, b)
+		}
+	}
+	for ip, peer := range want {
+		if got := table.Lookup(ip); got != peer {
+			t.Fatalf("Lookup(%v) = %p after compaction, want %p", ip, got, peer)
+		}
+	}
+
+	// The compacted table still takes changes.
+	table.RemoveByPeer(peers[25])
+	table.Insert(net.IP{10, 9, 8, 7}, 32, peers[0])
+	if got := table.Lookup(netaddr.IPv4(10, 9, 8, 7)); got != peers[0] {
+		t.Errorf("Lookup after insert = %p, want %p", got, peers[0])
+	}
+}
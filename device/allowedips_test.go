@@ -8,7 +8,11 @@ package device
 import (
 	"math/rand"
 	"net"
+	"reflect"
+	"sync"
 	"testing"
+
+	"inet.af/netaddr"
 )
 
 /* Todo: More comprehensive
@@ -258,3 +262,200 @@ func TestTrieIPv6(t *testing.T) {
 	assertEQ(h, 0x24046800, 0x40040800, 0x10101010, 0x10101010)
 	assertEQ(a, 0x24046800, 0x40040800, 0xdeadbeef, 0xdeadbeef)
 }
+
+func TestAllowedIPsLookupAndEntries(t *testing.T) {
+	var table AllowedIPs
+	a := &Peer{}
+	b := &Peer{}
+
+	insert := func(peer *Peer, s string) {
+		prefix := netaddr.MustParseIPPrefix(s)
+		ipnet := prefix.IPNet()
+		ip := ipnet.IP.To4()
+		if ip == nil {
+			ip = ipnet.IP.To16()
+		}
+		table.Insert(ip, uint(prefix.Bits), peer)
+	}
+	insert(a, "10.0.0.0/8")
+	insert(b, "10.1.0.0/16")
+	insert(a, "fd00::/64")
+	insert(b, "192.168.1.1/32")
+
+	lookups := []struct {
+		ip   string
+		peer *Peer
+	}{
+		{"10.2.3.4", a},
+		{"10.1.3.4", b},
+		{"192.168.1.1", b},
+		{"192.168.1.2", nil},
+		{"fd00::1", a},
+		{"fd01::1", nil},
+	}
+	for _, l := range lookups {
+		if got := table.Lookup(netaddr.MustParseIP(l.ip)); got != l.peer {
+			t.Errorf("Lookup(%s) = %p, want %p", l.ip, got, l.peer)
+		}
+	}
+	if got := table.Lookup(netaddr.IP{}); got != nil {
+		t.Errorf("Lookup(zero IP) = %p, want nil", got)
+	}
+
+	var got []netaddr.IPPrefix
+	table.EntriesForPeerFunc(a, func(prefix netaddr.IPPrefix) bool {
+		got = append(got, prefix)
+		return true
+	})
+	want := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.0/8"),
+		netaddr.MustParseIPPrefix("fd00::/64"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EntriesForPeerFunc(a) = %v, want %v", got, want)
+	}
+
+	calls := 0
+	table.EntriesForPeerFunc(a, func(netaddr.IPPrefix) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("EntriesForPeerFunc did not stop early: %d calls", calls)
+	}
+}
+
+func TestAllowedIPsOwnerAndOverlaps(t *testing.T) {
+	var table AllowedIPs
+	a := &Peer{}
+	b := &Peer{}
+	table.ReplaceForPeer(a, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.0/8"),
+		netaddr.MustParseIPPrefix("10.1.2.0/24"),
+		netaddr.MustParseIPPrefix("fd00::/64"),
+	})
+	table.ReplaceForPeer(b, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.1.0.0/16"),
+		netaddr.MustParseIPPrefix("192.168.0.0/16"),
+	})
+
+	owners := []struct {
+		prefix string
+		peer   *Peer
+	}{
+		{"10.0.0.0/8", a},
+		{"10.1.0.0/16", b},
+		{"10.1.2.0/24", a},
+		{"10.1.2.0/25", nil},
+		{"10.0.0.0/7", nil},
+		{"fd00::/64", a},
+		{"fd00::/63", nil},
+	}
+	for _, o := range owners {
+		if got := table.Owner(netaddr.MustParseIPPrefix(o.prefix)); got != o.peer {
+			t.Errorf("Owner(%s) = %p, want %p", o.prefix, got, o.peer)
+		}
+	}
+
+	// 10.1.0.0/16 (b) lies in 10.0.0.0/8 (a). 10.1.2.0/24 (a) lies in
+	// both, but only 10.1.0.0/16 belongs to another peer.
+	want := []AllowedIPOverlap{{
+		Outer:     netaddr.MustParseIPPrefix("10.0.0.0/8"),
+		OuterPeer: a,
+		Inner:     netaddr.MustParseIPPrefix("10.1.0.0/16"),
+		InnerPeer: b,
+	}, {
+		Outer:     netaddr.MustParseIPPrefix("10.1.0.0/16"),
+		OuterPeer: b,
+		Inner:     netaddr.MustParseIPPrefix("10.1.2.0/24"),
+		InnerPeer: a,
+	}}
+	if got := table.Overlaps(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Overlaps() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAllowedIPsCopyOnWrite(t *testing.T) {
+	var table AllowedIPs
+	a := &Peer{}
+	b := &Peer{}
+	table.ReplaceForPeer(a, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.0/8"),
+		netaddr.MustParseIPPrefix("fd00::/64"),
+	})
+	table.ReplaceForPeer(b, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.0/16"),
+		netaddr.MustParseIPPrefix("10.128.0.0/16"),
+	})
+	old := table.load()
+
+	// Lookups run throughout the writes; the race detector checks that
+	// they need no lock.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			table.Lookup(netaddr.MustParseIP("10.0.1.1"))
+			table.Lookup(netaddr.MustParseIP("fd00::1"))
+		}
+	}()
+
+	// Removing a from the node holding both of b's prefixes below it
+	// must keep them.
+	table.RemoveByPeer(a)
+	table.Insert(net.IP{10, 0, 0, 0}, 16, a)
+	table.ReplaceForPeer(b, nil)
+	close(stop)
+	wg.Wait()
+
+	now := []struct {
+		ip   string
+		peer *Peer
+	}{
+		{"10.0.1.1", a},
+		{"10.128.1.1", nil},
+		{"10.1.1.1", nil},
+		{"fd00::1", nil},
+	}
+	for _, l := range now {
+		if got := table.Lookup(netaddr.MustParseIP(l.ip)); got != l.peer {
+			t.Errorf("Lookup(%s) = %p, want %p", l.ip, got, l.peer)
+		}
+	}
+
+	// The version loaded before the writes is unchanged.
+	before := []struct {
+		ip   string
+		peer *Peer
+	}{
+		{"10.0.1.1", b},
+		{"10.128.1.1", b},
+		{"10.1.1.1", a},
+		{"fd00::1", a},
+	}
+	for _, l := range before {
+		ip := netaddr.MustParseIP(l.ip)
+		addr := ip.As16()
+		var got *Peer
+		if ip.Is4() {
+			got = old.IPv4.lookup(addr[12:])
+		} else {
+			got = old.IPv6.lookup(addr[:])
+		}
+		if got != l.peer {
+			t.Errorf("old version: lookup(%s) = %p, want %p", l.ip, got, l.peer)
+		}
+	}
+
+	table.RemoveByPeer(a)
+	if !table.isEmpty() {
+		t.Error("table not empty after removing every peer")
+	}
+}
@@ -0,0 +1,19 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+// authorized reports whether DeviceOptions.Authorize accepts a handshake
+// message from peer, received from src. Without it, all are accepted.
+func (device *Device) authorized(peer *Peer, src conn.Endpoint) bool {
+	if device.authorize == nil {
+		return true
+	}
+	return device.authorize(peer.PublicKey(), src)
+}
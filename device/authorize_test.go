@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestAuthorize(t *testing.T) {
+	var revoked AtomicBool
+	revoked.Set(true)
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		if i != 0 {
+			return
+		}
+		opts.Authorize = func(pk NoisePublicKey, src conn.Endpoint) bool {
+			return !revoked.Get()
+		}
+	})
+	peer0 := pair[0].dev.Peers()[0]
+
+	// dev0 refuses dev1's initiations while dev1 is revoked.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	waitFor(t, "the initiation to be refused", func() bool {
+		return pair[0].dev.DropCounts()[DropUnauthorized] > 0
+	})
+	if peer0.keypairs.Current() != nil {
+		t.Fatal("session established with a revoked peer")
+	}
+
+	revoked.Set(false)
+	pair.Send(t, Ping, nil)
+}
+
+func TestAuthorizeResponse(t *testing.T) {
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		if i != 0 {
+			return
+		}
+		opts.Authorize = func(pk NoisePublicKey, src conn.Endpoint) bool {
+			return false
+		}
+	})
+	peer0 := pair[0].dev.Peers()[0]
+
+	// dev0 initiates, and refuses dev1's response without moving its
+	// handshake on.
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	waitFor(t, "the response to be refused", func() bool {
+		return pair[0].dev.DropCounts()[DropUnauthorized] > 0
+	})
+	peer0.handshake.mutex.RLock()
+	state := peer0.handshake.state
+	peer0.handshake.mutex.RUnlock()
+	if state != handshakeInitiationCreated {
+		t.Errorf("refused response left handshake state %v", state)
+	}
+	if peer0.keypairs.Current() != nil {
+		t.Fatal("session established from a refused response")
+	}
+}
@@ -0,0 +1,276 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package bench measures devices end to end: packets are written to one
+// device's TUN device and read from another's, carried between them over
+// in-memory binds, so that the numbers reflect the device rather than
+// the system's network stack. The devices run on a manual clock and draw
+// their keys and randomness from seeded sources, so that every run does
+// the same work.
+//
+//	go test -run NONE -bench . ./device/bench
+package bench
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+)
+
+// Seed seeds the keys and random sources of the devices NewStar creates.
+const Seed = 1
+
+// Timeout is how long a packet may take to arrive before a benchmark
+// fails. The clock is manual, so a lost handshake is never retried.
+const Timeout = 5 * time.Second
+
+// A Node is a device in a Star.
+type Node struct {
+	Dev       *device.Device
+	TUN       *tuntest.ChannelTUN
+	IP        net.IP // its address inside the tunnel
+	PublicKey wgcfg.Key
+}
+
+// A Star is a hub device with a peer for each of its spoke devices, each
+// of which has the hub as its only peer, allowed all of 10.0.0.0/8.
+type Star struct {
+	Hub    *Node
+	Spokes []*Node
+	Clock  *device.ManualClock
+}
+
+// NewStar creates a Star with the given number of spokes, up and
+// configured but with no sessions yet. The devices are closed when tb
+// is done.
+func NewStar(tb testing.TB, spokes int) *Star {
+	tb.Helper()
+	network := bindtest.NewNetwork()
+	keys := rand.New(rand.NewSource(Seed))
+	s := &Star{Clock: device.NewManualClock(time.Unix(1e9, 0))}
+
+	newNode := func(i int, ip net.IP) (*Node, bindtest.ChannelEndpoint, wgcfg.PrivateKey) {
+		var raw [32]byte
+		keys.Read(raw[:])
+		key, err := wgcfg.ParsePrivateHexKey(hex.EncodeToString(raw[:]))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		bind, ep := network.NewBind()
+		n := &Node{TUN: tuntest.NewChannelTUN(), IP: ip, PublicKey: key.Public()}
+		n.Dev = device.NewDevice(n.TUN.TUN(), &device.DeviceOptions{
+			Logger: device.NewLogger(device.LogLevelError, fmt.Sprintf("dev%d: ", i)),
+			Clock:  s.Clock,
+			Rand:   newSeededRand(Seed + int64(i)),
+			CreateBind: func(uint16) (conn.Bind, uint16, error) {
+				return bind, uint16(ep), nil
+			},
+			CreateEndpoint: func(_ [32]byte, addr string) (conn.Endpoint, error) {
+				return bindtest.ParseEndpoint(addr)
+			},
+			SkipBindUpdate: true,
+		})
+		tb.Cleanup(n.Dev.Close)
+		return n, ep, key
+	}
+
+	hub, hubEndpoint, hubKey := newNode(0, net.IPv4(10, 0, 0, 1))
+	s.Hub = hub
+	hubCfg := &wgcfg.Config{PrivateKey: hubKey}
+	for i := 1; i <= spokes; i++ {
+		spoke, _, spokeKey := newNode(i, net.IPv4(10, 1, byte(i>>8), byte(i)))
+		s.Spokes = append(s.Spokes, spoke)
+		cfg := &wgcfg.Config{
+			PrivateKey: spokeKey,
+			Peers: []wgcfg.Peer{{
+				PublicKey:  hubKey.Public(),
+				AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+				Endpoints:  hubEndpoint.DstToString(),
+			}},
+		}
+		configure(tb, spoke, cfg)
+		hubCfg.Peers = append(hubCfg.Peers, wgcfg.Peer{
+			PublicKey:  spoke.PublicKey,
+			AllowedIPs: []netaddr.IPPrefix{{IP: ipOf(spoke.IP), Bits: 32}},
+		})
+	}
+	configure(tb, hub, hubCfg)
+	return s
+}
+
+func configure(tb testing.TB, n *Node, cfg *wgcfg.Config) {
+	tb.Helper()
+	if err := n.Dev.Reconfig(cfg); err != nil {
+		tb.Fatal(err)
+	}
+	if err := n.Dev.Up(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func ipOf(ip net.IP) netaddr.IP {
+	addr, _ := netaddr.FromStdIP(ip)
+	return addr
+}
+
+// Disconnect ends the sessions between the hub and each of spokes, on
+// both sides, so that the next packets between them wait for new
+// handshakes. It first advances the clock past the limits on how often
+// one peer may initiate handshakes.
+//
+// The spokes' sessions are expired rather than dropped, as with
+// ZeroAndFlushAll: the flush that does is asynchronous, and would drop
+// the next packet, the one that should start the new handshake, if the
+// packet were queued before the flush was done. Nothing would retry the
+// handshake on the manual clock.
+func (s *Star) Disconnect(spokes ...*Node) {
+	s.Clock.Advance(device.RekeyTimeout + time.Second)
+	for _, spoke := range spokes {
+		for _, peer := range spoke.Dev.Peers() {
+			peer.ExpireCurrentKeypairs()
+		}
+		if peer := s.Hub.Dev.LookupPeer(device.NoisePublicKey(spoke.PublicKey)); peer != nil {
+			peer.ZeroAndFlushAll()
+		}
+	}
+}
+
+// A Flow is a direction packets are sent in, from one node to another.
+type Flow struct {
+	From, To *Node
+}
+
+// Transfer sends n packets of size bytes, spread over flows in turn,
+// keeping no more than window of them in flight, and fails tb unless
+// they all arrive within Timeout of each other.
+func Transfer(tb testing.TB, flows []Flow, n, size, window int) {
+	tb.Helper()
+	done := make(chan struct{})
+	defer close(done)
+
+	// Read what arrives at every destination.
+	arrived := make(chan struct{}, window)
+	seen := make(map[*Node]bool)
+	for _, f := range flows {
+		if seen[f.To] {
+			continue
+		}
+		seen[f.To] = true
+		go func(to *Node) {
+			for {
+				select {
+				case <-to.TUN.Inbound:
+				case <-done:
+					return
+				}
+				select {
+				case arrived <- struct{}{}:
+				case <-done:
+					return
+				}
+			}
+		}(f.To)
+	}
+
+	pkts := make([][]byte, len(flows))
+	for i, f := range flows {
+		pkts[i] = Packet(f.To.IP, f.From.IP, size)
+	}
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	wait := func(sent, received int) {
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(Timeout)
+		select {
+		case <-arrived:
+		case <-timer.C:
+			tb.Fatalf("%d of %d packets arrived", received, sent)
+		}
+	}
+
+	sent, received := 0, 0
+	for sent < n {
+		if sent-received >= window {
+			wait(sent, received)
+			received++
+			continue
+		}
+		i := sent % len(flows)
+		flows[i].From.TUN.Outbound <- pkts[i]
+		sent++
+	}
+	for received < n {
+		wait(sent, received)
+		received++
+	}
+}
+
+// Packet returns an IPv4 UDP packet of size bytes from src to dst.
+func Packet(dst, src net.IP, size int) []byte {
+	const (
+		ipv4Size = 20
+		udpSize  = 8
+	)
+	if size < ipv4Size+udpSize {
+		size = ipv4Size + udpSize
+	}
+	pkt := make([]byte, size)
+	ip := pkt[:ipv4Size]
+	ip[0] = 0x45 // version 4, 5 words of header
+	binary.BigEndian.PutUint16(ip[2:], uint16(size))
+	ip[8] = 64 // TTL
+	ip[9] = 17 // UDP
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+	udp := pkt[ipv4Size:]
+	binary.BigEndian.PutUint16(udp[0:], 9) // discard
+	binary.BigEndian.PutUint16(udp[2:], 9)
+	binary.BigEndian.PutUint16(udp[4:], uint16(size-ipv4Size))
+	return pkt
+}
+
+// checksum is the internet checksum of RFC 1071.
+func checksum(buf []byte) uint16 {
+	var v uint32
+	for i := 0; i+1 < len(buf); i += 2 {
+		v += uint32(binary.BigEndian.Uint16(buf[i:]))
+	}
+	for v > 0xffff {
+		v = (v >> 16) + (v & 0xffff)
+	}
+	return ^uint16(v)
+}
+
+// seededRand is a reproducible source for DeviceOptions.Rand.
+type seededRand struct {
+	sync.Mutex
+	*rand.Rand
+}
+
+func newSeededRand(seed int64) *seededRand {
+	return &seededRand{Rand: rand.New(rand.NewSource(seed))}
+}
+
+func (r *seededRand) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.Rand.Read(p)
+}
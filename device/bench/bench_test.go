@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package bench
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// MTU-sized packets, and at most this many in flight, which keeps well
+// within the devices' queues and the binds'.
+const (
+	packetSize = tuntest.DefaultMTU
+	window     = 256
+)
+
+// TestStar checks the harness: every spoke reaches the hub, and the hub
+// every spoke, again after being disconnected.
+func TestStar(t *testing.T) {
+	s := NewStar(t, 3)
+	for i := 0; i < 2; i++ {
+		for _, spoke := range s.Spokes {
+			Transfer(t, []Flow{{spoke, s.Hub}}, 1, packetSize, 1)
+			Transfer(t, []Flow{{s.Hub, spoke}}, 1, packetSize, 1)
+		}
+		s.Disconnect(s.Spokes...)
+	}
+}
+
+// connect establishes the sessions between the hub and spokes.
+func connect(b *testing.B, s *Star) {
+	var flows []Flow
+	for _, spoke := range s.Spokes {
+		flows = append(flows, Flow{spoke, s.Hub})
+	}
+	Transfer(b, flows, len(flows), packetSize, len(flows))
+}
+
+// BenchmarkThroughput sends packets from one peer to another.
+func BenchmarkThroughput(b *testing.B) {
+	s := NewStar(b, 1)
+	connect(b, s)
+	b.SetBytes(packetSize)
+	b.ResetTimer()
+	Transfer(b, []Flow{{s.Spokes[0], s.Hub}}, b.N, packetSize, window)
+}
+
+// BenchmarkFanout sends packets from the hub to each of its peers in
+// turn.
+func BenchmarkFanout(b *testing.B) {
+	for _, spokes := range []int{4, 16, 64} {
+		b.Run(fmt.Sprintf("peers=%d", spokes), func(b *testing.B) {
+			s := NewStar(b, spokes)
+			connect(b, s)
+			var flows []Flow
+			for _, spoke := range s.Spokes {
+				flows = append(flows, Flow{s.Hub, spoke})
+			}
+			b.SetBytes(packetSize)
+			b.ResetTimer()
+			Transfer(b, flows, b.N, packetSize, window)
+		})
+	}
+}
+
+// BenchmarkLatency sends one packet at a time from one peer to another,
+// each op being the time one takes to arrive.
+func BenchmarkLatency(b *testing.B) {
+	s := NewStar(b, 1)
+	connect(b, s)
+	b.ResetTimer()
+	Transfer(b, []Flow{{s.Spokes[0], s.Hub}}, b.N, packetSize, 1)
+}
+
+// BenchmarkReconnect times the first packet from a peer with no session,
+// which waits for a handshake.
+func BenchmarkReconnect(b *testing.B) {
+	s := NewStar(b, 1)
+	spoke := s.Spokes[0]
+	flows := []Flow{{spoke, s.Hub}}
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s.Disconnect(spoke)
+		b.StartTimer()
+		Transfer(b, flows, 1, packetSize, 1)
+	}
+}
+
+// BenchmarkHandshakeStorm has every peer of the hub handshake with it at
+// once, each op being one storm.
+func BenchmarkHandshakeStorm(b *testing.B) {
+	for _, spokes := range []int{16, 64} {
+		b.Run(fmt.Sprintf("peers=%d", spokes), func(b *testing.B) {
+			s := NewStar(b, spokes)
+			var flows []Flow
+			for _, spoke := range s.Spokes {
+				flows = append(flows, Flow{spoke, s.Hub})
+			}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s.Disconnect(s.Spokes...)
+				b.StartTimer()
+				Transfer(b, flows, len(flows), packetSize, len(flows))
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and runs timers for the protocol core of a
+// device: handshake timestamps and rate limits, handshake retransmission,
+// keepalives, rekeying and session expiry. Devices use the system clock
+// unless DeviceOptions.Clock gives them another, such as a ManualClock,
+// so that a simulation can step through those timers without waiting
+// for them. Cookie secrets and cookies expire by it too. Packet traces
+// and worker scaling always use the system clock.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// A ClockTimer is a timer started by Clock.AfterFunc. Its methods behave
+// as those of time.Timer.
+type ClockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+func (device *Device) now() time.Time {
+	return device.clock.Now()
+}
+
+func (device *Device) since(t time.Time) time.Duration {
+	return device.clock.Now().Sub(t)
+}
+
+// ManualClock is a Clock that only moves when told to. Timers fire in
+// Advance, one at a time in the order they are due, in the goroutine
+// calling it. Together with DeviceOptions.Rand and an in-memory Bind,
+// such as conn/bindtest's, it makes the protocol's timing and keys
+// reproducible. The device's routines still run concurrently, so a
+// simulation must wait for the packets it sends to be processed before
+// advancing the clock past what they would change.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers manualTimers
+}
+
+// NewManualClock returns a ManualClock reading start.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	t := &manualTimer{clock: c, f: f, index: -1}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due by then.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].when.After(end) {
+		t := heap.Pop(&c.timers).(*manualTimer)
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	f     func()
+	when  time.Time
+	index int // in clock.timers, or -1 if stopped
+}
+
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := t.index >= 0
+	t.when = c.now.Add(d)
+	if active {
+		heap.Fix(&c.timers, t.index)
+	} else {
+		heap.Push(&c.timers, t)
+	}
+	return active
+}
+
+type manualTimers []*manualTimer
+
+func (h manualTimers) Len() int           { return len(h) }
+func (h manualTimers) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+func (h manualTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *manualTimers) Push(x interface{}) {
+	t := x.(*manualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *manualTimers) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+type lockedRand struct {
+	sync.Mutex
+	*rand.Rand
+}
+
+// jitter returns a random duration below maxMs milliseconds, for spreading
+// out timers. It draws from its own source, seeded from the device's
+// random numbers, so that timers on other routines do not change which
+// random numbers the handshakes get.
+func (device *Device) jitter(maxMs int32) time.Duration {
+	device.jitterRand.Lock()
+	defer device.jitterRand.Unlock()
+	return time.Millisecond * time.Duration(device.jitterRand.Int31n(maxMs))
+}
+
+func (device *Device) seedJitter(r io.Reader) {
+	var seed [8]byte
+	io.ReadFull(r, seed[:])
+	device.jitterRand.Rand = rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
@@ -3,14 +3,15 @@
 package device
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
 	"strings"
 	"sync/atomic"
-	"time"
 
-	"github.com/tailscale/wireguard-go/ipc"
+	"github.com/tailscale/wireguard-go/conn"
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"inet.af/netaddr"
 )
@@ -44,13 +45,148 @@ func (device *Device) config() (*wgcfg.Config, error) {
 	return cfg, nil
 }
 
+// ReconfigOption modifies the behavior of Reconfig.
+type ReconfigOption int
+
+const (
+	// DryRun makes Reconfig check cfg, as ValidateConfig does, without
+	// applying it.
+	DryRun ReconfigOption = iota + 1
+)
+
+// ValidateConfig reports whether Reconfig could apply cfg, without
+// changing the device. It checks cfg as wgcfg.Config.ValidateWith does,
+// allowing a missing private key, and that every endpoint can be created
+// and that the listen port can be bound if it would change. A prefix
+// allowed for two peers is rejected only under
+// DeviceOptions.RejectAllowedIPConflicts; otherwise, as Reconfig always
+// has, the device routes it to one of them.
+//
+// Endpoints are checked by creating and discarding them, so a
+// DeviceOptions.CreateEndpoint hook must tolerate that.
+func (device *Device) ValidateConfig(cfg *wgcfg.Config) error {
+	if err := device.validatePeers(cfg); err != nil {
+		return err
+	}
+	for _, p := range cfg.Peers {
+		if p.Endpoints == "" {
+			continue
+		}
+		if _, err := device.createEndpoint(p.PublicKey, p.Endpoints); err != nil {
+			return fmt.Errorf("%w: peer %s: %q: %v", ErrEndpointParse, device.redactKey(p.PublicKey), device.redactAddrs(p.Endpoints), device.redactAddrErr(err))
+		}
+	}
+
+	device.net.RLock()
+	checkPort := cfg.ListenPort != 0 && !device.listenPortSatisfied(cfg.ListenPort)
+	device.net.RUnlock()
+	if checkPort {
+		bind, _, err := device.bindPort(context.Background(), cfg.ListenPort)
+		if err != nil {
+			return ErrPortInUse
+		}
+		bind.Close()
+	}
+	return nil
+}
+
+// validatePeers performs the checks of ValidateConfig that need no
+// resources, those of wgcfg.Config.ValidateWith. Reconfig runs them
+// before changing anything; endpoints and the port are checked as they
+// are created.
+func (device *Device) validatePeers(cfg *wgcfg.Config) error {
+	if len(cfg.Peers) > MaxPeers {
+		return fmt.Errorf("wireguard: too many peers: %d > %d", len(cfg.Peers), MaxPeers)
+	}
+	err := cfg.ValidateWith(wgcfg.ValidateOptions{
+		NoPrivateKey:   true,
+		AnyEndpoints:   true,
+		SharedPrefixes: !device.rejectAllowedIPConflicts,
+	})
+	var verr *wgcfg.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	if verr.Peer < 0 {
+		return fmt.Errorf("wireguard: %v", verr)
+	}
+	pk := cfg.Peers[verr.Peer].PublicKey
+	if pk.IsZero() {
+		return fmt.Errorf("%w: peer %d has an empty public key", ErrInvalidKey, verr.Peer)
+	}
+	return fmt.Errorf("wireguard: peer %s: %s: %v", device.redactKey(pk), verr.Field, verr.Err)
+}
+
 // Reconfig replaces the existing device configuration with cfg.
-func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
+// A cfg that fails the checks of ValidateConfig is rejected without
+// changing the device; other failures leave the device with no peers.
+// It logs how cfg differs, as by wgcfg.Diff, from the configuration of
+// the last Reconfig to succeed; changes made through UAPI or NewPeer
+// and RemovePeer in between are not seen.
+// Like Up and Down, it waits for other transitions of the device, and
+// fails with ErrDeviceClosed once the device is closed.
+func (device *Device) Reconfig(cfg *wgcfg.Config, opts ...ReconfigOption) error {
+	return device.ReconfigContext(context.Background(), cfg, opts...)
+}
+
+// ReconfigContext is Reconfig, giving up with ctx's error if ctx is done
+// while it waits for another transition, opens a new UDP socket or
+// creates the peers' endpoints. Giving up after changing the device
+// leaves it with no peers, as other failures do.
+func (device *Device) ReconfigContext(ctx context.Context, cfg *wgcfg.Config, opts ...ReconfigOption) error {
+	for _, opt := range opts {
+		if opt == DryRun {
+			return device.ValidateConfig(cfg)
+		}
+	}
+	return device.auditConfigChange(ConfigSourceAPI, func() error {
+		return device.reconfig(ctx, cfg)
+	})
+}
+
+func (device *Device) reconfig(ctx context.Context, cfg *wgcfg.Config) (err error) {
+	ctx, span := device.startSpan(ctx, "wireguard.Reconfig", SpanAttribute{Key: SpanKeyPeers, Value: int64(len(cfg.Peers))})
+	defer func() { endSpan(span, err) }()
+
+	if err := device.validatePeers(cfg); err != nil {
+		device.log.Debug.Printf("device.Reconfig: invalid config: %v", err)
+		return err
+	}
+
+	if err := device.state.LockContext(ctx); err != nil {
+		return err
+	}
+	defer device.state.Unlock()
+	if device.isClosed() {
+		return ErrDeviceClosed
+	}
+
+	diff := wgcfg.Diff(device.state.applied, cfg)
+	span.SetAttributes(
+		SpanAttribute{Key: SpanKeyPeersAdded, Value: int64(len(diff.Added))},
+		SpanAttribute{Key: SpanKeyPeersRemoved, Value: int64(len(diff.Removed))},
+		SpanAttribute{Key: SpanKeyPeersChanged, Value: int64(len(diff.Changed))})
+	if device.redaction.Keys {
+		device.log.Debug.Printf("device.Reconfig: %d peers added, %d removed, %d changed",
+			len(diff.Added), len(diff.Removed), len(diff.Changed))
+	} else {
+		device.log.Debug.Printf("device.Reconfig: %v", diff)
+	}
+
+	defer func() {
+		if err == nil {
+			device.syncRoutes()
+		}
+	}()
 	defer func() {
 		if err != nil {
 			device.log.Debug.Printf("device.Reconfig: failed: %v", err)
 			device.RemoveAllPeers()
+			device.state.applied = nil
+			return
 		}
+		applied := cfg.Copy()
+		device.state.applied = &applied
 	}()
 
 	// Remove any current peers not in the new configuration.
@@ -64,9 +200,8 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 		delete(oldPeers, NoisePublicKey(p.PublicKey))
 	}
 	for k := range oldPeers {
-		wk := wgcfg.Key(k)
-		device.log.Debug.Printf("device.Reconfig: removing old peer %s", wk.ShortString())
-		device.RemovePeer(k)
+		device.log.Debug.Printf("device.Reconfig: removing old peer %s", device.redactKey(k))
+		device.removePeerContext(ctx, k)
 	}
 
 	device.staticIdentity.Lock()
@@ -80,50 +215,108 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 		}
 	}
 
+	// Rebinding closes the sockets and forgets every peer's cached source
+	// address, so only do it if the port actually changes. A port of
+	// zero means any port, which the current one satisfies, as does any
+	// port of the listen port range for a port in it.
 	device.net.Lock()
-	device.net.port = cfg.ListenPort
+	rebind := cfg.ListenPort != device.net.port && !device.listenPortSatisfied(cfg.ListenPort)
+	if rebind {
+		device.net.port = cfg.ListenPort
+	}
 	device.net.Unlock()
 
-	if err := device.BindUpdate(); err != nil {
-		return ErrPortInUse
+	if rebind {
+		if err := device.BindUpdateContext(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return ErrPortInUse
+		}
+	}
+
+	if err := device.BindSetMark(cfg.FwMark); err != nil {
+		return err
+	}
+	if err := device.setUAPIExtensions(nil, cfg.Extensions); err != nil {
+		return fmt.Errorf("wireguard: %w", err)
+	}
+
+	// Create all new endpoints before changing any peer, so that a bad
+	// endpoint fails the Reconfig without disturbing the others.
+	endpoints := make([]conn.Endpoint, len(cfg.Peers))
+	for i, p := range cfg.Peers {
+		if p.Endpoints == "" {
+			continue
+		}
+		if peer := device.LookupPeer(NoisePublicKey(p.PublicKey)); peer != nil {
+			peer.RLock()
+			same := peer.endpoint != nil && endpointsEqual(p.Endpoints, peer.endpoint.Addrs())
+			peer.RUnlock()
+			if same {
+				continue
+			}
+		}
+		endpoints[i], err = device.createEndpointContext(ctx, p.PublicKey, p.Endpoints)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("%w: peer %s: %v", ErrEndpointParse, device.redactKey(p.PublicKey), device.redactAddrErr(err))
+		}
 	}
 
-	// TODO(crawshaw): UAPI supports an fwmark field
+	// Into an empty table, as when loading the initial configuration,
+	// every route goes in at once at the end; see AllowedIPs.InsertBulk.
+	var bulk []AllowedIPEntry
+	bulkLoad := device.allowedips.isEmpty()
 
 	newKeepalivePeers := make(map[wgcfg.Key]*Peer)
-	for _, p := range cfg.Peers {
+	for i, p := range cfg.Peers {
 		peer := device.LookupPeer(NoisePublicKey(p.PublicKey))
 		if peer == nil {
-			device.log.Debug.Printf("device.Reconfig: new peer %s", p.PublicKey.ShortString())
-			peer, err = device.NewPeer(NoisePublicKey(p.PublicKey))
+			device.log.Debug.Printf("device.Reconfig: new peer %s", device.redactKey(p.PublicKey))
+			peer, err = device.newPeerContext(ctx, NoisePublicKey(p.PublicKey))
 			if err != nil {
 				return err
 			}
-			if p.PersistentKeepalive != 0 && device.isUp.Get() {
+			if p.PersistentKeepalive != 0 && device.isUp() {
 				newKeepalivePeers[p.PublicKey] = peer
 			}
 		}
 
+		peer.SetPassive(p.Passive)
+		peer.SetDisabled(p.Disabled)
+		peer.SetValidity(p.NotBefore, p.NotAfter)
+		if err := peer.SetMTU(int(p.MTU)); err != nil {
+			return fmt.Errorf("wireguard: peer %s: %w", device.redactKey(p.PublicKey), err)
+		}
+		peer.SetHandshakeSources(p.HandshakeSources)
+		if err := peer.SetLocalAddr(p.LocalAddr); err != nil {
+			return fmt.Errorf("wireguard: peer %s: local address %q: %w", device.redactKey(p.PublicKey), p.LocalAddr, err)
+		}
+		if err := device.setUAPIExtensions(peer, p.Extensions); err != nil {
+			return fmt.Errorf("wireguard: peer %s: %w", device.redactKey(p.PublicKey), err)
+		}
+
 		peer.Lock()
 		atomic.StoreUint32(&peer.persistentKeepaliveInterval, uint32(p.PersistentKeepalive))
-		if p.Endpoints != "" && (peer.endpoint == nil || !endpointsEqual(p.Endpoints, peer.endpoint.Addrs())) {
-			ep, err := device.createEndpoint(p.PublicKey, p.Endpoints)
-			if err != nil {
-				peer.Unlock()
-				return err
-			}
+		if ep := endpoints[i]; ep != nil {
 			peer.endpoint = ep
 
 			// TODO(crawshaw): whether or not a new keepalive is necessary
 			// on changing the endpoint depends on the semantics of the
 			// CreateEndpoint func, which is not properly defined. Define it.
-			if p.PersistentKeepalive != 0 && device.isUp.Get() {
+			if p.PersistentKeepalive != 0 && device.isUp() {
 				newKeepalivePeers[p.PublicKey] = peer
 
-				// Make sure the new handshake will get fired.
-				peer.handshake.mutex.Lock()
-				peer.handshake.lastSentHandshake = time.Now().Add(-RekeyTimeout)
-				peer.handshake.mutex.Unlock()
+				// A session survives the move to a new endpoint, so
+				// only hurry the handshake along if there is none.
+				if peer.keypairs.Current() == nil {
+					peer.handshake.mutex.Lock()
+					peer.handshake.lastSentHandshake = device.now().Add(-RekeyTimeout)
+					peer.handshake.mutex.Unlock()
+				}
 			}
 		}
 		allowedIPsChanged := !cidrsEqual(peer.allowedIPs, p.AllowedIPs)
@@ -132,11 +325,22 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 		}
 		peer.Unlock()
 
+		if peer.setDisabledRoutes(p.AllowedIPs) {
+			continue
+		}
+		if bulkLoad {
+			for _, prefix := range p.AllowedIPs {
+				bulk = append(bulk, AllowedIPEntry{Prefix: prefix, Peer: peer})
+			}
+			continue
+		}
 		if allowedIPsChanged {
-			// RemoveByPeer is currently (2020-07-24) very
-			// expensive on large networks, so we avoid
-			// calling it when possible.
-			device.allowedips.RemoveByPeer(peer)
+			// Replace the peer's routes in one step, so that packets for
+			// prefixes it keeps are never dropped in between. Removal
+			// is currently (2020-07-24) very expensive on large
+			// networks, so we avoid it when possible.
+			device.allowedips.ReplaceForPeer(peer, p.AllowedIPs)
+			continue
 		}
 		// DANGER: allowedIP is a value type. Its contents (the IP and
 		// Mask) are overwritten on every iteration through the
@@ -151,9 +355,13 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 		}
 	}
 
+	if bulkLoad {
+		device.allowedips.InsertBulk(bulk)
+	}
+
 	// Send immediate keepalive if we're turning it on and before it wasn't on.
 	for k, peer := range newKeepalivePeers {
-		device.log.Debug.Printf("device.Reconfig: sending keepalive to peer %s", k.ShortString())
+		device.log.Debug.Printf("device.Reconfig: sending keepalive to peer %s", device.redactKey(k))
 		peer.SendKeepalive()
 	}
 
@@ -206,5 +414,3 @@ func cidrsEqual(x, y []netaddr.IPPrefix) bool {
 	}
 	return true
 }
-
-var ErrPortInUse = fmt.Errorf("wireguard: local port in use: %w", &IPCError{ipc.IpcErrorPortInUse})
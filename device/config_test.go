@@ -4,11 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"net"
 	"os"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/ipc"
 	"github.com/tailscale/wireguard-go/tun"
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"inet.af/netaddr"
@@ -177,6 +183,394 @@ func TestConfig(t *testing.T) {
 	})
 }
 
+// TestReconfigKeepsSessions checks that reapplying an unchanged
+// configuration leaves the sockets and the established session alone.
+func TestReconfigKeepsSessions(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		t.Fatal("no session after ping")
+	}
+	dev.net.RLock()
+	bind := dev.net.bind
+	dev.net.RUnlock()
+
+	cfg := dev.Config()
+	for _, port := range []uint16{cfg.ListenPort, 0} {
+		cfg.ListenPort = port
+		if err := dev.Reconfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+		dev.net.RLock()
+		rebound := dev.net.bind != bind
+		dev.net.RUnlock()
+		if rebound {
+			t.Errorf("port %d: Reconfig rebound the unchanged socket", port)
+		}
+		if dev.LookupPeer(pair[1].dev.staticIdentity.publicKey) != peer {
+			t.Fatalf("port %d: Reconfig replaced the peer", port)
+		}
+		if peer.keypairs.Current() != keypair {
+			t.Errorf("port %d: Reconfig replaced the session", port)
+		}
+	}
+
+	// Changing only the allowed IPs keeps the session too.
+	cfg.Peers[0].AllowedIPs = append(cfg.Peers[0].AllowedIPs, netaddr.MustParseIPPrefix("10.9.9.0/24"))
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if peer.keypairs.Current() != keypair {
+		t.Error("allowed IPs change replaced the session")
+	}
+	if got := dev.AllowedIPs().Lookup(netaddr.MustParseIP("10.9.9.1")); got != peer {
+		t.Errorf("new allowed IP routed to %v, want peer", got)
+	}
+	pair.Send(t, Pong, nil)
+}
+
+func TestValidateConfig(t *testing.T) {
+	pk1, _ := newPrivateKey()
+	pk2, _ := newPrivateKey()
+	pk3, _ := newPrivateKey()
+	peer := func(pk NoisePrivateKey, prefix string) wgcfg.Peer {
+		return wgcfg.Peer{
+			PublicKey:  wgcfg.Key(pk.publicKey()),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(prefix)},
+		}
+	}
+	good := &wgcfg.Config{
+		PrivateKey: wgcfg.PrivateKey(pk1),
+		Peers:      []wgcfg.Peer{peer(pk2, "10.0.0.2/32")},
+	}
+
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger:                   NewLogger(LogLevelError, "device"),
+		RejectAllowedIPConflicts: true,
+	})
+	defer device.Close()
+	if err := device.Reconfig(good); err != nil {
+		t.Fatal(err)
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	busyPort := uint16(udp.LocalAddr().(*net.UDPAddr).Port)
+
+	badEndpoint := peer(pk3, "10.0.0.3/32")
+	badEndpoint.Endpoints = "not an endpoint"
+	tests := []struct {
+		name   string
+		modify func(cfg *wgcfg.Config)
+		want   string
+	}{
+		{"duplicate peer", func(cfg *wgcfg.Config) {
+			cfg.Peers = append(cfg.Peers, peer(pk2, "10.0.0.3/32"))
+		}, "duplicate of peer 0"},
+		{"own key", func(cfg *wgcfg.Config) {
+			cfg.Peers = append(cfg.Peers, peer(pk1, "10.0.0.3/32"))
+		}, "own public key"},
+		{"allowed IP conflict", func(cfg *wgcfg.Config) {
+			cfg.Peers = append(cfg.Peers, peer(pk3, "10.0.0.2/32"))
+		}, "also allowed for peer 0"},
+		{"bad endpoint", func(cfg *wgcfg.Config) {
+			cfg.Peers = append(cfg.Peers, badEndpoint)
+		}, "invalid endpoint"},
+		{"port in use", func(cfg *wgcfg.Config) {
+			cfg.ListenPort = busyPort
+		}, "port in use"},
+	}
+	for _, tt := range tests {
+		cfg := &wgcfg.Config{PrivateKey: good.PrivateKey, Peers: append([]wgcfg.Peer(nil), good.Peers...)}
+		tt.modify(cfg)
+		for _, err := range []error{device.ValidateConfig(cfg), device.Reconfig(cfg, DryRun)} {
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+			}
+		}
+	}
+
+	// Neither failed checks nor dry runs change the device.
+	cfg := &wgcfg.Config{PrivateKey: good.PrivateKey, Peers: []wgcfg.Peer{peer(pk3, "10.0.0.3/32")}}
+	if err := device.Reconfig(cfg, DryRun); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Peers = append(cfg.Peers, cfg.Peers[0])
+	if err := device.Reconfig(cfg); err == nil {
+		t.Error("Reconfig accepted duplicate peers")
+	}
+	if got := device.Config(); len(got.Peers) != 1 || got.Peers[0].PublicKey != good.Peers[0].PublicKey {
+		t.Errorf("device changed: %+v", got.Peers)
+	}
+
+	// Without RejectAllowedIPConflicts, a prefix allowed for two peers is
+	// accepted, as it always was.
+	lenient := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "lenient"),
+	})
+	defer lenient.Close()
+	cfg = &wgcfg.Config{PrivateKey: good.PrivateKey, Peers: []wgcfg.Peer{peer(pk2, "10.0.0.2/32"), peer(pk3, "10.0.0.2/32")}}
+	if err := lenient.ValidateConfig(cfg); err != nil {
+		t.Errorf("ValidateConfig rejected a shared prefix: %v", err)
+	}
+	if err := lenient.Reconfig(cfg); err != nil {
+		t.Errorf("Reconfig rejected a shared prefix: %v", err)
+	}
+}
+
+func TestReconfigFwMark(t *testing.T) {
+	binds, _ := bindtest.NewChannelBinds()
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "device"),
+		CreateBind: func(uint16) (conn.Bind, uint16, error) {
+			return binds[0], 1, nil
+		},
+	})
+	defer device.Close()
+	pk, _ := newPrivateKey()
+	cfg := &wgcfg.Config{PrivateKey: wgcfg.PrivateKey(pk), FwMark: 0x51}
+
+	// A mark set while the device is down is applied to the bind it opens.
+	if err := device.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if got := binds[0].LastMark(); got != 0x51 {
+		t.Errorf("bind mark %#x, want 0x51", got)
+	}
+
+	cfg.FwMark = 0x52
+	if err := device.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := binds[0].LastMark(); got != 0x52 {
+		t.Errorf("bind mark %#x after Reconfig, want 0x52", got)
+	}
+	if got := device.Config().FwMark; got != 0x52 {
+		t.Errorf("Config().FwMark = %#x, want 0x52", got)
+	}
+}
+
+func TestIpcSetAllowedIPConflict(t *testing.T) {
+	pk1, _ := newPrivateKey()
+	pk2, _ := newPrivateKey()
+	pub1, pub2 := pk1.publicKey(), pk2.publicKey()
+
+	for _, reject := range []bool{false, true} {
+		var conflicts []AllowedIPConflict
+		device := NewDevice(newNilTun(), &DeviceOptions{
+			Logger: NewLogger(LogLevelError, "device"),
+			AllowedIPConflict: func(c AllowedIPConflict) {
+				conflicts = append(conflicts, c)
+			},
+			RejectAllowedIPConflicts: reject,
+		})
+		defer device.Close()
+
+		err := device.IpcSetOperation(uapiCfg(
+			"public_key", pub1.ToHex(),
+			"allowed_ip", "10.0.0.0/24",
+			"public_key", pub2.ToHex(),
+			"allowed_ip", "10.0.0.0/8",
+			"allowed_ip", "10.0.0.0/24",
+		))
+		if reject != (err != nil) {
+			t.Errorf("reject=%v: IpcSetOperation error = %v", reject, err)
+		}
+
+		peer1, peer2 := device.LookupPeer(pub1), device.LookupPeer(pub2)
+		want := []AllowedIPConflict{{
+			Prefix:   netaddr.MustParseIPPrefix("10.0.0.0/24"),
+			Owner:    peer1,
+			Claimant: peer2,
+		}}
+		if !reflect.DeepEqual(conflicts, want) {
+			t.Errorf("reject=%v: conflicts = %+v, want %+v", reject, conflicts, want)
+		}
+		wantOwner := peer2
+		if reject {
+			wantOwner = peer1
+		}
+		if got := device.AllowedIPs().Lookup(netaddr.MustParseIP("10.0.0.1")); got != wantOwner {
+			t.Errorf("reject=%v: 10.0.0.1 routed to %v, want %v", reject, got, wantOwner)
+		}
+	}
+}
+
+type errWriter struct{ n int }
+
+func (w *errWriter) Write(b []byte) (int, error) {
+	if w.n == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	w.n--
+	return len(b), nil
+}
+
+func TestIpcGetFiltered(t *testing.T) {
+	pk1, _ := newPrivateKey()
+	pk2, _ := newPrivateKey()
+	pk3, _ := newPrivateKey()
+	cfg := &wgcfg.Config{
+		PrivateKey: wgcfg.PrivateKey(pk1),
+		Peers: []wgcfg.Peer{{
+			PublicKey:  wgcfg.Key(pk2.publicKey()),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.2/32")},
+		}, {
+			PublicKey:  wgcfg.Key(pk3.publicKey()),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.3/32")},
+		}},
+	}
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "device"),
+	})
+	defer device.Close()
+	if err := device.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(filter IPCGetFilter) *wgcfg.Config {
+		t.Helper()
+		buf := new(bytes.Buffer)
+		if err := device.IpcGetOperationFiltered(buf, filter); err != nil {
+			t.Fatal(err)
+		}
+		got, err := wgcfg.FromUAPI(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	key := pk3.publicKey()
+	got := get(IPCGetFilter{Peer: &key})
+	if got.PrivateKey != cfg.PrivateKey {
+		t.Error("single peer get lost the device fields")
+	}
+	if len(got.Peers) != 1 || got.Peers[0].PublicKey != cfg.Peers[1].PublicKey {
+		t.Errorf("single peer get returned %+v, want only %s", got.Peers, cfg.Peers[1].PublicKey.ShortString())
+	} else if !reflect.DeepEqual(got.Peers[0].AllowedIPs, cfg.Peers[1].AllowedIPs) {
+		t.Errorf("allowed IPs = %v, want %v", got.Peers[0].AllowedIPs, cfg.Peers[1].AllowedIPs)
+	}
+
+	missing := pk1.publicKey()
+	if got := get(IPCGetFilter{Peer: &missing}); len(got.Peers) != 0 {
+		t.Errorf("get of unknown peer returned %d peers", len(got.Peers))
+	}
+
+	if got := get(IPCGetFilter{FilterAllowedIPs: true}); len(got.Peers) != 2 || len(got.Peers[0].AllowedIPs) != 0 {
+		t.Errorf("filtered get returned %+v", got.Peers)
+	}
+
+	// A write error part way through stops the stream.
+	err := device.IpcGetOperation(&errWriter{n: 1})
+	if ipcErr, ok := err.(*IPCError); !ok || ipcErr.ErrorCode() != ipc.IpcErrorIO {
+		t.Errorf("get to failing writer = %v, want IO error", err)
+	}
+}
+
+type recordingRoutes struct {
+	mu     sync.Mutex
+	routes []netaddr.IPPrefix
+	sets   int
+}
+
+func (r *recordingRoutes) Set(prefixes []netaddr.IPPrefix) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sets++
+	r.routes = append([]netaddr.IPPrefix(nil), prefixes...)
+	sort.Slice(r.routes, func(i, j int) bool {
+		return r.routes[i].String() < r.routes[j].String()
+	})
+	return nil
+}
+
+func (r *recordingRoutes) get() []netaddr.IPPrefix {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.routes
+}
+
+func TestReconfigRoutes(t *testing.T) {
+	pk1, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk2, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk3, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := new(recordingRoutes)
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "device"),
+		Routes: routes,
+	})
+	defer device.Close()
+
+	cfg := &wgcfg.Config{
+		PrivateKey: wgcfg.PrivateKey(pk1),
+		Peers: []wgcfg.Peer{{
+			PublicKey:  wgcfg.Key(pk2.publicKey()),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.2/32")},
+		}, {
+			PublicKey: wgcfg.Key(pk3.publicKey()),
+			AllowedIPs: []netaddr.IPPrefix{
+				netaddr.MustParseIPPrefix("0.0.0.0/0"),
+				netaddr.MustParseIPPrefix("fd00::/64"),
+			},
+		}},
+	}
+	if err := device.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("0.0.0.0/0"),
+		netaddr.MustParseIPPrefix("10.0.0.2/32"),
+		netaddr.MustParseIPPrefix("fd00::/64"),
+	}
+	if got := routes.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("routes after Reconfig = %v, want %v", got, want)
+	}
+
+	cfg.Peers = cfg.Peers[:1]
+	if err := device.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want = want[1:2]
+	if got := routes.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("routes after removing peer = %v, want %v", got, want)
+	}
+
+	// Changes that leave the routes alone, or fail, do not set them.
+	if err := device.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.IpcSet("public_key=" + wgcfg.Key(pk2.publicKey()).HexString() + "\npersistent_keepalive_interval=25\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.IpcSet("public_key=" + wgcfg.Key(pk3.publicKey()).HexString() + "\nallowed_ip=10.0.0.3/32\nmtu=bogus\n"); err == nil {
+		t.Fatal("IpcSet accepted an invalid mtu")
+	}
+	if routes.sets != 2 {
+		t.Errorf("routes set %d times, want 2", routes.sets)
+	}
+}
+
 // TODO: replace with a loopback tunnel
 type nilTun struct {
 	events chan tun.Event
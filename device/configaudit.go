@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// ConfigSource is where a change to the configuration of a device came
+// from.
+type ConfigSource string
+
+const (
+	ConfigSourceAPI  ConfigSource = "api"  // Reconfig or ReconfigContext
+	ConfigSourceUAPI ConfigSource = "uapi" // IpcSetOperation, IpcSet or the UAPI socket
+)
+
+// ConfigChange describes a change to the configuration of a device, for
+// DeviceOptions.ConfigChanged.
+type ConfigChange struct {
+	Time   time.Time
+	Source ConfigSource
+
+	// Diff is how the device's configuration, as reported by Config,
+	// differs after the change. Fields the device does not keep, such
+	// as wgcfg.Config.Addresses, never appear in it.
+	Diff *wgcfg.ConfigDiff
+
+	// Err is the error the change failed with, if any. A failed change
+	// may still have changed the device: Reconfig then leaves it with
+	// no peers, and UAPI set with the lines before the failing one
+	// applied.
+	Err error
+}
+
+// configAudit serializes the changes reported to ConfigChanged, so that
+// each is told apart from the others.
+type configAudit struct {
+	sync.Mutex
+	changed func(ConfigChange)
+}
+
+// auditConfigChange calls apply, reporting to the ConfigChanged hook how
+// it changed the configuration of the device.
+func (device *Device) auditConfigChange(source ConfigSource, apply func() error) error {
+	if device.configAudit.changed == nil {
+		return apply()
+	}
+	device.configAudit.Lock()
+	before, err := device.config()
+	if err != nil {
+		device.configAudit.Unlock()
+		device.log.Error.Println("Config change not audited:", err)
+		return apply()
+	}
+	applyErr := apply()
+	after, err := device.config()
+	device.configAudit.Unlock()
+	if err != nil {
+		device.log.Error.Println("Config change not audited:", err)
+		return applyErr
+	}
+
+	diff := wgcfg.Diff(before, after)
+	if !diff.Empty() {
+		device.configAudit.changed(ConfigChange{
+			Time:   device.now(),
+			Source: source,
+			Diff:   diff,
+			Err:    applyErr,
+		})
+	}
+	return applyErr
+}
@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestConfigChanged(t *testing.T) {
+	var changes []ConfigChange
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:        NewLogger(LogLevelError, "dev: "),
+		ConfigChanged: func(c ConfigChange) { changes = append(changes, c) },
+	})
+	defer dev.Close()
+	// Up before the changes, so that the port it binds is not one.
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := peerKey.Public()
+	cfg := &wgcfg.Config{
+		PrivateKey: privateKey,
+		Peers:      []wgcfg.Peer{{PublicKey: pk}},
+	}
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.IpcSet("public_key=" + pk.HexString() + "\npersistent_keepalive_interval=25\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("%d changes reported, want 2: %+v", len(changes), changes)
+	}
+	if c := changes[0]; c.Source != ConfigSourceAPI || c.Err != nil ||
+		!reflect.DeepEqual(c.Diff.Added, []wgcfg.Key{pk}) || !reflect.DeepEqual(c.Diff.Fields, []string{"PrivateKey"}) {
+		t.Errorf("first change %+v", c.Diff)
+	}
+	want := []wgcfg.PeerDiff{{PublicKey: pk, Fields: []string{"PersistentKeepalive"}}}
+	if c := changes[1]; c.Source != ConfigSourceUAPI || !reflect.DeepEqual(c.Diff.Changed, want) {
+		t.Errorf("second change from %s: %v", c.Source, c.Diff)
+	}
+}
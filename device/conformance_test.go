@@ -0,0 +1,133 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// captureBind is a Bind that keeps a copy of every datagram it sends.
+type captureBind struct {
+	conn.Bind
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (b *captureBind) Send(pkt []byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	b.sent = append(b.sent, append([]byte(nil), pkt...))
+	b.mu.Unlock()
+	return b.Bind.Send(pkt, ep)
+}
+
+func (b *captureBind) datagrams() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]byte(nil), b.sent...)
+}
+
+// checkWireMessage checks that pkt is a message as the WireGuard
+// protocol defines it, with its reserved bytes zero.
+func checkWireMessage(pkt []byte) error {
+	if len(pkt) < 4 {
+		return fmt.Errorf("%d bytes", len(pkt))
+	}
+	switch msgType := binary.LittleEndian.Uint32(pkt[:4]); msgType {
+	case MessageInitiationType:
+		if len(pkt) != MessageInitiationSize {
+			return fmt.Errorf("initiation of %d bytes", len(pkt))
+		}
+	case MessageResponseType:
+		if len(pkt) != MessageResponseSize {
+			return fmt.Errorf("response of %d bytes", len(pkt))
+		}
+	case MessageCookieReplyType:
+		if len(pkt) != MessageCookieReplySize {
+			return fmt.Errorf("cookie reply of %d bytes", len(pkt))
+		}
+	case MessageTransportType:
+		if len(pkt) < MessageTransportSize || (len(pkt)-MessageTransportSize)%PaddingMultiple != 0 {
+			return fmt.Errorf("transport message of %d bytes", len(pkt))
+		}
+	default:
+		return fmt.Errorf("type %#08x", msgType)
+	}
+	return nil
+}
+
+func TestStrictConformance(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	var binds [2]*captureBind
+	pair := genSimPairWithOptions(t, clock, 1, func(i int, opts *DeviceOptions) {
+		opts.Strict = true
+		// Extensions a strict device ignores.
+		opts.Reserved.Set = func(*Peer, uint8) [3]byte { return [3]byte{1, 2, 3} }
+		opts.ForeignDatagram = func([]byte, conn.Endpoint) {}
+		create := opts.CreateBind
+		opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := create(port)
+			binds[i] = &captureBind{Bind: bind}
+			return binds[i], port, err
+		}
+	})
+	for i := range pair {
+		if !pair[i].dev.Strict() {
+			t.Fatalf("device %d not strict", i)
+		}
+		if err := pair[i].dev.SendDatagram([]byte("probe"), pair[i].dev.Peers()[0].Endpoint()); !errors.Is(err, errStrict) {
+			t.Errorf("device %d SendDatagram = %v, want %v", i, err, errStrict)
+		}
+	}
+
+	// Under load, dev0 answers the first initiation with a cookie reply,
+	// and the retry, with a MAC2, with a response.
+	pair[0].dev.rate.underLoadUntil.Store(time.Now().Add(time.Hour))
+	msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pair[1].tun.Outbound <- msg
+	waitFor(t, "a cookie reply", func() bool {
+		return pair[1].dev.CookieReplies() > 0
+	})
+	step(clock, RekeyTimeout+RekeyTimeoutJitterMaxMs*time.Millisecond, 100*time.Millisecond)
+	select {
+	case <-pair[0].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	pair.Send(t, Pong, nil)
+	pair[0].dev.Peers()[0].SendKeepalive()
+	waitFor(t, "a keepalive", func() bool {
+		for _, pkt := range binds[0].datagrams() {
+			if len(pkt) == MessageKeepaliveSize {
+				return true
+			}
+		}
+		return false
+	})
+
+	seen := make(map[uint32]int)
+	for i, bind := range binds {
+		for _, pkt := range bind.datagrams() {
+			if err := checkWireMessage(pkt); err != nil {
+				t.Errorf("device %d sent a nonconforming message: %v: %x", i, err, pkt)
+				continue
+			}
+			seen[binary.LittleEndian.Uint32(pkt[:4])]++
+		}
+	}
+	for _, msgType := range []uint32{MessageInitiationType, MessageResponseType, MessageCookieReplyType, MessageTransportType} {
+		if seen[msgType] == 0 {
+			t.Errorf("no message of type %d sent", msgType)
+		}
+	}
+}
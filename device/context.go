@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+// A ctxMutex is a mutex that can be waited for under a context. Its zero
+// value is unlocked.
+type ctxMutex struct {
+	once sync.Once
+	ch   chan struct{} // holds a value while locked
+	rank lockRank      // see lockRank
+}
+
+func (m *ctxMutex) init() {
+	m.once.Do(func() { m.ch = make(chan struct{}, 1) })
+}
+
+func (m *ctxMutex) Lock() {
+	m.init()
+	if lockOrderEnabled {
+		lockOrderAcquire(m, m.rank)
+	}
+	m.ch <- struct{}{}
+}
+
+// LockContext locks m, unless ctx is done first.
+func (m *ctxMutex) LockContext(ctx context.Context) error {
+	m.init()
+	if lockOrderEnabled {
+		lockOrderAcquire(m, m.rank)
+	}
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if lockOrderEnabled {
+			lockOrderRelease(m)
+		}
+		return ctx.Err()
+	}
+}
+
+func (m *ctxMutex) Unlock() {
+	<-m.ch
+	if lockOrderEnabled {
+		lockOrderRelease(m)
+	}
+}
+
+/* The CreateBind and CreateEndpoint callbacks know nothing of contexts,
+ * and may block on DNS or worse. They run in goroutines of their own, so
+ * that the device can stop waiting for them; a bind that turns up after
+ * that is closed, and an endpoint dropped.
+ */
+
+func (device *Device) createBindContext(ctx context.Context, port uint16) (conn.Bind, uint16, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	type result struct {
+		bind conn.Bind
+		port uint16
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		bind, port, err := device.createBind(port, device)
+		done <- result{bind, port, err}
+	}()
+	select {
+	case r := <-done:
+		return r.bind, r.port, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				r.bind.Close()
+			}
+		}()
+		return nil, 0, ctx.Err()
+	}
+}
+
+func (device *Device) createEndpointContext(ctx context.Context, key [32]byte, s string) (conn.Endpoint, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		ep  conn.Endpoint
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ep, err := device.createEndpoint(key, s)
+		done <- result{ep, err}
+	}()
+	select {
+	case r := <-done:
+		return r.ep, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
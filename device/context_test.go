@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestUpContext(t *testing.T) {
+	binds, _ := bindtest.NewChannelBinds()
+	release := make(chan struct{})
+	created := make(chan *bindtest.ChannelBind, 4)
+	dev := NewDevice(newDummyTUN("dummy"), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, ""),
+		CreateBind: func(uint16) (conn.Bind, uint16, error) {
+			<-release
+			bind := binds[0].Reopen()
+			created <- bind
+			return bind, 1, nil
+		},
+	})
+	defer dev.Close()
+
+	// The first Up hangs in CreateBind; the second waits for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dev.UpContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("UpContext with hung CreateBind: %v", err)
+	}
+	hung := make(chan error)
+	go func() { hung <- dev.Up() }()
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dev.UpContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("UpContext behind a hung Up: %v", err)
+	}
+
+	// The abandoned bind is closed once it turns up; the last is in use.
+	close(release)
+	if err := <-hung; err != nil {
+		t.Fatal(err)
+	}
+	dev.net.RLock()
+	inUse := dev.net.bind
+	dev.net.RUnlock()
+	for _, bind := range []*bindtest.ChannelBind{<-created, <-created} {
+		if conn.Bind(bind) == inUse {
+			continue
+		}
+		waitFor(t, "the abandoned bind to close", func() bool {
+			return bind.Send(nil, bindtest.ChannelEndpoint(2)) != nil
+		})
+	}
+}
+
+func TestReconfigContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	dev := NewDevice(newDummyTUN("dummy"), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, ""),
+		CreateEndpoint: func(_ [32]byte, s string) (conn.Endpoint, error) {
+			<-release
+			return bindtest.ParseEndpoint(s)
+		},
+	})
+	defer dev.Close()
+
+	cfg, err := wgcfg.FromUAPI(uapiCfg(
+		"private_key", "481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58",
+		"public_key", "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725",
+		"endpoint", "127.0.0.1:1",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dev.ReconfigContext(ctx, cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReconfigContext with hung CreateEndpoint: %v", err)
+	}
+	if n := len(dev.Peers()); n != 0 {
+		t.Errorf("%d peers after giving up, want none", n)
+	}
+}
@@ -8,6 +8,8 @@ package device
 import (
 	"crypto/hmac"
 	"crypto/rand"
+	"errors"
+	"io"
 	"sync"
 	"time"
 
@@ -15,16 +17,55 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+/* A CookieChecker checks MAC1 against the keys derived from the device's
+ * public key and, while an embedder rotates it, from others it also
+ * answers to. The keys are derived when set rather than per packet. A
+ * packet MAC'd for the device's own key costs one MAC to check, however
+ * many others there are; only packets for other keys, or for none, cost
+ * one per key.
+ */
+
 type CookieChecker struct {
 	sync.RWMutex
-	mac1 struct {
-		key [blake2s.Size]byte
-	}
+	rand io.Reader           // if nil, crypto/rand
+	keys []cookieCheckerKeys // the device's own first
 	mac2 struct {
-		secret        [blake2s.Size]byte
-		secretSet     time.Time
-		encryptionKey [chacha20poly1305.KeySize]byte
+		secret    [blake2s.Size]byte
+		secretSet time.Time
 	}
+
+	clock Clock // if nil, the system clock
+}
+
+// cookieCheckerKeys are the keys derived from one public key.
+type cookieCheckerKeys struct {
+	pk            NoisePublicKey
+	mac1          [blake2s.Size]byte
+	encryptionKey [chacha20poly1305.KeySize]byte // for cookie replies
+}
+
+func newCookieCheckerKeys(pk NoisePublicKey) cookieCheckerKeys {
+	k := cookieCheckerKeys{pk: pk}
+
+	// mac1 state
+
+	func() {
+		hash, _ := blake2s.New256(nil)
+		hash.Write([]byte(WGLabelMAC1))
+		hash.Write(pk[:])
+		hash.Sum(k.mac1[:0])
+	}()
+
+	// mac2 state
+
+	func() {
+		hash, _ := blake2s.New256(nil)
+		hash.Write([]byte(WGLabelCookie))
+		hash.Write(pk[:])
+		hash.Sum(k.encryptionKey[:0])
+	}()
+
+	return k
 }
 
 type CookieGenerator struct {
@@ -39,55 +80,95 @@ type CookieGenerator struct {
 		lastMAC1      [blake2s.Size128]byte
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
+
+	clock Clock // if nil, the system clock
 }
 
+// Init sets the public key of the device the checker checks for, which
+// SetPrivateKey does, and forgets its cookie secret. The other keys set by
+// SetOtherKeys are kept.
 func (st *CookieChecker) Init(pk NoisePublicKey) {
 	st.Lock()
 	defer st.Unlock()
 
-	// mac1 state
-
-	func() {
-		hash, _ := blake2s.New256(nil)
-		hash.Write([]byte(WGLabelMAC1))
-		hash.Write(pk[:])
-		hash.Sum(st.mac1.key[:0])
-	}()
+	keys := newCookieCheckerKeys(pk)
+	if len(st.keys) == 0 {
+		st.keys = []cookieCheckerKeys{keys}
+	} else {
+		st.keys = append([]cookieCheckerKeys{keys}, st.keys[1:]...)
+	}
+	st.mac2.secretSet = time.Time{}
+}
 
-	// mac2 state
+// SetOtherKeys sets the public keys, besides the device's own, that the
+// checker accepts MAC1 for, replacing those set before. Cookie replies
+// to handshakes MAC'd for one of them are encrypted for it, as the
+// initiator expects. The device only completes handshakes for its own
+// key: the others let packets to a key being rotated out pass MAC1 until
+// their initiators learn the new one.
+func (st *CookieChecker) SetOtherKeys(pks []NoisePublicKey) {
+	keys := make([]cookieCheckerKeys, 1, 1+len(pks))
+	for _, pk := range pks {
+		keys = append(keys, newCookieCheckerKeys(pk))
+	}
 
-	func() {
-		hash, _ := blake2s.New256(nil)
-		hash.Write([]byte(WGLabelCookie))
-		hash.Write(pk[:])
-		hash.Sum(st.mac2.encryptionKey[:0])
-	}()
+	st.Lock()
+	defer st.Unlock()
+	if len(st.keys) > 0 {
+		keys[0] = st.keys[0]
+	}
+	st.keys = keys
+}
 
-	st.mac2.secretSet = time.Time{}
+// Keys returns the public keys the checker accepts MAC1 for, the device's
+// own first.
+func (st *CookieChecker) Keys() []NoisePublicKey {
+	st.RLock()
+	defer st.RUnlock()
+	pks := make([]NoisePublicKey, len(st.keys))
+	for i := range st.keys {
+		pks[i] = st.keys[i].pk
+	}
+	return pks
 }
 
-func (st *CookieChecker) CheckMAC1(msg []byte) bool {
+func (st *CookieChecker) CheckMAC1(msg []byte) (ok bool) {
+	if ctauditEnabled {
+		defer ctauditTime(CTAuditMAC1, time.Now(), &ok)
+	}
 	st.RLock()
 	defer st.RUnlock()
+	return st.mac1Keys(msg) != nil
+}
 
+// mac1Keys returns the keys msg's MAC1 was computed with, or nil if none.
+// It must be called with st locked.
+func (st *CookieChecker) mac1Keys(msg []byte) *cookieCheckerKeys {
 	size := len(msg)
 	smac2 := size - blake2s.Size128
 	smac1 := smac2 - blake2s.Size128
 
 	var mac1 [blake2s.Size128]byte
 
-	mac, _ := blake2s.New128(st.mac1.key[:])
-	mac.Write(msg[:smac1])
-	mac.Sum(mac1[:0])
-
-	return hmac.Equal(mac1[:], msg[smac1:smac2])
+	for i := range st.keys {
+		mac, _ := blake2s.New128(st.keys[i].mac1[:])
+		mac.Write(msg[:smac1])
+		mac.Sum(mac1[:0])
+		if hmac.Equal(mac1[:], msg[smac1:smac2]) {
+			return &st.keys[i]
+		}
+	}
+	return nil
 }
 
-func (st *CookieChecker) CheckMAC2(msg []byte, src []byte) bool {
+func (st *CookieChecker) CheckMAC2(msg []byte, src []byte) (ok bool) {
+	if ctauditEnabled {
+		defer ctauditTime(CTAuditMAC2, time.Now(), &ok)
+	}
 	st.RLock()
 	defer st.RUnlock()
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if st.now().Sub(st.mac2.secretSet) > CookieRefreshTime {
 		return false
 	}
 
@@ -114,25 +195,61 @@ func (st *CookieChecker) CheckMAC2(msg []byte, src []byte) bool {
 	return hmac.Equal(mac2[:], msg[smac2:])
 }
 
+func (st *CookieChecker) randReader() io.Reader {
+	if st.rand != nil {
+		return st.rand
+	}
+	return rand.Reader
+}
+
+func (st *CookieChecker) now() time.Time {
+	if st.clock != nil {
+		return st.clock.Now()
+	}
+	return time.Now()
+}
+
+func (st *CookieGenerator) now() time.Time {
+	if st.clock != nil {
+		return st.clock.Now()
+	}
+	return time.Now()
+}
+
 func (st *CookieChecker) CreateReply(
 	msg []byte,
 	recv uint32,
 	src []byte,
 ) (*MessageCookieReply, error) {
+	var nonce [chacha20poly1305.NonceSizeX]byte
+	if _, err := io.ReadFull(st.randReader(), nonce[:]); err != nil {
+		return nil, err
+	}
+	return st.createReply(msg, recv, src, nonce)
+}
+
+// createReply is CreateReply with the nonce given, so that replies can be
+// checked against test vectors.
+func (st *CookieChecker) createReply(
+	msg []byte,
+	recv uint32,
+	src []byte,
+	nonce [chacha20poly1305.NonceSizeX]byte,
+) (*MessageCookieReply, error) {
 
 	st.RLock()
 
 	// refresh cookie secret
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if st.now().Sub(st.mac2.secretSet) > CookieRefreshTime {
 		st.RUnlock()
 		st.Lock()
-		_, err := rand.Read(st.mac2.secret[:])
+		_, err := io.ReadFull(st.randReader(), st.mac2.secret[:])
 		if err != nil {
 			st.Unlock()
 			return nil, err
 		}
-		st.mac2.secretSet = time.Now()
+		st.mac2.secretSet = st.now()
 		st.Unlock()
 		st.RLock()
 	}
@@ -156,14 +273,14 @@ func (st *CookieChecker) CreateReply(
 	reply := new(MessageCookieReply)
 	reply.Type = MessageCookieReplyType
 	reply.Receiver = recv
+	reply.Nonce = nonce
 
-	_, err := rand.Read(reply.Nonce[:])
-	if err != nil {
+	keys := st.mac1Keys(msg)
+	if keys == nil {
 		st.RUnlock()
-		return nil, err
+		return nil, errors.New("message has no valid mac1")
 	}
-
-	xchapoly, _ := chacha20poly1305.NewX(st.mac2.encryptionKey[:])
+	xchapoly, _ := chacha20poly1305.NewX(keys.encryptionKey[:])
 	xchapoly.Seal(reply.Cookie[:0], reply.Nonce[:], cookie[:], msg[smac1:smac2])
 
 	st.RUnlock()
@@ -192,7 +309,10 @@ func (st *CookieGenerator) Init(pk NoisePublicKey) {
 	st.mac2.cookieSet = time.Time{}
 }
 
-func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
+func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) (ok bool) {
+	if ctauditEnabled {
+		defer ctauditTime(CTAuditCookieReply, time.Now(), &ok)
+	}
 	st.Lock()
 	defer st.Unlock()
 
@@ -209,7 +329,7 @@ func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
 		return false
 	}
 
-	st.mac2.cookieSet = time.Now()
+	st.mac2.cookieSet = st.now()
 	st.mac2.cookie = cookie
 	return true
 }
@@ -239,7 +359,7 @@ func (st *CookieGenerator) AddMacs(msg []byte) {
 
 	// set mac2
 
-	if time.Since(st.mac2.cookieSet) > CookieRefreshTime {
+	if st.now().Sub(st.mac2.cookieSet) > CookieRefreshTime {
 		return
 	}
 
@@ -6,7 +6,9 @@
 package device
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestCookieMAC1(t *testing.T) {
@@ -189,3 +191,187 @@ func TestCookieMAC1(t *testing.T) {
 		0x7d, 0xa1, 0xd5, 0x85, 0x6d, 0xf0, 0x1b, 0xaa,
 	})
 }
+
+func TestCookieMAC1OtherKeys(t *testing.T) {
+	var pks [3]NoisePublicKey
+	for i := range pks {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pks[i] = sk.publicKey()
+	}
+	own, old, unknown := pks[0], pks[1], pks[2]
+
+	var checker CookieChecker
+	checker.Init(old)
+	checker.SetOtherKeys([]NoisePublicKey{old})
+	checker.Init(own) // rotated; old is kept among the others
+	if keys := checker.Keys(); len(keys) != 2 || keys[0] != own || keys[1] != old {
+		t.Fatalf("keys %v, want own then old", keys)
+	}
+
+	src := []byte{192, 168, 13, 37, 10, 10}
+	for _, tt := range []struct {
+		pk   NoisePublicKey
+		want bool
+	}{
+		{own, true},
+		{old, true},
+		{unknown, false},
+	} {
+		var generator CookieGenerator
+		generator.Init(tt.pk)
+		msg := make([]byte, MessageInitiationSize)
+		generator.AddMacs(msg)
+		if got := checker.CheckMAC1(msg); got != tt.want {
+			t.Errorf("CheckMAC1 for %x = %v, want %v", tt.pk[:4], got, tt.want)
+		}
+		if !tt.want {
+			continue
+		}
+
+		// The reply is encrypted for the key the initiator used.
+		reply, err := checker.CreateReply(msg, 1, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !generator.ConsumeReply(reply) {
+			t.Errorf("cookie reply for %x not accepted", tt.pk[:4])
+		}
+	}
+
+	checker.SetOtherKeys(nil)
+	var generator CookieGenerator
+	generator.Init(old)
+	msg := make([]byte, MessageInitiationSize)
+	generator.AddMacs(msg)
+	if checker.CheckMAC1(msg) {
+		t.Error("MAC1 for a removed key accepted")
+	}
+}
+
+func BenchmarkCookieCheckMAC1(b *testing.B) {
+	sk, _ := newPrivateKey()
+	own := sk.publicKey()
+	var generator CookieGenerator
+	generator.Init(own)
+	msg := make([]byte, MessageInitiationSize)
+	generator.AddMacs(msg)
+
+	// A packet for the device's own key costs the same however many
+	// other keys the checker has.
+	for _, n := range []int{0, 1, 16, 256} {
+		others := make([]NoisePublicKey, n)
+		for i := range others {
+			sk, _ := newPrivateKey()
+			others[i] = sk.publicKey()
+		}
+		var checker CookieChecker
+		checker.Init(own)
+		checker.SetOtherKeys(others)
+		b.Run(fmt.Sprintf("others=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if !checker.CheckMAC1(msg) {
+					b.Fatal("MAC1 rejected")
+				}
+			}
+		})
+	}
+}
+
+func TestCookieReplyUnsolicited(t *testing.T) {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		generator CookieGenerator
+		checker   CookieChecker
+	)
+	generator.Init(sk.publicKey())
+	checker.Init(sk.publicKey())
+
+	msg := make([]byte, MessageInitiationSize)
+	var other CookieGenerator
+	other.Init(sk.publicKey())
+	other.AddMacs(msg)
+	reply, err := checker.CreateReply(msg, 1, []byte{192, 168, 13, 37, 10, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reply to an initiation the generator never sent is refused,
+	// whether or not it has sent any.
+	if generator.ConsumeReply(reply) {
+		t.Error("cookie reply accepted before any initiation")
+	}
+	another := make([]byte, MessageInitiationSize)
+	another[0] = 1 // differs from msg, so its mac1 does too
+	generator.AddMacs(another)
+	if generator.ConsumeReply(reply) {
+		t.Error("cookie reply to another initiation accepted")
+	}
+}
+
+func TestCookieReply(t *testing.T) {
+	waits := make(chan time.Duration, 10)
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		if i == 1 {
+			opts.CookieReply = func(_ *Peer, wait time.Duration) { waits <- wait }
+		}
+	})
+	// dev0 is under load, so it answers dev1's first initiation with a
+	// cookie reply, and its retry, with the cookie, with a response.
+	pair[0].dev.rate.underLoadUntil.Store(time.Now().Add(time.Hour))
+	pair.Send(t, Ping, nil)
+
+	select {
+	case wait := <-waits:
+		if wait <= 0 || wait > RekeyTimeout+RekeyTimeoutJitterMaxMs*time.Millisecond {
+			t.Errorf("CookieReply wait %v", wait)
+		}
+	default:
+		t.Fatal("CookieReply not called")
+	}
+	if n := pair[1].dev.CookieReplies(); n != 1 {
+		t.Errorf("device CookieReplies = %d, want 1", n)
+	}
+	if n := pair[1].dev.Peers()[0].CookieReplies(); n != 1 {
+		t.Errorf("peer CookieReplies = %d, want 1", n)
+	}
+}
+
+func TestCookieClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	generator := CookieGenerator{clock: clock}
+	checker := CookieChecker{clock: clock}
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator.Init(sk.publicKey())
+	checker.Init(sk.publicKey())
+	src := []byte{192, 168, 13, 37, 10, 10, 10}
+
+	msg := make([]byte, MessageInitiationSize)
+	generator.AddMacs(msg)
+	reply, err := checker.CreateReply(msg, 1377, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !generator.ConsumeReply(reply) {
+		t.Fatal("failed to consume cookie reply")
+	}
+	generator.AddMacs(msg)
+	if !checker.CheckMAC2(msg, src) {
+		t.Fatal("MAC2 with a fresh cookie failed")
+	}
+
+	// The cookie and the secret it was made from expire by the clock.
+	clock.Advance(CookieRefreshTime + time.Second)
+	generator.AddMacs(msg)
+	if checker.CheckMAC2(msg, src) {
+		t.Error("MAC2 with an expired cookie passed")
+	}
+}
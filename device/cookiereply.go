@@ -0,0 +1,44 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* A peer under load answers an initiation without a valid MAC2 with a
+ * cookie reply. The initiation is not resent at once: the retransmit
+ * timer already running resends it, this time with a MAC2 made from the
+ * cookie, so the wait until then is what the connection is delayed by.
+ */
+
+// cookieReplyReceived is called when a cookie reply from peer has been
+// consumed.
+func (peer *Peer) cookieReplyReceived() {
+	device := peer.device
+	atomic.AddUint64(&device.stats.cookieReplies, 1)
+	atomic.AddUint64(&peer.cookie.replies, 1)
+	wait := time.Duration(atomic.LoadInt64(&peer.cookie.retryAtNano) - device.now().UnixNano())
+	if wait < 0 || !peer.timers.retransmitHandshake.IsPending() {
+		wait = 0
+	}
+	device.log.Debug.Println(peer, "- Under load; retrying handshake with cookie in", wait)
+	if cookieReply := device.cookieReply; cookieReply != nil {
+		cookieReply(peer, wait)
+	}
+}
+
+// CookieReplies reports how many cookie replies the device has
+// accepted from peers under load.
+func (device *Device) CookieReplies() uint64 {
+	return atomic.LoadUint64(&device.stats.cookieReplies)
+}
+
+// CookieReplies returns the number of cookie replies accepted from peer.
+func (peer *Peer) CookieReplies() uint64 {
+	return atomic.LoadUint64(&peer.cookie.replies)
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Constant-time audit mode times the paths that compare secrets against
+ * what a peer sent: MAC1 and MAC2 validation, cookie reply decryption
+ * and key comparison. Each path is timed separately for inputs it
+ * accepts and inputs it rejects, so that a reviewer can see whether the
+ * time a path takes depends on more than the length of its input.
+ *
+ * The mode is built with the ctaudit tag:
+ *
+ *	go test -tags ctaudit ./device
+ *
+ * Without the tag the timing calls compile away and CTAuditStats returns
+ * nil.
+ */
+
+// A CTAuditPath is a path timed in constant-time audit mode.
+type CTAuditPath int
+
+const (
+	CTAuditMAC1             CTAuditPath = iota // CookieChecker.CheckMAC1
+	CTAuditMAC2                                // CookieChecker.CheckMAC2
+	CTAuditCookieReply                         // CookieGenerator.ConsumeReply
+	CTAuditPublicKeyEquals                     // NoisePublicKey.Equals
+	CTAuditPrivateKeyEquals                    // NoisePrivateKey.Equals
+
+	numCTAuditPaths
+)
+
+var ctauditPathNames = [numCTAuditPaths]string{
+	CTAuditMAC1:             "mac1",
+	CTAuditMAC2:             "mac2",
+	CTAuditCookieReply:      "cookie-reply",
+	CTAuditPublicKeyEquals:  "public-key-equals",
+	CTAuditPrivateKeyEquals: "private-key-equals",
+}
+
+func (p CTAuditPath) String() string {
+	if p < 0 || p >= numCTAuditPaths {
+		return "unknown"
+	}
+	return ctauditPathNames[p]
+}
+
+// CTAuditStat summarizes the times a path took for the inputs it
+// accepted, or for those it rejected.
+type CTAuditStat struct {
+	Path     CTAuditPath
+	Accepted bool
+	Count    uint64
+	Mean     time.Duration
+	StdDev   time.Duration
+	Min      time.Duration
+	Max      time.Duration
+}
@@ -0,0 +1,26 @@
+// +build !ctaudit
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+// ctauditEnabled reports whether the ctaudit tag was given. Timing calls
+// are guarded by it so that they compile away without the tag.
+const ctauditEnabled = false
+
+func ctauditTime(path CTAuditPath, start time.Time, accepted *bool) {}
+
+// CTAuditStats returns the times taken by each path timed in constant-time
+// audit mode, or nil if the ctaudit tag was not given.
+func CTAuditStats() []CTAuditStat { return nil }
+
+// ResetCTAuditStats forgets the times recorded in constant-time audit
+// mode.
+func ResetCTAuditStats() {}
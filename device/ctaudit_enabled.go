@@ -0,0 +1,97 @@
+// +build ctaudit
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ctauditEnabled reports whether the ctaudit tag was given. Timing calls
+// are guarded by it so that they compile away without the tag.
+const ctauditEnabled = true
+
+// ctauditAcc accumulates the times of one path and outcome, keeping
+// their running mean and sum of squared deviations (Welford's method) so
+// that the variance is accurate however many are recorded.
+type ctauditAcc struct {
+	count    uint64
+	mean     float64
+	m2       float64
+	min, max time.Duration
+}
+
+func (a *ctauditAcc) add(d time.Duration) {
+	a.count++
+	x := float64(d)
+	delta := x - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (x - a.mean)
+	if a.count == 1 || d < a.min {
+		a.min = d
+	}
+	if d > a.max {
+		a.max = d
+	}
+}
+
+var ctaudit struct {
+	sync.Mutex
+	accs [numCTAuditPaths][2]ctauditAcc // rejected, accepted
+}
+
+// ctauditTime records the time since start for path, under the outcome
+// *accepted has when it is called. It is meant to be deferred, so that
+// *accepted is read once the path has returned.
+func ctauditTime(path CTAuditPath, start time.Time, accepted *bool) {
+	d := time.Since(start)
+	i := 0
+	if *accepted {
+		i = 1
+	}
+	ctaudit.Lock()
+	ctaudit.accs[path][i].add(d)
+	ctaudit.Unlock()
+}
+
+// CTAuditStats returns the times taken by each path timed in constant-time
+// audit mode, or nil if the ctaudit tag was not given.
+func CTAuditStats() []CTAuditStat {
+	ctaudit.Lock()
+	defer ctaudit.Unlock()
+	var stats []CTAuditStat
+	for path := range ctaudit.accs {
+		for i, a := range ctaudit.accs[path] {
+			if a.count == 0 {
+				continue
+			}
+			st := CTAuditStat{
+				Path:     CTAuditPath(path),
+				Accepted: i == 1,
+				Count:    a.count,
+				Mean:     time.Duration(a.mean),
+				Min:      a.min,
+				Max:      a.max,
+			}
+			if a.count > 1 {
+				st.StdDev = time.Duration(math.Sqrt(a.m2 / float64(a.count-1)))
+			}
+			stats = append(stats, st)
+		}
+	}
+	return stats
+}
+
+// ResetCTAuditStats forgets the times recorded in constant-time audit
+// mode.
+func ResetCTAuditStats() {
+	ctaudit.Lock()
+	ctaudit.accs = [numCTAuditPaths][2]ctauditAcc{}
+	ctaudit.Unlock()
+}
@@ -0,0 +1,74 @@
+// +build ctaudit
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+// TestCTAuditTiming times the audited paths with inputs that differ from
+// what they expect in the first byte, and in the last. A comparison that
+// stops at the first differing byte takes longer for the latter. The
+// times are logged rather than checked, since they depend on the
+// machine; run with -v to see them.
+func TestCTAuditTiming(t *testing.T) {
+	const rounds = 10000
+
+	var (
+		generator CookieGenerator
+		checker   CookieChecker
+	)
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	generator.Init(pk)
+	checker.Init(pk)
+
+	msg := make([]byte, MessageInitiationSize)
+	generator.AddMacs(msg)
+	smac2 := len(msg) - 16
+	smac1 := smac2 - 16
+
+	measure := func(name string, f func()) {
+		ResetCTAuditStats()
+		for i := 0; i < rounds; i++ {
+			f()
+		}
+		stats := CTAuditStats()
+		if len(stats) == 0 {
+			t.Fatalf("%s: nothing recorded", name)
+		}
+		for _, st := range stats {
+			t.Logf("%s: %s accepted=%v n=%d mean=%v stddev=%v min=%v max=%v",
+				name, st.Path, st.Accepted, st.Count, st.Mean, st.StdDev, st.Min, st.Max)
+		}
+	}
+
+	for _, pos := range []int{0, 15} {
+		bad := append([]byte(nil), msg...)
+		bad[smac1+pos] ^= 1
+		measure("mac1", func() {
+			if checker.CheckMAC1(bad) {
+				t.Fatal("bad MAC1 accepted")
+			}
+		})
+	}
+
+	other := pk
+	for _, pos := range []int{0, NoisePublicKeySize - 1} {
+		key := pk
+		key[pos] ^= 1
+		measure("public key", func() {
+			if key.Equals(other) {
+				t.Fatal("different keys compare equal")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// TestConstantTimePrimitives checks that the functions comparing secrets
+// against what a peer sent do so with constant-time primitives, and not
+// with comparisons that return at the first differing byte.
+func TestConstantTimePrimitives(t *testing.T) {
+	tests := []struct {
+		file string
+		fn   string // receiver type, if any, then name
+		uses string // the primitive it must call
+	}{
+		{"cookie.go", "CookieChecker.mac1Keys", "hmac.Equal"},
+		{"cookie.go", "CookieChecker.CheckMAC2", "hmac.Equal"},
+		{"noise-types.go", "NoisePublicKey.Equals", "subtle.ConstantTimeCompare"},
+		{"noise-types.go", "NoisePrivateKey.Equals", "subtle.ConstantTimeCompare"},
+		{"noise-helpers.go", "isZero", "subtle.ConstantTimeByteEq"},
+	}
+	banned := map[string]bool{
+		"bytes.Equal":       true,
+		"bytes.Compare":     true,
+		"reflect.DeepEqual": true,
+	}
+
+	fset := token.NewFileSet()
+	files := make(map[string]*ast.File)
+	for _, tt := range tests {
+		f, ok := files[tt.file]
+		if !ok {
+			var err error
+			f, err = parser.ParseFile(fset, tt.file, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[tt.file] = f
+		}
+		decl := findFunc(f, tt.fn)
+		if decl == nil {
+			t.Errorf("%s: %s not found", tt.file, tt.fn)
+			continue
+		}
+		var found bool
+		ast.Inspect(decl.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			name := selectorName(call.Fun)
+			if name == tt.uses {
+				found = true
+			}
+			if banned[name] {
+				t.Errorf("%s: %s calls %s", fset.Position(call.Pos()), tt.fn, name)
+			}
+			return true
+		})
+		if !found {
+			t.Errorf("%s: %s does not call %s", tt.file, tt.fn, tt.uses)
+		}
+	}
+}
+
+func findFunc(f *ast.File, name string) *ast.FuncDecl {
+	for _, d := range f.Decls {
+		decl, ok := d.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		fn := decl.Name.Name
+		if decl.Recv != nil && len(decl.Recv.List) == 1 {
+			typ := decl.Recv.List[0].Type
+			if star, ok := typ.(*ast.StarExpr); ok {
+				typ = star.X
+			}
+			if ident, ok := typ.(*ast.Ident); ok {
+				fn = ident.Name + "." + fn
+			}
+		}
+		if fn == name {
+			return decl
+		}
+	}
+	return nil
+}
+
+// selectorName returns pkg.Name for a call to a package's function, or
+// the empty string.
+func selectorName(fun ast.Expr) string {
+	sel, ok := fun.(*ast.SelectorExpr)
+	if !ok {
+		return ""
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	return pkg.Name + "." + sel.Sel.Name
+}
@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+/* NAT traversal protocols, such as ICE or Tailscale's disco, work best
+ * when their probes leave from the very port WireGuard uses, as that is
+ * the mapping they are trying to open. Rather than replace the Bind to
+ * get at the socket, they can have the device pass them what is not
+ * WireGuard, and send on its sockets.
+ */
+
+// isMessageType reports whether b, the first byte of a datagram, is the
+// type of a WireGuard message.
+func isMessageType(b byte) bool {
+	return b >= MessageInitiationType && b <= MessageTransportType
+}
+
+// SendDatagram sends pkt, which need not be a WireGuard message, to ep
+// from the device's UDP socket. Datagrams that come back, if they do not
+// start with a WireGuard message type, are passed to
+// DeviceOptions.ForeignDatagram.
+func (device *Device) SendDatagram(pkt []byte, ep conn.Endpoint) error {
+	if device.frozen.Get() {
+		return errors.New("device is frozen")
+	}
+	if device.strict {
+		return errStrict
+	}
+	return device.sendOnBind(pkt, ep)
+}
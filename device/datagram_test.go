@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+func TestForeignDatagram(t *testing.T) {
+	type datagram struct {
+		pkt []byte
+		src conn.Endpoint
+	}
+	var received [2]chan datagram
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		c := make(chan datagram, 1)
+		received[i] = c
+		opts.ForeignDatagram = func(pkt []byte, src conn.Endpoint) {
+			c <- datagram{append([]byte(nil), pkt...), src}
+		}
+	})
+	pair.Send(t, Ping, nil)
+
+	recv := func(i int) datagram {
+		select {
+		case d := <-received[i]:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("dev%d: no datagram", i)
+			return datagram{}
+		}
+	}
+
+	// A probe shorter than any WireGuard message, and one the length of
+	// a keepalive, both get through.
+	probe := []byte{0x80, 'p', 'i', 'n', 'g'}
+	if err := pair[1].dev.SendDatagram(probe, pair[1].dev.Peers()[0].Endpoint()); err != nil {
+		t.Fatal(err)
+	}
+	got := recv(0)
+	if !bytes.Equal(got.pkt, probe) {
+		t.Fatalf("received %q, want %q", got.pkt, probe)
+	}
+	pong := make([]byte, MessageKeepaliveSize)
+	pong[0] = 0x81
+	if err := pair[0].dev.SendDatagram(pong, got.src); err != nil {
+		t.Fatal(err)
+	}
+	if got := recv(1); !bytes.Equal(got.pkt, pong) {
+		t.Fatalf("received %q, want %q", got.pkt, pong)
+	}
+
+	// WireGuard traffic is unaffected.
+	pair.Send(t, Pong, nil)
+	select {
+	case d := <-received[0]:
+		t.Errorf("WireGuard message passed on: %x", d.pkt)
+	default:
+	}
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DeadPeerDetection decides when a peer is considered down: when data
+// sent to it has gone unanswered for After, and at least Attempts
+// handshake initiations were sent to it in the meantime. Anything
+// authenticated from the peer brings it back up.
+//
+// The zero value disables detection.
+type DeadPeerDetection struct {
+	After    time.Duration
+	Attempts int
+}
+
+func (d DeadPeerDetection) enabled() bool {
+	return d.After > 0
+}
+
+type peerDeadness struct {
+	unansweredSinceNano int64  // first data sent since hearing from the peer; zero if none
+	initiations         uint32 // handshake initiations sent since hearing from the peer
+	down                AtomicBool
+}
+
+// IsDown reports whether the device considers peer down under its
+// DeadPeerDetection policy.
+func (peer *Peer) IsDown() bool {
+	return peer.dead.down.Get()
+}
+
+/* Should be called after data is sent to the peer. */
+func (peer *Peer) deadPeerDataSent() {
+	if !peer.device.deadPeer.enabled() {
+		return
+	}
+	atomic.CompareAndSwapInt64(&peer.dead.unansweredSinceNano, 0, peer.device.now().UnixNano())
+	peer.deadPeerCheck()
+}
+
+/* Should be called after a handshake initiation is sent to the peer. */
+func (peer *Peer) deadPeerHandshakeInitiated() {
+	if !peer.device.deadPeer.enabled() {
+		return
+	}
+	atomic.AddUint32(&peer.dead.initiations, 1)
+	peer.deadPeerCheck()
+}
+
+/* Should be called after any authenticated packet is received from the peer. */
+func (peer *Peer) deadPeerAnswered() {
+	if !peer.device.deadPeer.enabled() {
+		return
+	}
+	atomic.StoreInt64(&peer.dead.unansweredSinceNano, 0)
+	atomic.StoreUint32(&peer.dead.initiations, 0)
+	if peer.dead.down.Swap(false) {
+		peer.device.log.Info.Println(peer, "- Peer is up again")
+		peer.device.announceRoutes(peer, true)
+		if up := peer.device.peerUp; up != nil {
+			up(peer)
+		}
+	}
+}
+
+func (peer *Peer) deadPeerCheck() {
+	policy := peer.device.deadPeer
+	since := atomic.LoadInt64(&peer.dead.unansweredSinceNano)
+	if since == 0 || peer.device.since(time.Unix(0, since)) < policy.After {
+		return
+	}
+	if int(atomic.LoadUint32(&peer.dead.initiations)) < policy.Attempts {
+		return
+	}
+	if !peer.dead.down.Swap(true) {
+		peer.device.log.Info.Printf("%s - Peer is down: nothing heard for %v despite %d handshake attempts\n",
+			peer, policy.After, atomic.LoadUint32(&peer.dead.initiations))
+		peer.device.announceRoutes(peer, false)
+		if down := peer.device.peerDown; down != nil {
+			down(peer)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// blackholeBind silently drops what it is asked to send while blocked.
+type blackholeBind struct {
+	*bindtest.ChannelBind
+	blocked AtomicBool
+}
+
+func (b *blackholeBind) Send(pkt []byte, ep conn.Endpoint) error {
+	if b.blocked.Get() {
+		return nil
+	}
+	return b.ChannelBind.Send(pkt, ep)
+}
+
+func (b *blackholeBind) SendWithFlowLabel(pkt []byte, ep conn.Endpoint, label uint32) error {
+	return b.Send(pkt, ep)
+}
+
+// genDeadPeerPair makes a pair whose second device can be made to stop
+// answering the first, which detects dead peers.
+func genDeadPeerPair(t *testing.T, clock *ManualClock, configure func(opts *DeviceOptions)) (testPair, *blackholeBind) {
+	var hole *blackholeBind
+	pair := genSimPairWithOptions(t, clock, 1, func(i int, opts *DeviceOptions) {
+		createBind := opts.CreateBind
+		if i == 1 {
+			opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+				bind, port, err := createBind(port)
+				hole = &blackholeBind{ChannelBind: bind.(*bindtest.ChannelBind)}
+				return hole, port, err
+			}
+			return
+		}
+		opts.DeadPeer = DeadPeerDetection{After: 20 * time.Second, Attempts: 2}
+		configure(opts)
+	})
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	return pair, hole
+}
+
+// silence makes the second device of a pair from genDeadPeerPair stop
+// answering the first until long enough after the first sends it data
+// for the first to consider it down.
+func silence(t *testing.T, clock *ManualClock, pair testPair, hole *blackholeBind) {
+	hole.blocked.Set(true)
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	<-pair[1].tun.Inbound
+	step(clock, 35*time.Second, 100*time.Millisecond)
+}
+
+func TestDeadPeerDetection(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	events := make(chan string, 4)
+	pair, hole := genDeadPeerPair(t, clock, func(opts *DeviceOptions) {
+		opts.PeerDown = func(*Peer) { events <- "down" }
+		opts.PeerUp = func(*Peer) { events <- "up" }
+	})
+	peer := pair[0].dev.Peers()[0]
+
+	// The other end stops answering, but keeps receiving.
+	hole.blocked.Set(true)
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	<-pair[1].tun.Inbound
+	step(clock, 15*time.Second, 100*time.Millisecond)
+	if peer.IsDown() {
+		t.Fatal("peer down before DeadPeer.After")
+	}
+	step(clock, 20*time.Second, 100*time.Millisecond)
+	waitFor(t, "the peer to go down", peer.IsDown)
+	if ev := <-events; ev != "down" {
+		t.Fatalf("got %q, want down", ev)
+	}
+
+	hole.blocked.Set(false)
+	step(clock, 10*time.Second, 100*time.Millisecond)
+	waitFor(t, "the peer to come back up", func() bool {
+		return !peer.IsDown()
+	})
+	if ev := <-events; ev != "up" {
+		t.Fatalf("got %q, want up", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected %q", ev)
+	default:
+	}
+}
+
+func TestRouteAnnouncer(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	announcements := NewRouteAnnouncements(4)
+	pair, hole := genDeadPeerPair(t, clock, func(opts *DeviceOptions) {
+		opts.RouteAnnouncer = announcements
+	})
+	peer := pair[0].dev.Peers()[0]
+	prefixes := peer.AllowedIPs()
+
+	check := func(withdraw bool) {
+		t.Helper()
+		select {
+		case a := <-announcements.C:
+			if a.Withdraw != withdraw || a.Peer != peer.PublicKey() || !reflect.DeepEqual(a.Prefixes, prefixes) {
+				t.Errorf("got %+v, want withdraw=%v of %v", a, withdraw, prefixes)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no announcement (withdraw=%v)", withdraw)
+		}
+	}
+	silence(t, clock, pair, hole)
+	check(true)
+	hole.blocked.Set(false)
+	step(clock, 10*time.Second, 100*time.Millisecond)
+	check(false)
+}
+
+func TestRouteAnnouncementsDropWhenFull(t *testing.T) {
+	announcements := NewRouteAnnouncements(1)
+	announcements.Withdraw(NoisePublicKey{1}, nil)
+	announcements.Announce(NoisePublicKey{1}, nil) // must not block
+	if n := announcements.Dropped(); n != 1 {
+		t.Errorf("dropped %d, want 1", n)
+	}
+	if a := <-announcements.C; !a.Withdraw {
+		t.Errorf("got %+v, want the withdrawal sent first", a)
+	}
+}
@@ -0,0 +1,230 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package debug serves a device's counters over HTTP, so that a daemon
+// can expose them on a debug port with one call:
+//
+//	mux := http.NewServeMux()
+//	debug.Register(mux, dev)
+//	go http.ListenAndServe("localhost:6060", mux)
+//
+// The device's state is served as a single JSON object, in the manner of
+// expvar, at /debug/wireguard, alongside the pprof handlers under
+// /debug/pprof/. The device labels its routines with device.WorkerLabel,
+// so profiles can be broken down by worker.
+package debug
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/device"
+)
+
+// Path is where Register serves the device's state.
+const Path = "/debug/wireguard"
+
+// Register adds Handler(dev) at Path to mux, along with the pprof
+// handlers under /debug/pprof/.
+func Register(mux *http.ServeMux, dev *device.Device) {
+	mux.Handle(Path, Handler(dev))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// Handler returns a handler serving the state of dev as JSON.
+func Handler(dev *device.Device) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(snapshot(dev))
+	})
+}
+
+// State is the JSON document served by Handler.
+type State struct {
+	// Drops is the number of packets dropped for each reason, keyed by
+	// the reason's name. Reasons with none are omitted.
+	Drops map[string]uint64 `json:"drops"`
+
+	// SocketErrors is the number of errors of each kind the UDP sockets
+	// returned, keyed by the kind's name. Kinds with none are omitted.
+	SocketErrors map[string]uint64 `json:"socket_errors"`
+
+	// Socket reports on the UDP socket buffers, including the datagrams
+	// dropped for want of room, if the device's Bind can.
+	Socket *conn.SocketStats `json:"socket,omitempty"`
+
+	Queues         device.QueueDepths     `json:"queues"`
+	QueueHighWater device.QueueDepths     `json:"queue_high_water"`
+	AllowedIPs     device.AllowedIPsStats `json:"allowed_ips"`
+	IndexTable     device.IndexTableStats `json:"index_table"`
+	Relay          *Relay                 `json:"relay,omitempty"`
+	Peers          []Peer                 `json:"peers"`
+
+	// Events is the device's event log, oldest first.
+	Events []Event `json:"events"`
+}
+
+// Event is an entry of the device's event log; see device.Event.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Peer   string    `json:"peer,omitempty"` // base64
+	Detail string    `json:"detail,omitempty"`
+	Count  int       `json:"count"`
+}
+
+// Relay counts the packets relayed between pairs of peers; see
+// device.Device.RelayStats.
+type Relay struct {
+	Pairs        []RelayPair `json:"pairs"`
+	OtherPackets uint64      `json:"other_packets,omitempty"`
+	OtherBytes   uint64      `json:"other_bytes,omitempty"`
+}
+
+// RelayPair counts the packets relayed from one peer to another.
+type RelayPair struct {
+	From    string `json:"from"` // base64
+	To      string `json:"to"`   // base64
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Peer summarizes a peer.
+type Peer struct {
+	PublicKey          string             `json:"public_key"` // base64
+	Endpoint           string             `json:"endpoint,omitempty"`
+	LocalAddr          string             `json:"local_addr,omitempty"`
+	AllowedIPs         []string           `json:"allowed_ips"`
+	LastHandshake      time.Time          `json:"last_handshake"` // zero if none
+	TxBytes            uint64             `json:"tx_bytes"`
+	RxBytes            uint64             `json:"rx_bytes"`
+	Passive            bool               `json:"passive,omitempty"`
+	Disabled           bool               `json:"disabled,omitempty"`
+	Expired            bool               `json:"expired,omitempty"`
+	MTU                int                `json:"mtu,omitempty"`
+	Quarantined        bool               `json:"quarantined,omitempty"`
+	Down               bool               `json:"down,omitempty"`
+	HandshakeCrossings uint64             `json:"handshake_crossings,omitempty"`
+	EndpointFlaps      uint64             `json:"endpoint_flaps,omitempty"`
+	DuplicateKeys      uint64             `json:"duplicate_keys,omitempty"`
+	Quality            device.PeerQuality `json:"quality"`
+
+	// Queues and QueueHighWater are the depths of the peer's queues, now
+	// and at their highest.
+	Queues         device.PeerQueueDepths `json:"queues"`
+	QueueHighWater device.PeerQueueDepths `json:"queue_high_water"`
+
+	// HandshakeRTT summarizes the peer's RTTHistogram, once it has a
+	// sample.
+	HandshakeRTT *HandshakeRTT `json:"handshake_rtt,omitempty"`
+}
+
+// HandshakeRTT summarizes the round-trip times of a peer's handshakes.
+// The quantiles are bounds of histogram buckets; see
+// device.RTTHistogram.Quantile.
+type HandshakeRTT struct {
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func snapshot(dev *device.Device) State {
+	stats := dev.StatsSnapshot()
+	st := State{
+		Drops:          make(map[string]uint64),
+		SocketErrors:   make(map[string]uint64),
+		Socket:         stats.Socket,
+		Queues:         stats.Queues,
+		QueueHighWater: stats.QueueHighWater,
+		AllowedIPs:     stats.AllowedIPs,
+		IndexTable:     stats.IndexTable,
+		Peers:          []Peer{},
+		Events:         []Event{},
+	}
+	for reason, n := range stats.Drops {
+		st.Drops[reason.String()] = n
+	}
+	for kind, n := range stats.SocketErrors {
+		st.SocketErrors[kind.String()] = n
+	}
+	if relay := stats.Relay; len(relay.Pairs) > 0 {
+		st.Relay = &Relay{
+			Pairs:        make([]RelayPair, len(relay.Pairs)),
+			OtherPackets: relay.OtherPackets,
+			OtherBytes:   relay.OtherBytes,
+		}
+		for i, pair := range relay.Pairs {
+			st.Relay.Pairs[i] = RelayPair{
+				From:    base64.StdEncoding.EncodeToString(pair.From[:]),
+				To:      base64.StdEncoding.EncodeToString(pair.To[:]),
+				Packets: pair.Packets,
+				Bytes:   pair.Bytes,
+			}
+		}
+	}
+	for _, peer := range stats.Peers {
+		p := Peer{
+			PublicKey:          base64.StdEncoding.EncodeToString(peer.PublicKey[:]),
+			Endpoint:           peer.Endpoint,
+			LocalAddr:          peer.LocalAddr,
+			AllowedIPs:         []string{},
+			LastHandshake:      peer.LastHandshake,
+			TxBytes:            peer.TxBytes,
+			RxBytes:            peer.RxBytes,
+			Passive:            peer.Passive,
+			Disabled:           peer.Disabled,
+			Expired:            peer.Expired,
+			MTU:                peer.MTU,
+			Quarantined:        peer.Quarantined,
+			Down:               peer.Down,
+			HandshakeCrossings: peer.HandshakeCrossings,
+			EndpointFlaps:      peer.EndpointFlaps,
+			DuplicateKeys:      peer.DuplicateKeys,
+			Quality:            peer.Quality,
+			Queues:             peer.Queues,
+			QueueHighWater:     peer.QueueHighWater,
+		}
+		for _, prefix := range peer.AllowedIPs {
+			p.AllowedIPs = append(p.AllowedIPs, prefix.String())
+		}
+		if h := &peer.RTTHistogram; h.Total > 0 {
+			p.HandshakeRTT = &HandshakeRTT{
+				Count: h.Total,
+				Mean:  h.Mean(),
+				P50:   h.Quantile(0.5),
+				P90:   h.Quantile(0.9),
+				P99:   h.Quantile(0.99),
+				Max:   h.Max,
+			}
+		}
+		st.Peers = append(st.Peers, p)
+	}
+	for _, ev := range dev.Events(time.Time{}) {
+		e := Event{
+			Time:   ev.Time,
+			Kind:   string(ev.Kind),
+			Detail: ev.Detail,
+			Count:  ev.Count,
+		}
+		if !ev.Peer.IsZero() {
+			e.Peer = base64.StdEncoding.EncodeToString(ev.Peer[:])
+		}
+		st.Events = append(st.Events, e)
+	}
+	return st
+}
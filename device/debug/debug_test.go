@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+)
+
+func TestRegister(t *testing.T) {
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), &device.DeviceOptions{
+		Logger: device.NewLogger(device.LogLevelError, t.Name()+": "),
+	})
+	defer dev.Close()
+
+	privateKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &wgcfg.Config{
+		PrivateKey: privateKey,
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peerKey.Public(),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.2/32")},
+			Endpoints:  "127.0.0.1:51820",
+		}},
+	}
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	Register(mux, dev)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", res.Status)
+	}
+	var st State
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Drops == nil {
+		t.Error("no drop counters")
+	}
+	if st.SocketErrors == nil {
+		t.Error("no socket error counters")
+	}
+	if st.Events == nil {
+		t.Error("no event log")
+	}
+	if len(st.Peers) != 1 {
+		t.Fatalf("got %d peers, want 1", len(st.Peers))
+	}
+	p := st.Peers[0]
+	if p.PublicKey != peerKey.Public().Base64() {
+		t.Errorf("public key %s, want %s", p.PublicKey, peerKey.Public().Base64())
+	}
+	if p.Endpoint != "127.0.0.1:51820" {
+		t.Errorf("endpoint %q", p.Endpoint)
+	}
+	if len(p.AllowedIPs) != 1 || p.AllowedIPs[0] != "10.0.0.2/32" {
+		t.Errorf("allowed IPs %v", p.AllowedIPs)
+	}
+	if st.AllowedIPs.IPv4.Prefixes != 1 {
+		t.Errorf("table stats %+v, want one IPv4 prefix", st.AllowedIPs)
+	}
+
+	res, err = http.Get(srv.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("pprof status %s", res.Status)
+	}
+}
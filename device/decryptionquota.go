@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+/* The decryption queue is shared by all peers. Once it is saturated,
+ * filled past DecryptionSaturation of its capacity, each peer may only
+ * have its share of it waiting: the capacity divided among the peers with
+ * packets waiting. A peer flooding the device, or in the middle of a bulk
+ * transfer, then loses its own packets over its share, dropped as
+ * DropOverQuota, rather than everyone losing whichever packets arrive
+ * once the queue is full.
+ */
+
+// DecryptionSaturation is the fraction of the decryption queue's
+// capacity past which peers are held to their share of it.
+const DecryptionSaturation = 0.75
+
+// decryptionAllowed reports whether a packet from peer may join the
+// decryption queue.
+func (device *Device) decryptionAllowed(peer *Peer) bool {
+	queue := device.queue.decryption
+	if float64(len(queue)) < DecryptionSaturation*float64(cap(queue)) {
+		return true
+	}
+	peers := atomic.LoadInt32(&device.decryptingPeers)
+	if peers < 1 {
+		peers = 1
+	}
+	quota := int32(cap(queue)) / peers
+	if quota < 1 {
+		quota = 1
+	}
+	return atomic.LoadInt32(&peer.decrypting) < quota
+}
+
+// decryptionQueued counts a packet from peer joining the decryption
+// queue, and decryptionDequeued one leaving it.
+func (peer *Peer) decryptionQueued() {
+	if atomic.AddInt32(&peer.decrypting, 1) == 1 {
+		atomic.AddInt32(&peer.device.decryptingPeers, 1)
+	}
+}
+
+func (peer *Peer) decryptionDequeued() {
+	if atomic.AddInt32(&peer.decrypting, -1) == 0 {
+		atomic.AddInt32(&peer.device.decryptingPeers, -1)
+	}
+}
@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestDecryptionQuota(t *testing.T) {
+	// The quota needs only the queue and the counts, not running workers
+	// that would drain the queue.
+	dev := new(Device)
+	queue := make(chan *QueueInboundElement, 8)
+	dev.queue.decryption = queue
+	bulk, quiet := &Peer{device: dev}, &Peer{device: dev}
+
+	fill := func(peer *Peer) bool {
+		if !dev.decryptionAllowed(peer) {
+			return false
+		}
+		peer.decryptionQueued()
+		queue <- &QueueInboundElement{peer: peer}
+		return true
+	}
+
+	// Alone, the bulk peer may fill the queue.
+	for i := 0; i < 6; i++ {
+		if !fill(bulk) {
+			t.Fatalf("packet %d refused below saturation", i)
+		}
+	}
+	if !fill(bulk) || !fill(bulk) {
+		t.Fatal("the only peer refused its whole share")
+	}
+	if dev.decryptionAllowed(bulk) {
+		t.Fatal("peer allowed more than the queue holds")
+	}
+
+	// With the queue drained to saturation, a second peer's packets get
+	// in while the bulk peer, over its share of half, is refused.
+	for i := 0; i < 2; i++ {
+		(<-queue).peer.decryptionDequeued()
+	}
+	if !fill(quiet) {
+		t.Fatal("quiet peer refused")
+	}
+	if got := dev.decryptingPeers; got != 2 {
+		t.Errorf("decryptingPeers = %d, want 2", got)
+	}
+	if dev.decryptionAllowed(bulk) {
+		t.Error("bulk peer allowed over its share")
+	}
+	if !dev.decryptionAllowed(quiet) {
+		t.Error("quiet peer refused within its share")
+	}
+
+	for len(queue) > 0 {
+		(<-queue).peer.decryptionDequeued()
+	}
+	if dev.decryptingPeers != 0 || bulk.decrypting != 0 || quiet.decrypting != 0 {
+		t.Errorf("counts left after draining: %d, %d, %d", dev.decryptingPeers, bulk.decrypting, quiet.decrypting)
+	}
+}
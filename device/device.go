@@ -6,9 +6,12 @@
 package device
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"runtime"
+	"io"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,48 +20,94 @@ import (
 	"github.com/tailscale/wireguard-go/ratelimiter"
 	"github.com/tailscale/wireguard-go/rwcancel"
 	"github.com/tailscale/wireguard-go/tun"
+	"github.com/tailscale/wireguard-go/tun/addrconf"
+	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
-	"inet.af/netaddr"
 )
 
 type Device struct {
-	isUp           AtomicBool // device is (going) up
-	isClosed       AtomicBool // device is closed? (acting as guard)
-	log            *Logger
-	handshakeDone  func(peerKey NoisePublicKey, peer *Peer, allowedIPs *AllowedIPs)
-	skipBindUpdate bool
-	createBind     func(uport uint16, device *Device) (conn.Bind, uint16, error)
-	createEndpoint func(key [32]byte, s string) (conn.Endpoint, error)
+	// These fields are accessed with atomic operations, which must be
+	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
+	// allocated struct will be 64-bit aligned. So we place
+	// atomically-accessed fields up front, so that they can share in
+	// this alignment before smaller fields throw it off.
+	stats struct {
+		unexpectedIPv4 uint64 // IPv4 packets dropped for a disallowed source address
+		unexpectedIPv6 uint64 // IPv6 packets dropped for a disallowed source address
+
+		handshakeCrossings uint64 // initiations received while awaiting a response to one sent
+		cookieReplies      uint64 // see CookieReplies
+		indexCollisions    uint64 // see IndexTableStats.Collisions
+		autoRebinds        uint64 // see AutoRebinds
+	}
+	rebind struct {
+		failingSinceNano int64 // when sends on the bind started failing; zero if they are not
+	}
+	drops        [numDropReasons]uint64  // see DropCounts
+	socketErrors [numSocketErrors]uint64 // see SocketErrorCounts
+
+	frozen          AtomicBool // state handed over by Snapshot; no packets flow
+	rebinding       AtomicBool // an automatic rebind is under way; see AutoRebind
+	log             *Logger
+	handshakeCaps   handshakeCaps
+	authorize       func(pk NoisePublicKey, src conn.Endpoint) bool
+	handshakeDone   func(info HandshakeInfo)
+	handshakeRetry  HandshakeRetry
+	gaveUp          func(peer *Peer)
+	cookieReply     func(peer *Peer, wait time.Duration)
+	deadPeer        DeadPeerDetection
+	peerDown        func(peer *Peer)
+	peerUp          func(peer *Peer)
+	foreignDatagram func(pkt []byte, src conn.Endpoint)
+	bindFailed      func(err error)
+	flowLabelMode   FlowLabelMode
+	roaming         Roaming
+	relay           bool
+	relayPolicy     func(from, to *Peer) bool
+	relayStats      relayStats // see RelayStats
+	reserved        HeaderReserved
+	strict          bool // see Strict
+	skipBindUpdate  bool
+	createBind      func(uport uint16, device *Device) (conn.Bind, uint16, error)
+	createEndpoint  func(key [32]byte, s string) (conn.Endpoint, error)
+
+	logging struct {
+		sync.Mutex           // serializes changes to log; see SetLogLevel
+		output     io.Writer // where log writes, once changed at runtime
+	}
 
-	// synchronized resources (locks acquired in order)
+	// synchronized resources (locks acquired in order; see lockRank)
 
 	state struct {
 		stopping sync.WaitGroup
-		sync.Mutex
-		changing AtomicBool
-		current  bool
+		ctxMutex        // serializes Up, Down, Reconfig and Close
+		state    uint32 // a DeviceState, accessed atomically; see State
+
+		applied *wgcfg.Config // by the last Reconfig to succeed; see Reconfig
 	}
 
 	net struct {
 		stopping sync.WaitGroup
-		sync.RWMutex
+		rankedRWMutex
 		bind          conn.Bind // bind interface
 		netlinkCancel *rwcancel.RWCancel
 		port          uint16 // listening port
-		fwmark        uint32 // mark value (0 = disabled)
+		fwmark        uint32 // mark value (0 = disabled), stored atomically
+
+		closing AtomicBool // set while the device closes bind
 	}
 
 	staticIdentity struct {
-		sync.RWMutex
+		rankedRWMutex
 		privateKey NoisePrivateKey
 		publicKey  NoisePublicKey
 	}
 
 	peers struct {
-		empty        AtomicBool // empty reports whether len(keyMap) == 0
-		sync.RWMutex            // protects keyMap
-		keyMap       map[NoisePublicKey]*Peer
+		empty         AtomicBool // empty reports whether len(keyMap) == 0
+		rankedRWMutex            // protects keyMap
+		keyMap        map[NoisePublicKey]*Peer
 	}
 
 	// unprotected / "self-synchronising resources"
@@ -67,7 +116,57 @@ type Device struct {
 	indexTable    IndexTable
 	cookieChecker CookieChecker
 
-	unexpectedip func(key *NoisePublicKey, ip netaddr.IP)
+	unexpectedip       func(key *NoisePublicKey, pkt UnexpectedIPPacket)
+	unexpectedIPPolicy UnexpectedIPPolicy
+	endpointFlapPolicy EndpointFlapPolicy
+	endpointFlapping   func(flap EndpointFlap)
+	duplicateKeyPolicy DuplicateKeyPolicy
+	duplicateKey       func(dup DuplicateKey)
+	routes             RouteSetter
+	routesSynced       routesSynced
+	routeAnnouncer     RouteAnnouncer
+	unknownUAPIKeys    UnknownUAPIKeys
+	uapiPreserved      uapiPreserved // see UnknownUAPIKeysPreserve
+	redaction          Redaction
+	configAudit        configAudit // see ConfigChanged
+	interfaceConfigErr error       // see InterfaceConfigError
+
+	allowedIPConflict        func(c AllowedIPConflict)
+	rejectAllowedIPConflicts bool
+	handshakeSources         knownHandshakeSources // see handshakePriority
+	decryptingPeers          int32                 // accessed atomically; see decryptionAllowed
+	portRotation             PortRotation
+	autoRebind               AutoRebind
+	fragmentIPv4Packets      bool
+	bindControl              func(network string, fd uintptr) error
+	nonceStore               NonceStore
+	nonceStoreMutex          sync.Mutex
+	snapshots                bool
+	peerStore                peerStoreState
+	listenPortRange          PortRange
+	listenPortChosen         func(port uint16)
+	tracer                   *packetTracer
+	spanTracer               SpanTracer
+	events                   *eventLog // nil if off; see Events
+	clock                    Clock
+	rand                     io.Reader // a checkedRand but in tests
+	randFailed               func(err error)
+	randBroken               AtomicBool // see failRand
+	jitterRand               lockedRand
+	workers                  struct {
+		Workers
+		runningEncryption int32 // encryption workers, when adaptive
+		runningDecryption int32 // likewise decryption workers
+	}
+
+	sizes struct {
+		queueOutbound, queueInbound, queueHandshake int
+	}
+
+	socketBuffers struct {
+		autotune bool
+		receive  int32 // accessed atomically; see autotunedReceiveBuffer
+	}
 
 	rate struct {
 		underLoadUntil atomic.Value
@@ -75,24 +174,37 @@ type Device struct {
 	}
 
 	pool struct {
+		config                   Pools // resolved; never PoolDefault
 		messageBufferPool        *sync.Pool
-		messageBufferReuseChan   chan *[MaxMessageSize]byte
+		messageBufferSize        int32 // accessed atomically; see messageBufferSize
+		messageBufferReuseChan   chan []byte
 		inboundElementPool       *sync.Pool
 		inboundElementReuseChan  chan *QueueInboundElement
 		outboundElementPool      *sync.Pool
 		outboundElementReuseChan chan *QueueOutboundElement
+		leaks                    elementLeaks
 	}
 
 	queue struct {
 		encryption *encryptionQueue
 		decryption chan *QueueInboundElement
 		handshake  chan QueueHandshakeElement
+
+		// handshakePriority takes the handshake messages of configured
+		// peers when handshake is full; see handshakePriority.
+		handshakePriority chan QueueHandshakeElement
+	}
+
+	queueHighWater struct { // see QueueHighWater
+		handshake, encryption, decryption highWater
 	}
 
 	signals struct {
 		stop chan struct{}
 	}
 
+	running runningRoutines // see Routines
+
 	tun struct {
 		device tun.Device
 		mtu    int32
@@ -112,9 +224,9 @@ type encryptionQueue struct {
 	wg sync.WaitGroup
 }
 
-func newEncryptionQueue() *encryptionQueue {
+func newEncryptionQueue(size int) *encryptionQueue {
 	q := &encryptionQueue{
-		c: make(chan *QueueOutboundElement, QueueOutboundSize),
+		c: make(chan *QueueOutboundElement, size),
 	}
 	q.wg.Add(1)
 	go func() {
@@ -138,83 +250,104 @@ func unsafeRemovePeer(device *Device, peer *Peer, key NoisePublicKey) {
 	device.peers.empty.Set(len(device.peers.keyMap) == 0)
 }
 
-func deviceUpdateState(device *Device) error {
-
-	// check if state already being updated (guard)
-
-	if device.state.changing.Swap(true) {
-		return nil
+/* Up, Down, Reconfig and Close are serialized by the state lock: each
+ * waits for the others to finish, so that an Up overlapping a Down is
+ * applied after it rather than lost, and each reports what became of its
+ * own transition.
+ */
+func (device *Device) setState(ctx context.Context, up bool) (err error) {
+	name := "wireguard.Down"
+	if up {
+		name = "wireguard.Up"
 	}
+	ctx, span := device.startSpan(ctx, name)
+	defer func() { endSpan(span, err) }()
 
-	// compare to current state of device
-
-	device.state.Lock()
-
-	newIsUp := device.isUp.Get()
+	if err := device.state.LockContext(ctx); err != nil {
+		return err
+	}
+	defer device.state.Unlock()
 
-	if newIsUp == device.state.current {
-		device.state.changing.Set(false)
-		device.state.Unlock()
+	from, to := device.State(), DeviceDown
+	if up {
+		to = DeviceUp
+	}
+	if from == to {
 		return nil
 	}
+	if device.isClosed() || !device.transition(from, to) {
+		return ErrDeviceClosed
+	}
 
-	// change state of device
-
-	switch newIsUp {
-	case true:
-		if err := device.BindUpdate(); err != nil {
-			device.isUp.Set(false)
-			device.state.Unlock()
-			return fmt.Errorf("unable to update bind: %w\n", err)
-		}
-		device.peers.RLock()
-		for _, peer := range device.peers.keyMap {
-			if err := peer.Start(); err != nil {
-				device.state.Unlock()
-				device.peers.RUnlock()
-				return err
-			}
-			if atomic.LoadUint32(&peer.persistentKeepaliveInterval) > 0 {
-				peer.SendKeepalive()
-			}
-		}
-		device.peers.RUnlock()
-
-	case false:
+	if !up {
 		device.BindClose()
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
 			peer.Stop()
 		}
 		device.peers.RUnlock()
+		return nil
 	}
 
-	// update state variables
-
-	device.state.current = newIsUp
-	device.state.changing.Set(false)
-	device.state.Unlock()
-
-	// check for state change in the mean time
-
-	return deviceUpdateState(device)
+	if err := device.BindUpdateContext(ctx); err != nil {
+		device.transition(DeviceUp, DeviceDown) // unless Close has begun
+		return fmt.Errorf("unable to update bind: %w", err)
+	}
+	/* The device stays up even if a peer fails to start, so that a
+	 * later Down tears down what did.
+	 */
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if err := peer.Start(); err != nil {
+			return err
+		}
+		if atomic.LoadUint32(&peer.persistentKeepaliveInterval) > 0 {
+			peer.SendKeepalive()
+		}
+	}
+	return nil
 }
 
+// Up brings the device up, opening its UDP socket and starting its
+// peers. It waits for any Down, Reconfig or Close under way, and fails
+// with ErrDeviceClosed once the device is closed.
 func (device *Device) Up() error {
+	return device.UpContext(context.Background())
+}
 
-	// closed device cannot be brought up
+// UpContext is Up, giving up with ctx's error if ctx is done before the
+// device is up, whether waiting for another transition or for its UDP
+// socket.
+func (device *Device) UpContext(ctx context.Context) error {
+	return device.setState(ctx, true)
+}
 
-	if device.isClosed.Get() {
-		return errors.New("device is closed")
-	}
+// Down brings the device down, closing its UDP socket and stopping its
+// peers. Like Up, it waits for other transitions and fails with
+// ErrDeviceClosed once the device is closed.
+func (device *Device) Down() error {
+	return device.setState(context.Background(), false)
+}
 
-	device.isUp.Set(true)
-	return deviceUpdateState(device)
+// UnexpectedIPCounts reports how many packets have been dropped, per IP
+// family, because their inner source address was not allowed for the peer
+// that sent them.
+func (device *Device) UnexpectedIPCounts() (ipv4, ipv6 uint64) {
+	return atomic.LoadUint64(&device.stats.unexpectedIPv4), atomic.LoadUint64(&device.stats.unexpectedIPv6)
 }
 
-func (device *Device) Down() error {
-	device.isUp.Set(false)
-	return deviceUpdateState(device)
+// HandshakeCrossings reports how many handshake initiations have crossed
+// one the device sent, with both peers initiating at once.
+func (device *Device) HandshakeCrossings() uint64 {
+	return atomic.LoadUint64(&device.stats.handshakeCrossings)
+}
+
+// CookieChecker returns the checker of the MAC1 and MAC2 fields of
+// handshakes sent to the device. SetPrivateKey sets its key; SetOtherKeys
+// adds more.
+func (device *Device) CookieChecker() *CookieChecker {
+	return &device.cookieChecker
 }
 
 func (device *Device) IsUnderLoad() bool {
@@ -222,7 +355,7 @@ func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
 
 	now := time.Now()
-	underLoad := len(device.queue.handshake) >= UnderLoadQueueSize
+	underLoad := len(device.queue.handshake) >= device.sizes.queueHandshake/8
 	if underLoad {
 		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime))
 		return true
@@ -234,6 +367,22 @@ func (device *Device) IsUnderLoad() bool {
 	return until.After(now)
 }
 
+// QueueDepths is the number of elements waiting in each of the
+// device's shared queues.
+type QueueDepths struct {
+	Handshake, Encryption, Decryption int
+}
+
+// QueueDepths returns how many elements are waiting in the device's
+// handshake, encryption and decryption queues.
+func (device *Device) QueueDepths() QueueDepths {
+	return QueueDepths{
+		Handshake:  len(device.queue.handshake) + len(device.queue.handshakePriority),
+		Encryption: len(device.queue.encryption.c),
+		Decryption: len(device.queue.decryption),
+	}
+}
+
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	var peersToStop []*Peer
 	defer func() {
@@ -298,16 +447,298 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	return nil
 }
 
+// HandshakeInfo describes a completed handshake with a peer.
+type HandshakeInfo struct {
+	PublicKey  NoisePublicKey
+	Peer       *Peer
+	AllowedIPs *AllowedIPs
+
+	// Initiator reports whether we sent the handshake initiation.
+	// If false, the peer initiated and we responded.
+	Initiator bool
+
+	// Endpoint is the remote endpoint from which the message that
+	// completed the handshake was received.
+	Endpoint conn.Endpoint
+
+	// LocalIndex and RemoteIndex are the receiver indices of the
+	// negotiated keypair: LocalIndex is the index the peer uses to
+	// address packets to us, RemoteIndex the one we use for the peer.
+	LocalIndex  uint32
+	RemoteIndex uint32
+
+	// Time is when the keypair was derived.
+	Time time.Time
+}
+
+// DeviceOptions are the options of NewDevice. Unless its documentation
+// says otherwise, a function among them that the device calls back as
+// events occur is called synchronously from the routine that found the
+// event, a packet processing, handshake or timer routine, so it must
+// return quickly and must not block, or the traffic of every peer waits
+// on it.
 type DeviceOptions struct {
 	Logger *Logger
 
 	// UnexpectedIP is called when a packet is received from a
 	// validated peer with an unexpected internal IP address.
 	// The packet is then dropped.
-	UnexpectedIP func(key *NoisePublicKey, ip netaddr.IP)
+	UnexpectedIP func(key *NoisePublicKey, pkt UnexpectedIPPacket)
+
+	// UnexpectedIPPolicy controls sampling of UnexpectedIP calls and
+	// quarantining of peers that repeatedly send such packets.
+	UnexpectedIPPolicy UnexpectedIPPolicy
+
+	// EndpointFlapPolicy detects peers whose endpoint roams back and
+	// forth, as when two clients share a key, and optionally holds
+	// them to one endpoint.
+	EndpointFlapPolicy EndpointFlapPolicy
+
+	// EndpointFlapping, if non-nil, is called when a peer is found
+	// flapping under EndpointFlapPolicy.
+	EndpointFlapping func(flap EndpointFlap)
+
+	// DuplicateKeyPolicy detects peers whose key is in use by two
+	// clients at once, and what to do about them.
+	DuplicateKeyPolicy DuplicateKeyPolicy
+
+	// DuplicateKey, if non-nil, is called when a peer's key is found in
+	// use by two clients under DuplicateKeyPolicy.
+	DuplicateKey func(dup DuplicateKey)
+
+	// HandshakeCaps limits the handshake messages that may be queued
+	// from one address or prefix.
+	HandshakeCaps HandshakeCaps
+
+	// Authorize, if non-nil, is called with the public key of the peer
+	// that sent a handshake initiation or response, and its source,
+	// once the message has passed MAC validation and been authenticated
+	// but before the handshake is completed. If it returns false the
+	// message is dropped, and no session is established. It lets a
+	// revocation list or external policy be consulted at connection
+	// time rather than only when the device is configured.
+	Authorize func(pk NoisePublicKey, src conn.Endpoint) bool
 
 	// HandshakeDone is called every time we complete a peer handshake.
-	HandshakeDone func(peerKey NoisePublicKey, peer *Peer, allowedIPs *AllowedIPs)
+	HandshakeDone func(info HandshakeInfo)
+
+	// ConfigChanged, if non-nil, is called after every Reconfig or UAPI
+	// set that changes the configuration of the device, with how and
+	// where from, for an audit log. Changes are serialized while it is
+	// set, and each costs two reads of the configuration, as by Config.
+	// It must not change the configuration itself.
+	ConfigChanged func(change ConfigChange)
+
+	// HandshakeRetry is the schedule on which unanswered handshake
+	// initiations are retried. Peer.SetHandshakeRetry overrides it.
+	HandshakeRetry HandshakeRetry
+
+	// HandshakeGaveUp, if non-nil, is called when a peer's handshake
+	// goes unanswered for all the attempts its HandshakeRetry allows.
+	HandshakeGaveUp func(peer *Peer)
+
+	// CookieReply, if non-nil, is called when a peer under load answers
+	// a handshake initiation with a cookie reply rather than a response,
+	// with how long until the initiation is retried, proving the
+	// device's address with the cookie. It explains a slow connection to
+	// a busy server.
+	CookieReply func(peer *Peer, wait time.Duration)
+
+	// DeadPeer is the policy by which peers are considered down.
+	DeadPeer DeadPeerDetection
+
+	// PeerDown and PeerUp, if non-nil, are called when a peer goes down
+	// under DeadPeer, and when it is heard from again.
+	PeerDown func(peer *Peer)
+	PeerUp   func(peer *Peer)
+
+	// InterfaceConfig, if non-nil, is applied to the TUN interface by
+	// NewDevice, assigning its addresses and MTU and bringing it up.
+	// If that fails, the device is still created; the error is logged
+	// and reported by InterfaceConfigError.
+	InterfaceConfig *addrconf.Config
+
+	// AllowedIPConflict, if non-nil, is called when IpcSetOperation gives
+	// a peer an allowed IP that is routed to another peer. Reconfig does
+	// not call it.
+	AllowedIPConflict func(c AllowedIPConflict)
+
+	// RejectAllowedIPConflicts makes IpcSetOperation fail on such a
+	// conflict instead of moving the prefix to the new peer, and Reconfig
+	// reject a configuration that allows a prefix for two peers instead
+	// of routing it to one of them.
+	RejectAllowedIPConflicts bool
+
+	// Routes, if non-nil, is updated with the allowed IPs of all peers
+	// after every Reconfig and IpcSetOperation that succeeds and changes
+	// them.
+	Routes RouteSetter
+
+	// RouteAnnouncer, if non-nil, is told when a peer's allowed IPs
+	// should be withdrawn or announced as it goes down or up under
+	// DeadPeer.
+	RouteAnnouncer RouteAnnouncer
+
+	// UnknownUAPIKeys is what IpcSetOperation and Reconfig do with keys
+	// they do not know. Registered UAPIExtensions are known.
+	UnknownUAPIKeys UnknownUAPIKeys
+
+	// PortRotation, if its Interval is non-zero, makes the device move
+	// to a new local UDP port periodically.
+	PortRotation PortRotation
+
+	// AutoRebind, if its After is non-zero, makes the device reopen its
+	// UDP sockets when every send on them has failed for that long. It
+	// is unavailable with SkipBindUpdate.
+	AutoRebind AutoRebind
+
+	// NonceStore, if non-nil, is where the device saves the send nonces
+	// of its sessions, for Restore to skip past.
+	NonceStore NonceStore
+
+	// Snapshots makes the device keep the keys of its sessions, which
+	// Snapshot and Handover hand over and otherwise fail without.
+	Snapshots bool
+
+	// PeerStore, if non-nil, is where the device saves the last known
+	// endpoints and handshake times of its peers, and restores them
+	// from when it creates them.
+	PeerStore PeerStore
+
+	// Clock, if non-nil, replaces the system clock for the protocol's
+	// timers and timestamps. See ManualClock.
+	Clock Clock
+
+	// Rand, if non-nil, replaces crypto/rand as the source of ephemeral
+	// keys, session indices, cookie secrets, timer jitter and rotated
+	// ports. It must be safe for concurrent use. It is meant for reproducible simulations
+	// and for vetted sources: a predictable one makes the device
+	// insecure.
+	Rand io.Reader
+
+	// RandFailed, if non-nil, is called when a read from the random
+	// source fails, before the device closes itself, as it then must.
+	RandFailed func(err error)
+
+	// ListenPortRange, if non-empty, is where the device looks for a
+	// free port when the listen port it is given, itself in the range,
+	// is in use. A listen port of zero means the start of the range.
+	ListenPortRange PortRange
+
+	// ListenPortChosen, if non-nil, is called with the local port each
+	// time the device binds its UDP sockets.
+	ListenPortChosen func(port uint16)
+
+	// Workers sizes the pools of encryption, decryption and handshake
+	// routines, and can pin them to CPUs.
+	Workers Workers
+
+	// PacketTraceSize, if positive, turns packet tracing on: every
+	// packet is given an ID, and the last PacketTraceSize stages reached
+	// are kept for Device.PacketTrace. It costs a lock per stage, so it
+	// is meant for debugging.
+	PacketTraceSize int
+
+	// EventLogSize is how many of the latest significant events, such
+	// as handshakes, rekeys, endpoint changes and drops, the device
+	// keeps for Device.Events. Zero keeps DefaultEventLogSize; a
+	// negative size turns the event log off.
+	EventLogSize int
+
+	// SpanTracer, if non-nil, is given spans for Up, Down, Reconfig,
+	// BindUpdate, adding and removing peers and handshakes; see
+	// SpanTracer.
+	SpanTracer SpanTracer
+
+	// Redaction keeps public keys and IP addresses out of the device's
+	// logs and errors, including those of the default UnexpectedIP; see
+	// Redaction.
+	Redaction Redaction
+
+	// BindOptions restricts the UDP sockets to a local address or
+	// network interface and sets them up. Its Control is also called
+	// with the sockets of peers given a local address of their own. It
+	// is ignored if CreateBind is set.
+	BindOptions conn.BindOptions
+
+	// LowMemory, if true, shrinks the device to fit in the memory of an
+	// iOS or macOS Network Extension: queues of LowMemoryQueueSize
+	// packets, a fixed LowMemoryBuffers packet buffers, and a single
+	// worker of each kind unless Workers says otherwise.
+	LowMemory bool
+
+	// FragmentIPv4, if true, makes the device fragment IPv4 packets
+	// over a peer's MTU, set with Peer.SetMTU, that do not have the
+	// don't-fragment bit set, as a router would, rather than drop them.
+	// Packets that may not be fragmented are still dropped and answered
+	// with an ICMP error.
+	FragmentIPv4 bool
+
+	// Pools configures how the device reuses its packet buffers. It
+	// overrides LowMemory's.
+	Pools Pools
+
+	// AutotuneSocketBuffers, if true, makes the device grow the receive
+	// buffer of its UDP sockets whenever the system drops datagrams for
+	// want of room in it, checking every SocketBufferCheckInterval, up
+	// to MaxAutotunedSocketBuffer. It logs each size reached, which
+	// BindOptions.ReceiveBuffer can then start at. It needs a Bind that
+	// is a conn.SocketBufferBind, as the default one on Linux is.
+	AutotuneSocketBuffers bool
+
+	// LeakCheck, if positive, makes the device keep track of the queue
+	// elements it takes from its pools, logging the stack that took each
+	// one not returned within LeakCheck. Packets wait up to
+	// RekeyAttemptTime for a handshake, so it should be longer. Tracking
+	// costs a stack trace per packet; it is meant for debugging.
+	LeakCheck time.Duration
+
+	// BindFailed, if non-nil, is called when the device stops receiving
+	// on one of its UDP sockets because of an error other than the
+	// device closing it, leaving it deaf to that address family until
+	// the next BindUpdate, which BindFailed may call. It is called from
+	// the stopped receive routine.
+	BindFailed func(err error)
+
+	// ForeignDatagram, if non-nil, is given the datagrams received on the
+	// device's UDP sockets whose first byte is not a WireGuard message
+	// type, such as NAT traversal probes, instead of the device dropping
+	// them. pkt is only valid during the call. See SendDatagram.
+	ForeignDatagram func(pkt []byte, src conn.Endpoint)
+
+	// FlowLabel is how the device picks the IPv6 flow labels of the
+	// datagrams it sends to its peers. By default it leaves them to
+	// the system.
+	FlowLabel FlowLabelMode
+
+	// Roaming is the policy by which peers' endpoints follow their
+	// packets. By default any authenticated packet moves them.
+	Roaming Roaming
+
+	// Relay, if true, makes the device forward a packet from one peer
+	// to an address another peer is allowed straight to that peer,
+	// rather than writing it to the TUN device for the system to route
+	// back, as a hub does for its spokes. RelayPolicy, if non-nil,
+	// decides which peers may reach which this way; the packets of
+	// those it refuses are written to the TUN device as usual.
+	Relay       bool
+	RelayPolicy func(from, to *Peer) bool
+
+	// RelayStatsPairs is how many pairs of peers Device.RelayStats
+	// counts relayed packets for separately; the packets of pairs seen
+	// after that many are counted together. If zero,
+	// DefaultRelayStatsPairs.
+	RelayStatsPairs int
+
+	// Reserved, if its hooks are set, makes the device send and accept
+	// data in the reserved bytes of the message header. By default they
+	// are zero, and messages in which they are not are dropped.
+	Reserved HeaderReserved
+
+	// Strict, if true, keeps the device to the wire protocol of upstream
+	// WireGuard: Reserved and ForeignDatagram are ignored, with an
+	// error logged, and SendDatagram fails.
+	Strict bool
 
 	CreateEndpoint func(key [32]byte, s string) (conn.Endpoint, error)
 	CreateBind     func(uport uint16) (conn.Bind, uint16, error)
@@ -316,22 +747,69 @@ type DeviceOptions struct {
 
 func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 	device := new(Device)
-
-	device.isUp.Set(false)
-	device.isClosed.Set(false)
+	device.state.rank = lockRankState
+	device.net.rank = lockRankNet
+	device.staticIdentity.rank = lockRankStaticIdentity
+	device.peers.rank = lockRankPeers
+
+	device.clock = systemClock{}
+	device.rand = rand.Reader
+	device.sizes.queueOutbound = QueueOutboundSize
+	device.sizes.queueInbound = QueueInboundSize
+	device.sizes.queueHandshake = QueueHandshakeSize
+	device.relayStats.limit = DefaultRelayStatsPairs
 
 	if opts != nil {
 		if opts.Logger != nil {
 			device.log = opts.Logger
 		}
+		if opts.Clock != nil {
+			device.clock = opts.Clock
+		}
+		if opts.Rand != nil {
+			device.rand = opts.Rand
+		}
+		device.randFailed = opts.RandFailed
 		if opts.UnexpectedIP != nil {
 			device.unexpectedip = opts.UnexpectedIP
 		} else {
-			device.unexpectedip = func(key *NoisePublicKey, ip netaddr.IP) {
-				device.log.Info.Printf("IPv4 packet with disallowed source address %s from %v", ip, key)
+			device.unexpectedip = func(key *NoisePublicKey, pkt UnexpectedIPPacket) {
+				device.log.Info.Printf("IPv%d packet with disallowed source address %s (dst %s, proto %d) from peer %s",
+					pkt.Version, device.redactNetaddr(pkt.Src), device.redactNetaddr(pkt.Dst), pkt.Protocol, device.redactKey(*key))
 			}
 		}
+		device.unexpectedIPPolicy = opts.UnexpectedIPPolicy
+		device.endpointFlapPolicy = opts.EndpointFlapPolicy
+		device.endpointFlapping = opts.EndpointFlapping
+		device.duplicateKeyPolicy = opts.DuplicateKeyPolicy
+		device.duplicateKey = opts.DuplicateKey
+		device.handshakeCaps.caps = opts.HandshakeCaps
+		device.authorize = opts.Authorize
+		device.spanTracer = opts.SpanTracer
+		device.redaction = opts.Redaction
 		device.handshakeDone = opts.HandshakeDone
+		device.configAudit.changed = opts.ConfigChanged
+		device.handshakeRetry = opts.HandshakeRetry
+		device.gaveUp = opts.HandshakeGaveUp
+		device.cookieReply = opts.CookieReply
+		device.deadPeer = opts.DeadPeer
+		device.peerDown = opts.PeerDown
+		device.peerUp = opts.PeerUp
+		device.foreignDatagram = opts.ForeignDatagram
+		device.bindFailed = opts.BindFailed
+		device.flowLabelMode = opts.FlowLabel
+		device.roaming = opts.Roaming
+		device.relay = opts.Relay
+		device.relayPolicy = opts.RelayPolicy
+		device.reserved = opts.Reserved
+		if opts.RelayStatsPairs > 0 {
+			device.relayStats.limit = opts.RelayStatsPairs
+		}
+		device.routes = opts.Routes
+		device.routeAnnouncer = opts.RouteAnnouncer
+		device.unknownUAPIKeys = opts.UnknownUAPIKeys
+		device.allowedIPConflict = opts.AllowedIPConflict
+		device.rejectAllowedIPConflicts = opts.RejectAllowedIPConflicts
 		if opts.CreateEndpoint != nil {
 			device.createEndpoint = opts.CreateEndpoint
 		} else {
@@ -344,14 +822,72 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 				return opts.CreateBind(uport)
 			}
 		} else {
+			bindOpts := opts.BindOptions
+			device.bindControl = bindOpts.Control
 			device.createBind = func(uport uint16, device *Device) (conn.Bind, uint16, error) {
-				return conn.CreateBind(uport)
+				opts := bindOpts
+				if n := device.autotunedReceiveBuffer(); n > opts.ReceiveBuffer {
+					opts.ReceiveBuffer = n
+				}
+				return conn.CreateBindWithOptions(uport, opts)
 			}
 		}
 		device.skipBindUpdate = opts.SkipBindUpdate
+		device.portRotation = opts.PortRotation
+		device.autoRebind = opts.AutoRebind
+		device.nonceStore = opts.NonceStore
+		device.snapshots = opts.Snapshots
+		device.peerStore.store = opts.PeerStore
+		device.socketBuffers.autotune = opts.AutotuneSocketBuffers
+		device.fragmentIPv4Packets = opts.FragmentIPv4
+		if opts.LeakCheck > 0 {
+			device.pool.leaks.after = opts.LeakCheck
+			device.pool.leaks.held = make(map[interface{}]*elementHold)
+		}
+		if opts.ListenPortRange.valid() {
+			device.listenPortRange = opts.ListenPortRange
+		} else {
+			device.log.Error.Println("Invalid listen port range:", opts.ListenPortRange.Min, "-", opts.ListenPortRange.Max)
+		}
+		device.listenPortChosen = opts.ListenPortChosen
+		device.workers.Workers = opts.Workers
+		if opts.LowMemory {
+			device.lowMemory()
+		}
+		if !opts.Pools.valid() {
+			device.log.Error.Println("Invalid pool configuration:", opts.Pools.Mode, opts.Pools.Size)
+		} else if opts.Pools.Mode != PoolDefault {
+			device.pool.config = opts.Pools
+		}
+		if opts.PacketTraceSize > 0 {
+			device.tracer = newPacketTracer(opts.PacketTraceSize)
+		}
+		if opts.Strict {
+			device.applyStrict(opts)
+		}
+	}
+	eventLogSize := DefaultEventLogSize
+	if opts != nil && opts.EventLogSize != 0 {
+		eventLogSize = opts.EventLogSize
+	}
+	if eventLogSize > 0 {
+		device.events = newEventLog(eventLogSize)
 	}
+	device.rand = checkedRand{device: device, source: device.rand}
+	device.cookieChecker.rand = device.rand
+	device.cookieChecker.clock = device.clock
 
 	device.tun.device = tunDevice
+	if opts != nil && opts.InterfaceConfig != nil {
+		name, err := tunDevice.Name()
+		if err == nil {
+			err = addrconf.Apply(name, *opts.InterfaceConfig)
+		}
+		if err != nil {
+			device.log.Error.Println("Failed to configure interface:", err)
+			device.interfaceConfigErr = err
+		}
+	}
 	mtu, err := device.tun.device.MTU()
 	if err != nil {
 		device.log.Error.Println("Trouble determining MTU, assuming default:", err)
@@ -363,17 +899,20 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 
 	device.rate.limiter.Init()
 	device.rate.underLoadUntil.Store(time.Time{})
+	device.seedJitter(device.rand)
 
 	device.indexTable.Init()
 	device.allowedips.Reset()
 
+	device.pool.config = device.pool.config.resolve()
 	device.PopulatePools()
 
 	// create queues
 
-	device.queue.handshake = make(chan QueueHandshakeElement, QueueHandshakeSize)
-	device.queue.encryption = newEncryptionQueue()
-	device.queue.decryption = make(chan *QueueInboundElement, QueueInboundSize)
+	device.queue.handshake = make(chan QueueHandshakeElement, device.sizes.queueHandshake)
+	device.queue.handshakePriority = make(chan QueueHandshakeElement, device.sizes.queueHandshake/8+1)
+	device.queue.encryption = newEncryptionQueue(device.sizes.queueOutbound)
+	device.queue.decryption = make(chan *QueueInboundElement, device.sizes.queueInbound)
 
 	// prepare signals
 
@@ -386,22 +925,65 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 
 	// start workers
 
-	cpus := runtime.NumCPU()
 	device.state.stopping.Wait()
-	for i := 0; i < cpus; i++ {
-		device.state.stopping.Add(2) // decryption and handshake
-		go device.RoutineEncryption()
-		go device.RoutineDecryption()
-		go device.RoutineHandshake()
+	encryptionWorkers := workerCount(device.workers.Encryption)
+	decryptionWorkers := workerCount(device.workers.Decryption)
+	if device.workers.Adaptive {
+		encryptionWorkers, decryptionWorkers = 1, 1
+		device.workers.runningEncryption, device.workers.runningDecryption = 1, 1
+		device.state.stopping.Add(1)
+		device.goRoutine("worker scaler", device.RoutineScaleWorkers)
+	}
+	for i := 0; i < encryptionWorkers; i++ {
+		i := i
+		device.goRoutine("encryption worker", func() {
+			device.pinWorker(device.workers.EncryptionCPUs, i)
+			device.RoutineEncryption()
+		})
+	}
+	for i := 0; i < decryptionWorkers; i++ {
+		i := i
+		device.state.stopping.Add(1)
+		device.goRoutine("decryption worker", func() {
+			device.pinWorker(device.workers.DecryptionCPUs, i)
+			device.RoutineDecryption()
+		})
+	}
+	for i := 0; i < workerCount(device.workers.Handshake); i++ {
+		device.state.stopping.Add(1)
+		device.goRoutine("handshake worker", device.RoutineHandshake)
 	}
 
 	device.state.stopping.Add(2)
-	go device.RoutineReadFromTUN()
-	go device.RoutineTUNEventReader()
+	device.goRoutine("TUN reader", device.RoutineReadFromTUN)
+	device.goRoutine("TUN event reader", device.RoutineTUNEventReader)
+
+	if device.portRotation.Interval > 0 {
+		device.state.stopping.Add(1)
+		device.goRoutine("port rotator", device.RoutineRotatePort)
+	}
+	if device.nonceStore != nil {
+		device.goRoutine("nonce saver", device.RoutineSaveNonces)
+	}
+	if device.peerStore.store != nil {
+		device.loadPeerRecords()
+		device.goRoutine("peer saver", device.RoutineSavePeers)
+	}
+	if device.socketBuffers.autotune {
+		device.goRoutine("socket buffer autotuner", device.RoutineAutotuneSocketBuffers)
+	}
+	if device.pool.leaks.after > 0 {
+		device.goRoutine("leak checker", device.RoutineCheckLeaks)
+	}
 
 	return device
 }
 
+// AllowedIPs returns the routing table mapping inner addresses to peers.
+func (device *Device) AllowedIPs() *AllowedIPs {
+	return &device.allowedips
+}
+
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	device.peers.RLock()
 	defer device.peers.RUnlock()
@@ -409,8 +991,73 @@ func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	return device.peers.keyMap[pk]
 }
 
+// peersSnapshot returns the peers currently configured. It holds
+// device.peers only long enough to copy the map, as IpcGetOperation
+// does, so callers can take their time over each peer without stalling
+// the data path or a waiting writer. Peers may be removed after the
+// snapshot is taken; see isCurrentPeer.
+func (device *Device) peersSnapshot() []*Peer {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Peers returns the peers currently configured, ordered by public key.
+func (device *Device) Peers() []*Peer {
+	peers := device.peersSnapshot()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].handshake.remoteStatic.LessThan(&peers[j].handshake.remoteStatic)
+	})
+	return peers
+}
+
+// isCurrentPeer reports whether peer has not been removed from the device.
+func (device *Device) isCurrentPeer(peer *Peer) bool {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	return device.peers.keyMap[peer.handshake.remoteStatic] == peer
+}
+
+// InterfaceConfigError returns the error, if any, from applying
+// DeviceOptions.InterfaceConfig when the device was created. A device
+// whose interface could not be configured still runs, but likely has no
+// addresses or is down.
+func (device *Device) InterfaceConfigError() error {
+	return device.interfaceConfigErr
+}
+
+// TriggerAllHandshakes calls TriggerHandshake on every running peer
+// with an endpoint, returning the first error.
+func (device *Device) TriggerAllHandshakes() error {
+	var firstErr error
+	for _, peer := range device.peersSnapshot() {
+		if !peer.isRunning.Get() || peer.Endpoint() == nil {
+			continue
+		}
+		if err := peer.TriggerHandshake(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // RemovePeer stops the Peer and removes it from routing.
 func (device *Device) RemovePeer(key NoisePublicKey) {
+	device.removePeerContext(context.Background(), key)
+}
+
+// removePeerContext is RemovePeer, tracing it as a child of any span in
+// ctx.
+func (device *Device) removePeerContext(ctx context.Context, key NoisePublicKey) {
+	_, span := device.startSpan(ctx, "wireguard.RemovePeer", device.peerAttribute(key))
+	defer span.End()
+
 	device.peers.Lock()
 	peer := device.peers.keyMap[key]
 	if peer != nil {
@@ -445,10 +1092,18 @@ func (device *Device) FlushPacketQueues() {
 		select {
 		case elem, ok := <-device.queue.decryption:
 			if ok {
+				elem.peer.decryptionDequeued()
 				elem.Drop()
 				elem.Unlock()
 			}
-		case <-device.queue.handshake:
+		case elem, ok := <-device.queue.handshake:
+			if ok {
+				device.handshakeCaps.release(elem.endpoint.DstIP())
+			}
+		case elem, ok := <-device.queue.handshakePriority:
+			if ok {
+				device.handshakeCaps.release(elem.endpoint.DstIP())
+			}
 		default:
 			return
 		}
@@ -457,19 +1112,26 @@ func (device *Device) FlushPacketQueues() {
 }
 
 func (device *Device) Close() {
-	if device.isClosed.Swap(true) {
-		return
+	for {
+		from := device.State()
+		if from >= DeviceClosing {
+			return
+		}
+		if device.transition(from, DeviceClosing) {
+			break
+		}
 	}
 
 	device.log.Info.Println("Device closing")
-	device.state.changing.Set(true)
-	device.state.Lock()
-	defer device.state.Unlock()
 
+	/* Transitions waiting on the state lock find the device closed once
+	 * they have it, so routines that make them, like the TUN event
+	 * reader, can finish while Close waits for them below.
+	 */
+	device.state.Lock()
 	device.tun.device.Close()
 	device.BindClose()
-
-	device.isUp.Set(false)
+	device.state.Unlock()
 
 	// We kept a reference to the encryption queue,
 	// in case we started any new peers that might write to it.
@@ -478,13 +1140,18 @@ func (device *Device) Close() {
 	close(device.signals.stop)
 	device.state.stopping.Wait()
 
+	if !device.frozen.Get() {
+		if err := device.SavePeers(); err != nil {
+			device.log.Error.Println("Failed to save peers:", err)
+		}
+	}
 	device.RemoveAllPeers()
 
 	device.FlushPacketQueues()
 
 	device.rate.limiter.Close()
 
-	device.state.changing.Set(false)
+	device.transition(DeviceClosing, DeviceClosed)
 	device.log.Info.Println("Interface closed")
 }
 
@@ -493,14 +1160,14 @@ func (device *Device) Wait() chan struct{} {
 }
 
 func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
-	if device.isClosed.Get() {
+	if device.isClosed() {
 		return
 	}
 
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(device.now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			peer.SendKeepalive()
@@ -509,17 +1176,39 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RUnlock()
 }
 
+/* Every send on the device's bind, here or in Peer.SendBuffer, holds
+ * device.net read locked for the whole of the send. The lock is the
+ * fence that unsafeCloseBind's callers take write locked: they wait out
+ * the sends under way on the old socket, and none starts on it once
+ * they have closed it, so BindUpdate never returns while a sender still
+ * holds the socket it replaced.
+ */
+
+// sendOnBind sends pkt to ep on the device's bind.
+func (device *Device) sendOnBind(pkt []byte, ep conn.Endpoint) error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.net.bind == nil {
+		return errors.New("no UDP socket")
+	}
+	err := device.countSendError(device.net.bind.Send(pkt, ep))
+	device.noteSend(err)
+	return err
+}
+
 func unsafeCloseBind(device *Device) error {
 	var err error
 	netc := &device.net
 	if netc.netlinkCancel != nil {
 		netc.netlinkCancel.Cancel()
 	}
+	netc.closing.Set(true)
 	if netc.bind != nil {
 		err = netc.bind.Close()
 		netc.bind = nil
 	}
 	netc.stopping.Wait()
+	netc.closing.Set(false)
 	return err
 }
 
@@ -542,17 +1231,24 @@ func (device *Device) BindSetMark(mark uint32) error {
 
 	// update fwmark on existing bind
 
-	device.net.fwmark = mark
-	if device.isUp.Get() && device.net.bind != nil {
+	atomic.StoreUint32(&device.net.fwmark, mark)
+	if device.isUp() && device.net.bind != nil {
 		if err := device.net.bind.SetMark(mark); err != nil {
 			return err
 		}
 	}
 
-	// clear cached source addresses
+	// clear cached source addresses, and mark peers' own binds
 
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
+		peer.localBind.RLock()
+		if peer.localBind.bind != nil {
+			if err := peer.localBind.bind.SetMark(mark); err != nil {
+				device.log.Error.Println(peer, "- Failed to update fwmark of local bind:", err)
+			}
+		}
+		peer.localBind.RUnlock()
 		peer.Lock()
 		defer peer.Unlock()
 		if peer.endpoint != nil {
@@ -565,6 +1261,35 @@ func (device *Device) BindSetMark(mark uint32) error {
 }
 
 func (device *Device) BindUpdate() error {
+	return device.BindUpdateContext(context.Background())
+}
+
+// BindUpdateContext is BindUpdate, giving up with ctx's error if ctx is
+// done before the new socket is open. The device is then left without
+// one, as when opening it fails.
+func (device *Device) BindUpdateContext(ctx context.Context) (err error) {
+	ctx, span := device.startSpan(ctx, "wireguard.BindUpdate")
+	defer func() { endSpan(span, err) }()
+
+	// A frozen device's sockets belong to the process it was handed to;
+	// closing them would shut them down for it too.
+	if device.frozen.Get() {
+		return errors.New("device is frozen")
+	}
+
+	/* The callback runs after the locks below are released,
+	 * so that it may query the device.
+	 */
+	var bound uint16
+	defer func() {
+		if bound == 0 {
+			return
+		}
+		span.SetAttributes(SpanAttribute{Key: SpanKeyListenPort, Value: int64(bound)})
+		if device.listenPortChosen != nil {
+			device.listenPortChosen(bound)
+		}
+	}()
 
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -582,13 +1307,13 @@ func (device *Device) BindUpdate() error {
 
 	// open new sockets
 
-	if device.isUp.Get() {
+	if device.isUp() {
 
 		// bind to new port
 
 		var err error
 		netc := &device.net
-		netc.bind, netc.port, err = device.createBind(netc.port, device)
+		netc.bind, netc.port, err = device.bindPort(ctx, netc.port)
 		if err != nil {
 			netc.bind = nil
 			netc.port = 0
@@ -626,10 +1351,12 @@ func (device *Device) BindUpdate() error {
 		// start receiving routines
 
 		device.net.stopping.Add(2)
-		go device.RoutineReceiveIncoming(ipv4.Version, netc.bind)
-		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind)
+		bind := netc.bind
+		device.goRoutine("receive incoming IPv4", func() { device.RoutineReceiveIncoming(ipv4.Version, bind) })
+		device.goRoutine("receive incoming IPv6", func() { device.RoutineReceiveIncoming(ipv6.Version, bind) })
 
 		device.log.Debug.Println("UDP bind has been updated")
+		bound = netc.port
 	}
 
 	return nil
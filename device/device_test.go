@@ -16,6 +16,8 @@ import (
 	"time"
 
 	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
 )
 
 func getFreePort(t *testing.T) string {
@@ -133,6 +135,13 @@ func (pair *testPair) Send(t *testing.T, ping SendDirection, done chan struct{})
 
 // genTestPair creates a testPair.
 func genTestPair(t *testing.T) (pair testPair) {
+	return genTestPairWithOptions(t, nil)
+}
+
+// genTestPairWithOptions creates a testPair.
+// If configure is non-nil, it is called with the options
+// of each device before the device is created.
+func genTestPairWithOptions(t *testing.T, configure func(i int, opts *DeviceOptions)) (pair testPair) {
 	const maxAttempts = 10
 NextAttempt:
 	for i := 0; i < maxAttempts; i++ {
@@ -146,9 +155,13 @@ NextAttempt:
 			} else {
 				p.ip = net.ParseIP("1.0.0.2")
 			}
-			p.dev = NewDevice(p.tun.TUN(), &DeviceOptions{
+			opts := &DeviceOptions{
 				Logger: NewLogger(LogLevelDebug, fmt.Sprintf("dev%d: ", i)),
-			})
+			}
+			if configure != nil {
+				configure(i, opts)
+			}
+			p.dev = NewDevice(p.tun.TUN(), opts)
 			p.dev.Up()
 			if err := p.dev.IpcSetOperation(cfg[i]); err != nil {
 				// genConfigs attempted to pick ports that were free.
@@ -164,12 +177,13 @@ NextAttempt:
 			// The device might still not be up, e.g. due to an error
 			// in RoutineTUNEventReader's call to dev.Up that got swallowed.
 			// Assume it's due to a transient error (port in use), and retry.
-			if !p.dev.isUp.Get() {
+			if !p.dev.isUp() {
 				t.Logf("device %d did not come up, trying again", i)
 				continue NextAttempt
 			}
-			// The device is up. Close it when the test completes.
-			t.Cleanup(p.dev.Close)
+			// The device is up. Close it when the test completes,
+			// and check that it leaves no routines running.
+			t.Cleanup(func() { closeAndCheckRoutines(t, p.dev) })
 		}
 		return // success
 	}
@@ -188,6 +202,250 @@ func TestTwoDevicePing(t *testing.T) {
 	})
 }
 
+func TestHandshakeDone(t *testing.T) {
+	var done [2]chan HandshakeInfo
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		done[i] = make(chan HandshakeInfo, 10)
+		opts.HandshakeDone = func(info HandshakeInfo) {
+			done[i] <- info
+		}
+	})
+	// dev1 sends the first packet, so it initiates the handshake.
+	pair.Send(t, Ping, nil)
+
+	for i, wantInitiator := range []bool{false, true} {
+		select {
+		case info := <-done[i]:
+			if info.Initiator != wantInitiator {
+				t.Errorf("dev%d: Initiator = %v, want %v", i, info.Initiator, wantInitiator)
+			}
+			if info.PublicKey != pair[1-i].dev.staticIdentity.publicKey {
+				t.Errorf("dev%d: wrong PublicKey", i)
+			}
+			if info.Endpoint == nil || info.LocalIndex == 0 || info.Time.IsZero() {
+				t.Errorf("dev%d: incomplete info: %+v", i, info)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("dev%d: HandshakeDone not called", i)
+		}
+	}
+}
+
+func TestTriggerHandshake(t *testing.T) {
+	var done [2]chan HandshakeInfo
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		done[i] = make(chan HandshakeInfo, 10)
+		opts.HandshakeDone = func(info HandshakeInfo) {
+			done[i] <- info
+		}
+	})
+
+	// No packet needs a session yet; dev0 establishes one anyway.
+	if err := pair[0].dev.TriggerAllHandshakes(); err != nil {
+		t.Fatal(err)
+	}
+	for i, wantInitiator := range []bool{true, false} {
+		select {
+		case info := <-done[i]:
+			if info.Initiator != wantInitiator {
+				t.Errorf("dev%d: Initiator = %v, want %v", i, info.Initiator, wantInitiator)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("dev%d: no handshake after TriggerAllHandshakes", i)
+		}
+	}
+
+	// A second trigger within RekeyTimeout is rate limited.
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if err := peer.TriggerHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done[0]:
+		t.Error("handshake repeated within RekeyTimeout")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	peer.Stop()
+	if err := peer.TriggerHandshake(); err == nil {
+		t.Error("TriggerHandshake succeeded on stopped peer")
+	}
+}
+
+func TestPassivePeer(t *testing.T) {
+	var done [2]chan HandshakeInfo
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		done[i] = make(chan HandshakeInfo, 10)
+		opts.HandshakeDone = func(info HandshakeInfo) {
+			done[i] <- info
+		}
+	})
+	dev0 := pair[0].dev
+	pub1 := pair[1].dev.staticIdentity.publicKey
+	if err := dev0.IpcSetOperation(uapiCfg(
+		"public_key", pub1.ToHex(),
+		"passive", "true",
+		"persistent_keepalive_interval", "1",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := dev0.Config(); len(cfg.Peers) != 1 || !cfg.Peers[0].Passive {
+		t.Fatalf("passive flag not reported: %+v", cfg.Peers)
+	}
+
+	// dev0 has a packet for dev1, but must not initiate.
+	msg := tuntest.Ping(pair[1].ip, pair[0].ip)
+	pair[0].tun.Outbound <- msg
+	if err := dev0.LookupPeer(pub1).TriggerHandshake(); err == nil {
+		t.Error("TriggerHandshake succeeded on passive peer")
+	}
+	select {
+	case <-done[0]:
+		t.Fatal("passive peer initiated a handshake")
+	case <-pair[1].tun.Inbound:
+		t.Fatal("packet sent to passive peer without a session")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Once dev1 initiates, dev0 answers and its packet goes through.
+	pair.Send(t, Ping, nil)
+	select {
+	case info := <-done[0]:
+		if info.Initiator {
+			t.Error("passive side was the initiator")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no handshake")
+	}
+	select {
+	case got := <-pair[1].tun.Inbound:
+		if !bytes.Equal(got, msg) {
+			t.Error("queued packet did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued packet not delivered after handshake")
+	}
+}
+
+func TestPassiveUAPIValues(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	for _, tt := range []struct {
+		value string
+		want  bool
+	}{{"1", true}, {"false", false}, {"TRUE", true}, {"0", false}} {
+		if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "passive", tt.value)); err != nil {
+			t.Fatalf("passive=%s: %v", tt.value, err)
+		}
+		if got := dev.Config().Peers[0].Passive; got != tt.want {
+			t.Errorf("passive=%s: Passive is %v", tt.value, got)
+		}
+	}
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "passive", "yes")); err == nil {
+		t.Error("IpcSetOperation accepted passive=yes")
+	}
+}
+
+func TestUnexpectedIP(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+
+	// 1.0.0.9 is not in the AllowedIPs that dev0 has for dev1.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, net.ParseIP("1.0.0.9"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v4, v6 := pair[0].dev.UnexpectedIPCounts()
+		if v4 == 1 && v6 == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("UnexpectedIPCounts() = %d, %d; want 1, 0", v4, v6)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnexpectedIPQuarantine(t *testing.T) {
+	reports := make(chan UnexpectedIPPacket, 10)
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.UnexpectedIP = func(key *NoisePublicKey, pkt UnexpectedIPPacket) {
+			reports <- pkt
+		}
+		opts.UnexpectedIPPolicy = UnexpectedIPPolicy{
+			SampleInterval:      time.Hour,
+			QuarantineThreshold: 3,
+			QuarantineDuration:  time.Hour,
+		}
+	})
+	pair.Send(t, Ping, nil)
+
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	for i := 0; i < 3; i++ {
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, net.ParseIP("1.0.0.9"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.UnexpectedIPCount() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("UnexpectedIPCount() = %d, want 3", peer.UnexpectedIPCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the first packet is reported; the rest fall within SampleInterval.
+	pkt := <-reports
+	if pkt.Src != netaddr.IPv4(1, 0, 0, 9) || pkt.Dst != netaddr.IPv4(1, 0, 0, 1) || pkt.Version != 4 || pkt.Protocol != 1 {
+		t.Errorf("unexpected report: %+v", pkt)
+	}
+	select {
+	case pkt := <-reports:
+		t.Errorf("unexpected second report: %+v", pkt)
+	default:
+	}
+	if !peer.IsQuarantined() {
+		t.Fatal("peer not quarantined after reaching threshold")
+	}
+}
+
+// TestBlockedIpcGetReader checks that a UAPI client that stops reading
+// part way through a get holds no locks: peers can still be changed and
+// handshakes still complete.
+func TestBlockedIpcGetReader(t *testing.T) {
+	pair := genTestPair(t)
+	dev := pair[0].dev
+
+	r, w := io.Pipe()
+	getDone := make(chan error, 1)
+	go func() {
+		getDone <- dev.IpcGetOperation(w)
+	}()
+	defer func() {
+		r.Close()
+		<-getDone
+	}()
+	// Read the device fields, then stop reading, leaving the get
+	// blocked writing the peer.
+	if _, err := r.Read(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := make(chan struct{})
+	go func() {
+		dev.RemovePeer(NoisePublicKey{})
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer removal blocked by stalled get")
+	}
+
+	pair[1].dev.Peers()[0].ExpireCurrentKeypairs()
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
 // TestConcurrencySafety does other things concurrently with tunnel use.
 // It is intended to be used with the race detector to catch data races.
 func TestConcurrencySafety(t *testing.T) {
@@ -256,6 +514,140 @@ func TestConcurrencySafety(t *testing.T) {
 	close(done)
 }
 
+func TestOverlappingStateChanges(t *testing.T) {
+	pair := genTestPair(t)
+	dev := pair[0].dev
+
+	flap := func(wg *sync.WaitGroup, up bool, closing bool) {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			var err error
+			if up {
+				err = dev.Up()
+			} else {
+				err = dev.Down()
+			}
+			if err != nil && !(closing && errors.Is(err, ErrDeviceClosed)) {
+				t.Error(err)
+			}
+		}
+	}
+
+	// Every transition is applied in turn, none lost to another under way.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go flap(&wg, i%2 == 0, false)
+	}
+	wg.Wait()
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.net.bind != nil {
+		t.Fatal("bind open after Down")
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+
+	// Transitions overlapping Close either finish before it or fail.
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go flap(&wg, i%2 == 0, true)
+	}
+	dev.Close()
+	wg.Wait()
+	if dev.net.bind != nil {
+		t.Error("bind open after Close")
+	}
+	if err := dev.Up(); !errors.Is(err, ErrDeviceClosed) {
+		t.Errorf("Up after Close: %v, want ErrDeviceClosed", err)
+	}
+	if err := dev.Down(); !errors.Is(err, ErrDeviceClosed) {
+		t.Errorf("Down after Close: %v, want ErrDeviceClosed", err)
+	}
+	if err := dev.Reconfig(&wgcfg.Config{}); !errors.Is(err, ErrDeviceClosed) {
+		t.Errorf("Reconfig after Close: %v, want ErrDeviceClosed", err)
+	}
+}
+
+func TestBindChurnUnderTraffic(t *testing.T) {
+	pair := genTestPair(t)
+	dev := pair[0].dev
+	pair.Send(t, Ping, nil)
+
+	// Both devices send all the while, and dev, under load, answers
+	// initiations with cookie replies, which it sends on its bind too.
+	dev.rate.underLoadUntil.Store(time.Now().Add(time.Hour))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range pair {
+		p, other := pair[i], pair[1-i]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			msg := tuntest.Ping(other.ip, p.ip)
+			for {
+				select {
+				case p.tun.Outbound <- msg:
+				case <-done:
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-p.tun.Inbound:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			dev.SendDatagram([]byte("hello"), dev.Peers()[0].Endpoint())
+			// Let the other device initiate again at once.
+			pair[1].dev.Peers()[0].ExpireCurrentKeypairs()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		var err error
+		switch i % 3 {
+		case 0:
+			err = dev.Down()
+		case 1:
+			err = dev.Up()
+		case 2:
+			err = dev.BindUpdate()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	dev.rate.underLoadUntil.Store(time.Time{})
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
 func assertNil(t *testing.T, err error) {
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+/* A disabled peer keeps its configuration, but its allowed IPs are taken
+ * out of the routing table, where the rest of the configuration keeps
+ * them, and held by the peer until it is enabled again. Configuring
+ * allowed IPs for a disabled peer changes those it holds. A peer outside
+ * its validity window is withheld in the same way, whether or not it is
+ * disabled; on is set while either holds.
+ */
+type peerDisabled struct {
+	sync.Mutex
+	on       AtomicBool
+	admin    AtomicBool         // SetDisabled
+	expired  AtomicBool         // outside the validity window
+	prefixes []netaddr.IPPrefix // allowed IPs held while on
+}
+
+// SetDisabled disables or enables peer. A disabled peer is stopped, and
+// its allowed IPs are withdrawn from routing, so that no packets flow to
+// or from it, until it is enabled again; its configuration and
+// statistics are kept. Enabling the peer restores its routes and, if the
+// device is up, starts it.
+func (peer *Peer) SetDisabled(disabled bool) {
+	peer.withhold(&peer.disabled.admin, disabled)
+}
+
+// Disabled reports whether peer is disabled.
+func (peer *Peer) Disabled() bool {
+	return peer.disabled.admin.Get()
+}
+
+// withhold sets reason, one of the reasons in peer.disabled to withhold
+// peer, and withholds or restores peer if that changes whether any
+// holds.
+func (peer *Peer) withhold(reason *AtomicBool, set bool) {
+	device := peer.device
+	pd := &peer.disabled
+	pd.Lock()
+	reason.Set(set)
+	on := pd.admin.Get() || pd.expired.Get()
+	if pd.on.Get() == on {
+		pd.Unlock()
+		return
+	}
+	if on {
+		pd.prefixes = nil
+		device.allowedips.EntriesForPeerFunc(peer, func(prefix netaddr.IPPrefix) bool {
+			pd.prefixes = append(pd.prefixes, prefix)
+			return true
+		})
+		device.allowedips.RemoveByPeer(peer)
+		pd.on.Set(true)
+		pd.Unlock()
+		if pd.admin.Get() {
+			device.log.Info.Println(peer, "- Disabled")
+		} else {
+			device.log.Info.Println(peer, "- Outside its validity window")
+		}
+		peer.Stop()
+		if !peer.IsDown() {
+			device.announceRoutes(peer, false)
+		}
+	} else {
+		prefixes := pd.prefixes
+		pd.prefixes = nil
+		pd.on.Set(false)
+		// A removed peer must not be routed to again.
+		device.peers.RLock()
+		current := device.peers.keyMap[peer.handshake.remoteStatic] == peer
+		if current {
+			device.allowedips.ReplaceForPeer(peer, prefixes)
+		}
+		device.peers.RUnlock()
+		pd.Unlock()
+		if !current {
+			return
+		}
+		device.log.Info.Println(peer, "- Enabled")
+		if device.isUp() {
+			if err := peer.Start(); err != nil {
+				device.log.Error.Println(peer, "- Failed to start:", err)
+			}
+		}
+		if !peer.IsDown() {
+			device.announceRoutes(peer, true)
+		}
+	}
+	device.syncRoutes()
+}
+
+// setDisabledRoutes replaces the allowed IPs held by a disabled peer,
+// reporting whether it is disabled; if not, it does nothing.
+func (peer *Peer) setDisabledRoutes(prefixes []netaddr.IPPrefix) bool {
+	pd := &peer.disabled
+	pd.Lock()
+	defer pd.Unlock()
+	if !pd.on.Get() {
+		return false
+	}
+	pd.prefixes = append([]netaddr.IPPrefix(nil), prefixes...)
+	return true
+}
+
+// addDisabledRoute adds prefix to the allowed IPs held by a disabled
+// peer, reporting whether it is disabled; if not, it does nothing.
+func (peer *Peer) addDisabledRoute(prefix netaddr.IPPrefix) bool {
+	pd := &peer.disabled
+	pd.Lock()
+	defer pd.Unlock()
+	if !pd.on.Get() {
+		return false
+	}
+	for _, p := range pd.prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	pd.prefixes = append(pd.prefixes, prefix)
+	return true
+}
+
+// disabledRoutes returns the allowed IPs held by peer, and whether it is
+// disabled.
+func (peer *Peer) disabledRoutes() ([]netaddr.IPPrefix, bool) {
+	pd := &peer.disabled
+	pd.Lock()
+	defer pd.Unlock()
+	if !pd.on.Get() {
+		return nil, false
+	}
+	return append([]netaddr.IPPrefix(nil), pd.prefixes...), true
+}
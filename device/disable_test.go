@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestDisabledPeer(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.Peers()[0]
+	rx := peer.RxBytes()
+	routed := netaddr.MustParseIP("1.0.0.2")
+	extra := netaddr.MustParseIPPrefix("10.0.0.0/8")
+
+	peer.SetDisabled(true)
+	if !peer.Disabled() || peer.isRunning.Get() {
+		t.Fatal("disabled peer still running")
+	}
+	if owner := dev.allowedips.Lookup(routed); owner != nil {
+		t.Errorf("%v still routed to the disabled peer", routed)
+	}
+
+	// Its configuration is kept, and can be changed while it is disabled.
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "allowed_ip", extra.String())); err != nil {
+		t.Fatal(err)
+	}
+	if owner := dev.allowedips.Lookup(extra.IP); owner != nil {
+		t.Errorf("%v routed to the disabled peer", extra)
+	}
+	want := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("1.0.0.2/32"), extra}
+	if got := peer.AllowedIPs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AllowedIPs of the disabled peer = %v, want %v", got, want)
+	}
+	get, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(get, "disabled=true\n") || !strings.Contains(get, "allowed_ip=10.0.0.0/8\n") {
+		t.Errorf("IpcGet of the disabled peer:\n%s", get)
+	}
+	cfg := dev.Config()
+	if !cfg.Peers[0].Disabled || len(cfg.Peers[0].AllowedIPs) != 2 {
+		t.Errorf("Config of the disabled peer: %+v", cfg.Peers[0])
+	}
+
+	// Enabling it, here through Reconfig, restores its routes and traffic.
+	cfg.Peers[0].Disabled = false
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if peer.Disabled() {
+		t.Fatal("peer still disabled")
+	}
+	for _, ip := range []netaddr.IP{routed, extra.IP} {
+		if owner := dev.allowedips.Lookup(ip); owner != peer {
+			t.Errorf("%v routed to %v after enabling, want the peer", ip, owner)
+		}
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+	if peer.RxBytes() <= rx {
+		t.Error("statistics lost with the peer disabled")
+	}
+}
+
+func TestDisabledUAPIValues(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	for _, tt := range []struct {
+		value string
+		want  bool
+	}{{"1", true}, {"false", false}, {"TRUE", true}, {"0", false}} {
+		if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "disabled", tt.value)); err != nil {
+			t.Fatalf("disabled=%s: %v", tt.value, err)
+		}
+		if got := dev.Peers()[0].Disabled(); got != tt.want {
+			t.Errorf("disabled=%s: Disabled is %v", tt.value, got)
+		}
+	}
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "disabled", "yes")); err == nil {
+		t.Error("IpcSetOperation accepted disabled=yes")
+	}
+}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+// A DropReason is why the device dropped a packet. Device.DropCounts
+// reports how many packets were dropped for each.
+type DropReason int
+
+const (
+	// Outbound, from the TUN device to a peer.
+	DropNoPeer         DropReason = iota // no peer is allowed the destination
+	DropPeerDown                         // the peer is not running
+	DropQueueFull                        // a queue was full; in either direction
+	DropFlushed                          // the peer's queue was flushed
+	DropNonceExhausted                   // the session's nonces are used up
+	DropSendFailed                       // the UDP socket failed
+	DropTooBig                           // the packet exceeds the peer's MTU
+
+	// Inbound, from a peer to the TUN device.
+	DropInvalidMessage   // not a WireGuard message of a known type and size
+	DropUnknownReceiver  // no session or handshake has the receiver index
+	DropNoKeypair        // the receiver index is of a handshake, not a session
+	DropKeypairExpired   // the session is too old
+	DropOverQuota        // the peer has its share of a full decryption queue
+	DropDecryptFailed    // authentication failed
+	DropQuarantined      // the peer is quarantined
+	DropReplayed         // the counter was seen before
+	DropMalformed        // not a well-formed IP packet
+	DropDisallowedSource // the source is not allowed for the peer
+	DropTUNWriteFailed   // the TUN device failed
+	DropTruncated        // the datagram filled the message buffer; see MessageBufferSize
+
+	// Inbound handshake messages.
+	DropInvalidMAC       // mac1 does not match
+	DropCookieRequired   // under load, without a valid mac2; a cookie was sent
+	DropRateLimited      // the source sent too many handshakes
+	DropInvalidHandshake // the handshake message failed to authenticate
+	DropHandshakeSource  // the source is not among the peer's handshake sources
+	DropPeerDisabled     // the peer is disabled or outside its validity window
+	DropUnauthorized     // DeviceOptions.Authorize refused the peer
+	DropHandshakeCap     // the source has too many handshakes queued; see HandshakeCaps
+	DropDuplicateKey     // the peer's key is in use elsewhere; see DuplicateKeyPolicy
+
+	numDropReasons
+)
+
+var dropReasonNames = [numDropReasons]string{
+	DropNoPeer:           string(StageNoPeer),
+	DropPeerDown:         string(StagePeerDown),
+	DropQueueFull:        string(StageQueueFull),
+	DropFlushed:          string(StageFlushed),
+	DropNonceExhausted:   string(StageNonceExhausted),
+	DropSendFailed:       string(StageSendFailed),
+	DropTooBig:           string(StageTooBig),
+	DropInvalidMessage:   "invalid-message",
+	DropUnknownReceiver:  "unknown-receiver",
+	DropNoKeypair:        string(StageNoKeypair),
+	DropKeypairExpired:   string(StageKeypairExpired),
+	DropOverQuota:        string(StageOverQuota),
+	DropDecryptFailed:    string(StageDecryptFailed),
+	DropQuarantined:      string(StageQuarantined),
+	DropReplayed:         string(StageReplayed),
+	DropMalformed:        string(StageMalformed),
+	DropDisallowedSource: string(StageDisallowedSource),
+	DropTUNWriteFailed:   string(StageTUNWriteFailed),
+	DropTruncated:        "truncated",
+	DropInvalidMAC:       "invalid-mac",
+	DropCookieRequired:   "cookie-required",
+	DropRateLimited:      "rate-limited",
+	DropInvalidHandshake: "invalid-handshake",
+	DropHandshakeSource:  "handshake-source",
+	DropPeerDisabled:     "peer-disabled",
+	DropUnauthorized:     "unauthorized",
+	DropHandshakeCap:     "handshake-cap",
+	DropDuplicateKey:     "duplicate-key",
+}
+
+func (r DropReason) String() string {
+	if r < 0 || r >= numDropReasons {
+		return "unknown"
+	}
+	return dropReasonNames[r]
+}
+
+// dropPacket counts a packet dropped for reason, and records it in the
+// packet trace as the stage of the same name if the packet is traced.
+func (device *Device) dropPacket(traceID uint64, reason DropReason) {
+	atomic.AddUint64(&device.drops[reason], 1)
+	device.tracePacket(traceID, PacketStage(reason.String()))
+	device.logEvent(EventDrop, nil, reason.String())
+}
+
+// DropCounts returns the number of packets dropped for each reason,
+// omitting reasons with none.
+func (device *Device) DropCounts() map[DropReason]uint64 {
+	counts := make(map[DropReason]uint64)
+	for r := DropReason(0); r < numDropReasons; r++ {
+		if n := atomic.LoadUint64(&device.drops[r]); n != 0 {
+			counts[r] = n
+		}
+	}
+	return counts
+}
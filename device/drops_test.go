@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestDropReasonNames(t *testing.T) {
+	seen := make(map[string]DropReason)
+	for r := DropReason(0); r < numDropReasons; r++ {
+		name := r.String()
+		if name == "" || name == "unknown" {
+			t.Errorf("reason %d has no name", r)
+		}
+		if prev, ok := seen[name]; ok {
+			t.Errorf("reasons %d and %d are both %q", prev, r, name)
+		}
+		seen[name] = r
+	}
+}
+
+func TestDropCounts(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+
+	// An unroutable packet from the TUN device.
+	pair[0].tun.Outbound <- tuntest.Ping(net.ParseIP("9.9.9.9"), pair[0].ip)
+
+	// Datagrams that are not valid WireGuard messages.
+	dev.net.RLock()
+	port := int(dev.net.port)
+	dev.net.RUnlock()
+	c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	short := make([]byte, MinMessageSize-1)
+	transport := make([]byte, MessageTransportSize)
+	binary.LittleEndian.PutUint32(transport, MessageTransportType)
+	binary.LittleEndian.PutUint32(transport[MessageTransportOffsetReceiver:], 0xdeadbeef)
+	initiation := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(initiation, MessageInitiationType)
+	for _, msg := range [][]byte{short, transport, initiation} {
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[DropReason]uint64{
+		DropNoPeer:          1,
+		DropInvalidMessage:  1,
+		DropUnknownReceiver: 1,
+		DropInvalidMAC:      1,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := dev.DropCounts()
+		ok := true
+		for r, n := range want {
+			if got[r] != n {
+				ok = false
+			}
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("DropCounts() = %v, want at least %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,254 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+// DuplicateKeyAction is what a device does about a peer whose key is in
+// use by two clients at once; see DuplicateKeyPolicy.
+type DuplicateKeyAction int
+
+const (
+	// DuplicateKeyWarn only reports the peer.
+	DuplicateKeyWarn DuplicateKeyAction = iota
+
+	// DuplicateKeyPreferNewest keeps the client whose handshake found
+	// the duplicate: handshakes from other endpoints are refused, and
+	// the peer is held to that client's endpoint.
+	DuplicateKeyPreferNewest
+
+	// DuplicateKeyPreferOldest keeps the client the peer had before:
+	// handshakes from other endpoints, starting with the one that found
+	// the duplicate, are refused, and the peer is held to its endpoint.
+	DuplicateKeyPreferOldest
+
+	// DuplicateKeyDisconnect drops the peer's sessions and refuses all
+	// of its handshakes, disconnecting both clients.
+	DuplicateKeyDisconnect
+)
+
+var duplicateKeyActionNames = [...]string{
+	DuplicateKeyWarn:         "warn",
+	DuplicateKeyPreferNewest: "prefer-newest",
+	DuplicateKeyPreferOldest: "prefer-oldest",
+	DuplicateKeyDisconnect:   "disconnect",
+}
+
+func (a DuplicateKeyAction) String() string {
+	if a < 0 || int(a) >= len(duplicateKeyActionNames) {
+		return "unknown"
+	}
+	return duplicateKeyActionNames[a]
+}
+
+// DuplicateKeyPolicy detects a private key used by two clients at once,
+// a common misconfiguration: each client's handshake resets the other's
+// session and moves the peer's endpoint to itself, so that neither
+// works for long. It is told apart from a client that roams by its
+// handshake initiations alternating between endpoints. The zero value
+// detects nothing.
+type DuplicateKeyPolicy struct {
+	// Threshold, if non-zero, is how many handshake initiations of a
+	// peer, each from an endpoint other than that of the one before,
+	// within Window mark its key as duplicate.
+	Threshold int
+
+	// Window is the period Threshold applies to.
+	// If zero, DefaultDuplicateKeyWindow is used.
+	Window time.Duration
+
+	// Action is what is done once a duplicate is found.
+	Action DuplicateKeyAction
+
+	// HoldDown is how long Action lasts, after which the peer is
+	// watched afresh. If zero, RejectAfterTime is used.
+	HoldDown time.Duration
+}
+
+// DefaultDuplicateKeyWindow is the DuplicateKeyPolicy.Window used if it
+// is zero.
+const DefaultDuplicateKeyWindow = 2 * time.Minute
+
+func (policy *DuplicateKeyPolicy) window() time.Duration {
+	if policy.Window == 0 {
+		return DefaultDuplicateKeyWindow
+	}
+	return policy.Window
+}
+
+func (policy *DuplicateKeyPolicy) holdDown() time.Duration {
+	if policy.HoldDown == 0 {
+		return RejectAfterTime
+	}
+	return policy.HoldDown
+}
+
+// DuplicateKey describes a peer whose key was found in use by two
+// clients, for DeviceOptions.DuplicateKey.
+type DuplicateKey struct {
+	PublicKey NoisePublicKey
+	Endpoints [2]string // of the last two initiations, older first, as conn.Endpoint.DstToString
+	Action    DuplicateKeyAction
+	Until     time.Time // when Action ends; zero for DuplicateKeyWarn
+}
+
+// peerDuplicateKey tracks the endpoints of a peer's handshake
+// initiations under the device's DuplicateKeyPolicy.
+type peerDuplicateKey struct {
+	sync.Mutex
+	duplicateKeyState
+}
+
+type duplicateKeyState struct {
+	last        []byte // the endpoint of the last initiation, as DstToBytes
+	lastString  string
+	windowStart time.Time
+	switches    int
+	keep        []byte // while held, the only endpoint accepted; nil for none
+	heldUntil   time.Time
+}
+
+// held reports whether the peer is held under its DuplicateKeyAction,
+// and if so whether addr is the endpoint it is held to.
+func (d *duplicateKeyState) held(now time.Time, addr []byte) (held, kept bool) {
+	if !now.Before(d.heldUntil) {
+		return false, false
+	}
+	return true, d.keep != nil && bytes.Equal(d.keep, addr)
+}
+
+// account accounts for an initiation from addr, reporting whether it is
+// accepted and, if it found the key duplicate, describing what was found
+// apart from the key.
+func (d *duplicateKeyState) account(now time.Time, policy *DuplicateKeyPolicy, addr []byte, addrString string) (accept bool, dup *DuplicateKey) {
+	if held, kept := d.held(now, addr); held {
+		return kept, nil
+	}
+	if d.last == nil || bytes.Equal(d.last, addr) {
+		d.last, d.lastString = addr, addrString
+		return true, nil
+	}
+	if now.Sub(d.windowStart) > policy.window() {
+		d.windowStart = now
+		d.switches = 0
+	}
+	d.switches++
+	prev, prevString := d.last, d.lastString
+	d.last, d.lastString = addr, addrString
+	if d.switches < policy.Threshold {
+		return true, nil
+	}
+
+	d.windowStart = now
+	d.switches = 0
+	dup = &DuplicateKey{
+		Endpoints: [2]string{prevString, d.lastString},
+		Action:    policy.Action,
+	}
+	accept = true
+	switch policy.Action {
+	case DuplicateKeyPreferNewest:
+		d.keep = addr
+	case DuplicateKeyPreferOldest:
+		d.keep, d.last, d.lastString = prev, prev, prevString
+		accept = false
+	case DuplicateKeyDisconnect:
+		d.keep = nil
+		accept = false
+	}
+	if policy.Action != DuplicateKeyWarn {
+		d.heldUntil = now.Add(policy.holdDown())
+		dup.Until = d.heldUntil
+	}
+	return accept, dup
+}
+
+/* Reports whether a handshake initiation of peer from ep is to be
+ * accepted under the device's DuplicateKeyPolicy, without accounting for
+ * it; see noteInitiationFrom.
+ *
+ * Obs. Called by the handshake routine, after the initiation is
+ * authenticated and before it is committed.
+ */
+func (peer *Peer) acceptInitiationFrom(ep conn.Endpoint) bool {
+	device := peer.device
+	if device.duplicateKeyPolicy.Threshold == 0 {
+		return true
+	}
+	d := &peer.duplicateKey
+	d.Lock()
+	state := d.duplicateKeyState
+	d.Unlock()
+	accept, _ := state.account(device.now(), &device.duplicateKeyPolicy, ep.DstToBytes(), ep.DstToString())
+	return accept
+}
+
+/* Accounts for a handshake initiation of peer from ep, acting on and
+ * reporting the duplicate key it finds, if any.
+ *
+ * Obs. Called by the handshake routine for an initiation once it is
+ * committed, or once acceptInitiationFrom has refused it, but not for
+ * one that went stale before it could be committed.
+ */
+func (peer *Peer) noteInitiationFrom(ep conn.Endpoint) {
+	device := peer.device
+	if device.duplicateKeyPolicy.Threshold == 0 {
+		return
+	}
+	d := &peer.duplicateKey
+	d.Lock()
+	_, dup := d.account(device.now(), &device.duplicateKeyPolicy, ep.DstToBytes(), ep.DstToString())
+	d.Unlock()
+	if dup == nil {
+		return
+	}
+	dup.PublicKey = peer.handshake.remoteStatic
+
+	if dup.Action == DuplicateKeyDisconnect {
+		peer.ZeroAndFlushAll()
+	}
+	device.reportDuplicateKey(peer, *dup)
+}
+
+// duplicateKeyHolds reports whether peer, held under its DuplicateKeyAction,
+// may not roam to ep.
+//
+// Obs. Called with the peer's mutex held.
+func (peer *Peer) duplicateKeyHolds(ep conn.Endpoint) bool {
+	if peer.device.duplicateKeyPolicy.Threshold == 0 {
+		return false
+	}
+	d := &peer.duplicateKey
+	d.Lock()
+	defer d.Unlock()
+	held, kept := d.held(peer.device.now(), ep.DstToBytes())
+	return held && !kept
+}
+
+// reportDuplicateKey counts, logs and reports dup, found by
+// noteInitiationFrom.
+func (device *Device) reportDuplicateKey(peer *Peer, dup DuplicateKey) {
+	atomic.AddUint64(&peer.stats.duplicateKeys, 1)
+	device.logEvent(EventDuplicateKey, peer, dup.Action.String())
+	device.log.Error.Printf("%v - Key in use by two clients, at %s and %s; %v\n",
+		peer, device.redactAddrs(dup.Endpoints[0]), device.redactAddrs(dup.Endpoints[1]), dup.Action)
+	if device.duplicateKey != nil {
+		device.duplicateKey(dup)
+	}
+}
+
+// DuplicateKeys reports how many times peer's key has been found in use
+// by two clients under the device's DuplicateKeyPolicy.
+func (peer *Peer) DuplicateKeys() uint64 {
+	return atomic.LoadUint64(&peer.stats.duplicateKeys)
+}
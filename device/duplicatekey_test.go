@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// initiateFrom passes an initiation of peer from ep through the duplicate
+// key policy as the handshake routine does, as if it were committed
+// whenever accepted.
+func initiateFrom(peer *Peer, ep bindtest.ChannelEndpoint) bool {
+	accept := peer.acceptInitiationFrom(ep)
+	peer.noteInitiationFrom(ep)
+	return accept
+}
+
+func TestDuplicateKeyActions(t *testing.T) {
+	a, b := bindtest.ChannelEndpoint(1), bindtest.ChannelEndpoint(2)
+	for _, tt := range []struct {
+		action DuplicateKeyAction
+		found  bool // whether the initiation that finds the duplicate is accepted
+		a, b   bool // whether later ones from a and b are, while held
+	}{
+		{DuplicateKeyWarn, true, true, true},
+		{DuplicateKeyPreferNewest, true, true, false},
+		{DuplicateKeyPreferOldest, false, false, true},
+		{DuplicateKeyDisconnect, false, false, false},
+	} {
+		t.Run(tt.action.String(), func(t *testing.T) {
+			clock := NewManualClock(time.Unix(1e9, 0))
+			var dups []DuplicateKey
+			dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+				Logger: NewLogger(LogLevelSilent, ""),
+				Clock:  clock,
+				DuplicateKeyPolicy: DuplicateKeyPolicy{
+					Threshold: 2,
+					Action:    tt.action,
+					HoldDown:  time.Minute,
+				},
+				DuplicateKey: func(dup DuplicateKey) { dups = append(dups, dup) },
+			})
+			defer dev.Close()
+			peer, err := dev.NewPeer(NoisePublicKey{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a, then b, is one switch; back to a is the second.
+			for _, ep := range []bindtest.ChannelEndpoint{a, b} {
+				if !initiateFrom(peer, ep) {
+					t.Fatalf("initiation from %v refused", ep)
+				}
+				clock.Advance(time.Second)
+			}
+			if got := initiateFrom(peer, a); got != tt.found {
+				t.Errorf("initiation finding the duplicate accepted %v, want %v", got, tt.found)
+			}
+			if len(dups) != 1 || dups[0].Action != tt.action || peer.DuplicateKeys() != 1 {
+				t.Fatalf("reported %+v, count %d", dups, peer.DuplicateKeys())
+			}
+			if dups[0].Endpoints != [2]string{b.DstToString(), a.DstToString()} {
+				t.Errorf("endpoints %q", dups[0].Endpoints)
+			}
+
+			if got := initiateFrom(peer, a); got != tt.a {
+				t.Errorf("later initiation from a accepted %v, want %v", got, tt.a)
+			}
+			if got := initiateFrom(peer, b); got != tt.b {
+				t.Errorf("later initiation from b accepted %v, want %v", got, tt.b)
+			}
+
+			refused := b
+			if tt.b {
+				refused = a
+			}
+			clock.Advance(time.Minute)
+			if !initiateFrom(peer, refused) {
+				t.Errorf("initiation from %v refused after the hold-down", refused)
+			}
+		})
+	}
+}
+
+func TestDuplicateKeyHoldsEndpoint(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, ""),
+		Clock:  clock,
+		DuplicateKeyPolicy: DuplicateKeyPolicy{
+			Threshold: 1,
+			Action:    DuplicateKeyPreferNewest,
+		},
+	})
+	defer dev.Close()
+	peer, err := dev.NewPeer(NoisePublicKey{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := bindtest.ChannelEndpoint(1), bindtest.ChannelEndpoint(2)
+	initiateFrom(peer, a)
+	initiateFrom(peer, b)
+	peer.SetEndpointFromPacket(b)
+
+	// Packets of a's session, still valid, do not move the peer back.
+	peer.SetEndpointFromPacket(a)
+	if peer.Endpoint() != b {
+		t.Errorf("endpoint %v, want %v", peer.Endpoint(), b)
+	}
+}
+
+func TestDuplicateKeyCheckChangesNothing(t *testing.T) {
+	var dups []DuplicateKey
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, ""),
+		DuplicateKeyPolicy: DuplicateKeyPolicy{
+			Threshold: 1,
+			Action:    DuplicateKeyDisconnect,
+		},
+		DuplicateKey: func(dup DuplicateKey) { dups = append(dups, dup) },
+	})
+	defer dev.Close()
+	peer, err := dev.NewPeer(NoisePublicKey{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := bindtest.ChannelEndpoint(1), bindtest.ChannelEndpoint(2)
+	initiateFrom(peer, a)
+
+	// Initiations checked but never committed, as when they go stale,
+	// count no switches.
+	for i := 0; i < 3; i++ {
+		if peer.acceptInitiationFrom(b) {
+			t.Fatal("initiation finding the duplicate accepted")
+		}
+	}
+	if len(dups) != 0 || peer.DuplicateKeys() != 0 {
+		t.Fatalf("unaccounted initiations reported %+v", dups)
+	}
+	if !initiateFrom(peer, a) {
+		t.Error("initiation from the first endpoint refused")
+	}
+}
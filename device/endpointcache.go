@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// A PeerEndpoint is the last endpoint a peer was seen at.
+type PeerEndpoint struct {
+	PublicKey wgcfg.Key
+	Endpoint  string // as conn.Endpoint.DstToString
+}
+
+// ExportEndpoints returns, for every peer that has sent the device an
+// authenticated packet, the endpoint the last one came from, ordered by
+// public key. Unlike Peer.Endpoint, it never reports an endpoint that
+// only the configuration claims, so a server can save it and, after a
+// restart, pass it to ImportEndpoints to reach roaming clients where
+// they were rather than wait for them to reconnect.
+func (device *Device) ExportEndpoints() []PeerEndpoint {
+	var eps []PeerEndpoint
+	for _, peer := range device.Peers() {
+		peer.RLock()
+		ep := peer.validEndpoint
+		peer.RUnlock()
+		if ep == nil {
+			continue
+		}
+		eps = append(eps, PeerEndpoint{
+			PublicKey: wgcfg.Key(peer.handshake.remoteStatic),
+			Endpoint:  ep.DstToString(),
+		})
+	}
+	return eps
+}
+
+// ImportEndpoints sets the endpoints of the device's peers to those
+// exported by ExportEndpoints, replacing any configured, as
+// SetPeerEndpoint does. Until an authenticated packet comes from
+// elsewhere, ExportEndpoints reports them again. Endpoints of unknown
+// peers are skipped; the first that does not parse is returned as an
+// ErrEndpointParse after the rest are imported.
+func (device *Device) ImportEndpoints(eps []PeerEndpoint) error {
+	var firstErr error
+	for _, pe := range eps {
+		peer := device.LookupPeer(NoisePublicKey(pe.PublicKey))
+		if peer == nil {
+			continue
+		}
+		ep, err := device.createEndpoint(pe.PublicKey, pe.Endpoint)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%w: peer %s: %q: %v", ErrEndpointParse, device.redactKey(pe.PublicKey), device.redactAddrs(pe.Endpoint), device.redactAddrErr(err))
+			}
+			continue
+		}
+		ep.ClearSrc()
+		peer.Lock()
+		peer.endpoint = ep
+		peer.validEndpoint = ep
+		peer.Unlock()
+	}
+	return firstErr
+}
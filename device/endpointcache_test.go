@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestExportEndpoints(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	eps := pair[0].dev.ExportEndpoints()
+	if len(eps) != 1 {
+		t.Fatalf("exported %+v, want one endpoint", eps)
+	}
+	if want := pair[0].dev.Peers()[0].Endpoint().DstToString(); eps[0].Endpoint != want {
+		t.Errorf("exported endpoint %s, want %s", eps[0].Endpoint, want)
+	}
+}
+
+func TestImportEndpoints(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "endpoint", "127.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if eps := dev.ExportEndpoints(); len(eps) != 0 {
+		t.Errorf("exported configured endpoints %+v", eps)
+	}
+
+	key, err := wgcfg.ParseHexKey(testPeerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unknown wgcfg.Key
+	unknown[0] = 1
+	err = dev.ImportEndpoints([]PeerEndpoint{
+		{PublicKey: unknown, Endpoint: "127.0.0.1:3"},
+		{PublicKey: key, Endpoint: "nowhere"},
+		{PublicKey: key, Endpoint: "127.0.0.1:2"},
+	})
+	if !errors.Is(err, ErrEndpointParse) {
+		t.Errorf("ImportEndpoints: %v, want ErrEndpointParse", err)
+	}
+	if ep := dev.Peers()[0].Endpoint().DstToString(); ep != "127.0.0.1:2" {
+		t.Errorf("endpoint %s after import, want 127.0.0.1:2", ep)
+	}
+	if eps := dev.ExportEndpoints(); len(eps) != 1 || eps[0].Endpoint != "127.0.0.1:2" {
+		t.Errorf("exported %+v after import", eps)
+	}
+}
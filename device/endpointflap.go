@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+// EndpointFlapPolicy damps peers whose authenticated packets keep
+// arriving from different endpoints in turn, as they do when two clients
+// share a key: each moves the peer's endpoint to itself, so that replies
+// alternate between them and neither works. The zero value detects
+// nothing, leaving roaming as it is.
+type EndpointFlapPolicy struct {
+	// Threshold, if non-zero, is how many times the endpoint of a peer
+	// may roam within Window before the peer is taken to be flapping.
+	Threshold int
+
+	// Window is the period Threshold applies to.
+	// If zero, DefaultEndpointFlapWindow is used.
+	Window time.Duration
+
+	// HoldDown, if non-zero, is how long a flapping peer is held to the
+	// endpoint it had: packets from other endpoints are still accepted,
+	// but do not move it there. Endpoints set by SetPeerEndpoint, UAPI
+	// or Reconfig apply regardless.
+	HoldDown time.Duration
+}
+
+// DefaultEndpointFlapWindow is the EndpointFlapPolicy.Window used if it
+// is zero.
+const DefaultEndpointFlapWindow = 10 * time.Second
+
+func (policy *EndpointFlapPolicy) window() time.Duration {
+	if policy.Window == 0 {
+		return DefaultEndpointFlapWindow
+	}
+	return policy.Window
+}
+
+// EndpointFlap describes a peer found flapping, for
+// DeviceOptions.EndpointFlapping.
+type EndpointFlap struct {
+	PublicKey NoisePublicKey
+	From, To  string    // the endpoints of the last roam, as conn.Endpoint.DstToString
+	HeldUntil time.Time // zero unless the peer is held to From; see EndpointFlapPolicy.HoldDown
+}
+
+// peerFlap counts the roams of a peer under the device's
+// EndpointFlapPolicy. It is protected by the peer's mutex.
+type peerFlap struct {
+	windowStart time.Time
+	roams       int
+	heldUntil   time.Time
+}
+
+/* Accounts for the endpoint of peer roaming from old to new, reporting
+ * whether the peer is found flapping and whether it is to be held to
+ * old instead.
+ *
+ * Obs. Called with the peer's mutex held.
+ */
+func (peer *Peer) dampRoam(old, new conn.Endpoint) (flap *EndpointFlap, held bool) {
+	device := peer.device
+	policy := &device.endpointFlapPolicy
+	if policy.Threshold == 0 || old == nil {
+		return nil, false
+	}
+	now := device.now()
+	f := &peer.flap
+	if now.Before(f.heldUntil) {
+		return nil, true
+	}
+	if now.Sub(f.windowStart) > policy.window() {
+		f.windowStart = now
+		f.roams = 0
+	}
+	f.roams++
+	if f.roams < policy.Threshold {
+		return nil, false
+	}
+
+	f.windowStart = now
+	f.roams = 0
+	flap = &EndpointFlap{
+		PublicKey: peer.handshake.remoteStatic,
+		From:      old.DstToString(),
+		To:        new.DstToString(),
+	}
+	if policy.HoldDown > 0 {
+		f.heldUntil = now.Add(policy.HoldDown)
+		flap.HeldUntil = f.heldUntil
+		return flap, true
+	}
+	return flap, false
+}
+
+// reportEndpointFlap counts, logs and reports flap, found by dampRoam.
+func (device *Device) reportEndpointFlap(peer *Peer, flap *EndpointFlap) {
+	atomic.AddUint64(&peer.stats.endpointFlaps, 1)
+	detail := ""
+	if !flap.HeldUntil.IsZero() {
+		detail = "held"
+	}
+	device.logEvent(EventEndpointFlap, peer, detail)
+	device.log.Info.Printf("%v - Endpoint flapping: roamed %d times within %v, lately from %s to %s\n",
+		peer, device.endpointFlapPolicy.Threshold, device.endpointFlapPolicy.window(), device.redactAddrs(flap.From), device.redactAddrs(flap.To))
+	if device.endpointFlapping != nil {
+		device.endpointFlapping(*flap)
+	}
+}
+
+// EndpointFlaps reports how many times peer has been found flapping
+// under the device's EndpointFlapPolicy.
+func (peer *Peer) EndpointFlaps() uint64 {
+	return atomic.LoadUint64(&peer.stats.endpointFlaps)
+}
+
+// EndpointHeld reports whether peer is held to its endpoint after
+// flapping; see EndpointFlapPolicy.HoldDown.
+func (peer *Peer) EndpointHeld() bool {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.device.now().Before(peer.flap.heldUntil)
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestEndpointFlapHoldDown(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	var flaps []EndpointFlap
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+		Clock:  clock,
+		EndpointFlapPolicy: EndpointFlapPolicy{
+			Threshold: 3,
+			HoldDown:  time.Minute,
+		},
+		EndpointFlapping: func(flap EndpointFlap) { flaps = append(flaps, flap) },
+	})
+	defer dev.Close()
+	peer, err := dev.NewPeer(NoisePublicKey{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := bindtest.ChannelEndpoint(1), bindtest.ChannelEndpoint(2)
+
+	// The first endpoint is no roam; the next three are, and the third
+	// trips the threshold, holding the peer to a.
+	for _, ep := range []bindtest.ChannelEndpoint{a, b, a, b, b} {
+		peer.SetEndpointFromPacket(ep)
+		clock.Advance(time.Second)
+	}
+	if len(flaps) != 1 {
+		t.Fatalf("%d flaps reported, want 1", len(flaps))
+	}
+	if flaps[0].From != a.DstToString() || flaps[0].To != b.DstToString() || flaps[0].HeldUntil.IsZero() {
+		t.Errorf("flap %+v", flaps[0])
+	}
+	if peer.Endpoint() != a || !peer.EndpointHeld() {
+		t.Errorf("endpoint %v, held %v; want %v, held", peer.Endpoint(), peer.EndpointHeld(), a)
+	}
+	if n := peer.EndpointFlaps(); n != 1 {
+		t.Errorf("EndpointFlaps %d, want 1", n)
+	}
+
+	clock.Advance(time.Minute)
+	peer.SetEndpointFromPacket(b)
+	if peer.Endpoint() != b || peer.EndpointHeld() {
+		t.Errorf("after the hold-down, endpoint %v, held %v; want %v", peer.Endpoint(), peer.EndpointHeld(), b)
+	}
+}
+
+func TestEndpointFlapSlowRoaming(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:             NewLogger(LogLevelError, "dev: "),
+		Clock:              clock,
+		EndpointFlapPolicy: EndpointFlapPolicy{Threshold: 2, HoldDown: time.Minute},
+	})
+	defer dev.Close()
+	peer, err := dev.NewPeer(NoisePublicKey{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		peer.SetEndpointFromPacket(bindtest.ChannelEndpoint(i))
+		clock.Advance(DefaultEndpointFlapWindow + time.Second)
+	}
+	if n := peer.EndpointFlaps(); n != 0 {
+		t.Errorf("a peer roaming once a window flapped %d times", n)
+	}
+}
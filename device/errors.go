@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/ipc"
+)
+
+/* Errors returned by the device's operations, for errors.Is. They are
+ * wrapped with the details of the failure, and the ones IpcSetOperation
+ * returns wrap the IPCError it reports to UAPI clients in turn.
+ */
+var (
+	// ErrDeviceClosed is returned by Up, Down, Reconfig and NewPeer
+	// once Close has been called.
+	ErrDeviceClosed = errors.New("wireguard: device is closed")
+
+	// ErrPeerNotFound is returned by operations on a peer the device
+	// does not have.
+	ErrPeerNotFound = errors.New("wireguard: no such peer")
+
+	// ErrInvalidKey is returned for a private, public or preshared key
+	// that cannot be parsed, or is not allowed where it is given.
+	ErrInvalidKey = fmt.Errorf("wireguard: invalid key: %w", &IPCError{ipc.IpcErrorInvalid})
+
+	// ErrEndpointParse is returned for a peer endpoint that cannot be
+	// parsed or resolved.
+	ErrEndpointParse = fmt.Errorf("wireguard: invalid endpoint: %w", &IPCError{ipc.IpcErrorInvalid})
+
+	// ErrPortInUse is returned when the device cannot bind its listen
+	// port.
+	ErrPortInUse = fmt.Errorf("wireguard: local port in use: %w", &IPCError{ipc.IpcErrorPortInUse})
+)
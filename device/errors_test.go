@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/ipc"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestTypedErrors(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	const pub = "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"
+
+	ipcTests := []struct {
+		name string
+		cfg  []string
+		want error
+	}{
+		{"private key", []string{"private_key", "zz"}, ErrInvalidKey},
+		{"public key", []string{"public_key", "1234"}, ErrInvalidKey},
+		{"preshared key", []string{"public_key", pub, "preshared_key", "zz"}, ErrInvalidKey},
+		{"endpoint", []string{"public_key", pub, "endpoint", "nowhere"}, ErrEndpointParse},
+	}
+	for _, tt := range ipcTests {
+		err := dev.IpcSetOperation(uapiCfg(tt.cfg...))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+		var ipcErr *IPCError
+		if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+			t.Errorf("%s: %v does not carry IpcErrorInvalid", tt.name, err)
+		}
+	}
+
+	var zero wgcfg.Config
+	zero.Peers = []wgcfg.Peer{{}}
+	if err := dev.Reconfig(&zero); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Reconfig with an empty public key: %v", err)
+	}
+
+	var missing NoisePublicKey
+	missing[0] = 1
+	if _, err := dev.SetPeerEndpoint(missing, bindtest.ChannelEndpoint(1), SetEndpointOptions{}); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("SetPeerEndpoint of a missing peer: %v", err)
+	}
+}
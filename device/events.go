@@ -0,0 +1,176 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The event log keeps the device's latest significant events in a ring,
+ * so that what happened in the last few minutes can be asked after the
+ * fact, through Events or a UAPI get, without verbose logging having
+ * been turned on beforehand. It is on by default and costs nothing per
+ * packet but on the paths it records.
+ */
+
+// An EventKind is a kind of event recorded in the event log.
+type EventKind string
+
+const (
+	EventHandshakeInitiated EventKind = "handshake-initiated" // an initiation was sent; Detail is "retry" for a retry
+	EventSession            EventKind = "session"             // a first session was established; Detail is "initiator" or "responder"
+	EventRekey              EventKind = "rekey"               // a session replaced another; likewise
+	EventHandshakeGaveUp    EventKind = "handshake-gave-up"   // the handshake went unanswered for too long
+	EventEndpoint           EventKind = "endpoint"            // the endpoint changed; Detail is the new one, "set" or "roamed"
+	EventEndpointFlap       EventKind = "endpoint-flap"       // the endpoint roamed too often; Detail is "held" if the peer was held to it
+	EventDuplicateKey       EventKind = "duplicate-key"       // the key is in use by two clients; Detail is the DuplicateKeyAction
+	EventDrop               EventKind = "drop"                // packets were dropped; Detail is the DropReason
+)
+
+// DefaultEventLogSize is how many events the event log keeps if
+// DeviceOptions.EventLogSize is zero.
+const DefaultEventLogSize = 256
+
+// An Event is an entry of the event log.
+type Event struct {
+	// Time is when the event, or the last of a run of them, happened.
+	Time time.Time
+	Kind EventKind
+
+	// Peer is the public key of the peer the event concerns, or zero
+	// for events of the device as a whole, such as drops.
+	Peer   NoisePublicKey
+	Detail string
+
+	// Count is how many times the event happened in a row. Drops for
+	// one reason are counted in one event until another intervenes, so
+	// that a flood of them does not push everything else out of the
+	// log. Other events have a Count of 1.
+	Count int
+}
+
+// String formats ev as the UAPI reports it: its time, kind, count, peer
+// in hex or "-" and detail, separated by spaces.
+func (ev Event) String() string {
+	var b strings.Builder
+	b.WriteString(ev.Time.UTC().Format(time.RFC3339Nano))
+	b.WriteByte(' ')
+	b.WriteString(string(ev.Kind))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Itoa(ev.Count))
+	b.WriteByte(' ')
+	if ev.Peer.IsZero() {
+		b.WriteByte('-')
+	} else {
+		b.WriteString(hex.EncodeToString(ev.Peer[:]))
+	}
+	if ev.Detail != "" {
+		b.WriteByte(' ')
+		b.WriteString(ev.Detail)
+	}
+	return b.String()
+}
+
+// An eventLog keeps the latest events in a ring.
+type eventLog struct {
+	sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]Event, size)}
+}
+
+// last returns the latest event, or nil if there is none.
+func (l *eventLog) last() *Event {
+	switch {
+	case l.next > 0:
+		return &l.events[l.next-1]
+	case l.full:
+		return &l.events[len(l.events)-1]
+	}
+	return nil
+}
+
+// logEvent records an event concerning peer, or the device if peer is
+// nil. It does nothing if the event log is off.
+func (device *Device) logEvent(kind EventKind, peer *Peer, detail string) {
+	l := device.events
+	if l == nil {
+		return
+	}
+	ev := Event{Time: device.now(), Kind: kind, Detail: detail, Count: 1}
+	if peer != nil {
+		ev.Peer = peer.handshake.remoteStatic
+	}
+	l.Lock()
+	defer l.Unlock()
+	if kind == EventDrop {
+		if last := l.last(); last != nil && last.Kind == kind && last.Peer == ev.Peer && last.Detail == detail {
+			last.Count++
+			last.Time = ev.Time
+			return
+		}
+	}
+	l.events[l.next] = ev
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// Events returns the events in the event log that happened at or after
+// since, oldest first; all of them if since is zero. The log keeps up to
+// DeviceOptions.EventLogSize events. Events returns nil if it is off.
+func (device *Device) Events(since time.Time) []Event {
+	l := device.events
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	var events []Event
+	add := func(evs []Event) {
+		for _, ev := range evs {
+			if !ev.Time.Before(since) {
+				events = append(events, ev)
+			}
+		}
+	}
+	if l.full {
+		add(l.events[l.next:])
+	}
+	add(l.events[:l.next])
+	return events
+}
+
+// logSession records the session of keypair, established with peer, as
+// a rekey if the peer had a session before.
+func (peer *Peer) logSession(keypair *Keypair) {
+	device := peer.device
+	if device.events == nil {
+		return
+	}
+	peer.keypairs.RLock()
+	rekey := peer.keypairs.previous != nil
+	peer.keypairs.RUnlock()
+	kind := EventSession
+	if rekey {
+		kind = EventRekey
+	}
+	role := "responder"
+	if keypair.isInitiator {
+		role = "initiator"
+	}
+	device.logEvent(kind, peer, role)
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestEventLogRing(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:       NewLogger(LogLevelError, "dev: "),
+		Clock:        clock,
+		EventLogSize: 3,
+	})
+	defer dev.Close()
+	start := clock.Now()
+
+	dev.logEvent(EventDrop, nil, DropNoPeer.String())
+	clock.Advance(time.Second)
+	dev.logEvent(EventDrop, nil, DropNoPeer.String())
+	dev.logEvent(EventHandshakeGaveUp, nil, "")
+	clock.Advance(time.Second)
+	dev.logEvent(EventDrop, nil, DropNoPeer.String())
+	dev.logEvent(EventDrop, nil, DropQueueFull.String())
+
+	events := dev.Events(time.Time{})
+	var kinds []string
+	for _, ev := range events {
+		kinds = append(kinds, string(ev.Kind)+" "+ev.Detail)
+	}
+	want := []string{"handshake-gave-up ", "drop no-peer", "drop queue-full"}
+	if strings.Join(kinds, ",") != strings.Join(want, ",") {
+		t.Fatalf("events %q, want %q", kinds, want)
+	}
+
+	// The first two drops were counted in one event, since pushed out
+	// of the ring; the third followed another event, so starts anew.
+	if events[1].Count != 1 {
+		t.Errorf("count %d, want 1", events[1].Count)
+	}
+	if got := dev.Events(start.Add(2 * time.Second)); len(got) != 2 {
+		t.Errorf("%d events in the last second, want 2", len(got))
+	}
+}
+
+func TestEventLogCoalescesDrops(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer dev.Close()
+	for i := 0; i < 1000; i++ {
+		dev.logEvent(EventDrop, nil, DropNoPeer.String())
+	}
+	events := dev.Events(time.Time{})
+	if len(events) != 1 || events[0].Count != 1000 {
+		t.Fatalf("events %+v, want one of 1000 drops", events)
+	}
+}
+
+func TestEventLogOff(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:       NewLogger(LogLevelError, "dev: "),
+		EventLogSize: -1,
+	})
+	defer dev.Close()
+	dev.logEvent(EventDrop, nil, DropNoPeer.String())
+	if events := dev.Events(time.Time{}); events != nil {
+		t.Errorf("events %+v with the log off", events)
+	}
+}
+
+func TestEventsHandshake(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil) // from the second device, which initiates
+
+	for i, want := range []string{"responder", "initiator"} {
+		dev := pair[i].dev
+		peer := dev.Peers()[0]
+		found := false
+		for _, ev := range dev.Events(time.Time{}) {
+			if ev.Kind == EventSession && ev.Peer == peer.handshake.remoteStatic && ev.Detail == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("device %d logged no %s session: %+v", i, want, dev.Events(time.Time{}))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pair[0].dev.IpcGetOperationFiltered(&buf, IPCGetFilter{Events: 5 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "event=") || !strings.Contains(buf.String(), " session 1 ") {
+		t.Errorf("get reported no session event:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"golang.org/x/crypto/blake2s"
+)
+
+// FlowLabelMode is how a device picks the IPv6 flow label of the
+// datagrams it sends to a peer. Routers balancing load over equal-cost
+// paths often hash the flow label along with the addresses and ports;
+// left to the system, it may change at any time and move the session to
+// a path with different latency, reordering its packets. Labels are only
+// set if the device's Bind is a conn.FlowLabelBind.
+type FlowLabelMode int
+
+const (
+	// FlowLabelSystem leaves the label to the system.
+	FlowLabelSystem FlowLabelMode = iota
+
+	// FlowLabelPerPeer gives each peer a random label for as long as it
+	// is configured on the device.
+	FlowLabelPerPeer
+
+	// FlowLabelFromKey derives each peer's label from its public key,
+	// so that it survives restarts and is the same on every device.
+	FlowLabelFromKey
+
+	// FlowLabelPerSession gives each peer a new random label with each
+	// session, so that rekeying spreads a long-lived peer over the paths.
+	FlowLabelPerSession
+)
+
+/* The labels with the top bit set are reserved for those the kernel
+ * picks itself on systems that enforce flowlabel_state_ranges, so the
+ * labels picked here keep it clear.
+ */
+const flowLabelMask = 0x7ffff
+
+func flowLabelFrom(x uint32) uint32 {
+	if x &= flowLabelMask; x == 0 {
+		return 1
+	}
+	return x
+}
+
+func flowLabelFromKey(pk NoisePublicKey) uint32 {
+	sum := blake2s.Sum256(append([]byte("wireguard-go flow label"), pk[:]...))
+	return flowLabelFrom(binary.LittleEndian.Uint32(sum[:]))
+}
+
+// newFlowLabel sets peer's label as the device's mode has it for a new
+// peer, if session is false, or a new session.
+func (peer *Peer) newFlowLabel(session bool) {
+	var label uint32
+	switch device := peer.device; device.flowLabelMode {
+	case FlowLabelPerPeer:
+		if session {
+			return
+		}
+		x, err := randUint32(device.rand)
+		if err != nil {
+			return
+		}
+		label = flowLabelFrom(x)
+	case FlowLabelFromKey:
+		if session {
+			return
+		}
+		label = flowLabelFromKey(peer.handshake.remoteStatic)
+	case FlowLabelPerSession:
+		x, err := randUint32(device.rand)
+		if err != nil {
+			return
+		}
+		label = flowLabelFrom(x)
+	default:
+		return
+	}
+	atomic.StoreUint32(&peer.flowLabel, label)
+}
+
+// FlowLabel returns the IPv6 flow label the device sends to peer with,
+// or zero if it leaves the label to the system.
+func (peer *Peer) FlowLabel() uint32 {
+	return atomic.LoadUint32(&peer.flowLabel)
+}
+
+// send sends buffer to the peer's endpoint on bind with the peer's flow
+// label, if it has one and bind can set it.
+func (peer *Peer) send(bind conn.Bind, buffer []byte) error {
+	if label := atomic.LoadUint32(&peer.flowLabel); label != 0 {
+		if bind, ok := bind.(conn.FlowLabelBind); ok {
+			return bind.SendWithFlowLabel(buffer, peer.endpoint, label)
+		}
+	}
+	return bind.Send(buffer, peer.endpoint)
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+)
+
+func TestFlowLabel(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       FlowLabelMode
+		perSession bool
+	}{
+		{"system", FlowLabelSystem, false},
+		{"per-peer", FlowLabelPerPeer, false},
+		{"from-key", FlowLabelFromKey, false},
+		{"per-session", FlowLabelPerSession, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(time.Unix(1e9, 0))
+			var binds [2]*bindtest.ChannelBind
+			pair := genSimPairWithOptions(t, clock, 1, func(i int, opts *DeviceOptions) {
+				opts.FlowLabel = tt.mode
+				createBind := opts.CreateBind
+				opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+					bind, port, err := createBind(port)
+					binds[i] = bind.(*bindtest.ChannelBind)
+					return bind, port, err
+				}
+			})
+			pair.Send(t, Ping, nil)
+			pair.Send(t, Pong, nil)
+			peer1 := pair[1].dev.Peers()[0]
+			label := peer1.FlowLabel()
+			if tt.mode == FlowLabelSystem {
+				if label != 0 || binds[1].LastFlowLabel() != 0 {
+					t.Fatalf("label %#x set, want it left to the system", label)
+				}
+				return
+			}
+			if label == 0 || label > flowLabelMask {
+				t.Fatalf("label %#x out of range", label)
+			}
+			if got := binds[1].LastFlowLabel(); got != label {
+				t.Errorf("sent with label %#x, want %#x", got, label)
+			}
+			if tt.mode == FlowLabelFromKey {
+				if want := flowLabelFromKey(peer1.handshake.remoteStatic); label != want {
+					t.Errorf("label %#x, want %#x derived from the key", label, want)
+				}
+			}
+
+			first := peer1.keypairs.Current()
+			step(clock, RekeyAfterTime+time.Second, time.Second)
+			pair.Send(t, Ping, nil)
+			waitFor(t, "rekey", func() bool {
+				return peer1.keypairs.Current() != first
+			})
+			pair.Send(t, Ping, nil)
+			if changed := peer1.FlowLabel() != label; changed != tt.perSession {
+				t.Errorf("label changed with the session: %v, want %v", changed, tt.perSession)
+			}
+			if got := binds[1].LastFlowLabel(); got != peer1.FlowLabel() {
+				t.Errorf("sent with label %#x after rekeying, want %#x", got, peer1.FlowLabel())
+			}
+		})
+	}
+}
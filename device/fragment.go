@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	ipv4FlagDontFragment  = 0x4000
+	ipv4FlagMoreFragments = 0x2000
+	ipv4FragmentOffset    = 0x1fff
+)
+
+// mayFragment reports whether packet is an IPv4 packet without the
+// don't-fragment bit.
+func mayFragment(packet []byte) bool {
+	return len(packet) >= ipv4.HeaderLen && packet[0]>>4 == ipv4.Version &&
+		binary.BigEndian.Uint16(packet[6:])&ipv4FlagDontFragment == 0
+}
+
+// fragmentIPv4 splits packet, an IPv4 packet that may be fragmented,
+// into fragments of at most mtu bytes, each in a new outbound element.
+// It returns nil if packet is malformed.
+func (device *Device) fragmentIPv4(packet []byte, mtu int) []*QueueOutboundElement {
+	ihl := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[IPv4offsetTotalLength:]))
+	if ihl < ipv4.HeaderLen || total < ihl || total > len(packet) {
+		return nil
+	}
+	header, payload := packet[:ihl], packet[ihl:total]
+	flags := binary.BigEndian.Uint16(packet[6:])
+	offset := int(flags&ipv4FragmentOffset) * 8
+	more := flags&ipv4FlagMoreFragments != 0
+
+	// Fragments after the first carry only the options marked to be
+	// copied into every fragment.
+	rest := append([]byte{}, header[:ipv4.HeaderLen]...)
+	for options := header[ipv4.HeaderLen:]; len(options) > 0; {
+		kind := options[0]
+		if kind == 0 {
+			break
+		}
+		length := 1
+		if kind != 1 {
+			if len(options) < 2 || options[1] < 2 || int(options[1]) > len(options) {
+				break
+			}
+			length = int(options[1])
+		}
+		if kind&0x80 != 0 {
+			rest = append(rest, options[:length]...)
+		}
+		options = options[length:]
+	}
+	for len(rest)%4 != 0 {
+		rest = append(rest, 0)
+	}
+	rest[0] = ipv4.Version<<4 | byte(len(rest)/4)
+
+	var fragments []*QueueOutboundElement
+	for first := true; len(payload) > 0; first = false {
+		h := header
+		if !first {
+			h = rest
+		}
+		n := (mtu - len(h)) &^ 7
+		if n <= 0 {
+			for _, elem := range fragments {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+			return nil
+		}
+		last := n >= len(payload)
+		if last {
+			n = len(payload)
+		}
+		elem := device.NewOutboundElement()
+		elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+len(h)+n]
+		copy(elem.packet, h)
+		copy(elem.packet[len(h):], payload[:n])
+		binary.BigEndian.PutUint16(elem.packet[IPv4offsetTotalLength:], uint16(len(elem.packet)))
+		fragment := flags&^(ipv4FlagMoreFragments|ipv4FragmentOffset) | uint16(offset/8)
+		if !last || more {
+			fragment |= ipv4FlagMoreFragments
+		}
+		binary.BigEndian.PutUint16(elem.packet[6:], fragment)
+		elem.packet[10], elem.packet[11] = 0, 0
+		binary.BigEndian.PutUint16(elem.packet[10:], checksum(elem.packet[:len(h)], 0))
+		elem.traceID = device.newPacketID()
+		fragments = append(fragments, elem)
+		payload = payload[n:]
+		offset += n
+	}
+	return fragments
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestFragmentIPv4(t *testing.T) {
+	device := &Device{}
+	device.pool.config = Pools{Mode: PoolSync}
+	device.PopulatePools()
+
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	plain := testIPv4(src, dst, ipv4.HeaderLen+len(payload), false, 17, payload)
+
+	// With a record route option, not copied, and a security option,
+	// copied into every fragment.
+	options := []byte{7, 7, 4, 0, 0, 0, 0, 1, 0x82, 3, 0, 0}
+	header := append(append([]byte{}, plain[:ipv4.HeaderLen]...), options...)
+	header[0] = ipv4.Version<<4 | byte(len(header)/4)
+	binary.BigEndian.PutUint16(header[IPv4offsetTotalLength:], uint16(len(header)+len(payload)))
+	withOptions := append(header, payload...)
+
+	for name, packet := range map[string][]byte{"plain": plain, "options": withOptions} {
+		t.Run(name, func(t *testing.T) {
+			const mtu = 1280
+			fragments := device.fragmentIPv4(packet, mtu)
+			if len(fragments) != 3 {
+				t.Fatalf("%d fragments, want 3", len(fragments))
+			}
+			var got []byte
+			for i, elem := range fragments {
+				p := elem.packet
+				ihl := int(p[0]&0x0f) * 4
+				if len(p) > mtu {
+					t.Errorf("fragment %d of %d bytes", i, len(p))
+				}
+				if int(binary.BigEndian.Uint16(p[IPv4offsetTotalLength:])) != len(p) {
+					t.Errorf("fragment %d total length %d, want %d", i, binary.BigEndian.Uint16(p[IPv4offsetTotalLength:]), len(p))
+				}
+				if checksum(p[:ihl], 0) != 0 {
+					t.Errorf("fragment %d has a bad header checksum", i)
+				}
+				flags := binary.BigEndian.Uint16(p[6:])
+				if offset := int(flags&ipv4FragmentOffset) * 8; offset != len(got) {
+					t.Errorf("fragment %d at offset %d, want %d", i, offset, len(got))
+				}
+				if more := flags&ipv4FlagMoreFragments != 0; more != (i < len(fragments)-1) {
+					t.Errorf("fragment %d more fragments %v", i, more)
+				}
+				if name == "options" && i > 0 && !bytes.Equal(p[ipv4.HeaderLen:ihl], []byte{0x82, 3, 0, 0}) {
+					t.Errorf("fragment %d options %x, want only the copied one", i, p[ipv4.HeaderLen:ihl])
+				}
+				got = append(got, p[ihl:]...)
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Error("fragments do not reassemble to the payload")
+			}
+		})
+	}
+}
+
+func TestFragmentIPv4Peer(t *testing.T) {
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.FragmentIPv4 = true
+	})
+	dev0 := pair[0].dev
+	pub1 := pair[1].dev.staticIdentity.publicKey
+	if err := dev0.LookupPeer(pub1).SetMTU(1280); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+
+	pair[0].tun.Outbound <- testIPv4(pair[0].ip, pair[1].ip, 1400, false, 17, nil)
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-pair[1].tun.Inbound:
+			if len(got) > 1280 {
+				t.Errorf("fragment %d of %d bytes", i, len(got))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fragment %d not received", i)
+		}
+	}
+	if n := dev0.DropCounts()[DropTooBig]; n != 0 {
+		t.Errorf("%d packets dropped as too big, want 0", n)
+	}
+}
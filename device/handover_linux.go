@@ -0,0 +1,216 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"golang.org/x/sys/unix"
+)
+
+/* A handover is a big-endian uint32 length followed by that many bytes
+ * of JSON-encoded handoverMessage. The first byte carries the open
+ * files as SCM_RIGHTS, in the order the message names them.
+ */
+
+type handoverMessage struct {
+	Files    []string // "tun", "udp4" or "udp6"
+	Snapshot *Snapshot
+}
+
+// Handover freezes the device, as Snapshot does, and sends its state,
+// its TUN device and its UDP sockets over c to a process calling
+// ReceiveHandover, so that a daemon can be replaced by a new binary
+// without dropping its sessions. Sockets of peers with a local address
+// are not handed over; the new process opens its own.
+//
+// The device must not be closed afterwards, as closing it would shut
+// down the sockets it now shares with the new process: the process
+// should exit instead. If Handover fails, the state was not handed
+// over, and the device is left running as it was.
+func (device *Device) Handover(c *net.UnixConn) (err error) {
+	var msg handoverMessage
+	var files []*os.File
+
+	// Gather the files first, as they may not be handed over, before the
+	// device is frozen.
+
+	if f := device.tun.device.File(); f != nil {
+		msg.Files = append(msg.Files, "tun")
+		files = append(files, f)
+	}
+
+	device.net.RLock()
+	bind := device.net.bind
+	device.net.RUnlock()
+	if bind != nil {
+		fb, ok := bind.(conn.FileBind)
+		if !ok {
+			return errors.New("bind cannot be handed over")
+		}
+		ipv4, ipv6, err := fb.Files()
+		if err != nil {
+			return err
+		}
+		for _, f := range []struct {
+			name string
+			file *os.File
+		}{{"udp4", ipv4}, {"udp6", ipv6}} {
+			if f.file != nil {
+				defer f.file.Close()
+				msg.Files = append(msg.Files, f.name)
+				files = append(files, f.file)
+			}
+		}
+	}
+
+	// Once frozen, the device is thawed again if the state does not get
+	// out: the new process never takes over its sessions.
+	if !device.frozen.Get() {
+		defer func() {
+			if err != nil {
+				device.frozen.Set(false)
+			}
+		}()
+	}
+	msg.Snapshot, err = device.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(body)))
+	if _, _, err := c.WriteMsgUnix(header[:], oob, nil); err != nil {
+		return err
+	}
+	_, err = c.Write(body)
+	return err
+}
+
+// A Handover is the state of a device received by ReceiveHandover.
+type Handover struct {
+	Snapshot *Snapshot
+
+	// TUN is the device's TUN device, to be passed to
+	// tun.CreateTUNFromFile, or nil if it had none to hand over.
+	TUN *os.File
+
+	bind conn.Bind
+	port uint16
+}
+
+// ReceiveHandover receives the state sent over c by Device.Handover.
+// To carry on, create a device with the TUN device and with CreateBind
+// set to the Handover's, then Restore the Snapshot and bring it up.
+func ReceiveHandover(c *net.UnixConn) (*Handover, error) {
+	var header [4]byte
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	n, oobn, _, _, err := c.ReadMsgUnix(header[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	if oobn > 0 {
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		for i := range msgs {
+			rights, err := unix.ParseUnixRights(&msgs[i])
+			if err != nil {
+				return nil, err
+			}
+			fds = append(fds, rights...)
+		}
+	}
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		files[i] = os.NewFile(uintptr(fd), "handover")
+	}
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	if _, err := io.ReadFull(c, header[n:]); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(c, body); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	var msg handoverMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	if len(msg.Files) != len(files) || msg.Snapshot == nil {
+		closeFiles()
+		return nil, fmt.Errorf("invalid handover: %d files for %v", len(files), msg.Files)
+	}
+
+	h := &Handover{Snapshot: msg.Snapshot}
+	var ipv4, ipv6 *os.File
+	for i, name := range msg.Files {
+		switch name {
+		case "tun":
+			h.TUN = files[i]
+		case "udp4":
+			ipv4 = files[i]
+		case "udp6":
+			ipv6 = files[i]
+		}
+	}
+	if ipv4 != nil || ipv6 != nil {
+		h.bind, h.port, err = conn.CreateBindFromFiles(ipv4, ipv6)
+		if ipv4 != nil {
+			ipv4.Close()
+		}
+		if ipv6 != nil {
+			ipv6.Close()
+		}
+		if err != nil {
+			if h.TUN != nil {
+				h.TUN.Close()
+			}
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// CreateBind is for DeviceOptions.CreateBind. It returns the handed
+// over sockets the first time, whatever the port, and creates new ones
+// after that.
+func (h *Handover) CreateBind(port uint16) (conn.Bind, uint16, error) {
+	if bind := h.bind; bind != nil {
+		h.bind = nil
+		return bind, h.port, nil
+	}
+	return conn.CreateBind(port)
+}
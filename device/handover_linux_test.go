@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"golang.org/x/sys/unix"
+)
+
+func unixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+		t.Cleanup(func() { c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func TestHandover(t *testing.T) {
+	pair := genSnapshotTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	peer1 := pair[1].dev.Peers()[0]
+	handshake := peer1.LastHandshake()
+
+	oldConn, newConn := unixConnPair(t)
+	errc := make(chan error, 1)
+	go func() { errc <- pair[0].dev.Handover(oldConn) }()
+	h, err := ReceiveHandover(newConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if h.TUN != nil {
+		t.Error("handed over a TUN device the old device did not have")
+	}
+	if len(h.Snapshot.Peers) != 1 || h.Snapshot.Peers[0].Current == nil {
+		t.Fatalf("snapshot lacks the peer's session: %+v", h.Snapshot.Peers)
+	}
+
+	// The old device is left open, as its process would exit instead.
+	// The new device's cleanup, registered later, runs first.
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), &DeviceOptions{
+		Logger:     NewLogger(LogLevelDebug, "dev0': "),
+		CreateBind: h.CreateBind,
+	})
+	t.Cleanup(dev.Close)
+	if err := dev.Restore(h.Snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Restore(h.Snapshot); err == nil {
+		t.Error("Restore succeeded on a device that is up")
+	}
+	pair[0].dev, pair[0].tun = dev, tun
+
+	// The old device's receive routine may take one more datagram
+	// from the shared socket, and drop it, before it waits for a thaw
+	// that never comes, so allow for a loss.
+	for i, p := range []struct{ src, dst testPeer }{{pair[1], pair[0]}, {pair[0], pair[1]}} {
+		msg := tuntest.Ping(p.dst.ip, p.src.ip)
+		got := false
+		for attempt := 0; attempt < 3 && !got; attempt++ {
+			p.src.tun.Outbound <- msg
+			select {
+			case recv := <-p.dst.tun.Inbound:
+				if !bytes.Equal(recv, msg) {
+					t.Fatalf("packet %d did not transit correctly", i)
+				}
+				got = true
+			case <-time.After(time.Second):
+			}
+		}
+		if !got {
+			t.Fatalf("packet %d did not transit after the handover", i)
+		}
+	}
+
+	if !peer1.LastHandshake().Equal(handshake) {
+		t.Error("the session was not carried over; a new handshake was needed")
+	}
+}
+
+func TestHandoverFailureThaws(t *testing.T) {
+	pair := genSnapshotTestPair(t)
+	pair.Send(t, Ping, nil)
+
+	// Fill the connection, so that Handover blocks sending once it has
+	// frozen the device.
+	oldConn, newConn := unixConnPair(t)
+	oldConn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		if _, err := oldConn.Write(make([]byte, 1<<16)); err != nil {
+			break
+		}
+	}
+	oldConn.SetWriteDeadline(time.Time{})
+
+	errc := make(chan error, 1)
+	go func() { errc <- pair[0].dev.Handover(oldConn) }()
+	for !pair[0].dev.frozen.Get() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A datagram arriving while frozen is left, not taken in.
+	msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pair[1].tun.Outbound <- msg
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("frozen device received a packet")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	newConn.Close()
+	if err := <-errc; err == nil {
+		t.Fatal("Handover succeeded with no process to receive it")
+	}
+	if pair[0].dev.frozen.Get() {
+		t.Fatal("device left frozen by a failed Handover")
+	}
+
+	// The device receives again.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
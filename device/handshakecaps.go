@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync"
+)
+
+// HandshakeCaps limits how many handshake messages from one source may
+// wait in the handshake queue at once. The ratelimiter only starts once
+// the device is under load, and limits the rate of each address; many
+// initiators, each within its rate, can still fill the queue and keep
+// others' handshakes out. Messages over a cap are dropped as
+// DropHandshakeCap. A zero cap is no cap.
+type HandshakeCaps struct {
+	PerIP     int // from one address
+	PerPrefix int // from one /24 of IPv4 or /48 of IPv6
+}
+
+// The prefixes HandshakeCaps.PerPrefix counts messages in.
+const (
+	HandshakeCapPrefixIPv4 = 24
+	HandshakeCapPrefixIPv6 = 48
+)
+
+// handshakeCaps counts the handshake messages queued from each address
+// and prefix, for the caps to be enforced.
+type handshakeCaps struct {
+	caps HandshakeCaps
+
+	sync.Mutex
+	ip     map[[net.IPv6len]byte]int
+	prefix map[[net.IPv6len]byte]int
+}
+
+func (hc *handshakeCaps) enabled() bool {
+	return hc.caps.PerIP > 0 || hc.caps.PerPrefix > 0
+}
+
+// handshakeCapKeys returns the keys ip is counted under.
+func handshakeCapKeys(ip net.IP) (addr, prefix [net.IPv6len]byte) {
+	var mask net.IPMask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(HandshakeCapPrefixIPv4, 8*net.IPv4len)
+	} else {
+		mask = net.CIDRMask(HandshakeCapPrefixIPv6, 8*net.IPv6len)
+	}
+	copy(addr[:], ip.To16())
+	copy(prefix[:], ip.Mask(mask).To16())
+	return addr, prefix
+}
+
+// acquire counts a message from ip, reporting false without counting it
+// if that would exceed a cap.
+func (hc *handshakeCaps) acquire(ip net.IP) bool {
+	if !hc.enabled() {
+		return true
+	}
+	addr, prefix := handshakeCapKeys(ip)
+
+	hc.Lock()
+	defer hc.Unlock()
+	if hc.caps.PerIP > 0 && hc.ip[addr] >= hc.caps.PerIP {
+		return false
+	}
+	if hc.caps.PerPrefix > 0 && hc.prefix[prefix] >= hc.caps.PerPrefix {
+		return false
+	}
+	if hc.ip == nil {
+		hc.ip = make(map[[net.IPv6len]byte]int)
+		hc.prefix = make(map[[net.IPv6len]byte]int)
+	}
+	hc.ip[addr]++
+	hc.prefix[prefix]++
+	return true
+}
+
+// release uncounts a message from ip counted by acquire, once it has left
+// the handshake queue.
+func (hc *handshakeCaps) release(ip net.IP) {
+	if !hc.enabled() {
+		return
+	}
+	addr, prefix := handshakeCapKeys(ip)
+
+	hc.Lock()
+	defer hc.Unlock()
+	if hc.ip[addr]--; hc.ip[addr] <= 0 {
+		delete(hc.ip, addr)
+	}
+	if hc.prefix[prefix]--; hc.prefix[prefix] <= 0 {
+		delete(hc.prefix, prefix)
+	}
+}
@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandshakeCaps(t *testing.T) {
+	hc := handshakeCaps{caps: HandshakeCaps{PerIP: 2, PerPrefix: 3}}
+
+	acquire := func(ip string, want bool) {
+		t.Helper()
+		if got := hc.acquire(net.ParseIP(ip)); got != want {
+			t.Fatalf("acquire(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	acquire("192.0.2.1", true)
+	acquire("192.0.2.1", true)
+	acquire("192.0.2.1", false) // per IP
+	acquire("192.0.2.2", true)
+	acquire("192.0.2.3", false) // per /24
+	acquire("198.51.100.1", true)
+
+	hc.release(net.ParseIP("192.0.2.1"))
+	acquire("192.0.2.3", true)
+	acquire("::ffff:192.0.2.4", false) // the same /24, mapped
+
+	acquire("2001:db8:1::1", true)
+	acquire("2001:db8:1::2", true)
+	acquire("2001:db8:1:ffff::3", true)
+	acquire("2001:db8:1::4", false) // per /48
+	acquire("2001:db8:2::1", true)
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "198.51.100.1",
+		"2001:db8:1::1", "2001:db8:1::2", "2001:db8:1:ffff::3", "2001:db8:2::1"} {
+		hc.release(net.ParseIP(ip))
+	}
+	if len(hc.ip) != 0 || len(hc.prefix) != 0 {
+		t.Errorf("counts left after releasing all: %v, %v", hc.ip, hc.prefix)
+	}
+}
+
+func TestHandshakeCapsDisabled(t *testing.T) {
+	var hc handshakeCaps
+	for i := 0; i < 100; i++ {
+		if !hc.acquire(net.ParseIP("192.0.2.1")) {
+			t.Fatal("acquire refused without caps")
+		}
+	}
+	if hc.ip != nil {
+		t.Error("counted without caps")
+	}
+}
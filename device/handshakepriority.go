@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+/* When the handshake queue is full, handshake messages that involve a
+ * configured peer still get through, on a smaller priority queue that the
+ * handshake workers serve first, so that peers can rekey during a flood
+ * of initiations from unknown sources. A message is given priority if it
+ * passes MAC1 and either answers a handshake or cookie of ours, found by
+ * its receiver index, or comes from an address a handshake was completed
+ * from within RejectAfterTime. The rest are dropped as before.
+ */
+
+const (
+	messageResponseOffsetReceiver    = 8
+	messageCookieReplyOffsetReceiver = 4
+)
+
+// knownHandshakeSources are the addresses handshakes were recently
+// completed from.
+type knownHandshakeSources struct {
+	sync.Mutex
+	m map[[net.IPv6len]byte]time.Time
+}
+
+// noteHandshakeSource records that a handshake message from ip was
+// accepted.
+func (device *Device) noteHandshakeSource(ip net.IP) {
+	addr, _ := handshakeCapKeys(ip)
+	now := device.now()
+
+	ks := &device.handshakeSources
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.m == nil {
+		ks.m = make(map[[net.IPv6len]byte]time.Time)
+	}
+	if _, ok := ks.m[addr]; !ok && len(ks.m) >= MaxPeers {
+		for a, t := range ks.m {
+			if now.Sub(t) > RejectAfterTime {
+				delete(ks.m, a)
+			}
+		}
+		if len(ks.m) >= MaxPeers {
+			return
+		}
+	}
+	ks.m[addr] = now
+}
+
+// knownHandshakeSource reports whether a handshake was completed from ip
+// within RejectAfterTime.
+func (device *Device) knownHandshakeSource(ip net.IP) bool {
+	addr, _ := handshakeCapKeys(ip)
+
+	ks := &device.handshakeSources
+	ks.Lock()
+	t, ok := ks.m[addr]
+	ks.Unlock()
+	return ok && device.since(t) <= RejectAfterTime
+}
+
+// handshakePriority reports whether elem, which did not fit in the
+// handshake queue, may go on the priority queue.
+func (device *Device) handshakePriority(elem *QueueHandshakeElement) bool {
+	switch elem.msgType {
+	case MessageInitiationType:
+		if !device.knownHandshakeSource(elem.endpoint.DstIP()) {
+			return false
+		}
+	case MessageResponseType:
+		receiver := binary.LittleEndian.Uint32(elem.packet[messageResponseOffsetReceiver:])
+		if device.indexTable.Lookup(receiver).handshake == nil {
+			return false
+		}
+	case MessageCookieReplyType:
+		// Cookie replies have no MAC1; the receiver must be ours.
+		receiver := binary.LittleEndian.Uint32(elem.packet[messageCookieReplyOffsetReceiver:])
+		return device.indexTable.Lookup(receiver).peer != nil
+	default:
+		return false
+	}
+	return device.cookieChecker.CheckMAC1(elem.packet)
+}
@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+func TestHandshakePriority(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	if _, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey()); err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := dev1.CreateMessageInitiation(peer2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, msg)
+	packet := buf.Bytes()
+	peer2.cookieGenerator.AddMacs(packet)
+
+	known, err := conn.CreateEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := conn.CreateEndpoint("198.51.100.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev2.noteHandshakeSource(known.DstIP())
+
+	initiation := func(ep conn.Endpoint, packet []byte) *QueueHandshakeElement {
+		return &QueueHandshakeElement{msgType: MessageInitiationType, packet: packet, endpoint: ep}
+	}
+	if !dev2.handshakePriority(initiation(known, packet)) {
+		t.Error("initiation from a known source not given priority")
+	}
+	if dev2.handshakePriority(initiation(unknown, packet)) {
+		t.Error("initiation from an unknown source given priority")
+	}
+	bad := append([]byte(nil), packet...)
+	bad[len(bad)-2*16] ^= 1
+	if dev2.handshakePriority(initiation(known, bad)) {
+		t.Error("initiation with a bad MAC1 given priority")
+	}
+
+	// A response to dev1's initiation has priority on dev1, whatever its
+	// source; one to an index dev1 does not know does not.
+	response := make([]byte, MessageResponseSize)
+	binary.LittleEndian.PutUint32(response, MessageResponseType)
+	binary.LittleEndian.PutUint32(response[messageResponseOffsetReceiver:], msg.Sender)
+	dev1.staticIdentity.RLock()
+	var generator CookieGenerator
+	generator.Init(dev1.staticIdentity.publicKey)
+	dev1.staticIdentity.RUnlock()
+	generator.AddMacs(response)
+	elem := &QueueHandshakeElement{msgType: MessageResponseType, packet: response, endpoint: unknown}
+	if !dev1.handshakePriority(elem) {
+		t.Error("response to our initiation not given priority")
+	}
+	binary.LittleEndian.PutUint32(response[messageResponseOffsetReceiver:], msg.Sender+1)
+	generator.AddMacs(response)
+	if dev1.handshakePriority(elem) {
+		t.Error("response to an unknown index given priority")
+	}
+}
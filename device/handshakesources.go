@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// SetHandshakeSources restricts the addresses from which peer's handshake
+// initiations and responses are accepted to those within prefixes. Unlike
+// AllowedIPs, which govern the addresses inside the tunnel, these govern
+// the outer source address, for site-to-site links that only ever come
+// from known WAN addresses. Handshakes from elsewhere are dropped. An
+// empty prefixes accepts them from anywhere.
+//
+// Transport data is not checked: it can only come from a session
+// established by an accepted handshake.
+func (peer *Peer) SetHandshakeSources(prefixes []netaddr.IPPrefix) {
+	var sources []netaddr.IPPrefix
+	for _, prefix := range prefixes {
+		sources = append(sources, prefix.Masked())
+	}
+	peer.Lock()
+	peer.handshakeSources = sources
+	peer.Unlock()
+}
+
+// HandshakeSources returns the prefixes set by SetHandshakeSources.
+func (peer *Peer) HandshakeSources() []netaddr.IPPrefix {
+	peer.RLock()
+	defer peer.RUnlock()
+	return append([]netaddr.IPPrefix(nil), peer.handshakeSources...)
+}
+
+func joinPrefixes(prefixes []netaddr.IPPrefix) string {
+	s := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		s[i] = prefix.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// handshakeSourceAllowed reports whether a handshake from ip is accepted
+// for peer.
+func (peer *Peer) handshakeSourceAllowed(ip net.IP) bool {
+	peer.RLock()
+	defer peer.RUnlock()
+	if len(peer.handshakeSources) == 0 {
+		return true
+	}
+	addr, ok := netaddr.FromStdIP(ip)
+	if !ok {
+		return false
+	}
+	for _, prefix := range peer.handshakeSources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
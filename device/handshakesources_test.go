@@ -0,0 +1,46 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"inet.af/netaddr"
+)
+
+func TestHandshakeSources(t *testing.T) {
+	pair := genTestPair(t)
+	peer0 := pair[0].dev.Peers()[0]
+	elsewhere := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.1/24")}
+	peer0.SetHandshakeSources(elsewhere)
+
+	// dev1's initiations come from loopback, so dev0 drops them.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	waitFor(t, "the initiation to be dropped", func() bool {
+		return pair[0].dev.DropCounts()[DropHandshakeSource] > 0
+	})
+	if peer0.keypairs.Current() != nil {
+		t.Fatal("session established from a disallowed source")
+	}
+
+	cfg, err := pair[0].dev.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")}
+	if got := cfg.Peers[0].HandshakeSources; !reflect.DeepEqual(got, want) {
+		t.Errorf("Config HandshakeSources = %v, want %v", got, want)
+	}
+
+	peer0.SetHandshakeSources(append(elsewhere, netaddr.MustParseIPPrefix("127.0.0.0/8")))
+	pair.Send(t, Ping, nil)
+	peer0.SetHandshakeSources(nil)
+	if got := peer0.HandshakeSources(); len(got) != 0 {
+		t.Errorf("HandshakeSources() = %v after clearing", got)
+	}
+}
@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// genImpairedPair creates a simulated testPair whose pair[1] sends
+// through an ImpairedBind with imp.
+func genImpairedPair(t *testing.T, imp bindtest.Impairments) (testPair, *bindtest.ImpairedBind) {
+	impaired := make(chan *bindtest.ImpairedBind, 1)
+	pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+		if i != 1 {
+			return
+		}
+		create := opts.CreateBind
+		opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := create(port)
+			if err != nil {
+				return nil, 0, err
+			}
+			b := bindtest.Impair(bind, imp)
+			select {
+			case impaired <- b:
+			default:
+			}
+			return b, port, nil
+		}
+	})
+	return pair, <-impaired
+}
+
+func TestImpairedDuplicates(t *testing.T) {
+	pair, bind := genImpairedPair(t, bindtest.Impairments{Duplicate: 1})
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Ping, nil)
+	waitFor(t, "duplicates to be dropped", func() bool {
+		return pair[0].dev.DropCounts()[DropReplayed] > 0
+	})
+	if bind.Stats().Duplicated == 0 {
+		t.Error("nothing duplicated")
+	}
+}
+
+func TestImpairedReorder(t *testing.T) {
+	pair, bind := genImpairedPair(t, bindtest.Impairments{
+		Reorder:      0.5,
+		ReorderDelay: 5 * time.Millisecond,
+		Seed:         1,
+	})
+	pair.Send(t, Ping, nil)
+
+	// Send a burst without waiting, for the reordered packets to be
+	// overtaken; all arrive, within the replay window.
+	const burst = 20
+	go func() {
+		for i := 0; i < burst; i++ {
+			pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+		}
+	}()
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < burst; i++ {
+		select {
+		case <-pair[0].tun.Inbound:
+		case <-timeout:
+			t.Fatalf("%d of %d packets arrived", i, burst)
+		}
+	}
+	if bind.Stats().Reordered == 0 {
+		t.Error("nothing reordered")
+	}
+	if n := pair[0].dev.DropCounts()[DropReplayed]; n != 0 {
+		t.Errorf("%d reordered packets dropped as replays", n)
+	}
+}
+
+func TestImpairedMTU(t *testing.T) {
+	pair, bind := genImpairedPair(t, bindtest.Impairments{MTU: MessageInitiationSize - 1})
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	waitFor(t, "the initiation to be dropped", func() bool {
+		return bind.Stats().TooBig > 0
+	})
+	if peer := pair[0].dev.Peers()[0]; peer.keypairs.Current() != nil {
+		t.Error("session established over a path too small for an initiation")
+	}
+}
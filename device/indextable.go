@@ -6,9 +6,10 @@
 package device
 
 import (
-	"crypto/rand"
 	"encoding/binary"
+	"io"
 	"sync"
+	"sync/atomic"
 )
 
 type IndexTableEntry struct {
@@ -17,82 +18,164 @@ type IndexTableEntry struct {
 	keypair   *Keypair
 }
 
+/* The table is split into shards, each under its own lock, by the low bits
+ * of the index. Indices are random, so the shards fill evenly, and a
+ * server handling many handshakes at once does not serialize them on one
+ * lock.
+ */
+
+const indexTableShards = 64 // a power of two
+
 type IndexTable struct {
+	shards [indexTableShards]indexTableShard
+}
+
+type indexTableShard struct {
 	sync.RWMutex
 	table map[uint32]IndexTableEntry
 }
 
-func randUint32() (uint32, error) {
+func (table *IndexTable) shard(index uint32) *indexTableShard {
+	return &table.shards[index&(indexTableShards-1)]
+}
+
+func randUint32(r io.Reader) (uint32, error) {
 	var integer [4]byte
-	_, err := rand.Read(integer[:])
+	_, err := io.ReadFull(r, integer[:])
 	// Arbitrary endianness; both are intrinsified by the Go compiler.
 	return binary.LittleEndian.Uint32(integer[:]), err
 }
 
 func (table *IndexTable) Init() {
-	table.Lock()
-	defer table.Unlock()
-	table.table = make(map[uint32]IndexTableEntry)
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.Lock()
+		shard.table = make(map[uint32]IndexTableEntry)
+		shard.Unlock()
+	}
 }
 
 func (table *IndexTable) Delete(index uint32) {
-	table.Lock()
-	defer table.Unlock()
-	delete(table.table, index)
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.table, index)
 }
 
 func (table *IndexTable) SwapIndexForKeypair(index uint32, keypair *Keypair) {
-	table.Lock()
-	defer table.Unlock()
-	entry, ok := table.table[index]
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	entry, ok := shard.table[index]
 	if !ok {
 		return
 	}
-	table.table[index] = IndexTableEntry{
+	shard.table[index] = IndexTableEntry{
 		peer:      entry.peer,
 		keypair:   keypair,
 		handshake: nil,
 	}
 }
 
+// insertKeypair adds keypair of peer at index, as Restore does for
+// sessions carried over from another process. It reports false if the
+// index is in use.
+func (table *IndexTable) insertKeypair(index uint32, peer *Peer, keypair *Keypair) bool {
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	if _, ok := shard.table[index]; ok {
+		atomic.AddUint64(&peer.device.stats.indexCollisions, 1)
+		return false
+	}
+	shard.table[index] = IndexTableEntry{
+		peer:    peer,
+		keypair: keypair,
+	}
+	return true
+}
+
 func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake) (uint32, error) {
 	for {
 		// generate random index
 
-		index, err := randUint32()
+		index, err := randUint32(peer.device.rand)
 		if err != nil {
 			return index, err
 		}
+		shard := table.shard(index)
 
 		// check if index used
 
-		table.RLock()
-		_, ok := table.table[index]
-		table.RUnlock()
+		shard.RLock()
+		_, ok := shard.table[index]
+		shard.RUnlock()
 		if ok {
+			atomic.AddUint64(&peer.device.stats.indexCollisions, 1)
 			continue
 		}
 
 		// check again while locked
 
-		table.Lock()
-		_, found := table.table[index]
+		shard.Lock()
+		_, found := shard.table[index]
 		if found {
-			table.Unlock()
+			shard.Unlock()
+			atomic.AddUint64(&peer.device.stats.indexCollisions, 1)
 			continue
 		}
-		table.table[index] = IndexTableEntry{
+		shard.table[index] = IndexTableEntry{
 			peer:      peer,
 			handshake: handshake,
 			keypair:   nil,
 		}
-		table.Unlock()
+		shard.Unlock()
 		return index, nil
 	}
 }
 
 func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
-	table.RLock()
-	defer table.RUnlock()
-	return table.table[id]
+	shard := table.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.table[id]
+}
+
+// IndexTableStats describes how full a device's index table is.
+type IndexTableStats struct {
+	Handshakes int // indices of handshakes in progress
+	Keypairs   int // indices of sessions
+
+	// MaxShard is the number of indices in the fullest of the table's
+	// shards, each of which holds about 1/64 of them.
+	MaxShard int
+
+	// Collisions is the number of random indices drawn that were
+	// already in use, and so drawn again.
+	Collisions uint64
+}
+
+// IndexTableStats returns how many receiver indices the device has in use,
+// how evenly they are spread, and how often new ones collided with them.
+func (device *Device) IndexTableStats() IndexTableStats {
+	table := &device.indexTable
+	st := IndexTableStats{
+		Collisions: atomic.LoadUint64(&device.stats.indexCollisions),
+	}
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.RLock()
+		for _, entry := range shard.table {
+			if entry.keypair != nil {
+				st.Keypairs++
+			} else {
+				st.Handshakes++
+			}
+		}
+		if n := len(shard.table); n > st.MaxShard {
+			st.MaxShard = n
+		}
+		shard.RUnlock()
+	}
+	return st
 }
@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIndexTable(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &dev.indexTable
+
+	// Draw the same index twice, then another in a different shard.
+	dev.rand = bytes.NewReader([]byte{
+		1, 0, 0, 0,
+		1, 0, 0, 0,
+		2, 0, 0, 0,
+	})
+	before := dev.IndexTableStats()
+	first, err := table.NewIndexForHandshake(peer, &peer.handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := table.NewIndexForHandshake(peer, &peer.handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 || second != 2 {
+		t.Fatalf("indices %d, %d; want 1, 2", first, second)
+	}
+
+	keypair := new(Keypair)
+	table.SwapIndexForKeypair(second, keypair)
+	if entry := table.Lookup(second); entry.keypair != keypair || entry.peer != peer {
+		t.Errorf("swapped entry %+v", entry)
+	}
+	if table.insertKeypair(first, peer, keypair) {
+		t.Error("inserted a keypair at an index in use")
+	}
+
+	st := dev.IndexTableStats()
+	if got := st.Handshakes - before.Handshakes; got != 1 {
+		t.Errorf("%d new handshake indices, want 1", got)
+	}
+	if got := st.Keypairs - before.Keypairs; got != 1 {
+		t.Errorf("%d new keypair indices, want 1", got)
+	}
+	if got := st.Collisions - before.Collisions; got != 2 {
+		t.Errorf("%d collisions, want 2", got)
+	}
+
+	table.Delete(first)
+	if entry := table.Lookup(first); entry.peer != nil {
+		t.Errorf("deleted index still maps to %+v", entry)
+	}
+}
+
+func BenchmarkIndexTableParallel(b *testing.B) {
+	dev := NewDevice(newDummyTUN("dummy"), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, ""),
+	})
+	defer dev.Close()
+	sk, _ := newPrivateKey()
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		b.Fatal(err)
+	}
+	table := &dev.indexTable
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			index, err := table.NewIndexForHandshake(peer, &peer.handshake)
+			if err != nil {
+				b.Fatal(err)
+			}
+			table.Lookup(index)
+			table.Delete(index)
+		}
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"unsafe"
 
 	"github.com/tailscale/wireguard-go/replay"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 /* Due to limitations in Go and /x/crypto there is currently
@@ -26,11 +27,17 @@ type Keypair struct {
 	sendNonce    uint64 // accessed atomically
 	send         cipher.AEAD
 	receive      cipher.AEAD
+	replayMutex  sync.Mutex // guards replayFilter against Snapshot
 	replayFilter replay.Filter
 	isInitiator  bool
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
+
+	// The keys of send and receive, kept only if the device takes
+	// Snapshots, so that it can hand the session over.
+	sendKey    [chacha20poly1305.KeySize]byte
+	receiveKey [chacha20poly1305.KeySize]byte
 }
 
 type Keypairs struct {
@@ -57,5 +64,7 @@ func (kp *Keypairs) Current() *Keypair {
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
 		device.indexTable.Delete(key.localIndex)
+		setZero(key.sendKey[:])
+		setZero(key.receiveKey[:])
 	}
 }
@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// elementLeaks tracks the queue elements taken from the device's pools
+// and not yet returned, for DeviceOptions.LeakCheck.
+type elementLeaks struct {
+	after time.Duration // zero if not tracking
+	sync.Mutex
+	held map[interface{}]*elementHold
+}
+
+type elementHold struct {
+	since    time.Time
+	stack    []uintptr
+	reported bool
+}
+
+// trackElement records elem as taken, with the stack above its caller
+// and skip more frames.
+func (device *Device) trackElement(elem interface{}, skip int) {
+	leaks := &device.pool.leaks
+	if leaks.after == 0 {
+		return
+	}
+	var pcs [32]uintptr
+	n := runtime.Callers(2+skip, pcs[:])
+	hold := &elementHold{since: device.now(), stack: pcs[:n:n]}
+	leaks.Lock()
+	leaks.held[elem] = hold
+	leaks.Unlock()
+}
+
+// untrackElement records elem as returned.
+func (device *Device) untrackElement(elem interface{}) {
+	leaks := &device.pool.leaks
+	if leaks.after == 0 {
+		return
+	}
+	leaks.Lock()
+	delete(leaks.held, elem)
+	leaks.Unlock()
+}
+
+// checkLeaks logs each element held for longer than DeviceOptions.LeakCheck
+// that it has not logged before, with the stack that took it, and
+// returns how many it logged.
+func (device *Device) checkLeaks() int {
+	leaks := &device.pool.leaks
+	now := device.now()
+	var reports []string
+	leaks.Lock()
+	for elem, hold := range leaks.held {
+		if hold.reported || now.Sub(hold.since) < leaks.after {
+			continue
+		}
+		hold.reported = true
+		var b strings.Builder
+		fmt.Fprintf(&b, "%T held for %v, taken at:", elem, now.Sub(hold.since).Round(time.Second))
+		frames := runtime.CallersFrames(hold.stack)
+		for {
+			frame, more := frames.Next()
+			fmt.Fprintf(&b, "\n\t%s\n\t\t%s:%d", frame.Function, frame.File, frame.Line)
+			if !more {
+				break
+			}
+		}
+		reports = append(reports, b.String())
+	}
+	leaks.Unlock()
+	for _, report := range reports {
+		device.log.Error.Println("Possible leak:", report)
+	}
+	return len(reports)
+}
+
+func (device *Device) RoutineCheckLeaks() {
+	ticker := time.NewTicker(device.pool.leaks.after / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+		}
+		device.checkLeaks()
+	}
+}
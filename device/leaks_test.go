@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakCheck(t *testing.T) {
+	const after = 2 * time.Minute
+	clock := NewManualClock(time.Unix(1e9, 0))
+	pair := genSimPairWithOptions(t, clock, 1, func(i int, opts *DeviceOptions) {
+		opts.LeakCheck = after
+	})
+	for i := 0; i < 16; i++ {
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+	}
+	dev := pair[0].dev
+
+	leaked := dev.NewOutboundElement()
+	step(clock, after+time.Second, time.Second)
+	pair.Send(t, Ping, nil)
+	if n := dev.checkLeaks(); n != 1 {
+		t.Fatalf("%d leaks reported, want 1", n)
+	}
+	if n := dev.checkLeaks(); n != 0 {
+		t.Errorf("%d leaks reported again, want 0", n)
+	}
+
+	dev.pool.leaks.Lock()
+	hold := dev.pool.leaks.held[leaked]
+	dev.pool.leaks.Unlock()
+	if hold == nil {
+		t.Fatal("leaked element not tracked")
+	}
+	var funcs []string
+	frames := runtime.CallersFrames(hold.stack)
+	for {
+		frame, more := frames.Next()
+		funcs = append(funcs, frame.Function)
+		if !more {
+			break
+		}
+	}
+	if len(funcs) < 2 || !strings.HasSuffix(funcs[0], ".NewOutboundElement") || !strings.HasSuffix(funcs[1], ".TestLeakCheck") {
+		t.Errorf("taken at %v, want NewOutboundElement from TestLeakCheck", funcs)
+	}
+
+	dev.PutMessageBuffer(leaked.buffer)
+	dev.PutOutboundElement(leaked)
+	step(clock, after+time.Second, time.Second)
+	if n := dev.checkLeaks(); n != 0 {
+		t.Errorf("%d leaks reported after the element was returned, want 0", n)
+	}
+}
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// linkLocalAddr returns an IPv6 link-local address of an interface that
+// is up, with the interface's name.
+func linkLocalAddr(t *testing.T) (net.IP, string) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.To4() == nil && ipn.IP.IsLinkLocalUnicast() {
+				return ipn.IP, iface.Name
+			}
+		}
+	}
+	t.Skip("no interface with an IPv6 link-local address")
+	return nil, ""
+}
+
+func TestLinkLocalEndpoint(t *testing.T) {
+	ip, zone := linkLocalAddr(t)
+	pair := genTestPair(t)
+	for i := range pair {
+		other := pair[1-i].dev
+		endpoint := net.JoinHostPort(ip.String()+"%"+zone, strconv.Itoa(int(other.net.port)))
+		if err := pair[i].dev.IpcSetOperation(uapiCfg(
+			"public_key", other.staticIdentity.publicKey.ToHex(),
+			"endpoint", endpoint,
+		)); err != nil {
+			t.Fatal(err)
+		}
+		if cfg := pair[i].dev.Config(); cfg.Peers[0].Endpoints != endpoint {
+			t.Errorf("device %d reports endpoint %q, want %q", i, cfg.Peers[0].Endpoints, endpoint)
+		}
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// The endpoints learnt from the peers' packets keep the zone.
+	for i := range pair {
+		peer := pair[i].dev.Peers()[0]
+		addr, err := net.ResolveUDPAddr("udp", peer.Endpoint().DstToString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addr.IP.Equal(ip) || addr.Zone != zone {
+			t.Errorf("device %d has endpoint %v, want %v%%%s", i, addr, ip, zone)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+)
+
+/* The device's locks are acquired in order: device.state, device.net,
+ * device.staticIdentity, device.peers and then the locks of peers. A
+ * goroutine holding one of them must not wait for one earlier in that
+ * order, lest it deadlock against a goroutine taking them the right way
+ * round.
+ *
+ * Lock order mode checks this as the locks are taken. It is built with
+ * the lockorder tag:
+ *
+ *	go test -tags lockorder ./...
+ *
+ * and records, for each goroutine, the ranked locks it holds and where it
+ * took them. Taking a lock ranked before one already held, or taking a
+ * lock the goroutine already holds, panics with the stacks of both
+ * acquisitions. Without the tag the checks compile away.
+ */
+
+// A lockRank is the place of a lock in the order locks are acquired in.
+// Locks of equal rank, such as those of two peers, may be held together.
+type lockRank uint8
+
+const (
+	lockRankNone lockRank = iota // not checked
+	lockRankState
+	lockRankNet
+	lockRankStaticIdentity
+	lockRankPeers
+	lockRankPeer
+
+	numLockRanks
+)
+
+var lockRankNames = [numLockRanks]string{
+	lockRankNone:           "unranked",
+	lockRankState:          "device.state",
+	lockRankNet:            "device.net",
+	lockRankStaticIdentity: "device.staticIdentity",
+	lockRankPeers:          "device.peers",
+	lockRankPeer:           "peer",
+}
+
+func (r lockRank) String() string {
+	if r < numLockRanks {
+		return lockRankNames[r]
+	}
+	return "unknown"
+}
+
+// A rankedRWMutex is a sync.RWMutex whose acquisitions are checked
+// against the lock order in lock order mode. Its zero value is unranked,
+// and is not checked.
+type rankedRWMutex struct {
+	sync.RWMutex
+	rank lockRank
+}
+
+func (m *rankedRWMutex) Lock() {
+	if lockOrderEnabled {
+		lockOrderAcquire(m, m.rank)
+	}
+	m.RWMutex.Lock()
+}
+
+func (m *rankedRWMutex) Unlock() {
+	m.RWMutex.Unlock()
+	if lockOrderEnabled {
+		lockOrderRelease(m)
+	}
+}
+
+func (m *rankedRWMutex) RLock() {
+	if lockOrderEnabled {
+		lockOrderAcquire(m, m.rank)
+	}
+	m.RWMutex.RLock()
+}
+
+func (m *rankedRWMutex) RUnlock() {
+	m.RWMutex.RUnlock()
+	if lockOrderEnabled {
+		lockOrderRelease(m)
+	}
+}
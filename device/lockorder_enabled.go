@@ -0,0 +1,114 @@
+// +build lockorder
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// lockOrderEnabled reports whether the lockorder tag was given. Checks
+// are guarded by it so that they compile away without the tag.
+const lockOrderEnabled = true
+
+// A heldLock is a ranked lock a goroutine holds.
+type heldLock struct {
+	m     interface{}
+	rank  lockRank
+	stack []byte // where it was acquired
+}
+
+var lockOrder struct {
+	sync.Mutex
+	held map[uint64][]heldLock // by goroutine
+}
+
+// goroutineID returns the id of the calling goroutine, as runtime.Stack
+// prints it. It is slow, but lock order mode is for debugging.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		panic("lockorder: cannot parse goroutine id: " + err.Error())
+	}
+	return id
+}
+
+// lockOrderAcquire is called before the calling goroutine waits for m,
+// of the given rank. It panics if the goroutine holds m already or holds
+// a lock ranked after m; otherwise it records m as held.
+func lockOrderAcquire(m interface{}, rank lockRank) {
+	if rank == lockRankNone {
+		return
+	}
+	g := goroutineID()
+	stack := debug.Stack()
+
+	lockOrder.Lock()
+	defer lockOrder.Unlock()
+	for _, h := range lockOrder.held[g] {
+		switch {
+		case h.m == m:
+			panic(fmt.Sprintf("lockorder: acquiring %v lock already held\n\nheld since:\n%s\nacquiring at:\n%s",
+				rank, h.stack, stack))
+		case h.rank > rank:
+			panic(fmt.Sprintf("lockorder: acquiring %v lock while holding %v lock\n\nheld since:\n%s\nacquiring at:\n%s",
+				rank, h.rank, h.stack, stack))
+		}
+	}
+	if lockOrder.held == nil {
+		lockOrder.held = make(map[uint64][]heldLock)
+	}
+	lockOrder.held[g] = append(lockOrder.held[g], heldLock{m: m, rank: rank, stack: stack})
+}
+
+// lockOrderRelease is called once m is unlocked. sync allows a lock to be
+// unlocked by a goroutine other than the one that locked it, so if the
+// caller does not hold m the other holders are searched.
+func lockOrderRelease(m interface{}) {
+	g := goroutineID()
+
+	lockOrder.Lock()
+	defer lockOrder.Unlock()
+	if lockOrderForget(g, m) {
+		return
+	}
+	for other := range lockOrder.held {
+		if lockOrderForget(other, m) {
+			return
+		}
+	}
+}
+
+// lockOrderForget removes the latest record of goroutine g holding m, and
+// reports whether there was one.
+func lockOrderForget(g uint64, m interface{}) bool {
+	held := lockOrder.held[g]
+	for i := len(held) - 1; i >= 0; i-- {
+		if held[i].m != m {
+			continue
+		}
+		held = append(held[:i], held[i+1:]...)
+		if len(held) == 0 {
+			delete(lockOrder.held, g)
+		} else {
+			lockOrder.held[g] = held
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+// +build lockorder
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+)
+
+// mustPanic calls f and returns what it panicked with, failing t if it
+// did not.
+func mustPanic(t *testing.T, f func()) (msg string) {
+	t.Helper()
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("no panic")
+		}
+		msg, _ = r.(string)
+	}()
+	f()
+	return ""
+}
+
+func TestLockOrderInOrder(t *testing.T) {
+	var state ctxMutex
+	state.rank = lockRankState
+	net := rankedRWMutex{rank: lockRankNet}
+	peers := rankedRWMutex{rank: lockRankPeers}
+	a := rankedRWMutex{rank: lockRankPeer}
+	b := rankedRWMutex{rank: lockRankPeer}
+
+	state.Lock()
+	net.RLock()
+	peers.Lock()
+	a.Lock()
+	b.RLock() // locks of equal rank may be held together
+	b.RUnlock()
+	a.Unlock()
+	peers.Unlock()
+	net.RUnlock()
+	state.Unlock()
+
+	// Released locks may be taken again, in any order.
+	peers.Lock()
+	peers.Unlock()
+	net.Lock()
+	net.Unlock()
+}
+
+func TestLockOrderViolation(t *testing.T) {
+	net := rankedRWMutex{rank: lockRankNet}
+	peers := rankedRWMutex{rank: lockRankPeers}
+
+	peers.RLock()
+	msg := mustPanic(t, net.Lock)
+	peers.RUnlock()
+	if !strings.Contains(msg, "acquiring device.net lock while holding device.peers lock") {
+		t.Errorf("panic %q does not name the locks", msg)
+	}
+	if !strings.Contains(msg, "TestLockOrderViolation") {
+		t.Errorf("panic %q has no stacks", msg)
+	}
+
+	// The failed acquisition is not recorded.
+	net.Lock()
+	net.Unlock()
+}
+
+func TestLockOrderRecursive(t *testing.T) {
+	peer := rankedRWMutex{rank: lockRankPeer}
+	peer.RLock()
+	msg := mustPanic(t, peer.RLock)
+	peer.RUnlock()
+	if !strings.Contains(msg, "acquiring peer lock already held") {
+		t.Errorf("panic %q does not name the lock", msg)
+	}
+}
+
+func TestLockOrderUnranked(t *testing.T) {
+	var unranked rankedRWMutex
+	peers := rankedRWMutex{rank: lockRankPeers}
+	peers.Lock()
+	unranked.Lock()
+	unranked.Unlock()
+	peers.Unlock()
+}
+
+// TestLockOrderHandoff unlocks a lock in a goroutine other than the one
+// that locked it, as sync allows, and checks that it is forgotten.
+func TestLockOrderHandoff(t *testing.T) {
+	net := rankedRWMutex{rank: lockRankNet}
+	peers := rankedRWMutex{rank: lockRankPeers}
+	peers.Lock()
+	done := make(chan struct{})
+	go func() {
+		peers.Unlock()
+		close(done)
+	}()
+	<-done
+	net.Lock()
+	net.Unlock()
+}
+
+// TestLockOrderDevice runs a pair of devices through a handshake and
+// reconfiguration with the device's own locks ranked.
+func TestLockOrderDevice(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	for i := range pair {
+		if err := pair[i].dev.Down(); err != nil {
+			t.Fatal(err)
+		}
+		if err := pair[i].dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pair.Send(t, Ping, nil)
+}
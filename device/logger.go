@@ -6,6 +6,7 @@
 package device
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -29,18 +30,7 @@ func NewLogger(level int, prepend string) *Logger {
 	output := os.Stdout
 	logger := new(Logger)
 
-	logErr, logInfo, logDebug := func() (io.Writer, io.Writer, io.Writer) {
-		if level >= LogLevelDebug {
-			return output, output, output
-		}
-		if level >= LogLevelInfo {
-			return output, output, ioutil.Discard
-		}
-		if level >= LogLevelError {
-			return output, ioutil.Discard, ioutil.Discard
-		}
-		return ioutil.Discard, ioutil.Discard, ioutil.Discard
-	}()
+	logErr, logInfo, logDebug := levelWriters(level, output)
 
 	logger.Debug = log.New(logDebug,
 		"DEBUG: "+prepend,
@@ -57,3 +47,102 @@ func NewLogger(level int, prepend string) *Logger {
 	)
 	return logger
 }
+
+// levelWriters returns the writers of the error, info and debug logs
+// of a logger at level writing to output.
+func levelWriters(level int, output io.Writer) (io.Writer, io.Writer, io.Writer) {
+	if level >= LogLevelDebug {
+		return output, output, output
+	}
+	if level >= LogLevelInfo {
+		return output, output, ioutil.Discard
+	}
+	if level >= LogLevelError {
+		return output, ioutil.Discard, ioutil.Discard
+	}
+	return ioutil.Discard, ioutil.Discard, ioutil.Discard
+}
+
+var logLevelNames = []string{
+	LogLevelSilent: "silent",
+	LogLevelError:  "error",
+	LogLevelInfo:   "info",
+	LogLevelDebug:  "debug",
+}
+
+// ParseLogLevel parses the name of a log level: "silent", "error",
+// "info" or "debug".
+func ParseLogLevel(s string) (int, error) {
+	for level, name := range logLevelNames {
+		if s == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// level returns the level the logger was made with and where it writes,
+// judging by which of its logs are discarded. A silent logger is taken
+// to write to os.Stdout, as NewLogger's do.
+func (logger *Logger) level() (int, io.Writer) {
+	for _, l := range []struct {
+		level int
+		log   *log.Logger
+	}{
+		{LogLevelDebug, logger.Debug},
+		{LogLevelInfo, logger.Info},
+		{LogLevelError, logger.Error},
+	} {
+		if w := l.log.Writer(); w != ioutil.Discard {
+			return l.level, w
+		}
+	}
+	return LogLevelSilent, os.Stdout
+}
+
+// SetLogLevel changes the level of the device's logger, as passed to
+// NewLogger, while the device runs. The logger is changed in place, so
+// other devices sharing it are affected too.
+func (device *Device) SetLogLevel(level int) error {
+	if level < LogLevelSilent || level > LogLevelDebug {
+		return fmt.Errorf("invalid log level %d", level)
+	}
+	device.logging.Lock()
+	defer device.logging.Unlock()
+	output := device.logging.output
+	if output == nil {
+		_, output = device.log.level()
+	}
+	device.setLogWriters(level, output)
+	return nil
+}
+
+// SetLogOutput redirects the device's logger to w, keeping its level.
+// Lines being written when it is called go to the old or the new
+// output, but are never lost or interleaved.
+func (device *Device) SetLogOutput(w io.Writer) {
+	device.logging.Lock()
+	defer device.logging.Unlock()
+	level, _ := device.log.level()
+	device.setLogWriters(level, w)
+}
+
+// LogLevel returns the level of the device's logger.
+func (device *Device) LogLevel() int {
+	device.logging.Lock()
+	defer device.logging.Unlock()
+	level, _ := device.log.level()
+	return level
+}
+
+// setLogWriters points the device's logs at the writers for level, and
+// remembers output for when the level is raised again from silent.
+// The loggers' own locks make this safe while they are in use.
+// It must be called with device.logging locked.
+func (device *Device) setLogWriters(level int, output io.Writer) {
+	device.logging.output = output
+	logErr, logInfo, logDebug := levelWriters(level, output)
+	device.log.Error.SetOutput(logErr)
+	device.log.Info.SetOutput(logInfo)
+	device.log.Debug.SetOutput(logDebug)
+}
@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestSetLogLevel(t *testing.T) {
+	dev := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, ""),
+	})
+	defer dev.Close()
+
+	out := new(lockedBuffer)
+	dev.SetLogOutput(out)
+	if level := dev.LogLevel(); level != LogLevelError {
+		t.Fatalf("level %d, want %d", level, LogLevelError)
+	}
+	dev.log.Info.Println("hidden")
+	dev.log.Error.Println("shown 1")
+
+	if err := dev.IpcSetOperation(uapiCfg("log_level", "info")); err != nil {
+		t.Fatal(err)
+	}
+	if level := dev.LogLevel(); level != LogLevelInfo {
+		t.Fatalf("level %d, want %d", level, LogLevelInfo)
+	}
+	dev.log.Info.Println("shown 2")
+	dev.log.Debug.Println("hidden")
+
+	// Going silent and back must not lose the output.
+	if err := dev.SetLogLevel(LogLevelSilent); err != nil {
+		t.Fatal(err)
+	}
+	dev.log.Error.Println("hidden")
+	if err := dev.IpcSetOperation(uapiCfg("log_level", "debug")); err != nil {
+		t.Fatal(err)
+	}
+	dev.log.Debug.Println("shown 3")
+
+	got := out.String()
+	for _, s := range []string{"shown 1", "shown 2", "shown 3"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("output lacks %q:\n%s", s, got)
+		}
+	}
+	if strings.Contains(got, "hidden") {
+		t.Errorf("output has lines above the level:\n%s", got)
+	}
+
+	if err := dev.IpcSetOperation(uapiCfg("log_level", "loud")); err == nil {
+		t.Error("invalid log_level accepted")
+	}
+	if err := dev.SetLogLevel(LogLevelDebug + 1); err == nil {
+		t.Error("invalid level accepted")
+	}
+}
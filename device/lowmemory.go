@@ -0,0 +1,42 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+/* A Network Extension on iOS or macOS is killed once it uses more than
+ * its memory limit, as little as 15MB, of which the Go runtime and the
+ * embedding app take their share. The ios build tag shrinks the device
+ * to fit, but only at compile time and only for iOS; the low-memory
+ * profile does the same for any device that asks for it.
+ */
+
+const (
+	// LowMemoryQueueSize is the size of each of the queues of a device
+	// with DeviceOptions.LowMemory.
+	LowMemoryQueueSize = 64
+
+	// LowMemoryBuffers is the number of message buffers, and of each
+	// kind of queue element, a device with DeviceOptions.LowMemory
+	// allocates. It allocates them up front and never more, so that its
+	// packet buffers take LowMemoryBuffers*MessageBufferSize(mtu) bytes:
+	// 128KiB at the default MTU.
+	LowMemoryBuffers = 64
+)
+
+// lowMemory applies the low-memory profile to the device's sizes and any
+// worker counts not given.
+func (device *Device) lowMemory() {
+	device.sizes.queueOutbound = LowMemoryQueueSize
+	device.sizes.queueInbound = LowMemoryQueueSize
+	device.sizes.queueHandshake = LowMemoryQueueSize
+	device.pool.config = Pools{Mode: PoolBounded, Size: LowMemoryBuffers}
+
+	workers := &device.workers.Workers
+	for _, n := range []*int{&workers.Encryption, &workers.Decryption, &workers.Handshake} {
+		if *n <= 0 {
+			*n = 1
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"testing"
+)
+
+func heapAlloc() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
+
+func TestLowMemory(t *testing.T) {
+	before := heapAlloc()
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.LowMemory = true
+		opts.Logger = NewLogger(LogLevelError, "")
+	})
+	for i := 0; i < 4*LowMemoryQueueSize; i++ {
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+	}
+
+	// The packet buffers, allocated up front, and a megabyte for the
+	// rest of each device.
+	const ceiling = LowMemoryBuffers*MaxMessageSize + 1<<20
+	if used := heapAlloc() - before; used > 2*ceiling {
+		t.Errorf("pair of devices uses %d bytes, want at most %d", used, 2*ceiling)
+	}
+
+	dev := pair[0].dev
+	if got := cap(dev.pool.messageBufferReuseChan); got != LowMemoryBuffers {
+		t.Errorf("%d message buffers, want %d", got, LowMemoryBuffers)
+	}
+	for name, got := range map[string]int{
+		"handshake":  cap(dev.queue.handshake),
+		"encryption": cap(dev.queue.encryption.c),
+		"decryption": cap(dev.queue.decryption),
+		"outbound":   cap(dev.Peers()[0].queue.outbound),
+		"inbound":    cap(dev.Peers()[0].queue.inbound),
+	} {
+		if got != LowMemoryQueueSize {
+			t.Errorf("%s queue of %d, want %d", name, got, LowMemoryQueueSize)
+		}
+	}
+	w := dev.workers.Workers
+	if w.Encryption != 1 || w.Decryption != 1 || w.Handshake != 1 {
+		t.Errorf("workers %+v, want one of each", w)
+	}
+}
@@ -0,0 +1,248 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MinPeerMTU is the smallest MTU a peer can be given: the smallest
+// datagram every IPv4 host must take. IPv6 needs 1280, and a smaller
+// MTU leaves a peer unreachable over IPv6 to all but the smallest
+// packets.
+const MinPeerMTU = 576
+
+// SetMTU sets the largest inner packet the device sends the peer, for a
+// peer behind a path with a smaller MTU than the TUN device's. Larger
+// packets read from the TUN device are dropped, and the sender told
+// with an ICMP "fragmentation needed" or "packet too big". IPv4 packets
+// that may be fragmented get no ICMP error; DeviceOptions.FragmentIPv4
+// fragments them instead. The MSS of TCP connections with the peer is
+// clamped to fit, so that they never send them. Zero, the default,
+// sends up to the TUN device's MTU.
+func (peer *Peer) SetMTU(mtu int) error {
+	if mtu != 0 && (mtu < MinPeerMTU || mtu > MaxContentSize) {
+		return fmt.Errorf("MTU %d out of range [%d, %d]", mtu, MinPeerMTU, MaxContentSize)
+	}
+	atomic.StoreInt32(&peer.mtu, int32(mtu))
+	return nil
+}
+
+// MTU returns the MTU set with SetMTU, or zero.
+func (peer *Peer) MTU() int {
+	return int(atomic.LoadInt32(&peer.mtu))
+}
+
+// effectiveMTU returns the MTU to pad the peer's packets to: its own, if
+// smaller than the TUN device's.
+func (peer *Peer) effectiveMTU() int {
+	mtu := int(atomic.LoadInt32(&peer.device.tun.mtu))
+	if own := peer.MTU(); own != 0 && own < mtu {
+		return own
+	}
+	return mtu
+}
+
+// packetTooBig tells the sender of packet, read from the TUN device,
+// that it exceeds mtu, writing the ICMP error back to the TUN device.
+func (device *Device) packetTooBig(packet []byte, mtu int) {
+	buffer := device.GetMessageBuffer()
+	defer device.PutMessageBuffer(buffer)
+	offset := MessageTransportOffsetContent
+	reply := appendPacketTooBig(buffer[offset:offset], packet, mtu)
+	if len(reply) == 0 {
+		return
+	}
+	if _, err := device.tun.device.Write(buffer[:offset+len(reply)], offset); err != nil {
+		device.log.Debug.Println("Failed to write ICMP packet too big to TUN device:", err)
+	}
+}
+
+/* The error comes from the packet's destination, as it would from a
+ * router on the way to it, and quotes as much of the packet as the
+ * smallest MTU of its version allows. None is sent about ICMP errors,
+ * nor, for IPv4, about packets that may be fragmented, which are
+ * dropped silently.
+ */
+const (
+	icmpv4Proto         = 1
+	icmpv6NextHeader    = 58
+	icmpHeaderLen       = 8
+	maxICMPv4PacketSize = 576
+	maxICMPv6PacketSize = 1280
+)
+
+// appendPacketTooBig appends to b the ICMP error telling the sender of
+// packet that it exceeds mtu, and returns b, or b unchanged if no error
+// is due.
+func appendPacketTooBig(b, packet []byte, mtu int) []byte {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[6]&0x40 == 0 {
+			return b
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[IPv4offsetProtocol] == icmpv4Proto && len(packet) > ihl {
+			switch packet[ihl] {
+			case 3, 4, 5, 11, 12:
+				return b
+			}
+		}
+		quote := len(packet)
+		if max := maxICMPv4PacketSize - ipv4.HeaderLen - icmpHeaderLen; quote > max {
+			quote = max
+		}
+		start := len(b)
+		b = append(b, make([]byte, ipv4.HeaderLen+icmpHeaderLen)...)
+		b = append(b, packet[:quote]...)
+		p := b[start:]
+		p[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+		binary.BigEndian.PutUint16(p[IPv4offsetTotalLength:], uint16(len(p)))
+		p[8] = 64 // TTL
+		p[IPv4offsetProtocol] = icmpv4Proto
+		copy(p[IPv4offsetSrc:], packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len])
+		copy(p[IPv4offsetDst:], packet[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len])
+		binary.BigEndian.PutUint16(p[10:], checksum(p[:ipv4.HeaderLen], 0))
+		icmp := p[ipv4.HeaderLen:]
+		icmp[0], icmp[1] = 3, 4 // destination unreachable, fragmentation needed
+		binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+		binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+		return b
+
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return b
+		}
+		if packet[IPv6offsetNextHeader] == icmpv6NextHeader && len(packet) > ipv6.HeaderLen && packet[ipv6.HeaderLen] < 128 {
+			return b
+		}
+		quote := len(packet)
+		if max := maxICMPv6PacketSize - ipv6.HeaderLen - icmpHeaderLen; quote > max {
+			quote = max
+		}
+		start := len(b)
+		b = append(b, make([]byte, ipv6.HeaderLen+icmpHeaderLen)...)
+		b = append(b, packet[:quote]...)
+		p := b[start:]
+		p[0] = ipv6.Version << 4
+		binary.BigEndian.PutUint16(p[IPv6offsetPayloadLength:], uint16(len(p)-ipv6.HeaderLen))
+		p[IPv6offsetNextHeader] = icmpv6NextHeader
+		p[7] = 64 // hop limit
+		copy(p[IPv6offsetSrc:], packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len])
+		copy(p[IPv6offsetDst:], packet[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len])
+		icmp := p[ipv6.HeaderLen:]
+		icmp[0] = 2 // packet too big
+		binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+		sum := pseudoHeaderSum(p[IPv6offsetSrc:IPv6offsetDst], p[IPv6offsetDst:ipv6.HeaderLen], icmpv6NextHeader, len(icmp))
+		binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, sum))
+		return b
+	}
+	return b
+}
+
+const tcpProto = 6
+
+// clampMSS lowers the maximum segment size a TCP SYN in packet offers to
+// what fits in mtu.
+func clampMSS(packet []byte, mtu int) {
+	if len(packet) < 1 {
+		return
+	}
+	var src, dst, tcp []byte
+	var mss int
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < ipv4.HeaderLen || ihl < ipv4.HeaderLen || len(packet) < ihl || packet[IPv4offsetProtocol] != tcpProto {
+			return
+		}
+		if binary.BigEndian.Uint16(packet[6:])&0x1fff != 0 {
+			return // not the first fragment
+		}
+		src = packet[IPv4offsetSrc:IPv4offsetDst]
+		dst = packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+		tcp = packet[ihl:]
+		mss = mtu - ipv4.HeaderLen - 20
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen || packet[IPv6offsetNextHeader] != tcpProto {
+			return
+		}
+		src = packet[IPv6offsetSrc:IPv6offsetDst]
+		dst = packet[IPv6offsetDst:ipv6.HeaderLen]
+		tcp = packet[ipv6.HeaderLen:]
+		mss = mtu - ipv6.HeaderLen - 20
+	default:
+		return
+	}
+	if len(tcp) < 20 || tcp[13]&0x02 == 0 {
+		return // not a SYN
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return
+	}
+	options := tcp[20:dataOffset]
+	for i := 0; i < len(options); {
+		switch kind := options[i]; kind {
+		case 0: // end of options
+			return
+		case 1: // no-op
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			return
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			return
+		}
+		if options[i] == 2 && length == 4 {
+			if int(binary.BigEndian.Uint16(options[i+2:])) <= mss {
+				return
+			}
+			binary.BigEndian.PutUint16(options[i+2:], uint16(mss))
+			tcp[16], tcp[17] = 0, 0
+			sum := pseudoHeaderSum(src, dst, tcpProto, len(tcp))
+			binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum))
+			return
+		}
+		i += length
+	}
+}
+
+// pseudoHeaderSum returns the unfolded sum of the pseudo-header TCP,
+// UDP, and ICMPv6 checksums cover.
+func pseudoHeaderSum(src, dst []byte, proto byte, length int) uint32 {
+	sum := sum16(src, 0)
+	sum = sum16(dst, sum)
+	return sum + uint32(proto) + uint32(length>>16) + uint32(length&0xffff)
+}
+
+func sum16(b []byte, sum uint32) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksum returns the Internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	sum = sum16(b, sum)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
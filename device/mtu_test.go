@@ -0,0 +1,177 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// testIPv4 returns an IPv4 packet of size bytes from src to dst, with the
+// don't-fragment bit set if df, carrying payload, if any, as protocol.
+func testIPv4(src, dst net.IP, size int, df bool, proto byte, payload []byte) []byte {
+	p := make([]byte, size)
+	p[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(p[IPv4offsetTotalLength:], uint16(size))
+	if df {
+		p[6] = 0x40
+	}
+	p[8] = 64
+	p[IPv4offsetProtocol] = proto
+	copy(p[IPv4offsetSrc:], src.To4())
+	copy(p[IPv4offsetDst:], dst.To4())
+	binary.BigEndian.PutUint16(p[10:], checksum(p[:ipv4.HeaderLen], 0))
+	copy(p[ipv4.HeaderLen:], payload)
+	return p
+}
+
+func testIPv6(src, dst net.IP, size int, next byte, payload []byte) []byte {
+	p := make([]byte, size)
+	p[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(p[IPv6offsetPayloadLength:], uint16(size-ipv6.HeaderLen))
+	p[IPv6offsetNextHeader] = next
+	p[7] = 64
+	copy(p[IPv6offsetSrc:], src.To16())
+	copy(p[IPv6offsetDst:], dst.To16())
+	copy(p[ipv6.HeaderLen:], payload)
+	return p
+}
+
+// testSYN returns a TCP SYN header offering mss, after a no-op.
+func testSYN(mss uint16) []byte {
+	tcp := make([]byte, 28)
+	tcp[12] = 7 << 4
+	tcp[13] = 0x02
+	tcp[20] = 1
+	tcp[21], tcp[22] = 2, 4
+	binary.BigEndian.PutUint16(tcp[23:], mss)
+	return tcp
+}
+
+func TestClampMSS(t *testing.T) {
+	src4, dst4 := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	src6, dst6 := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+	tests := []struct {
+		name   string
+		packet []byte
+		tcp    int // offset of the TCP header
+		want   uint16
+	}{
+		{"ipv4", testIPv4(src4, dst4, ipv4.HeaderLen+28, true, tcpProto, testSYN(1460)), ipv4.HeaderLen, 1240},
+		{"ipv4-smaller", testIPv4(src4, dst4, ipv4.HeaderLen+28, true, tcpProto, testSYN(1000)), ipv4.HeaderLen, 1000},
+		{"ipv6", testIPv6(src6, dst6, ipv6.HeaderLen+28, tcpProto, testSYN(1440)), ipv6.HeaderLen, 1220},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := tt.packet[tt.tcp:]
+			var src, dst []byte
+			if tt.tcp == ipv4.HeaderLen {
+				src, dst = src4.To4(), dst4.To4()
+			} else {
+				src, dst = src6, dst6
+			}
+			binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudoHeaderSum(src, dst, tcpProto, len(tcp))))
+
+			clampMSS(tt.packet, 1280)
+			if got := binary.BigEndian.Uint16(tcp[23:]); got != tt.want {
+				t.Errorf("MSS %d, want %d", got, tt.want)
+			}
+			if sum := checksum(tcp, pseudoHeaderSum(src, dst, tcpProto, len(tcp))); sum != 0 {
+				t.Errorf("TCP checksum off by %#x", sum)
+			}
+		})
+	}
+
+	// Only SYNs are touched.
+	ack := testSYN(1460)
+	ack[13] = 0x10
+	packet := testIPv4(src4, dst4, ipv4.HeaderLen+28, true, tcpProto, ack)
+	clampMSS(packet, 1280)
+	if got := binary.BigEndian.Uint16(packet[ipv4.HeaderLen+23:]); got != 1460 {
+		t.Errorf("MSS of an ACK changed to %d", got)
+	}
+}
+
+func TestAppendPacketTooBig(t *testing.T) {
+	src4, dst4 := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	src6, dst6 := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+
+	reply := appendPacketTooBig(nil, testIPv4(src4, dst4, 1400, true, 17, nil), 1280)
+	if len(reply) != maxICMPv4PacketSize {
+		t.Fatalf("ICMPv4 reply of %d bytes, want %d", len(reply), maxICMPv4PacketSize)
+	}
+	if !net.IP(reply[IPv4offsetSrc:IPv4offsetDst]).Equal(dst4) || !net.IP(reply[IPv4offsetDst:ipv4.HeaderLen]).Equal(src4) {
+		t.Errorf("ICMPv4 reply from %v to %v", net.IP(reply[IPv4offsetSrc:IPv4offsetDst]), net.IP(reply[IPv4offsetDst:ipv4.HeaderLen]))
+	}
+	icmp := reply[ipv4.HeaderLen:]
+	if icmp[0] != 3 || icmp[1] != 4 || binary.BigEndian.Uint16(icmp[6:]) != 1280 {
+		t.Errorf("ICMPv4 type %d code %d MTU %d, want 3, 4, 1280", icmp[0], icmp[1], binary.BigEndian.Uint16(icmp[6:]))
+	}
+	if checksum(reply[:ipv4.HeaderLen], 0) != 0 || checksum(icmp, 0) != 0 {
+		t.Error("bad ICMPv4 checksums")
+	}
+
+	if reply := appendPacketTooBig(nil, testIPv4(src4, dst4, 1400, false, 17, nil), 1280); len(reply) != 0 {
+		t.Error("ICMPv4 reply to a packet that may be fragmented")
+	}
+	unreachable := testIPv4(src4, dst4, 1400, true, icmpv4Proto, []byte{3, 1})
+	if reply := appendPacketTooBig(nil, unreachable, 1280); len(reply) != 0 {
+		t.Error("ICMPv4 reply to an ICMP error")
+	}
+
+	reply = appendPacketTooBig(nil, testIPv6(src6, dst6, 1400, 17, nil), 1280)
+	if len(reply) != maxICMPv6PacketSize {
+		t.Fatalf("ICMPv6 reply of %d bytes, want %d", len(reply), maxICMPv6PacketSize)
+	}
+	icmp = reply[ipv6.HeaderLen:]
+	if icmp[0] != 2 || binary.BigEndian.Uint32(icmp[4:]) != 1280 {
+		t.Errorf("ICMPv6 type %d MTU %d, want 2, 1280", icmp[0], binary.BigEndian.Uint32(icmp[4:]))
+	}
+	if checksum(icmp, pseudoHeaderSum(dst6, src6, icmpv6NextHeader, len(icmp))) != 0 {
+		t.Error("bad ICMPv6 checksum")
+	}
+}
+
+func TestPeerMTU(t *testing.T) {
+	pair := genTestPair(t)
+	dev0 := pair[0].dev
+	pub1 := pair[1].dev.staticIdentity.publicKey
+	if err := dev0.IpcSetOperation(uapiCfg(
+		"public_key", pub1.ToHex(),
+		"mtu", "1280",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := dev0.Config(); len(cfg.Peers) != 1 || cfg.Peers[0].MTU != 1280 {
+		t.Fatalf("MTU not reported: %+v", cfg.Peers)
+	}
+	pair.Send(t, Ping, nil)
+
+	pair[0].tun.Outbound <- testIPv4(pair[0].ip, pair[1].ip, 1400, true, 17, nil)
+	select {
+	case reply := <-pair[0].tun.Inbound:
+		icmp := reply[ipv4.HeaderLen:]
+		if icmp[0] != 3 || icmp[1] != 4 || binary.BigEndian.Uint16(icmp[6:]) != 1280 {
+			t.Errorf("got ICMP type %d code %d MTU %d, want fragmentation needed at 1280", icmp[0], icmp[1], binary.BigEndian.Uint16(icmp[6:]))
+		}
+	case <-pair[1].tun.Inbound:
+		t.Fatal("packet over the peer's MTU was sent")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ICMP reply")
+	}
+	if n := dev0.DropCounts()[DropTooBig]; n != 1 {
+		t.Errorf("%d packets dropped as too big, want 1", n)
+	}
+
+	if err := dev0.LookupPeer(pub1).SetMTU(100); err == nil {
+		t.Error("SetMTU accepted an MTU below MinPeerMTU")
+	}
+}
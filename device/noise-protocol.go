@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/blake2s"
@@ -191,7 +192,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	var err error
 	handshake.hash = InitialHash
 	handshake.chainKey = InitialChainKey
-	handshake.localEphemeral, err = newPrivateKey()
+	handshake.localEphemeral, err = newPrivateKeyFrom(device.rand)
 	if err != nil {
 		return nil, err
 	}
@@ -232,7 +233,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		handshake.chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	timestamp := tai64n.Now()
+	timestamp := tai64n.At(device.now())
 	aead, _ = chacha20poly1305.New(key[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
@@ -249,7 +250,35 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	return &msg, nil
 }
 
+// ConsumeMessageInitiation authenticates msg and, if it is valid, makes
+// it the peer's handshake in progress, returning the peer. It is
+// authenticateMessageInitiation followed by commitMessageInitiation;
+// RoutineHandshake calls those separately so that it can refuse an
+// initiation before it changes anything.
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	init := device.authenticateMessageInitiation(msg)
+	if init == nil {
+		return nil
+	}
+	return device.commitMessageInitiation(init)
+}
+
+// An authenticatedInitiation is a handshake initiation that has been
+// authenticated but has not yet changed the peer's handshake state.
+type authenticatedInitiation struct {
+	peer        *Peer
+	localStatic NoisePublicKey // the identity it was authenticated against
+	hash        [blake2s.Size]byte
+	chainKey    [blake2s.Size]byte
+	timestamp   tai64n.Timestamp
+	sender      uint32
+	ephemeral   NoisePublicKey
+}
+
+// authenticateMessageInitiation decrypts and verifies msg, checking it
+// against replay and flood, without changing any state. It returns nil
+// if msg is invalid or is not from a known peer.
+func (device *Device) authenticateMessageInitiation(msg *MessageInitiation) *authenticatedInitiation {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
@@ -318,8 +347,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	// protect against replay & flood
 
 	replay := !timestamp.After(handshake.lastTimestamp)
-	now := time.Now()
-	flood := !handshake.initiationLimit.CanTake(now)
+	flood := !handshake.initiationLimit.CanTake(device.now())
 	handshake.mutex.RUnlock()
 	if replay {
 		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, timestamp)
@@ -330,29 +358,76 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		return nil
 	}
 
+	return &authenticatedInitiation{
+		peer:        peer,
+		localStatic: device.staticIdentity.publicKey,
+		hash:        hash,
+		chainKey:    chainKey,
+		timestamp:   timestamp,
+		sender:      msg.Sender,
+		ephemeral:   msg.Ephemeral,
+	}
+}
+
+// commitMessageInitiation makes init the peer's handshake in progress,
+// unless it crossed our own initiation and loses, in which case it only
+// counts the crossing. It returns nil if init went stale after it was
+// authenticated: the private key changed, or another initiation from the
+// peer was committed with a timestamp as new.
+func (device *Device) commitMessageInitiation(init *authenticatedInitiation) *Peer {
+	defer setZero(init.hash[:])
+	defer setZero(init.chainKey[:])
+
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+	if !device.staticIdentity.publicKey.Equals(init.localStatic) {
+		return nil
+	}
+
+	peer := init.peer
+	handshake := &peer.handshake
+	now := device.now()
+
 	// update handshake state
 
 	handshake.mutex.Lock()
 
-	if handshake.state != handshakeInitiationCreated || device.staticIdentity.publicKey.LessThan(&handshake.remoteStatic) {
-		handshake.hash = hash
-		handshake.chainKey = chainKey
-		handshake.remoteIndex = msg.Sender
-		handshake.remoteEphemeral = msg.Ephemeral
-		if timestamp.After(handshake.lastTimestamp) {
-			handshake.lastTimestamp = timestamp
-		}
+	if !init.timestamp.After(handshake.lastTimestamp) {
+		handshake.mutex.Unlock()
+		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, init.timestamp)
+		return nil
+	}
+
+	/* If both sides initiate at once, each receives the other's
+	 * initiation with its own still awaiting a response. The side with
+	 * the greater public key remains the initiator and ignores the other's
+	 * initiation; the other responds to it, abandoning its own. That way
+	 * exactly one session comes out of the crossing, without waiting for
+	 * a retransmission. An initiation that went unanswered for RekeyTimeout
+	 * no longer counts, so a peer that missed it is not ignored until the
+	 * next one.
+	 */
+
+	crossing := handshake.state == handshakeInitiationCreated && now.Sub(handshake.lastSentHandshake) < RekeyTimeout
+	if crossing {
+		atomic.AddUint64(&device.stats.handshakeCrossings, 1)
+		atomic.AddUint64(&peer.stats.handshakeCrossings, 1)
+	}
+	if !crossing || device.staticIdentity.publicKey.LessThan(&handshake.remoteStatic) {
+		handshake.hash = init.hash
+		handshake.chainKey = init.chainKey
+		handshake.remoteIndex = init.sender
+		handshake.remoteEphemeral = init.ephemeral
+		handshake.lastTimestamp = init.timestamp
 		handshake.initiationLimit.Take(now)
+		handshake.lastInitiationConsumption = now
 		handshake.state = handshakeInitiationConsumed
 	} else {
-		device.log.Debug.Printf("%v - race: remote initiation IGNORED.\n", peer)
+		device.log.Debug.Printf("%v - ConsumeMessageInitiation: crossed our own initiation, ignored\n", peer)
 	}
 
 	handshake.mutex.Unlock()
 
-	setZero(hash[:])
-	setZero(chainKey[:])
-
 	return peer
 }
 
@@ -381,7 +456,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	// create ephemeral key
 
-	handshake.localEphemeral, err = newPrivateKey()
+	handshake.localEphemeral, err = newPrivateKeyFrom(device.rand)
 	if err != nil {
 		return nil, err
 	}
@@ -422,7 +497,33 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	return &msg, nil
 }
 
+// ConsumeMessageResponse authenticates msg and, if it is valid, moves the
+// handshake it answers on, returning the peer. It is
+// authenticateMessageResponse followed by commitMessageResponse;
+// RoutineHandshake calls those separately so that it can refuse a
+// response before it changes anything.
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
+	resp := device.authenticateMessageResponse(msg)
+	if resp == nil {
+		return nil
+	}
+	return device.commitMessageResponse(resp)
+}
+
+// An authenticatedResponse is a handshake response that has been
+// authenticated but has not yet changed the peer's handshake state.
+type authenticatedResponse struct {
+	peer       *Peer
+	localIndex uint32 // of the initiation it answers
+	hash       [blake2s.Size]byte
+	chainKey   [blake2s.Size]byte
+	sender     uint32
+}
+
+// authenticateMessageResponse decrypts and verifies msg against the
+// initiation it answers, without changing any state. It returns nil if
+// msg is invalid or answers no initiation in progress.
+func (device *Device) authenticateMessageResponse(msg *MessageResponse) *authenticatedResponse {
 	if msg.Type != MessageResponseType {
 		return nil
 	}
@@ -447,7 +548,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		handshake.mutex.RLock()
 		defer handshake.mutex.RUnlock()
 
-		if handshake.state != handshakeInitiationCreated {
+		if handshake.state != handshakeInitiationCreated || handshake.localIndex != msg.Receiver {
 			return false
 		}
 
@@ -498,24 +599,50 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	}()
 
 	if !ok {
+		setZero(hash[:])
+		setZero(chainKey[:])
 		return nil
 	}
 
+	return &authenticatedResponse{
+		peer:       lookup.peer,
+		localIndex: msg.Receiver,
+		hash:       hash,
+		chainKey:   chainKey,
+		sender:     msg.Sender,
+	}
+}
+
+// commitMessageResponse completes the handshake resp answers, leaving it
+// for BeginSymmetricSession, and records its round trip. It returns nil
+// if resp went stale after it was authenticated: the handshake answered
+// is no longer the one in progress.
+func (device *Device) commitMessageResponse(resp *authenticatedResponse) *Peer {
+	defer setZero(resp.hash[:])
+	defer setZero(resp.chainKey[:])
+
+	peer := resp.peer
+	handshake := &peer.handshake
+
 	// update handshake state
 
 	handshake.mutex.Lock()
 
-	handshake.hash = hash
-	handshake.chainKey = chainKey
-	handshake.remoteIndex = msg.Sender
+	if handshake.state != handshakeInitiationCreated || handshake.localIndex != resp.localIndex {
+		handshake.mutex.Unlock()
+		return nil
+	}
+	handshake.hash = resp.hash
+	handshake.chainKey = resp.chainKey
+	handshake.remoteIndex = resp.sender
 	handshake.state = handshakeResponseConsumed
+	sent := handshake.lastSentHandshake
 
 	handshake.mutex.Unlock()
 
-	setZero(hash[:])
-	setZero(chainKey[:])
+	peer.qualityRTT(device.since(sent))
 
-	return lookup.peer
+	return peer
 }
 
 /* Derives a new keypair from the current handshake state
@@ -565,11 +692,15 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair := new(Keypair)
 	keypair.send, _ = chacha20poly1305.New(sendKey[:])
 	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	if device.snapshots {
+		keypair.sendKey = sendKey
+		keypair.receiveKey = recvKey
+	}
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = device.now()
 	keypair.replayFilter.Reset()
 	keypair.isInitiator = isInitiator
 	keypair.localIndex = peer.handshake.localIndex
@@ -580,6 +711,8 @@ func (peer *Peer) BeginSymmetricSession() error {
 	device.indexTable.SwapIndexForKeypair(handshake.localIndex, keypair)
 	handshake.localIndex = 0
 
+	peer.newFlowLabel(true)
+
 	// rotate key pairs
 
 	keypairs := &peer.keypairs
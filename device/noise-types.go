@@ -9,6 +9,7 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"errors"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -42,7 +43,10 @@ func (key NoisePrivateKey) IsZero() bool {
 	return key.Equals(zero)
 }
 
-func (key NoisePrivateKey) Equals(tar NoisePrivateKey) bool {
+func (key NoisePrivateKey) Equals(tar NoisePrivateKey) (ok bool) {
+	if ctauditEnabled {
+		defer ctauditTime(CTAuditPrivateKeyEquals, time.Now(), &ok)
+	}
 	return subtle.ConstantTimeCompare(key[:], tar[:]) == 1
 }
 
@@ -78,7 +82,10 @@ func (key NoisePublicKey) IsZero() bool {
 	return key.Equals(zero)
 }
 
-func (key NoisePublicKey) Equals(tar NoisePublicKey) bool {
+func (key NoisePublicKey) Equals(tar NoisePublicKey) (ok bool) {
+	if ctauditEnabled {
+		defer ctauditTime(CTAuditPublicKeyEquals, time.Now(), &ok)
+	}
 	return subtle.ConstantTimeCompare(key[:], tar[:]) == 1
 }
 
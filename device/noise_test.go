@@ -148,3 +148,184 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func TestNoiseHandshakeCrossing(t *testing.T) {
+	for _, stale := range []bool{false, true} {
+		dev1 := randDevice(t)
+		dev2 := randDevice(t)
+		defer dev1.Close()
+		defer dev2.Close()
+
+		peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Order the sides so that the winner has the greater public key.
+		winner, loser := dev1, dev2
+		winnerPeer, loserPeer := peer2, peer1 // the other side, as each sees it
+		if dev1.staticIdentity.publicKey.LessThan(&dev2.staticIdentity.publicKey) {
+			winner, loser = dev2, dev1
+			winnerPeer, loserPeer = peer1, peer2
+		}
+
+		// Both initiate at once, as SendHandshakeInitiation does.
+		msgW, err := winner.CreateMessageInitiation(winnerPeer)
+		assertNil(t, err)
+		msgL, err := loser.CreateMessageInitiation(loserPeer)
+		assertNil(t, err)
+		winnerPeer.handshake.lastSentHandshake = winner.now()
+		loserPeer.handshake.lastSentHandshake = loser.now()
+		if stale {
+			winnerPeer.handshake.lastSentHandshake = winner.now().Add(-RekeyTimeout)
+		}
+
+		if winner.ConsumeMessageInitiation(msgL) == nil {
+			t.Fatal("winner rejected the crossing initiation")
+		}
+		if loser.ConsumeMessageInitiation(msgW) == nil {
+			t.Fatal("loser rejected the crossing initiation")
+		}
+
+		if stale {
+			// The winner's initiation went unanswered too long to
+			// count, so it responds like the loser.
+			if winnerPeer.handshake.state != handshakeInitiationConsumed {
+				t.Errorf("stale: winner state %v, want initiation consumed", winnerPeer.handshake.state)
+			}
+			if n := winner.HandshakeCrossings(); n != 0 {
+				t.Errorf("stale: winner counted %d crossings, want 0", n)
+			}
+			continue
+		}
+
+		if winnerPeer.handshake.state != handshakeInitiationCreated {
+			t.Fatalf("winner state %v, want initiation created", winnerPeer.handshake.state)
+		}
+		for _, dev := range []*Device{winner, loser} {
+			if n := dev.HandshakeCrossings(); n != 1 {
+				t.Errorf("device counted %d crossings, want 1", n)
+			}
+		}
+		if n := winnerPeer.HandshakeCrossings(); n != 1 {
+			t.Errorf("peer counted %d crossings, want 1", n)
+		}
+
+		// Only the loser responds, completing the winner's handshake.
+		msg, err := loser.CreateMessageResponse(loserPeer)
+		assertNil(t, err)
+		if winner.ConsumeMessageResponse(msg) == nil {
+			t.Fatal("winner rejected the response")
+		}
+		if _, err := winner.CreateMessageResponse(winnerPeer); err == nil {
+			t.Error("winner could respond to the ignored initiation")
+		}
+		assertNil(t, winnerPeer.BeginSymmetricSession())
+		assertNil(t, loserPeer.BeginSymmetricSession())
+		if w, l := winnerPeer.keypairs.Current(), loserPeer.keypairs.loadNext(); w == nil || l == nil || w.localIndex != l.remoteIndex || w.remoteIndex != l.localIndex {
+			t.Error("the sides derived different sessions")
+		}
+	}
+}
+
+func TestAuthenticateInitiationChangesNothing(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+
+	// An initiation that is authenticated, then refused, leaves the
+	// handshake as it was.
+	before := peer1.handshake.lastTimestamp
+	init := dev2.authenticateMessageInitiation(msg)
+	if init == nil || init.peer != peer1 {
+		t.Fatal("initiation failed to authenticate")
+	}
+	if peer1.handshake.state != handshakeZeroed || peer1.handshake.lastTimestamp != before {
+		t.Fatalf("authenticating changed the handshake: state %v", peer1.handshake.state)
+	}
+	if dev2.authenticateMessageInitiation(msg) == nil {
+		t.Fatal("refused initiation counted against a later one")
+	}
+
+	if dev2.commitMessageInitiation(init) != peer1 {
+		t.Fatal("initiation failed to commit")
+	}
+	if peer1.handshake.state != handshakeInitiationConsumed || peer1.handshake.lastTimestamp != init.timestamp {
+		t.Errorf("committing left state %v", peer1.handshake.state)
+	}
+
+	// Committing it again is a replay.
+	if init := dev2.authenticateMessageInitiation(msg); init != nil {
+		t.Error("replayed initiation authenticated")
+	}
+	if dev2.commitMessageInitiation(init) != nil {
+		t.Error("replayed initiation committed")
+	}
+}
+
+func TestAuthenticateResponseChangesNothing(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg1) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+
+	// A response that is authenticated, then refused, leaves the
+	// handshake as it was.
+	hash := peer2.handshake.hash
+	resp := dev1.authenticateMessageResponse(msg2)
+	if resp == nil || resp.peer != peer2 {
+		t.Fatal("response failed to authenticate")
+	}
+	if peer2.handshake.state != handshakeInitiationCreated || peer2.handshake.hash != hash {
+		t.Fatalf("authenticating changed the handshake: state %v", peer2.handshake.state)
+	}
+
+	if dev1.commitMessageResponse(resp) != peer2 {
+		t.Fatal("response failed to commit")
+	}
+	if peer2.handshake.state != handshakeResponseConsumed {
+		t.Errorf("committing left state %v", peer2.handshake.state)
+	}
+
+	// The handshake has moved on, so the response is stale.
+	if dev1.authenticateMessageResponse(msg2) != nil {
+		t.Error("response authenticated twice")
+	}
+	if dev1.commitMessageResponse(resp) != nil {
+		t.Error("response committed twice")
+	}
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+const (
+	// NonceSaveInterval is how often a device with a NonceStore saves
+	// the send nonces of its sessions.
+	NonceSaveInterval = time.Second
+
+	// NonceRestoreJump is how far past a saved nonce Restore starts a
+	// session, to cover the packets sent between the last save and a
+	// crash: over ten seconds' worth at a million packets a second.
+	NonceRestoreJump = 1 << 24
+)
+
+// A NonceMark records that no nonce at or above Nonce had been sent on a
+// session when it was saved.
+type NonceMark struct {
+	PublicKey  wgcfg.Key // the peer's
+	LocalIndex uint32    // the session's
+	Nonce      uint64
+}
+
+// A NonceStore keeps the send nonces of a device's sessions somewhere
+// that outlives the process, typically a file, so that a Snapshot taken
+// before a crash can be restored without reusing nonces: Restore skips
+// past both the Snapshot's nonces and the marks saved since, and saves
+// the nonces it resumes at before returning.
+//
+// SaveNonces replaces every mark saved before with marks. LoadNonces
+// returns the last marks saved. Neither is called concurrently with
+// itself or the other.
+type NonceStore interface {
+	SaveNonces(marks []NonceMark) error
+	LoadNonces() ([]NonceMark, error)
+}
+
+type nonceMarkKey struct {
+	publicKey  wgcfg.Key
+	localIndex uint32
+}
+
+// nonceMarks returns the marks of the device's sessions.
+func (device *Device) nonceMarks() []NonceMark {
+	var marks []NonceMark
+	for _, peer := range device.Peers() {
+		key := wgcfg.Key(peer.handshake.remoteStatic)
+		keypairs := &peer.keypairs
+		keypairs.RLock()
+		for _, keypair := range []*Keypair{keypairs.current, keypairs.previous, keypairs.loadNext()} {
+			if keypair != nil {
+				marks = append(marks, NonceMark{
+					PublicKey:  key,
+					LocalIndex: keypair.localIndex,
+					Nonce:      atomic.LoadUint64(&keypair.sendNonce),
+				})
+			}
+		}
+		keypairs.RUnlock()
+	}
+	return marks
+}
+
+// loadNonceMarks returns the marks in the device's store, or nil if it
+// has none. A store with no marks yields an empty map, not nil.
+func (device *Device) loadNonceMarks() (map[nonceMarkKey]uint64, error) {
+	if device.nonceStore == nil {
+		return nil, nil
+	}
+	device.nonceStoreMutex.Lock()
+	marks, err := device.nonceStore.LoadNonces()
+	device.nonceStoreMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[nonceMarkKey]uint64, len(marks))
+	for _, mark := range marks {
+		m[nonceMarkKey{mark.PublicKey, mark.LocalIndex}] = mark.Nonce
+	}
+	return m, nil
+}
+
+// restoredNonce returns the nonce to resume a session at, given the one
+// its snapshot records and the mark saved for it, or zero if none was.
+// Either may lag the nonces sent since, by up to NonceSaveInterval's
+// worth if the mark was saved or by any number if not, so the session
+// resumes NonceRestoreJump past the later of the two.
+func restoredNonce(snapNonce uint64, mark uint64) uint64 {
+	if mark < snapNonce {
+		mark = snapNonce
+	}
+	if mark >= RejectAfterMessages-NonceRestoreJump {
+		return RejectAfterMessages
+	}
+	return mark + NonceRestoreJump
+}
+
+// SaveNonces saves the send nonces of the device's sessions to its
+// NonceStore, which the device also does every NonceSaveInterval. It does
+// nothing if the device has no store.
+func (device *Device) SaveNonces() error {
+	if device.nonceStore == nil {
+		return nil
+	}
+	marks := device.nonceMarks()
+	device.nonceStoreMutex.Lock()
+	defer device.nonceStoreMutex.Unlock()
+	return device.nonceStore.SaveNonces(marks)
+}
+
+func (device *Device) RoutineSaveNonces() {
+	ticker := time.NewTicker(NonceSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+		}
+		// A frozen device's sessions belong to the process it was
+		// handed to, which saves their nonces itself.
+		if device.frozen.Get() {
+			continue
+		}
+		if err := device.SaveNonces(); err != nil {
+			device.log.Error.Println("Failed to save nonces:", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type memNonceStore struct {
+	sync.Mutex
+	marks []NonceMark
+}
+
+func (s *memNonceStore) SaveNonces(marks []NonceMark) error {
+	s.Lock()
+	defer s.Unlock()
+	s.marks = append([]NonceMark(nil), marks...)
+	return nil
+}
+
+func (s *memNonceStore) LoadNonces() ([]NonceMark, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.marks, nil
+}
+
+// genSnapshotTestPair creates a testPair whose devices take Snapshots.
+func genSnapshotTestPair(t *testing.T) testPair {
+	return genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.Snapshots = true
+	})
+}
+
+func TestSnapshotKeys(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	if _, err := pair[0].dev.Snapshot(); err == nil {
+		t.Fatal("Snapshot succeeded on a device without Snapshots")
+	}
+	if pair[0].dev.frozen.Get() {
+		t.Fatal("failed Snapshot froze the device")
+	}
+	var zero [chacha20poly1305.KeySize]byte
+	keypair := pair[0].dev.Peers()[0].keypairs.Current()
+	if keypair.sendKey != zero || keypair.receiveKey != zero {
+		t.Error("session keys kept by a device without Snapshots")
+	}
+
+	pair = genSnapshotTestPair(t)
+	pair.Send(t, Ping, nil)
+	peer := pair[0].dev.Peers()[0]
+	keypair = peer.keypairs.Current()
+	if keypair.sendKey == zero || keypair.receiveKey == zero {
+		t.Fatal("session keys not kept by a device with Snapshots")
+	}
+	peer.ZeroAndFlushAll()
+	if keypair.sendKey != zero || keypair.receiveKey != zero {
+		t.Error("session keys not zeroed with their session")
+	}
+}
+
+func TestRestoreSkipsSavedNonces(t *testing.T) {
+	pair := genSnapshotTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	snap, err := pair[0].dev.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := snap.Peers[0]
+	if ps.Current == nil {
+		t.Fatal("snapshot has no session")
+	}
+
+	// As if a device restored from snap had sent 100 more packets on
+	// the session and saved its nonce before crashing.
+	saved := ps.Current.SendNonce + 100
+	store := &memNonceStore{marks: []NonceMark{{
+		PublicKey:  ps.PublicKey,
+		LocalIndex: ps.Current.LocalIndex,
+		Nonce:      saved,
+	}}}
+	dev := NewDevice(newNilTun(), &DeviceOptions{
+		Logger:     NewLogger(LogLevelError, ""),
+		NonceStore: store,
+	})
+	defer dev.Close()
+	if err := dev.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := dev.LookupPeer(NoisePublicKey(ps.PublicKey))
+	if got, want := atomic.LoadUint64(&peer.keypairs.Current().sendNonce), saved+NonceRestoreJump; got != want {
+		t.Errorf("restored nonce %d, want %d", got, want)
+	}
+	if previous := peer.keypairs.previous; previous != nil && ps.Previous != nil {
+		if got, want := atomic.LoadUint64(&previous.sendNonce), ps.Previous.SendNonce+NonceRestoreJump; got != want {
+			t.Errorf("unsaved session resumed at %d, want %d", got, want)
+		}
+	}
+
+	// Restore saved the nonces it resumed at, without waiting for the
+	// nonce saver.
+	marks, _ := store.LoadNonces()
+	found := false
+	for _, mark := range marks {
+		if mark.PublicKey == ps.PublicKey && mark.LocalIndex == ps.Current.LocalIndex {
+			found = true
+			if mark.Nonce != saved+NonceRestoreJump {
+				t.Errorf("saved nonce %d, want %d", mark.Nonce, saved+NonceRestoreJump)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("session not saved: %+v", marks)
+	}
+}
+
+func TestRestoreTwice(t *testing.T) {
+	pair := genSnapshotTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	snap, err := pair[0].dev.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := snap.Peers[0]
+
+	// Each restore of the same snapshot, as after successive crashes,
+	// must resume past the nonces the ones before it may have sent.
+	store := &memNonceStore{}
+	var last uint64
+	for i := 0; i < 2; i++ {
+		dev := NewDevice(newNilTun(), &DeviceOptions{
+			Logger:     NewLogger(LogLevelError, ""),
+			NonceStore: store,
+		})
+		if err := dev.Restore(snap); err != nil {
+			t.Fatal(err)
+		}
+		nonce := atomic.LoadUint64(&dev.LookupPeer(NoisePublicKey(ps.PublicKey)).keypairs.Current().sendNonce)
+		dev.Close()
+		if nonce < last+NonceRestoreJump {
+			t.Errorf("restore %d resumed at %d, within NonceRestoreJump of %d", i, nonce, last)
+		}
+		last = nonce
+	}
+}
+
+func TestRestoredNonce(t *testing.T) {
+	tests := []struct {
+		snap, mark uint64
+		want       uint64
+	}{
+		{snap: 5, mark: 0, want: 5 + NonceRestoreJump},
+		{snap: 5, mark: 100, want: 100 + NonceRestoreJump},
+		{snap: 1 << 30, mark: 100, want: 1<<30 + NonceRestoreJump},
+		{snap: 5, mark: RejectAfterMessages - 1, want: RejectAfterMessages},
+	}
+	for _, tt := range tests {
+		if got := restoredNonce(tt.snap, tt.mark); got != tt.want {
+			t.Errorf("restoredNonce(%d, %d) = %d, want %d", tt.snap, tt.mark, got, tt.want)
+		}
+	}
+}
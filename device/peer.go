@@ -6,6 +6,8 @@
 package device
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -18,7 +20,7 @@ import (
 )
 
 const (
-	PeerRoutineNumber = 2
+	PeerRoutineNumber = 3
 )
 
 type Peer struct {
@@ -28,24 +30,56 @@ type Peer struct {
 	// atomically-accessed fields up front, so that they can share in
 	// this alignment before smaller fields throw it off.
 	stats struct {
-		txBytes           uint64 // bytes send to peer (endpoint)
-		rxBytes           uint64 // bytes received from peer
-		lastHandshakeNano int64  // nano seconds since epoch
+		txBytes            uint64 // bytes send to peer (endpoint)
+		rxBytes            uint64 // bytes received from peer
+		lastHandshakeNano  int64  // nano seconds since epoch
+		unexpectedIP       uint64 // packets dropped for a disallowed source address
+		handshakeCrossings uint64 // see Device.HandshakeCrossings
+		endpointFlaps      uint64 // see EndpointFlaps
+		duplicateKeys      uint64 // see DuplicateKeys
+	}
+	spoof struct {
+		strikes              uint64 // disallowed packets since the last quarantine
+		suppressed           uint64 // disallowed packets not yet reported due to sampling
+		lastReportNano       int64  // time of the last UnexpectedIP call
+		quarantinedUntilNano int64  // zero if the peer is not quarantined
+	}
+	cookie struct {
+		replies     uint64 // see CookieReplies
+		retryAtNano int64  // when the last initiation is to be retried
 	}
 	// This field is only 32 bits wide, but is still aligned to 64
 	// bits. Don't place other atomic fields after this one.
 	isRunning AtomicBool
 
 	// Mostly protects endpoint, but is generally taken whenever we modify peer
-	sync.RWMutex
+	rankedRWMutex
 	keypairs                    Keypairs
 	handshake                   Handshake
 	device                      *Device
 	endpoint                    conn.Endpoint
+	endpointSeq                 uint64        // of the last SetPeerEndpoint applied
+	validEndpoint               conn.Endpoint // source of the last authenticated packet; see ExportEndpoints
 	allowedIPs                  []netaddr.IPPrefix
-	persistentKeepaliveInterval uint32 // accessed atomically
+	handshakeSources            []netaddr.IPPrefix // see SetHandshakeSources
+	persistentKeepaliveInterval uint32             // accessed atomically
 
 	disableRoaming bool
+	passive        AtomicBool // see SetPassive
+	mtu            int32      // accessed atomically; see SetMTU
+	decrypting     int32      // accessed atomically; see decryptionAllowed
+
+	queueHighWater struct { // see QueueHighWater
+		staged, outbound, inbound highWater
+	}
+
+	localBind struct {
+		sync.RWMutex
+		addr     string // see SetLocalAddr
+		bind     conn.Bind
+		stopping sync.WaitGroup
+		closing  AtomicBool // set while closeLocalBind closes bind
+	}
 
 	timers struct {
 		retransmitHandshake     *Timer
@@ -57,10 +91,19 @@ type Peer struct {
 		needAnotherKeepalive    AtomicBool
 		sentLastMinuteHandshake AtomicBool
 	}
+	handshakeRetry *HandshakeRetry // accessed atomically; nil for the device's
+	quality        peerQuality     // see Quality
+	dead           peerDeadness    // see IsDown
+	uapiPreserved  uapiPreserved   // see UnknownUAPIKeysPreserve
+	disabled       peerDisabled    // see SetDisabled
+	validity       peerValidity    // see SetValidity
+	flap           peerFlap        // see EndpointFlapPolicy
+	flowLabel      uint32          // accessed atomically; see FlowLabel
 
 	signals struct {
 		newKeypairArrived chan struct{}
 		flushNonceQueue   chan struct{}
+		sendKeepalive     chan struct{} // see SendKeepalive
 	}
 
 	queue struct {
@@ -78,12 +121,22 @@ type Peer struct {
 	}
 
 	cookieGenerator CookieGenerator
+	handshakeSpan   handshakeSpan // see spanInitiationSent
+
+	duplicateKey peerDuplicateKey // see DuplicateKeyPolicy
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
+	return device.newPeerContext(context.Background(), pk)
+}
 
-	if device.isClosed.Get() {
-		return nil, errors.New("device closed")
+// newPeerContext is NewPeer, tracing it as a child of any span in ctx.
+func (device *Device) newPeerContext(ctx context.Context, pk NoisePublicKey) (_ *Peer, err error) {
+	_, span := device.startSpan(ctx, "wireguard.NewPeer", device.peerAttribute(pk))
+	defer func() { endSpan(span, err) }()
+
+	if device.isClosed() {
+		return nil, ErrDeviceClosed
 	}
 
 	// lock resources
@@ -103,9 +156,11 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	// create peer
 
 	peer := new(Peer)
+	peer.rank = lockRankPeer
 	peer.Lock()
 	defer peer.Unlock()
 
+	peer.cookieGenerator.clock = device.clock
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
 
@@ -126,9 +181,12 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	handshake.initiationLimit.Fill = HandshakeInitationRate
 	handshake.mutex.Unlock()
 
-	// reset endpoint
+	peer.newFlowLabel(false)
+
+	// reset endpoint, to the last known one if stored
 
 	peer.endpoint = nil
+	device.restorePeer(peer, pk)
 
 	// add
 
@@ -137,7 +195,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	// start peer
 
-	if peer.device.isUp.Get() {
+	if peer.device.isUp() {
 		peer.Start()
 	}
 
@@ -145,16 +203,25 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 }
 
 func (peer *Peer) SendBuffer(buffer []byte) error {
+	// A frozen device's sessions belong to the process it was handed
+	// to; sending on them would reuse nonces.
+	if peer.device.frozen.Get() {
+		return nil
+	}
+
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
+	peer.localBind.RLock()
+	defer peer.localBind.RUnlock()
 
-	if peer.device.net.bind == nil {
+	bind, err := peer.sendBind()
+	if err != nil {
 		// Packets can leak through to SendBuffer while the device is closing.
 		// When that happens, drop them silently to avoid spurious errors.
-		if peer.device.isClosed.Get() {
+		if peer.device.isClosed() {
 			return nil
 		}
-		return errors.New("no bind")
+		return err
 	}
 
 	peer.RLock()
@@ -164,7 +231,10 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("no known endpoint for peer")
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	err = peer.device.countSendError(peer.send(bind, buffer))
+	if bind == peer.device.net.bind {
+		peer.device.noteSend(err)
+	}
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
 	}
@@ -172,6 +242,9 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 }
 
 func (peer *Peer) String() string {
+	if peer.device != nil && peer.device.redaction.Keys {
+		return fmt.Sprintf("peer(%s)", redactedKey(peer.handshake.remoteStatic))
+	}
 	base64Key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
 	abbreviatedKey := "invalid"
 	if len(base64Key) == 44 {
@@ -180,10 +253,80 @@ func (peer *Peer) String() string {
 	return fmt.Sprintf("peer(%s)", abbreviatedKey)
 }
 
+// PublicKey returns the public key of peer.
+func (peer *Peer) PublicKey() NoisePublicKey {
+	return peer.handshake.remoteStatic
+}
+
+// Endpoint returns the current endpoint of peer, or nil if it is unknown.
+func (peer *Peer) Endpoint() conn.Endpoint {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.endpoint
+}
+
+// AllowedIPs returns the prefixes routed to peer, or that would be if
+// it were not disabled.
+func (peer *Peer) AllowedIPs() []netaddr.IPPrefix {
+	if prefixes, ok := peer.disabledRoutes(); ok {
+		return prefixes
+	}
+	var prefixes []netaddr.IPPrefix
+	peer.device.allowedips.EntriesForPeerFunc(peer, func(prefix netaddr.IPPrefix) bool {
+		prefixes = append(prefixes, prefix)
+		return true
+	})
+	return prefixes
+}
+
+// LastHandshake returns the time of the most recent completed handshake
+// with peer, or the zero Time if there has been none.
+func (peer *Peer) LastHandshake() time.Time {
+	nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+// TxBytes returns the number of bytes sent to peer.
+func (peer *Peer) TxBytes() uint64 {
+	return atomic.LoadUint64(&peer.stats.txBytes)
+}
+
+// RxBytes returns the number of bytes received from peer.
+func (peer *Peer) RxBytes() uint64 {
+	return atomic.LoadUint64(&peer.stats.rxBytes)
+}
+
+// HandshakeCrossings returns the number of handshake initiations from
+// peer that crossed one sent to it.
+func (peer *Peer) HandshakeCrossings() uint64 {
+	return atomic.LoadUint64(&peer.stats.handshakeCrossings)
+}
+
+// SetPassive sets whether the peer is passive. The device never
+// initiates a handshake with a passive peer or sends it keepalives; it
+// only answers the peer's handshakes and sends it data over sessions the
+// peer established. Packets for a passive peer without a session wait
+// for the peer to initiate one.
+func (peer *Peer) SetPassive(passive bool) {
+	peer.passive.Set(passive)
+}
+
+// Passive reports whether the peer is passive.
+func (peer *Peer) Passive() bool {
+	return peer.passive.Get()
+}
+
+// Start starts the peer's routines, with fresh queues, whether it has
+// never run or was stopped by Stop; statistics and configuration are
+// kept across a restart. Starting a running or disabled peer does
+// nothing.
 func (peer *Peer) Start() error {
 
 	// should never start a peer on a closed device
-	if peer.device.isClosed.Get() {
+	if peer.device.isClosed() {
 		return errors.New("Start called on closed device")
 	}
 
@@ -192,8 +335,8 @@ func (peer *Peer) Start() error {
 	peer.routines.Lock()
 	defer peer.routines.Unlock()
 
-	if peer.isRunning.Get() {
-		return errors.New("Start called on running device")
+	if peer.isRunning.Get() || peer.disabled.on.Get() {
+		return nil
 	}
 
 	device := peer.device
@@ -207,9 +350,10 @@ func (peer *Peer) Start() error {
 
 	// prepare queues
 	peer.queue.Lock()
-	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.outbound = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.inbound = make(chan *QueueInboundElement, QueueInboundSize)
+	sizes := &peer.device.sizes
+	peer.queue.nonce = make(chan *QueueOutboundElement, sizes.queueOutbound)
+	peer.queue.outbound = make(chan *QueueOutboundElement, sizes.queueOutbound)
+	peer.queue.inbound = make(chan *QueueInboundElement, sizes.queueInbound)
 	peer.queue.Unlock()
 
 	peer.timersInit()
@@ -219,14 +363,19 @@ func (peer *Peer) Start() error {
 	//peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
 	peer.signals.newKeypairArrived = make(chan struct{}, 1)
 	peer.signals.flushNonceQueue = make(chan struct{}, 1)
+	peer.signals.sendKeepalive = make(chan struct{}, 1)
 
 	// wait for routines to start
 
 	// RoutineNonce writes to the encryption queue; keep it alive until we are done.
 	device.queue.encryption.wg.Add(1)
-	go peer.RoutineNonce()
-	go peer.RoutineSequentialSender()
-	go peer.RoutineSequentialReceiver()
+	device.goRoutine(peer.String()+" nonce", peer.RoutineNonce)
+	device.goRoutine(peer.String()+" sequential sender", peer.RoutineSequentialSender)
+	device.goRoutine(peer.String()+" sequential receiver", peer.RoutineSequentialReceiver)
+
+	// A failure is logged, and leaves the peer unable to send until
+	// its local address is set again.
+	peer.openLocalBind()
 
 	peer.isRunning.Set(true)
 	return nil
@@ -263,7 +412,7 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	handshake.mutex.Lock()
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
 	handshake.mutex.Unlock()
 
 	keypairs := &peer.keypairs
@@ -278,17 +427,20 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	keypairs.Unlock()
 }
 
+// Stop stops the peer's routines and drops its sessions and queued
+// packets, until it is started again. Stopping a stopped peer does
+// nothing.
 func (peer *Peer) Stop() {
 
 	// prevent simultaneous start/stop operations
 
+	peer.routines.Lock()
+	defer peer.routines.Unlock()
+
 	if !peer.isRunning.Swap(false) {
 		return
 	}
 
-	peer.routines.Lock()
-	defer peer.routines.Unlock()
-
 	peer.device.log.Debug.Println(peer, "- Stopping...")
 
 	peer.timersStop()
@@ -298,6 +450,8 @@ func (peer *Peer) Stop() {
 	close(peer.routines.stop)
 	peer.routines.stopping.Wait()
 
+	peer.closeLocalBind()
+
 	// close queues
 
 	peer.queue.Lock()
@@ -306,13 +460,101 @@ func (peer *Peer) Stop() {
 	peer.queue.Unlock()
 
 	peer.ZeroAndFlushAll()
+	peer.spanHandshakeEnded(errSpanPeerStopped)
+
+	/* With its sessions gone, nothing is left that rate limiting its
+	 * initiations protects: once started again, the peer may initiate
+	 * at once rather than RekeyTimeout after its last initiation.
+	 */
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Time{}
+	peer.handshake.mutex.Unlock()
+}
+
+// SetEndpointOptions modify a SetPeerEndpoint.
+type SetEndpointOptions struct {
+	// Seq, if non-zero, orders the update among those with a non-zero
+	// Seq: it is only applied if Seq is greater than that of every such
+	// update applied to the peer before. A coordinator sending a stream
+	// of updates from several goroutines numbers them so that a late one
+	// cannot undo a newer one.
+	Seq uint64
+
+	// Handshake sends a handshake initiation to the new endpoint if the
+	// peer is running and not passive, as TriggerHandshake does.
+	Handshake bool
+}
+
+// SetPeerEndpoint sets the endpoint of the peer with public key pk to ep,
+// clearing the source address cached in ep, as a NAT traversal protocol
+// does on finding a better path; Reconfig is too heavy for that. It
+// reports whether the update was applied rather than ignored as out of
+// order. The peer still roams to wherever its packets come from, unless
+// roaming is disabled.
+func (device *Device) SetPeerEndpoint(pk NoisePublicKey, ep conn.Endpoint, opts SetEndpointOptions) (bool, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return false, ErrPeerNotFound
+	}
+	if ep == nil {
+		return false, errors.New("nil endpoint")
+	}
+
+	peer.Lock()
+	if opts.Seq != 0 {
+		if opts.Seq <= peer.endpointSeq {
+			peer.Unlock()
+			return false, nil
+		}
+		peer.endpointSeq = opts.Seq
+	}
+	ep.ClearSrc()
+	peer.endpoint = ep
+	peer.Unlock()
+	device.logEvent(EventEndpoint, peer, device.redactEndpoint(ep)+" set")
+
+	if opts.Handshake && peer.isRunning.Get() && !peer.passive.Get() {
+		if err := peer.SendHandshakeInitiation(false); err != nil {
+			device.log.Debug.Println(peer, "- Failed to send handshake to new endpoint:", err)
+		}
+	}
+	return true, nil
 }
 
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
+	device := peer.device
+	peer.Lock()
+	peer.validEndpoint = endpoint
 	if peer.disableRoaming {
+		peer.Unlock()
 		return
 	}
-	peer.Lock()
-	peer.endpoint = endpoint
+	// Compared only for the event log, flap damping and duplicate keys,
+	// as it costs per packet.
+	if device.events == nil && device.endpointFlapPolicy.Threshold == 0 && device.duplicateKeyPolicy.Threshold == 0 {
+		peer.endpoint = endpoint
+		peer.Unlock()
+		return
+	}
+	old := peer.endpoint
+	if old != nil && bytes.Equal(old.DstToBytes(), endpoint.DstToBytes()) {
+		peer.endpoint = endpoint
+		peer.Unlock()
+		return
+	}
+	if peer.duplicateKeyHolds(endpoint) {
+		peer.Unlock()
+		return
+	}
+	flap, held := peer.dampRoam(old, endpoint)
+	if !held {
+		peer.endpoint = endpoint
+	}
 	peer.Unlock()
+	if flap != nil {
+		device.reportEndpointFlap(peer, flap)
+	}
+	if !held {
+		device.logEvent(EventEndpoint, peer, device.redactEndpoint(endpoint)+" roamed")
+	}
 }
@@ -6,9 +6,15 @@
 package device
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 	"unsafe"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"inet.af/netaddr"
 )
 
 func checkAlignment(t *testing.T, name string, offset uintptr) {
@@ -39,5 +45,127 @@ func TestPeerAlignment(t *testing.T) {
 	}
 
 	checkAlignment(t, "Peer.stats", unsafe.Offsetof(p.stats))
+	checkAlignment(t, "Peer.spoof", unsafe.Offsetof(p.spoof))
 	checkAlignment(t, "Peer.isRunning", unsafe.Offsetof(p.isRunning))
 }
+
+// TestDeviceAlignment checks that atomically-accessed fields of Device are
+// aligned to 64-bit boundaries.
+func TestDeviceAlignment(t *testing.T) {
+	var d Device
+
+	checkAlignment(t, "Device.stats", unsafe.Offsetof(d.stats))
+}
+
+func TestPeerAccessors(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+
+	key := pair[1].dev.staticIdentity.publicKey
+	peer := pair[0].dev.LookupPeer(key)
+	if got := peer.PublicKey(); got != key {
+		t.Errorf("PublicKey() = %x, want %x", got, key)
+	}
+	if peer.Endpoint() == nil {
+		t.Error("Endpoint() = nil")
+	}
+	want := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("1.0.0.2/32")}
+	if got := peer.AllowedIPs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AllowedIPs() = %v, want %v", got, want)
+	}
+	if hs := peer.LastHandshake(); hs.IsZero() || time.Since(hs) > time.Minute {
+		t.Errorf("LastHandshake() = %v", hs)
+	}
+	if peer.TxBytes() == 0 || peer.RxBytes() == 0 {
+		t.Errorf("TxBytes() = %d, RxBytes() = %d; want non-zero", peer.TxBytes(), peer.RxBytes())
+	}
+}
+
+func TestSetPeerEndpoint(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	peer := dev.Peers()[0]
+	good := peer.Endpoint()
+	pk := peer.handshake.remoteStatic
+
+	// Updates numbered out of order from many goroutines leave the
+	// highest-numbered endpoint in place.
+	const n = 64
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		ep, err := conn.CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", 10000+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(seq uint64, ep conn.Endpoint) {
+			defer wg.Done()
+			if _, err := dev.SetPeerEndpoint(pk, ep, SetEndpointOptions{Seq: seq}); err != nil {
+				t.Error(err)
+			}
+		}(uint64(n+1-i), ep)
+	}
+	wg.Wait()
+	if got, want := peer.Endpoint().DstToString(), "127.0.0.1:10001"; got != want {
+		t.Errorf("endpoint %s, want %s from the last update", got, want)
+	}
+	if applied, _ := dev.SetPeerEndpoint(pk, good, SetEndpointOptions{Seq: n}); applied {
+		t.Error("applied an update numbered like one already applied")
+	}
+
+	// Moving back to the real endpoint with a handshake restores traffic.
+	applied, err := dev.SetPeerEndpoint(pk, good, SetEndpointOptions{Seq: n + 1, Handshake: true})
+	if err != nil || !applied {
+		t.Fatalf("update not applied: %v", err)
+	}
+	pair.Send(t, Ping, nil)
+
+	var unknown NoisePublicKey
+	if _, err := dev.SetPeerEndpoint(unknown, good, SetEndpointOptions{}); err == nil {
+		t.Error("set the endpoint of an unknown peer")
+	}
+}
+
+func TestPeerRestart(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	peer := pair[0].dev.Peers()[0]
+	rx := peer.RxBytes()
+
+	// Concurrent starts and stops leave the peer in one state or the
+	// other, never half started.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(start bool) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if start {
+					if err := peer.Start(); err != nil {
+						t.Error(err)
+					}
+				} else {
+					peer.Stop()
+				}
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+
+	peer.Stop()
+	peer.Stop()
+	if err := peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Start(); err != nil {
+		t.Fatalf("Start of a running peer: %v", err)
+	}
+	if got := peer.RxBytes(); got < rx {
+		t.Errorf("RxBytes %d after restart, was %d", got, rx)
+	}
+
+	// The restarted peer has no session and initiates a new one at once.
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+}
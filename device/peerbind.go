@@ -0,0 +1,162 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// SetLocalAddr gives the peer a UDP socket of its own, bound to addr,
+// from which its packets are sent in place of the device's socket.
+// Packets arriving on it are handled like those arriving on the
+// device's. This lets packets to some peers leave from another address,
+// such as one on a management network chosen by policy routing.
+//
+// The address has the form "host:port", where host is an IP address or
+// empty for any address, and a port of zero lets the system pick one.
+// The socket is open while the peer runs, and carries the device's
+// fwmark. An empty addr returns the peer to the device's socket.
+func (peer *Peer) SetLocalAddr(addr string) error {
+	if addr != "" {
+		if _, _, err := parseLocalAddr(addr); err != nil {
+			return err
+		}
+	}
+
+	peer.routines.Lock()
+	defer peer.routines.Unlock()
+
+	peer.localBind.Lock()
+	same := peer.localBind.addr == addr
+	peer.localBind.Unlock()
+	if same {
+		return nil
+	}
+
+	peer.closeLocalBind()
+	peer.localBind.Lock()
+	peer.localBind.addr = addr
+	peer.localBind.Unlock()
+	if peer.isRunning.Get() {
+		return peer.openLocalBind()
+	}
+	return nil
+}
+
+// LocalAddr returns the address set by SetLocalAddr.
+func (peer *Peer) LocalAddr() string {
+	peer.localBind.RLock()
+	defer peer.localBind.RUnlock()
+	return peer.localBind.addr
+}
+
+func parseLocalAddr(addr string) (conn.BindOptions, uint16, error) {
+	var opts conn.BindOptions
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return opts, 0, err
+	}
+	if host != "" {
+		if opts.Addr = net.ParseIP(host); opts.Addr == nil {
+			return opts, 0, fmt.Errorf("invalid local address %q", host)
+		}
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return opts, 0, fmt.Errorf("invalid local port %q", port)
+	}
+	return opts, uint16(n), nil
+}
+
+// openLocalBind opens the peer's socket, if it has a local address.
+// It must be called with peer.routines locked.
+func (peer *Peer) openLocalBind() error {
+	device := peer.device
+
+	peer.localBind.Lock()
+	defer peer.localBind.Unlock()
+
+	if peer.localBind.addr == "" || peer.localBind.bind != nil {
+		return nil
+	}
+	opts, port, err := parseLocalAddr(peer.localBind.addr)
+	if err != nil {
+		return err
+	}
+	opts.Control = device.bindControl
+	bind, _, err := conn.CreateBindWithOptions(port, opts)
+	if err != nil {
+		device.log.Error.Println(peer, "- Failed to bind local address", peer.localBind.addr, ":", err)
+		return err
+	}
+
+	/* The fwmark is read without locking device.net, which BindUpdate
+	 * holds while waiting for device.peers, as NewPeer starts peers with
+	 * device.peers locked. BindSetMark stores it before marking the open
+	 * local binds, so a bind opened meanwhile is marked by one or the other.
+	 */
+
+	if fwmark := atomic.LoadUint32(&device.net.fwmark); fwmark != 0 {
+		if err := bind.SetMark(fwmark); err != nil {
+			bind.Close()
+			return err
+		}
+	}
+
+	peer.localBind.bind = bind
+	peer.localBind.stopping.Add(2)
+	device.goRoutine(peer.String()+" receive incoming IPv4", func() {
+		device.receiveIncoming(ipv4.Version, bind, &peer.localBind.stopping, &peer.localBind.closing)
+	})
+	device.goRoutine(peer.String()+" receive incoming IPv6", func() {
+		device.receiveIncoming(ipv6.Version, bind, &peer.localBind.stopping, &peer.localBind.closing)
+	})
+	device.log.Debug.Println(peer, "- UDP bind on", peer.localBind.addr, "opened")
+	return nil
+}
+
+// closeLocalBind closes the peer's socket and waits for its receive
+// routines to finish.
+// It must be called with peer.routines locked.
+func (peer *Peer) closeLocalBind() {
+	peer.localBind.Lock()
+	bind := peer.localBind.bind
+	peer.localBind.bind = nil
+	peer.localBind.Unlock()
+
+	if bind == nil {
+		return
+	}
+	peer.localBind.closing.Set(true)
+	if err := bind.Close(); err != nil {
+		peer.device.log.Error.Println(peer, "- Failed to close local bind:", err)
+	}
+	peer.localBind.stopping.Wait()
+	peer.localBind.closing.Set(false)
+}
+
+// sendBind returns the bind to send the peer's packets on.
+// It must be called with device.net and peer.localBind read locked.
+func (peer *Peer) sendBind() (conn.Bind, error) {
+	if peer.localBind.addr == "" {
+		if peer.device.net.bind == nil {
+			return nil, errors.New("no bind")
+		}
+		return peer.device.net.bind, nil
+	}
+	if peer.localBind.bind == nil {
+		return nil, errors.New("no local bind")
+	}
+	return peer.localBind.bind, nil
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerLocalAddr(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	peer0 := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	if err := peer0.SetLocalAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+	if got := peer0.LocalAddr(); got != addr {
+		t.Fatalf("LocalAddr() = %q, want %q", got, addr)
+	}
+
+	// dev1 sees dev0's packets come from the peer's own port, and
+	// replies to it.
+	pair.Send(t, Pong, nil)
+	peer1 := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	suffix := fmt.Sprintf(":%d", port)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.HasSuffix(peer1.Endpoint().DstToString(), suffix) {
+		if time.Now().After(deadline) {
+			t.Fatalf("dev1 sends to %s, want port %d", peer1.Endpoint().DstToString(), port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pair.Send(t, Ping, nil)
+
+	cfg, err := pair[0].dev.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Peers[0].LocalAddr; got != addr {
+		t.Errorf("Config LocalAddr = %q, want %q", got, addr)
+	}
+
+	// Back on the device's socket.
+	if err := peer0.SetLocalAddr(""); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+
+	if err := peer0.SetLocalAddr("localhost:1"); err == nil {
+		t.Error("SetLocalAddr accepted a host name")
+	}
+}
@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// PeerSaveInterval is how often a device with a PeerStore saves what it
+// knows of its peers, if that has changed.
+const PeerSaveInterval = 10 * time.Second
+
+// A PeerRecord is what a PeerStore keeps of a peer.
+type PeerRecord struct {
+	PublicKey     wgcfg.Key
+	Endpoint      string    `json:",omitempty"` // last known, as conn.Endpoint.DstToString
+	LastHandshake time.Time `json:",omitempty"`
+}
+
+// A PeerStore keeps the last known endpoints and handshake times of a
+// device's peers somewhere that outlives the process, so that a device
+// created after a restart can reach its peers at once, without waiting
+// for them to reach it, or for the configuration to say where they are.
+//
+// SavePeers replaces every record saved before with records. LoadPeers
+// returns the last records saved. Neither is called concurrently with
+// itself or the other.
+type PeerStore interface {
+	SavePeers(records []PeerRecord) error
+	LoadPeers() ([]PeerRecord, error)
+}
+
+type peerStoreState struct {
+	sync.Mutex
+	store   PeerStore
+	restore map[NoisePublicKey]restoredPeer // loaded, for peers not yet created
+	saved   []PeerRecord                    // last saved
+}
+
+type restoredPeer struct {
+	endpoint          conn.Endpoint
+	lastHandshakeNano int64
+}
+
+// loadPeerRecords loads the device's store, keeping the records for
+// restorePeer. Endpoints that no longer parse are dropped.
+func (device *Device) loadPeerRecords() {
+	ps := &device.peerStore
+	ps.Lock()
+	defer ps.Unlock()
+	records, err := ps.store.LoadPeers()
+	if err != nil {
+		device.log.Error.Println("Failed to load peers:", err)
+		return
+	}
+	ps.saved = records
+	ps.restore = make(map[NoisePublicKey]restoredPeer, len(records))
+	for _, r := range records {
+		var rp restoredPeer
+		if !r.LastHandshake.IsZero() {
+			rp.lastHandshakeNano = r.LastHandshake.UnixNano()
+		}
+		if r.Endpoint != "" {
+			rp.endpoint, err = device.createEndpoint(r.PublicKey, r.Endpoint)
+			if err != nil {
+				device.log.Info.Printf("Dropping stored endpoint %s of peer %s: %v\n", device.redactAddrs(r.Endpoint), device.redactKey(r.PublicKey), device.redactAddrErr(err))
+			}
+		}
+		ps.restore[NoisePublicKey(r.PublicKey)] = rp
+	}
+}
+
+// restorePeer gives a new peer its stored endpoint and last handshake
+// time, if the store has them. The configuration may replace the
+// endpoint.
+func (device *Device) restorePeer(peer *Peer, pk NoisePublicKey) {
+	if device.peerStore.store == nil {
+		return
+	}
+	ps := &device.peerStore
+	ps.Lock()
+	rp, ok := ps.restore[pk]
+	delete(ps.restore, pk)
+	ps.Unlock()
+	if !ok {
+		return
+	}
+	if rp.endpoint != nil {
+		peer.endpoint = rp.endpoint
+	}
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, rp.lastHandshakeNano)
+}
+
+// peerRecords returns the records of the device's peers, ordered by
+// public key.
+func (device *Device) peerRecords() []PeerRecord {
+	peers := device.Peers()
+	records := make([]PeerRecord, 0, len(peers))
+	for _, peer := range peers {
+		r := PeerRecord{
+			PublicKey:     wgcfg.Key(peer.handshake.remoteStatic),
+			LastHandshake: peer.LastHandshake(),
+		}
+		if ep := peer.Endpoint(); ep != nil {
+			r.Endpoint = ep.DstToString()
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func peerRecordsEqual(a, b []PeerRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].PublicKey != b[i].PublicKey || a[i].Endpoint != b[i].Endpoint || !a[i].LastHandshake.Equal(b[i].LastHandshake) {
+			return false
+		}
+	}
+	return true
+}
+
+// SavePeers saves the last known endpoints and handshake times of the
+// device's peers to its PeerStore, if they have changed since the last
+// save, which the device also does every PeerSaveInterval and on Close.
+// It does nothing if the device has no store.
+func (device *Device) SavePeers() error {
+	if device.peerStore.store == nil {
+		return nil
+	}
+	records := device.peerRecords()
+	ps := &device.peerStore
+	ps.Lock()
+	defer ps.Unlock()
+	if peerRecordsEqual(records, ps.saved) {
+		return nil
+	}
+	if err := ps.store.SavePeers(records); err != nil {
+		return err
+	}
+	ps.saved = records
+	return nil
+}
+
+func (device *Device) RoutineSavePeers() {
+	ticker := time.NewTicker(PeerSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+		}
+		if device.frozen.Get() {
+			continue
+		}
+		if err := device.SavePeers(); err != nil {
+			device.log.Error.Println("Failed to save peers:", err)
+		}
+	}
+}
+
+// A PeerFile is a PeerStore that keeps the records as JSON in the file
+// it names, which it replaces atomically on every save. A missing file
+// holds no records.
+type PeerFile string
+
+func (f PeerFile) SavePeers(records []PeerRecord) error {
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(string(f)), filepath.Base(string(f))+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(f))
+}
+
+func (f PeerFile) LoadPeers() ([]PeerRecord, error) {
+	b, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []PeerRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
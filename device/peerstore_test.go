@@ -0,0 +1,56 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerStore(t *testing.T) {
+	store := PeerFile(filepath.Join(t.TempDir(), "peers.json"))
+	if records, err := store.LoadPeers(); err != nil || records != nil {
+		t.Fatalf("LoadPeers of a missing file: %v, %v", records, err)
+	}
+	newDevice := func() *Device {
+		return NewDevice(newDummyTUN("dummy"), &DeviceOptions{
+			Logger:    NewLogger(LogLevelError, ""),
+			PeerStore: store,
+		})
+	}
+
+	dev := newDevice()
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "endpoint", "127.0.0.1:1234")); err != nil {
+		t.Fatal(err)
+	}
+	handshake := time.Unix(1600000000, 0)
+	atomic.StoreInt64(&dev.Peers()[0].stats.lastHandshakeNano, handshake.UnixNano())
+	dev.Close()
+
+	records, err := store.LoadPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Endpoint != "127.0.0.1:1234" || !records[0].LastHandshake.Equal(handshake) {
+		t.Fatalf("saved %+v", records)
+	}
+
+	// After the restart, the peer is configured without an endpoint.
+	dev = newDevice()
+	defer dev.Close()
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey)); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.Peers()[0]
+	if ep := peer.Endpoint(); ep == nil || ep.DstToString() != "127.0.0.1:1234" {
+		t.Errorf("restored endpoint %v, want 127.0.0.1:1234", ep)
+	}
+	if !peer.LastHandshake().Equal(handshake) {
+		t.Errorf("restored last handshake %v, want %v", peer.LastHandshake(), handshake)
+	}
+}
@@ -5,13 +5,132 @@
 
 package device
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
-func (device *Device) PopulatePools() {
+// A PoolMode is how a device reuses its message buffers and queue
+// elements.
+type PoolMode int
+
+const (
+	// PoolDefault is the platform's mode: PoolBounded with
+	// PreallocatedBuffersPerPool of each, or PoolSync where that is
+	// zero, as it is but on Android and iOS.
+	PoolDefault PoolMode = iota
+
+	// PoolSync keeps them in sync.Pools, which allocate as needed and
+	// which the garbage collector empties.
+	PoolSync
+
+	// PoolBounded allocates Pools.Size of each up front and never
+	// more, capping the device's memory: when all are in use, taking
+	// one waits for one to be returned.
+	PoolBounded
+
+	// PoolPreallocated allocates Pools.Size of each up front and keeps
+	// them through garbage collections, sparing a busy server the
+	// allocations sync.Pools make after each. When they run out, more
+	// are allocated, and those that do not fit back are left to the
+	// garbage collector.
+	PoolPreallocated
+)
+
+var poolModeNames = [...]string{
+	PoolDefault:      "default",
+	PoolSync:         "sync",
+	PoolBounded:      "bounded",
+	PoolPreallocated: "preallocated",
+}
+
+func (m PoolMode) String() string {
+	if m < 0 || int(m) >= len(poolModeNames) {
+		return "unknown"
+	}
+	return poolModeNames[m]
+}
+
+// Pools configures how a device reuses its message buffers and queue
+// elements. The zero Pools is the platform's default.
+type Pools struct {
+	Mode PoolMode
+
+	// Size is the number of message buffers, and of each kind of queue
+	// element, that PoolBounded and PoolPreallocated allocate up front.
+	// Each message buffer is sized for the TUN device's MTU; see
+	// MessageBufferSize.
+	Size int
+}
+
+func (p Pools) valid() bool {
+	switch p.Mode {
+	case PoolDefault, PoolSync:
+		return true
+	case PoolBounded, PoolPreallocated:
+		return p.Size > 0
+	}
+	return false
+}
+
+// resolve returns p with PoolDefault replaced by the platform's mode.
+func (p Pools) resolve() Pools {
+	if p.Mode != PoolDefault {
+		return p
+	}
 	if PreallocatedBuffersPerPool == 0 {
+		return Pools{Mode: PoolSync}
+	}
+	return Pools{Mode: PoolBounded, Size: PreallocatedBuffersPerPool}
+}
+
+// MinMessageBufferSize is the smallest message buffer a device uses, to
+// receive the packets of peers with an MTU up to 2016 bytes whatever the
+// device's own, so that MTUs up to Ethernet's need not match.
+const MinMessageBufferSize = 2048
+
+// MessageBufferSize returns the size of the message buffers of a device
+// whose TUN device has an MTU of mtu: room for a packet of that size
+// sealed in a transport message, rounded up to a kilobyte, between
+// MinMessageBufferSize and MaxMessageSize. A device with the default MTU
+// thus takes 2KiB per buffer, not the 64KiB of the largest datagram.
+//
+// Datagrams are received into the same buffers, so one too large for
+// them, from a peer with a larger MTU, cannot be received whole. A
+// datagram that fills a buffer smaller than MaxMessageSize is taken to
+// be truncated and is dropped as DropTruncated; raising the TUN device's
+// MTU to the peer's lets it through.
+func MessageBufferSize(mtu int) int {
+	size := (mtu + MessageTransportSize + 1023) &^ 1023
+	if size < MinMessageBufferSize {
+		size = MinMessageBufferSize
+	}
+	if size > MaxMessageSize {
+		size = MaxMessageSize
+	}
+	return size
+}
+
+// messageBufferSize returns the size of the buffers GetMessageBuffer
+// returns.
+func (device *Device) messageBufferSize() int {
+	return int(atomic.LoadInt32(&device.pool.messageBufferSize))
+}
+
+// resizeMessageBuffers sizes the message buffers for a TUN device MTU of
+// mtu. Buffers too small for it are replaced as they are taken, and
+// larger ones are kept.
+func (device *Device) resizeMessageBuffers(mtu int) {
+	atomic.StoreInt32(&device.pool.messageBufferSize, int32(MessageBufferSize(mtu)))
+}
+
+func (device *Device) PopulatePools() {
+	device.resizeMessageBuffers(int(atomic.LoadInt32(&device.tun.mtu)))
+	size := device.pool.config.Size
+	if device.pool.config.Mode == PoolSync {
 		device.pool.messageBufferPool = &sync.Pool{
 			New: func() interface{} {
-				return new([MaxMessageSize]byte)
+				return make([]byte, device.messageBufferSize())
 			},
 		}
 		device.pool.inboundElementPool = &sync.Pool{
@@ -25,67 +144,140 @@ func (device *Device) PopulatePools() {
 			},
 		}
 	} else {
-		device.pool.messageBufferReuseChan = make(chan *[MaxMessageSize]byte, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i++ {
-			device.pool.messageBufferReuseChan <- new([MaxMessageSize]byte)
+		/* Each kind is carved out of a single slab, so that the garbage
+		 * collector has three objects to track instead of thousands.
+		 */
+		n := device.messageBufferSize()
+		buffers := make([]byte, size*n)
+		device.pool.messageBufferReuseChan = make(chan []byte, size)
+		for i := 0; i < size; i++ {
+			device.pool.messageBufferReuseChan <- buffers[i*n : (i+1)*n : (i+1)*n]
 		}
-		device.pool.inboundElementReuseChan = make(chan *QueueInboundElement, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i++ {
-			device.pool.inboundElementReuseChan <- new(QueueInboundElement)
+		inbound := make([]QueueInboundElement, size)
+		device.pool.inboundElementReuseChan = make(chan *QueueInboundElement, size)
+		for i := range inbound {
+			device.pool.inboundElementReuseChan <- &inbound[i]
 		}
-		device.pool.outboundElementReuseChan = make(chan *QueueOutboundElement, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i++ {
-			device.pool.outboundElementReuseChan <- new(QueueOutboundElement)
+		outbound := make([]QueueOutboundElement, size)
+		device.pool.outboundElementReuseChan = make(chan *QueueOutboundElement, size)
+		for i := range outbound {
+			device.pool.outboundElementReuseChan <- &outbound[i]
 		}
 	}
 }
 
-func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
-	if PreallocatedBuffersPerPool == 0 {
-		return device.pool.messageBufferPool.Get().(*[MaxMessageSize]byte)
-	} else {
+// GetMessageBuffer returns a buffer of messageBufferSize bytes.
+func (device *Device) GetMessageBuffer() []byte {
+	msg := device.getMessageBuffer()
+	if n := device.messageBufferSize(); len(msg) < n {
+		// Taken before the MTU grew.
+		msg = make([]byte, n)
+	}
+	return msg
+}
+
+func (device *Device) getMessageBuffer() []byte {
+	switch device.pool.config.Mode {
+	case PoolSync:
+		return device.pool.messageBufferPool.Get().([]byte)
+	case PoolPreallocated:
+		select {
+		case msg := <-device.pool.messageBufferReuseChan:
+			return msg
+		default:
+			return make([]byte, device.messageBufferSize())
+		}
+	default:
 		return <-device.pool.messageBufferReuseChan
 	}
 }
 
-func (device *Device) PutMessageBuffer(msg *[MaxMessageSize]byte) {
-	if PreallocatedBuffersPerPool == 0 {
+func (device *Device) PutMessageBuffer(msg []byte) {
+	switch device.pool.config.Mode {
+	case PoolSync:
 		device.pool.messageBufferPool.Put(msg)
-	} else {
+	case PoolPreallocated:
+		select {
+		case device.pool.messageBufferReuseChan <- msg:
+		default:
+		}
+	default:
 		device.pool.messageBufferReuseChan <- msg
 	}
 }
 
 func (device *Device) GetInboundElement() *QueueInboundElement {
-	if PreallocatedBuffersPerPool == 0 {
+	elem := device.getInboundElement()
+	device.trackElement(elem, 1)
+	return elem
+}
+
+func (device *Device) getInboundElement() *QueueInboundElement {
+	switch device.pool.config.Mode {
+	case PoolSync:
 		return device.pool.inboundElementPool.Get().(*QueueInboundElement)
-	} else {
+	case PoolPreallocated:
+		select {
+		case elem := <-device.pool.inboundElementReuseChan:
+			return elem
+		default:
+			return new(QueueInboundElement)
+		}
+	default:
 		return <-device.pool.inboundElementReuseChan
 	}
 }
 
 func (device *Device) PutInboundElement(elem *QueueInboundElement) {
+	device.untrackElement(elem)
 	elem.clearPointers()
-	if PreallocatedBuffersPerPool == 0 {
+	switch device.pool.config.Mode {
+	case PoolSync:
 		device.pool.inboundElementPool.Put(elem)
-	} else {
+	case PoolPreallocated:
+		select {
+		case device.pool.inboundElementReuseChan <- elem:
+		default:
+		}
+	default:
 		device.pool.inboundElementReuseChan <- elem
 	}
 }
 
 func (device *Device) GetOutboundElement() *QueueOutboundElement {
-	if PreallocatedBuffersPerPool == 0 {
+	elem := device.getOutboundElement()
+	device.trackElement(elem, 1)
+	return elem
+}
+
+func (device *Device) getOutboundElement() *QueueOutboundElement {
+	switch device.pool.config.Mode {
+	case PoolSync:
 		return device.pool.outboundElementPool.Get().(*QueueOutboundElement)
-	} else {
+	case PoolPreallocated:
+		select {
+		case elem := <-device.pool.outboundElementReuseChan:
+			return elem
+		default:
+			return new(QueueOutboundElement)
+		}
+	default:
 		return <-device.pool.outboundElementReuseChan
 	}
 }
 
 func (device *Device) PutOutboundElement(elem *QueueOutboundElement) {
+	device.untrackElement(elem)
 	elem.clearPointers()
-	if PreallocatedBuffersPerPool == 0 {
+	switch device.pool.config.Mode {
+	case PoolSync:
 		device.pool.outboundElementPool.Put(elem)
-	} else {
+	case PoolPreallocated:
+		select {
+		case device.pool.outboundElementReuseChan <- elem:
+		default:
+		}
+	default:
 		device.pool.outboundElementReuseChan <- elem
 	}
 }
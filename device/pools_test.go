@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestPools(t *testing.T) {
+	tests := []struct {
+		name  string
+		pools Pools
+		low   bool
+		want  Pools
+	}{
+		{"default", Pools{}, false, Pools{}.resolve()},
+		{"sync", Pools{Mode: PoolSync}, false, Pools{Mode: PoolSync}},
+		{"bounded", Pools{Mode: PoolBounded, Size: 16}, false, Pools{Mode: PoolBounded, Size: 16}},
+		{"preallocated", Pools{Mode: PoolPreallocated, Size: 16}, false, Pools{Mode: PoolPreallocated, Size: 16}},
+		{"low-memory", Pools{}, true, Pools{Mode: PoolBounded, Size: LowMemoryBuffers}},
+		{"low-memory-override", Pools{Mode: PoolPreallocated, Size: 256}, true, Pools{Mode: PoolPreallocated, Size: 256}},
+		{"invalid", Pools{Mode: PoolBounded}, false, Pools{}.resolve()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+				opts.Pools = tt.pools
+				opts.LowMemory = tt.low
+			})
+			pair.Send(t, Ping, nil)
+			pair.Send(t, Pong, nil)
+			dev := pair[0].dev
+			if got := dev.pool.config; got != tt.want {
+				t.Fatalf("pools %+v, want %+v", got, tt.want)
+			}
+			if tt.want.Mode == PoolSync {
+				return
+			}
+			if got := cap(dev.pool.messageBufferReuseChan); got != tt.want.Size {
+				t.Errorf("%d message buffers, want %d", got, tt.want.Size)
+			}
+		})
+	}
+}
+
+func TestPoolPreallocatedOverflow(t *testing.T) {
+	device := &Device{}
+	device.pool.config = Pools{Mode: PoolPreallocated, Size: 2}
+	device.PopulatePools()
+	var bufs [][]byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 4; i++ {
+			bufs = append(bufs, device.GetMessageBuffer())
+		}
+		for _, buf := range bufs {
+			device.PutMessageBuffer(buf)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("taking more buffers than preallocated blocked")
+	}
+	if got := len(device.pool.messageBufferReuseChan); got != 2 {
+		t.Errorf("%d buffers kept, want 2", got)
+	}
+}
+
+func TestMessageBufferSize(t *testing.T) {
+	tests := []struct {
+		mtu, want int
+	}{
+		{1280, MinMessageBufferSize},
+		{DefaultMTU, 2048},
+		{2016, 2048},
+		{2017, 3072},
+		{9000, 9216},
+		{65535, MaxMessageSize},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if want > MaxMessageSize {
+			want = MaxMessageSize
+		}
+		if got := MessageBufferSize(tt.mtu); got != want {
+			t.Errorf("MessageBufferSize(%d) = %d, want %d", tt.mtu, got, want)
+		}
+	}
+}
+
+func TestResizeMessageBuffers(t *testing.T) {
+	for _, mode := range []PoolMode{PoolSync, PoolBounded, PoolPreallocated} {
+		t.Run(mode.String(), func(t *testing.T) {
+			device := &Device{}
+			device.tun.mtu = DefaultMTU
+			device.pool.config = Pools{Mode: mode, Size: 4}
+			device.PopulatePools()
+			small := device.GetMessageBuffer()
+			if len(small) != MessageBufferSize(DefaultMTU) {
+				t.Fatalf("buffer of %d bytes, want %d", len(small), MessageBufferSize(DefaultMTU))
+			}
+			device.PutMessageBuffer(small)
+
+			device.resizeMessageBuffers(9000)
+			for i := 0; i < 4; i++ {
+				if got := device.GetMessageBuffer(); len(got) != MessageBufferSize(9000) {
+					t.Fatalf("buffer of %d bytes after the MTU grew, want %d", len(got), MessageBufferSize(9000))
+				}
+			}
+		})
+	}
+}
+
+func TestReceiveTruncated(t *testing.T) {
+	binds, _ := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, ""),
+		CreateBind: func(uint16) (conn.Bind, uint16, error) {
+			return binds[0], 1, nil
+		},
+	})
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A datagram too long for the buffers, as from a peer with a larger
+	// MTU, is counted, not taken for a shorter one.
+	pkt := make([]byte, MessageBufferSize(DefaultMTU)+100)
+	pkt[0] = MessageTransportType
+	if err := binds[1].Send(pkt, bindtest.ChannelEndpoint(1)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dev.DropCounts()[DropTruncated] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("drops %v, want one truncated", dev.DropCounts())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := dev.DropCounts()[DropUnknownReceiver]; n != 0 {
+		t.Errorf("truncated datagram also dropped as %v", DropUnknownReceiver)
+	}
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+// PortRange is an inclusive range of UDP ports. The zero PortRange is
+// empty.
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (r PortRange) empty() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+func (r PortRange) valid() bool {
+	return r.empty() || (r.Min != 0 && r.Min <= r.Max)
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return !r.empty() && port >= r.Min && port <= r.Max
+}
+
+// next returns the port after port in r, wrapping around to r.Min.
+func (r PortRange) next(port uint16) uint16 {
+	if port >= r.Max {
+		return r.Min
+	}
+	return port + 1
+}
+
+// bindPort creates a bind on port. If port lies in the listen port
+// range, or is zero and a range is set, a port that cannot be bound is
+// skipped in favour of the next one in the range, until every port of
+// it has been tried.
+func (device *Device) bindPort(ctx context.Context, port uint16) (conn.Bind, uint16, error) {
+	r := device.listenPortRange
+	if port == 0 && !r.empty() {
+		port = r.Min
+	}
+	if !r.contains(port) {
+		return device.createBindContext(ctx, port)
+	}
+
+	first := port
+	var err error
+	for {
+		var bind conn.Bind
+		var actual uint16
+		bind, actual, err = device.createBindContext(ctx, port)
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		if err == nil {
+			if port != first {
+				device.log.Info.Println("UDP port", first, "unavailable, using", actual)
+			}
+			return bind, actual, nil
+		}
+		device.log.Debug.Println("Failed to bind UDP port", port, ":", err)
+		port = r.next(port)
+		if port == first {
+			break
+		}
+	}
+	return nil, 0, fmt.Errorf("no port in listen port range %d-%d could be bound: %w", r.Min, r.Max, err)
+}
+
+// listenPortSatisfied reports whether the current bind already meets a
+// request for port: any port will do for zero, and any port of the
+// listen port range for a port in it.
+// It must be called with device.net locked.
+func (device *Device) listenPortSatisfied(port uint16) bool {
+	if device.net.bind == nil {
+		return false
+	}
+	if port == 0 || port == device.net.port {
+		return true
+	}
+	r := device.listenPortRange
+	return r.contains(port) && r.contains(device.net.port)
+}
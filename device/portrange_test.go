@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+func TestPortRangeNext(t *testing.T) {
+	r := PortRange{Min: 100, Max: 102}
+	for _, tt := range []struct{ in, want uint16 }{
+		{100, 101},
+		{101, 102},
+		{102, 100},
+	} {
+		if got := r.next(tt.in); got != tt.want {
+			t.Errorf("next(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+	if (PortRange{Min: 0, Max: 10}).valid() || (PortRange{Min: 10, Max: 9}).valid() {
+		t.Error("invalid range accepted")
+	}
+}
+
+func TestListenPortRange(t *testing.T) {
+	// Hold the first port of the range so the device must move on.
+	busy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	first := uint16(busy.LocalAddr().(*net.UDPAddr).Port)
+	if first > 65535-20 {
+		t.Skip("ephemeral port too close to the end of the port space")
+	}
+	r := PortRange{Min: first, Max: first + 20}
+
+	chosen := make(chan uint16, 4)
+	dev := NewDevice(newNilTun(), &DeviceOptions{
+		Logger:           NewLogger(LogLevelError, "dev: "),
+		ListenPortRange:  r,
+		ListenPortChosen: func(port uint16) { chosen <- port },
+	})
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.IpcSetOperation(uapiCfg("private_key", sk.ToHex(), "listen_port", "0")); err != nil {
+		t.Fatal(err)
+	}
+	dev.Up()
+
+	port := <-chosen
+	if port == first || !r.contains(port) {
+		t.Fatalf("bound port %d, want one in %d-%d other than %d", port, r.Min, r.Max, first)
+	}
+	if got := dev.Config().ListenPort; got != port {
+		t.Errorf("Config().ListenPort = %d, want %d", got, port)
+	}
+
+	// Asking for the busy port again is satisfied by the port in use.
+	cfg := dev.Config()
+	cfg.ListenPort = first
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-chosen:
+		t.Errorf("Reconfig rebound to port %d", p)
+	default:
+	}
+}
+
+func TestBindOptions(t *testing.T) {
+	for _, opts := range []conn.BindOptions{
+		{Addr: net.IPv4(127, 0, 0, 1)},
+		{Interface: "lo"},
+	} {
+		opts := opts
+		t.Run(fmt.Sprintf("%v/%s", opts.Addr, opts.Interface), func(t *testing.T) {
+			pair := genTestPairWithOptions(t, func(i int, o *DeviceOptions) {
+				o.BindOptions = opts
+			})
+			pair.Send(t, Ping, nil)
+			pair.Send(t, Pong, nil)
+
+			if opts.Addr == nil {
+				return
+			}
+			// The port is only taken on the given address.
+			dev := pair[0].dev
+			dev.net.RLock()
+			port := int(dev.net.port)
+			dev.net.RUnlock()
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port})
+			if err != nil {
+				t.Fatalf("port %d taken on other addresses: %v", port, err)
+			}
+			c.Close()
+		})
+	}
+}
+
+func TestBindControl(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		controls [2]map[string]int
+	)
+	pair := genTestPairWithOptions(t, func(i int, o *DeviceOptions) {
+		controls[i] = make(map[string]int)
+		o.BindOptions.Control = func(network string, fd uintptr) error {
+			mu.Lock()
+			defer mu.Unlock()
+			controls[i][network]++
+			return nil
+		}
+	})
+	pair.Send(t, Ping, nil)
+	count := func(i int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return controls[i]["udp4"]
+	}
+	before := count(0)
+	if before == 0 {
+		t.Fatal("Control not called with the IPv4 socket")
+	}
+
+	// Every new socket is handed to Control before it is used.
+	if err := pair[0].dev.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(0); got != before+1 {
+		t.Errorf("Control called %d times after a rebind, want %d", got, before+1)
+	}
+	pair.Send(t, Ping, nil)
+
+	dev := NewDevice(newDummyTUN("control"), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, ""),
+		BindOptions: conn.BindOptions{
+			Control: func(network string, fd uintptr) error {
+				return errors.New("not protected")
+			},
+		},
+	})
+	defer dev.Close()
+	if err := dev.Up(); err == nil {
+		t.Error("Up succeeded though Control failed")
+	}
+}
@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+	"time"
+)
+
+// PortRotation configures periodic rebinding of the device's UDP socket
+// to a new local port, so that the port, and any NAT mapping made for it,
+// cannot be used to follow the device over time. Sessions survive a
+// rotation: peers roam to the new port when they next hear from it, and
+// the device sends keepalives to every peer with a session right after
+// rebinding so that they do so at once.
+//
+// Rotation is meant for devices without a fixed listen port. A Reconfig
+// or UAPI set naming a port binds to it until the next rotation.
+type PortRotation struct {
+	// Interval is the time between rotations. Zero disables rotation,
+	// though RotatePort may still be called.
+	Interval time.Duration
+
+	// MinPort and MaxPort bound the ports chosen, inclusive. If both
+	// are zero, DeviceOptions.ListenPortRange bounds them instead, and
+	// if that is empty too, the operating system picks each port.
+	MinPort, MaxPort uint16
+}
+
+// portRotationAttempts is how many ports RotatePort tries before giving
+// up and returning to the port it started from.
+const portRotationAttempts = 10
+
+// RotatePort rebinds the device to a new local port, chosen as
+// DeviceOptions.PortRotation specifies. It does nothing while the device
+// is down.
+func (device *Device) RotatePort() error {
+	device.state.Lock()
+	defer device.state.Unlock()
+
+	if !device.isUp() {
+		return nil
+	}
+	if device.skipBindUpdate {
+		return errors.New("port rotation is unavailable with SkipBindUpdate")
+	}
+
+	device.net.RLock()
+	oldPort := device.net.port
+	device.net.RUnlock()
+
+	min, max := device.portRotation.MinPort, device.portRotation.MaxPort
+	if min == 0 && max == 0 {
+		min, max = device.listenPortRange.Min, device.listenPortRange.Max
+	}
+
+	var err error
+	for i := 0; i < portRotationAttempts; i++ {
+		var port uint16
+		port, err = pickPort(device.rand, min, max, oldPort)
+		if err != nil {
+			return err
+		}
+		device.net.Lock()
+		device.net.port = port
+		device.net.Unlock()
+		if err = device.BindUpdate(); err == nil {
+			device.net.RLock()
+			device.log.Debug.Println("UDP port rotated from", oldPort, "to", device.net.port)
+			device.net.RUnlock()
+			device.SendKeepalivesToPeersWithCurrentKeypair()
+			return nil
+		}
+	}
+
+	device.log.Error.Println("Failed to rotate UDP port:", err)
+	device.net.Lock()
+	device.net.port = oldPort
+	device.net.Unlock()
+	if err := device.BindUpdate(); err != nil {
+		device.log.Error.Println("Failed to return to UDP port", oldPort, ":", err)
+	}
+	return err
+}
+
+// pickPort returns a port in [min, max] other than current, chosen with
+// randomness from r, or zero, for any port, if min and max are zero.
+func pickPort(r io.Reader, min, max, current uint16) (uint16, error) {
+	if min == 0 && max == 0 {
+		return 0, nil
+	}
+	if min == 0 || max < min {
+		return 0, errors.New("invalid port rotation range")
+	}
+	n := int64(max) - int64(min) + 1
+	exclude := current >= min && current <= max
+	if exclude {
+		if n == 1 {
+			return current, nil
+		}
+		n--
+	}
+	i, err := rand.Int(r, big.NewInt(n))
+	if err != nil {
+		return 0, err
+	}
+	port := min + uint16(i.Int64())
+	if exclude && port >= current {
+		port++
+	}
+	return port, nil
+}
+
+func (device *Device) RoutineRotatePort() {
+	defer device.state.stopping.Done()
+	ticker := time.NewTicker(device.portRotation.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+		}
+		device.RotatePort()
+	}
+}
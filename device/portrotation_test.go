@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPickPort(t *testing.T) {
+	if port, err := pickPort(rand.Reader, 0, 0, 1234); port != 0 || err != nil {
+		t.Errorf("pickPort(0, 0) = %d, %v; want any port", port, err)
+	}
+	if _, err := pickPort(rand.Reader, 2000, 1000, 0); err == nil {
+		t.Error("pickPort accepted an empty range")
+	}
+	if port, err := pickPort(rand.Reader, 1000, 1000, 1000); port != 1000 || err != nil {
+		t.Errorf("pickPort of single-port range = %d, %v", port, err)
+	}
+	seen := make(map[uint16]bool)
+	for i := 0; i < 200; i++ {
+		port, err := pickPort(rand.Reader, 1000, 1003, 1001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port < 1000 || port > 1003 || port == 1001 {
+			t.Fatalf("pickPort(1000, 1003) excluding 1001 = %d", port)
+		}
+		seen[port] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("pickPort chose only %v", seen)
+	}
+
+	// The same randomness picks the same port.
+	var picked [2]uint16
+	for i := range picked {
+		port, err := pickPort(bytes.NewReader(make([]byte, 64)), 1000, 2000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[i] = port
+	}
+	if picked[0] != picked[1] {
+		t.Errorf("pickPort picked %v from the same randomness", picked)
+	}
+}
+
+func TestRotatePort(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+
+	dev := pair[0].dev
+	port := func() uint16 {
+		dev.net.RLock()
+		defer dev.net.RUnlock()
+		return dev.net.port
+	}
+	before := port()
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	keypair := peer.keypairs.Current()
+
+	if err := dev.RotatePort(); err != nil {
+		t.Fatal(err)
+	}
+	if after := port(); after == before || after == 0 {
+		t.Fatalf("port %d after rotation from %d", after, before)
+	}
+	if peer.keypairs.Current() != keypair {
+		t.Error("rotation replaced the session")
+	}
+
+	// dev1 learns the new port from dev0's keepalive and can still
+	// reach it.
+	peer1 := pair[1].dev.LookupPeer(dev.staticIdentity.publicKey)
+	want := fmt.Sprintf(":%d", port())
+	deadline := time.Now().Add(5 * time.Second)
+	for ep := peer1.Endpoint(); ep == nil || !strings.HasSuffix(ep.DstToString(), want); ep = peer1.Endpoint() {
+		if time.Now().After(deadline) {
+			t.Fatalf("peer endpoint %v did not roam to port%s", ep.DstToString(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func TestPortRotationInterval(t *testing.T) {
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		if i == 0 {
+			opts.PortRotation.Interval = 100 * time.Millisecond
+		}
+	})
+	dev := pair[0].dev
+	dev.net.RLock()
+	before := dev.net.port
+	dev.net.RUnlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		dev.net.RLock()
+		after := dev.net.port
+		dev.net.RUnlock()
+		if after != before {
+			// Close waits for the rotator, which it may find
+			// rotating.
+			dev.Close()
+			waitFor(t, "the port rotator to stop", func() bool {
+				return dev.Routines()["port rotator"] == 0
+			})
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("port never rotated")
+}
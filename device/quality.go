@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// QualityRTTScale is the round-trip time at which a path's quality score
+// halves, all else being equal.
+const QualityRTTScale = 200 * time.Millisecond
+
+// PeerQuality estimates the quality of the path to a peer from the
+// traffic the protocol already exchanges.
+//
+// Round-trip times are those of handshakes the device initiated, from
+// sending the initiation to receiving the response, smoothed as TCP does.
+//
+// Loss is estimated from data sent without anything coming back: after
+// sending data, the device expects to hear from the peer within
+// KeepaliveTimeout+RekeyTimeout, as the peer answers data with a
+// keepalive if it has none of its own to send. It is the smoothed
+// fraction of such waits that ran out.
+type PeerQuality struct {
+	RTT        time.Duration // smoothed, zero until measured
+	RTTVar     time.Duration // mean deviation of RTT
+	RTTSamples uint64
+
+	Loss   float64 // between 0 and 1
+	Probes uint64  // waits for the peer, answered or not
+	Lost   uint64  // waits that ran out
+
+	// Score sums the estimates up between 0, for a path that loses
+	// everything, and 1: (1-Loss) * QualityRTTScale/(QualityRTTScale+RTT).
+	Score float64
+}
+
+type peerQuality struct {
+	sync.Mutex
+	PeerQuality
+	rtts    RTTHistogram // see RTTHistogram
+	probing AtomicBool   // awaiting word from the peer since sending data
+}
+
+// qualityGain is the weight of each new sample in the smoothed estimates.
+const qualityGain = 1.0 / 8
+
+// Quality returns the estimated quality of the path to peer.
+func (peer *Peer) Quality() PeerQuality {
+	q := &peer.quality
+	q.Lock()
+	defer q.Unlock()
+	pq := q.PeerQuality
+	pq.Score = 1 - pq.Loss
+	if pq.RTTSamples > 0 {
+		pq.Score *= float64(QualityRTTScale) / float64(QualityRTTScale+pq.RTT)
+	}
+	return pq
+}
+
+// qualityRTT adds the round-trip time of a handshake.
+func (peer *Peer) qualityRTT(rtt time.Duration) {
+	/* A response that long in coming was raced by a retry, or the send
+	 * time was moved back to allow an early one.
+	 */
+	if rtt < 0 || rtt >= RekeyTimeout {
+		return
+	}
+	q := &peer.quality
+	q.Lock()
+	defer q.Unlock()
+	if q.RTTSamples == 0 {
+		q.RTT = rtt
+		q.RTTVar = rtt / 2
+	} else {
+		diff := q.RTT - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		q.RTTVar += time.Duration(qualityGain / 2 * float64(diff-q.RTTVar))
+		q.RTT += time.Duration(qualityGain * float64(rtt-q.RTT))
+	}
+	q.RTTSamples++
+	q.rtts.add(rtt)
+}
+
+// qualityProbe starts a wait for the peer, as data is sent.
+func (peer *Peer) qualityProbe() {
+	peer.quality.probing.Set(true)
+}
+
+// qualityAnswered ends a wait for the peer, as it is heard from.
+func (peer *Peer) qualityAnswered() {
+	if peer.quality.probing.Get() {
+		peer.qualityProbeDone(false)
+	}
+}
+
+// qualityLost ends a wait for the peer that ran out.
+func (peer *Peer) qualityLost() {
+	if peer.quality.probing.Get() {
+		peer.qualityProbeDone(true)
+	}
+}
+
+func (peer *Peer) qualityProbeDone(lost bool) {
+	q := &peer.quality
+	q.Lock()
+	defer q.Unlock()
+	if !q.probing.Get() {
+		return
+	}
+	q.probing.Set(false)
+	sample := 0.0
+	if lost {
+		sample = 1
+		q.Lost++
+	}
+	if q.Probes == 0 {
+		q.Loss = sample
+	} else {
+		q.Loss += qualityGain * (sample - q.Loss)
+	}
+	q.Probes++
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestPeerQualityEstimates(t *testing.T) {
+	var peer Peer
+
+	if q := peer.Quality(); q.Score != 1 {
+		t.Errorf("score %v with nothing measured, want 1", q.Score)
+	}
+
+	peer.qualityRTT(100 * time.Millisecond)
+	peer.qualityRTT(100 * time.Millisecond)
+	peer.qualityRTT(RekeyTimeout) // raced by a retry; ignored
+	q := peer.Quality()
+	if q.RTTSamples != 2 || q.RTT != 100*time.Millisecond {
+		t.Errorf("RTT %v from %d samples, want 100ms from 2", q.RTT, q.RTTSamples)
+	}
+
+	// Data is answered three times out of four.
+	for i := 0; i < 4; i++ {
+		peer.qualityProbe()
+		peer.qualityProbe() // more data while waiting
+		if i == 0 {
+			peer.qualityLost()
+		} else {
+			peer.qualityAnswered()
+			peer.qualityAnswered() // more heard, nothing awaited
+		}
+	}
+	q = peer.Quality()
+	if q.Probes != 4 || q.Lost != 1 {
+		t.Errorf("%d probes, %d lost; want 4, 1", q.Probes, q.Lost)
+	}
+	if q.Loss <= 0 || q.Loss >= 1 {
+		t.Errorf("loss %v, want between 0 and 1", q.Loss)
+	}
+	want := (1 - q.Loss) * float64(QualityRTTScale) / float64(QualityRTTScale+q.RTT)
+	if math.Abs(q.Score-want) > 1e-9 {
+		t.Errorf("score %v, want %v", q.Score, want)
+	}
+}
+
+func TestPeerQualityLoss(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	pair := genSimPair(t, clock, 1)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	peer := pair[1].dev.Peers()[0]
+	before := peer.Quality()
+	if before.RTTSamples != 1 || before.Lost != 0 {
+		t.Fatalf("after a handshake: %+v", before)
+	}
+
+	// Data the peer never answers counts as lost once the device stops
+	// waiting to hear back.
+	pair[0].dev.Close()
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	waitFor(t, "the data to be sent", func() bool {
+		return peer.quality.probing.Get()
+	})
+	step(clock, KeepaliveTimeout+RekeyTimeout+RekeyTimeoutJitterMaxMs*time.Millisecond, 100*time.Millisecond)
+	if q := peer.Quality(); q.Lost != 1 || q.Loss <= before.Loss || q.Score >= before.Score {
+		t.Errorf("after unanswered data: %+v", q)
+	}
+}
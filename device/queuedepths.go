@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+// A highWater is the most elements seen waiting in a queue. It is noted
+// as elements are queued, at the cost of an atomic load, and a swap only
+// when the mark rises.
+type highWater int32
+
+func (hw *highWater) note(depth int) {
+	for {
+		old := atomic.LoadInt32((*int32)(hw))
+		if int32(depth) <= old || atomic.CompareAndSwapInt32((*int32)(hw), old, int32(depth)) {
+			return
+		}
+	}
+}
+
+// queuedDepth returns the depth of a queue with the given length and
+// capacity once one more element is added to it, or its capacity if it is
+// full. Marks are noted with it just before an element is queued, since a
+// worker may take the element before the depth could be read after.
+func queuedDepth(length, capacity int) int {
+	if length < capacity {
+		return length + 1
+	}
+	return capacity
+}
+
+func (hw *highWater) load() int {
+	return int(atomic.LoadInt32((*int32)(hw)))
+}
+
+func (hw *highWater) reset() {
+	atomic.StoreInt32((*int32)(hw), 0)
+}
+
+// QueueHighWater returns the most elements seen waiting in each of the
+// device's shared queues since it was created or ResetQueueHighWater was
+// last called.
+func (device *Device) QueueHighWater() QueueDepths {
+	return QueueDepths{
+		Handshake:  device.queueHighWater.handshake.load(),
+		Encryption: device.queueHighWater.encryption.load(),
+		Decryption: device.queueHighWater.decryption.load(),
+	}
+}
+
+// ResetQueueHighWater forgets the high-water marks of the device's
+// queues and those of its peers, so that they start again from the
+// queues' current depths.
+func (device *Device) ResetQueueHighWater() {
+	device.queueHighWater.handshake.reset()
+	device.queueHighWater.encryption.reset()
+	device.queueHighWater.decryption.reset()
+	for _, peer := range device.Peers() {
+		peer.queueHighWater.staged.reset()
+		peer.queueHighWater.outbound.reset()
+		peer.queueHighWater.inbound.reset()
+	}
+}
+
+// PeerQueueDepths is the number of elements waiting in each of a peer's
+// queues.
+type PeerQueueDepths struct {
+	Staged   int `json:"staged"`   // waiting for a session and a nonce
+	Outbound int `json:"outbound"` // encrypted or being encrypted, waiting to be sent in order
+	Inbound  int `json:"inbound"`  // decrypted or being decrypted, waiting to be handled in order
+}
+
+// QueueDepths returns how many elements are waiting in peer's queues.
+func (peer *Peer) QueueDepths() PeerQueueDepths {
+	peer.queue.RLock()
+	defer peer.queue.RUnlock()
+	return PeerQueueDepths{
+		Staged:   len(peer.queue.nonce),
+		Outbound: len(peer.queue.outbound),
+		Inbound:  len(peer.queue.inbound),
+	}
+}
+
+// QueueHighWater returns the most elements seen waiting in each of peer's
+// queues since it was created or Device.ResetQueueHighWater was last
+// called.
+func (peer *Peer) QueueHighWater() PeerQueueDepths {
+	return PeerQueueDepths{
+		Staged:   peer.queueHighWater.staged.load(),
+		Outbound: peer.queueHighWater.outbound.load(),
+		Inbound:  peer.queueHighWater.inbound.load(),
+	}
+}
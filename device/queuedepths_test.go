@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestHighWater(t *testing.T) {
+	var hw highWater
+	for _, depth := range []int{3, 1, 7, 5} {
+		hw.note(depth)
+	}
+	if got := hw.load(); got != 7 {
+		t.Errorf("high water = %d, want 7", got)
+	}
+	hw.reset()
+	if got := hw.load(); got != 0 {
+		t.Errorf("high water = %d after reset, want 0", got)
+	}
+}
+
+func TestQueuedDepth(t *testing.T) {
+	for _, tt := range []struct{ length, capacity, want int }{
+		{0, 4, 1},
+		{3, 4, 4},
+		{4, 4, 4},
+	} {
+		if got := queuedDepth(tt.length, tt.capacity); got != tt.want {
+			t.Errorf("queuedDepth(%d, %d) = %d, want %d", tt.length, tt.capacity, got, tt.want)
+		}
+	}
+}
+
+func TestQueueHighWater(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+
+	// pair[1] sent the ping, and pair[0] received it, after a handshake.
+	sender, receiver := pair[1].dev, pair[0].dev
+	if hw := sender.QueueHighWater(); hw.Encryption < 1 {
+		t.Errorf("sender's QueueHighWater() = %+v, want an encryption mark", hw)
+	}
+	if hw := sender.Peers()[0].QueueHighWater(); hw.Staged < 1 || hw.Outbound < 1 {
+		t.Errorf("sender's peer's QueueHighWater() = %+v, want staged and outbound marks", hw)
+	}
+	if hw := receiver.QueueHighWater(); hw.Handshake < 1 || hw.Decryption < 1 {
+		t.Errorf("receiver's QueueHighWater() = %+v, want handshake and decryption marks", hw)
+	}
+	if hw := receiver.Peers()[0].QueueHighWater(); hw.Inbound < 1 {
+		t.Errorf("receiver's peer's QueueHighWater() = %+v, want an inbound mark", hw)
+	}
+
+	sender.ResetQueueHighWater()
+	if hw := sender.Peers()[0].QueueHighWater(); hw != (PeerQueueDepths{}) {
+		t.Errorf("QueueHighWater() = %+v after reset", hw)
+	}
+}
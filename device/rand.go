@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"io"
+)
+
+/* Everything random the device draws, ephemeral keys, indices, cookie
+ * secrets and nonces, flow labels and the seed of its timer jitter, comes
+ * from the one source DeviceOptions.Rand sets. A failed draw is fatal:
+ * rather than go on without the randomness the protocol's security rests
+ * on, the device reports the failure to DeviceOptions.RandFailed and
+ * closes.
+ */
+
+// checkedRand reads from the device's random source, failing the device
+// if it cannot fill a buffer.
+type checkedRand struct {
+	device *Device
+	source io.Reader
+}
+
+func (r checkedRand) Read(b []byte) (int, error) {
+	n, err := io.ReadFull(r.source, b)
+	if err != nil {
+		r.device.failRand(err)
+	}
+	return n, err
+}
+
+// failRand closes the device because its random source failed with err.
+// Only the first failure is reported.
+func (device *Device) failRand(err error) {
+	if device.randBroken.Swap(true) {
+		return
+	}
+	device.log.Error.Println("Random number generator failed, closing device:", err)
+	if randFailed := device.randFailed; randFailed != nil {
+		randFailed(err)
+	}
+	// The failing draw may be made by a routine Close waits for.
+	go device.Close()
+}
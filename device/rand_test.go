@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// failingRand reads from r until it is broken.
+type failingRand struct {
+	r      io.Reader
+	broken AtomicBool
+}
+
+var errRandBroken = errors.New("entropy source broken")
+
+func (f *failingRand) Read(b []byte) (int, error) {
+	if f.broken.Get() {
+		return 0, errRandBroken
+	}
+	return f.r.Read(b)
+}
+
+func TestRandFailed(t *testing.T) {
+	failed := make(chan error, 2)
+	var source *failingRand
+	pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+		if i == 1 {
+			source = &failingRand{r: opts.Rand}
+			opts.Rand = source
+			opts.RandFailed = func(err error) { failed <- err }
+		}
+	})
+	pair.Send(t, Ping, nil)
+
+	// The next handshake draws an ephemeral key, and the device, unable
+	// to, closes rather than go on.
+	source.broken.Set(true)
+	peer := pair[1].dev.Peers()[0]
+	peer.ExpireCurrentKeypairs()
+	if err := peer.SendHandshakeInitiation(false); err == nil {
+		t.Error("handshake initiated without randomness")
+	}
+	select {
+	case err := <-failed:
+		if !errors.Is(err, errRandBroken) {
+			t.Errorf("RandFailed(%v), want %v", err, errRandBroken)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RandFailed not called")
+	}
+	waitFor(t, "the device to close", func() bool {
+		return pair[1].dev.State() == DeviceClosed
+	})
+	if len(failed) != 0 {
+		t.Error("RandFailed called more than once")
+	}
+}
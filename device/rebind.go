@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* Some platforms leave a UDP socket useless after the network changes
+ * under it, as when another VPN comes up or the interface it was routed
+ * over goes away: every send fails, with EPERM or ENETUNREACH, long
+ * after there is a route again. Only a new socket recovers, which the
+ * device otherwise opens only on Down and Up.
+ */
+
+// AutoRebind configures reopening the device's UDP sockets when sending
+// on them has failed for a while.
+type AutoRebind struct {
+	// After is how long every send must have failed with a permission
+	// or unreachable error, with none succeeding, before the device
+	// rebinds to the same port. Zero disables rebinding.
+	After time.Duration
+}
+
+// noteSend records the outcome of a send on the device's own bind,
+// rebinding it if the sends have failed for long enough.
+func (device *Device) noteSend(err error) {
+	if device.autoRebind.After <= 0 {
+		return
+	}
+	since := &device.rebind.failingSinceNano
+	if err == nil {
+		if atomic.LoadInt64(since) != 0 {
+			atomic.StoreInt64(since, 0)
+		}
+		return
+	}
+	switch classifySendError(err) {
+	case SocketErrorPermission, SocketErrorUnreachable:
+	default:
+		return
+	}
+	now := device.now().UnixNano()
+	if atomic.CompareAndSwapInt64(since, 0, now) {
+		return
+	}
+	if time.Duration(now-atomic.LoadInt64(since)) < device.autoRebind.After {
+		return
+	}
+	// The caller holds device.net, which BindUpdate takes.
+	if device.rebinding.Swap(true) {
+		return
+	}
+	go func() {
+		defer device.rebinding.Set(false)
+		device.rebindAfterFailures()
+	}()
+}
+
+func (device *Device) rebindAfterFailures() {
+	device.state.Lock()
+	defer device.state.Unlock()
+
+	if !device.isUp() || device.skipBindUpdate {
+		return
+	}
+	device.log.Info.Println("UDP sends have failed for", device.autoRebind.After, "- rebinding")
+	if err := device.BindUpdate(); err != nil {
+		device.log.Error.Println("Failed to rebind:", err)
+		return
+	}
+	atomic.StoreInt64(&device.rebind.failingSinceNano, 0)
+	atomic.AddUint64(&device.stats.autoRebinds, 1)
+}
+
+// AutoRebinds returns the number of times the device has reopened its UDP
+// sockets as DeviceOptions.AutoRebind has it.
+func (device *Device) AutoRebinds() uint64 {
+	return atomic.LoadUint64(&device.stats.autoRebinds)
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+)
+
+func TestAutoRebind(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	var (
+		mu    sync.Mutex
+		binds []conn.Bind
+	)
+	pair := genSimPairWithOptions(t, clock, 1, func(i int, opts *DeviceOptions) {
+		if i != 1 {
+			return
+		}
+		opts.SkipBindUpdate = false
+		opts.AutoRebind = AutoRebind{After: 4 * time.Second}
+		createBind := opts.CreateBind
+		opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := createBind(port)
+			mu.Lock()
+			defer mu.Unlock()
+			// The first socket is wedged; its replacements work.
+			if len(binds) == 0 {
+				bind = &sendErrBind{bind.(*bindtest.ChannelBind), syscall.ENETUNREACH}
+			} else {
+				bind = bind.(*bindtest.ChannelBind).Reopen()
+			}
+			binds = append(binds, bind)
+			return bind, port, err
+		}
+	})
+	dev := pair[1].dev
+
+	// Handshake initiations keep failing until the device rebinds.
+	peer := dev.Peers()[0]
+	peer.TriggerHandshake()
+	step(clock, 3*time.Second, 100*time.Millisecond)
+	if n := dev.AutoRebinds(); n != 0 {
+		t.Fatalf("rebound %d times before AutoRebind.After", n)
+	}
+	step(clock, 4*time.Second, 100*time.Millisecond)
+	waitFor(t, "a rebind", func() bool {
+		return dev.AutoRebinds() == 1
+	})
+	mu.Lock()
+	if len(binds) != 2 {
+		t.Errorf("opened %d binds, want 2", len(binds))
+	}
+	mu.Unlock()
+
+	// The next retransmission gets through.
+	step(clock, RekeyTimeout+time.Second, 100*time.Millisecond)
+	waitFor(t, "a session", func() bool {
+		return peer.keypairs.Current() != nil
+	})
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if n := dev.AutoRebinds(); n != 1 {
+		t.Errorf("rebound %d times, want 1", n)
+	}
+}
@@ -7,35 +7,36 @@ package device
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"net"
 	"strconv"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/tailscale/wireguard-go/conn"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
-	"inet.af/netaddr"
 )
 
 type QueueHandshakeElement struct {
 	msgType  uint32
 	packet   []byte
 	endpoint conn.Endpoint
-	buffer   *[MaxMessageSize]byte
+	buffer   []byte
 }
 
 type QueueInboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer   *[MaxMessageSize]byte
+	buffer   []byte
 	packet   []byte
 	counter  uint64
 	keypair  *Keypair
 	endpoint conn.Endpoint
+	peer     *Peer  // counted in its decryption quota until dequeued
+	traceID  uint64 // see Device.newPacketID
 }
 
 // clearPointers clears elem fields that contain pointers.
@@ -47,6 +48,7 @@ func (elem *QueueInboundElement) clearPointers() {
 	elem.packet = nil
 	elem.keypair = nil
 	elem.endpoint = nil
+	elem.peer = nil
 }
 
 func (elem *QueueInboundElement) Drop() {
@@ -60,15 +62,19 @@ func (elem *QueueInboundElement) IsDropped() bool {
 func (device *Device) addToInboundAndDecryptionQueues(inboundQueue chan *QueueInboundElement, decryptionQueue chan *QueueInboundElement, elem *QueueInboundElement) bool {
 	select {
 	case inboundQueue <- elem:
+		elem.peer.decryptionQueued()
 		select {
 		case decryptionQueue <- elem:
 			return true
 		default:
+			elem.peer.decryptionDequeued()
+			device.dropPacket(elem.traceID, DropQueueFull)
 			elem.Drop()
 			elem.Unlock()
 			return false
 		}
 	default:
+		device.dropPacket(elem.traceID, DropQueueFull)
 		device.PutInboundElement(elem)
 		return false
 	}
@@ -92,7 +98,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if keypair != nil && keypair.isInitiator && peer.device.since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
 		peer.timers.sentLastMinuteHandshake.Set(true)
 		peer.SendHandshakeInitiation(false)
 	}
@@ -104,14 +110,33 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * IPv4 and IPv6 (separately)
  */
 func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
+	device.receiveIncoming(IP, bind, &device.net.stopping, &device.net.closing)
+}
+
+// receiveIncoming receives datagrams on bind until it is closed, then
+// marks stopping done. Besides the device's bind, peers with a local
+// address of their own have one. closing is set while the device
+// closes bind.
+func (device *Device) receiveIncoming(IP int, bind conn.Bind, stopping *sync.WaitGroup, closing *AtomicBool) {
 
+	var failed error
 	logDebug := device.log.Debug
 	defer func() {
 		logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - stopped")
-		device.net.stopping.Done()
+		stopping.Done()
+		if failed != nil && device.bindFailed != nil {
+			device.bindFailed(failed)
+		}
 	}()
 
 	logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - started")
+	labelWorker("receive")
+
+	if IP == ipv4.Version {
+		device.pinWorker(device.workers.ReceiveCPUs, 0)
+	} else {
+		device.pinWorker(device.workers.ReceiveCPUs, 1)
+	}
 
 	// receive datagrams until conn is closed
 
@@ -138,17 +163,44 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 
 		if err != nil {
 			device.PutMessageBuffer(buffer)
+			if device.receiveFailed(err, closing) {
+				device.log.Error.Println("Failed to receive on UDP socket:", err)
+				failed = err
+			}
 			return
 		}
 
+		if device.frozen.Get() {
+			// Leave the socket to the process the device was handed
+			// to, unless a failed Handover thaws the device again.
+			if !device.waitThawed(closing) {
+				device.PutMessageBuffer(buffer)
+				return
+			}
+			continue
+		}
+
+		// The socket discards what does not fit, so a datagram that
+		// fills a buffer sized for the MTU was likely longer.
+		if size == len(buffer) && size < MaxMessageSize {
+			device.dropPacket(0, DropTruncated)
+			continue
+		}
+
+		if size > 0 && !isMessageType(buffer[0]) && device.foreignDatagram != nil {
+			device.foreignDatagram(buffer[:size], endpoint)
+			continue
+		}
+
 		if size < MinMessageSize {
+			device.dropPacket(0, DropInvalidMessage)
 			continue
 		}
 
 		// check size of packet
 
 		packet := buffer[:size]
-		msgType := binary.LittleEndian.Uint32(packet[:4])
+		msgType := device.messageType(packet)
 
 		var okay bool
 
@@ -161,9 +213,13 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			// check size
 
 			if len(packet) < MessageTransportSize {
+				device.dropPacket(0, DropInvalidMessage)
 				continue
 			}
 
+			traceID := device.newPacketID()
+			device.tracePacket(traceID, StageReceived)
+
 			// lookup key pair
 
 			receiver := binary.LittleEndian.Uint32(
@@ -171,25 +227,40 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			)
 			value := device.indexTable.Lookup(receiver)
 			keypair := value.keypair
+			if value.peer == nil {
+				device.dropPacket(traceID, DropUnknownReceiver)
+				continue
+			}
 			if keypair == nil {
+				device.dropPacket(traceID, DropNoKeypair)
 				continue
 			}
 
 			// check keypair expiry
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+			if keypair.created.Add(RejectAfterTime).Before(device.now()) {
+				device.dropPacket(traceID, DropKeypairExpired)
 				continue
 			}
 
-			// create work element
+			// check the peer's share of the decryption queue
+
 			peer := value.peer
+			if !device.decryptionAllowed(peer) {
+				device.dropPacket(traceID, DropOverQuota)
+				continue
+			}
+
+			// create work element
 			elem := device.GetInboundElement()
 			elem.packet = packet
 			elem.buffer = buffer
 			elem.keypair = keypair
 			elem.dropped = AtomicFalse
 			elem.endpoint = endpoint
+			elem.peer = peer
 			elem.counter = 0
+			elem.traceID = traceID
 			elem.Mutex = sync.Mutex{}
 			elem.Lock()
 
@@ -197,10 +268,15 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 
 			peer.queue.RLock()
 			if peer.isRunning.Get() {
+				decryptionDepth := queuedDepth(len(device.queue.decryption), cap(device.queue.decryption))
+				inboundDepth := queuedDepth(len(peer.queue.inbound), cap(peer.queue.inbound))
 				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
 					buffer = device.GetMessageBuffer()
+					device.queueHighWater.decryption.note(decryptionDepth)
+					peer.queueHighWater.inbound.note(inboundDepth)
 				}
 			} else {
+				device.dropPacket(traceID, DropPeerDown)
 				device.PutInboundElement(elem)
 			}
 			peer.queue.RUnlock()
@@ -222,18 +298,31 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			logDebug.Println("Received message with unknown type")
 		}
 
-		if okay {
-			if (device.addToHandshakeQueue(
-				device.queue.handshake,
-				QueueHandshakeElement{
-					msgType:  msgType,
-					buffer:   buffer,
-					packet:   packet,
-					endpoint: endpoint,
-				},
-			)) {
-				buffer = device.GetMessageBuffer()
-			}
+		if !okay {
+			device.dropPacket(0, DropInvalidMessage)
+			continue
+		}
+		if !device.handshakeCaps.acquire(endpoint.DstIP()) {
+			device.dropPacket(0, DropHandshakeCap)
+			continue
+		}
+		elem := QueueHandshakeElement{
+			msgType:  msgType,
+			buffer:   buffer,
+			packet:   packet,
+			endpoint: endpoint,
+		}
+		handshakeDepth := queuedDepth(
+			len(device.queue.handshake)+len(device.queue.handshakePriority),
+			cap(device.queue.handshake)+cap(device.queue.handshakePriority),
+		)
+		if device.addToHandshakeQueue(device.queue.handshake, elem) ||
+			device.handshakePriority(&elem) && device.addToHandshakeQueue(device.queue.handshakePriority, elem) {
+			buffer = device.GetMessageBuffer()
+			device.queueHighWater.handshake.note(handshakeDepth)
+		} else {
+			device.handshakeCaps.release(endpoint.DstIP())
+			device.dropPacket(0, DropQueueFull)
 		}
 	}
 }
@@ -248,6 +337,7 @@ func (device *Device) RoutineDecryption() {
 		device.state.stopping.Done()
 	}()
 	logDebug.Println("Routine: decryption worker - started")
+	labelWorker("decryption")
 
 	for {
 		select {
@@ -259,6 +349,7 @@ func (device *Device) RoutineDecryption() {
 			if !ok {
 				return
 			}
+			elem.peer.decryptionDequeued()
 
 			// check if dropped
 
@@ -266,30 +357,41 @@ func (device *Device) RoutineDecryption() {
 				continue
 			}
 
-			// split message into fields
+			device.open(elem, &nonce)
+		}
+	}
+}
 
-			counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
-			content := elem.packet[MessageTransportOffsetContent:]
+/* Decrypts elem in place and releases it to the consumer.
+ * The nonce array is scratch space, as for QueueOutboundElement.seal.
+ */
+func (device *Device) open(elem *QueueInboundElement, nonce *[chacha20poly1305.NonceSize]byte) {
 
-			// decrypt and release to consumer
+	// split message into fields
 
-			var err error
-			elem.counter = binary.LittleEndian.Uint64(counter)
-			// copy counter to nonce
-			binary.LittleEndian.PutUint64(nonce[0x4:0xc], elem.counter)
-			elem.packet, err = elem.keypair.receive.Open(
-				content[:0],
-				nonce[:],
-				content,
-				nil,
-			)
-			if err != nil {
-				elem.Drop()
-				device.PutMessageBuffer(elem.buffer)
-			}
-			elem.Unlock()
-		}
+	counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
+	content := elem.packet[MessageTransportOffsetContent:]
+
+	// decrypt and release to consumer
+
+	var err error
+	elem.counter = binary.LittleEndian.Uint64(counter)
+	// copy counter to nonce
+	binary.LittleEndian.PutUint64(nonce[0x4:0xc], elem.counter)
+	elem.packet, err = elem.keypair.receive.Open(
+		content[:0],
+		nonce[:],
+		content,
+		nil,
+	)
+	if err != nil {
+		device.dropPacket(elem.traceID, DropDecryptFailed)
+		elem.Drop()
+		device.PutMessageBuffer(elem.buffer)
+	} else {
+		device.tracePacket(elem.traceID, StageDecrypted)
 	}
+	elem.Unlock()
 }
 
 /* Handles incoming packets related to handshake
@@ -302,6 +404,7 @@ func (device *Device) RoutineHandshake() {
 
 	var elem QueueHandshakeElement
 	var ok bool
+	var span Span // of the message being handled, if tracing spans
 
 	defer func() {
 		logDebug.Println("Routine: handshake worker - stopped")
@@ -309,25 +412,44 @@ func (device *Device) RoutineHandshake() {
 		if elem.buffer != nil {
 			device.PutMessageBuffer(elem.buffer)
 		}
+		if span != nil {
+			span.End()
+		}
 	}()
 
 	logDebug.Println("Routine: handshake worker - started")
+	labelWorker("handshake")
 
 	for {
 		if elem.buffer != nil {
 			device.PutMessageBuffer(elem.buffer)
 			elem.buffer = nil
 		}
+		if span != nil {
+			span.End()
+			span = nil
+		}
 
 		select {
-		case elem, ok = <-device.queue.handshake:
-		case <-device.signals.stop:
-			return
+		case elem, ok = <-device.queue.handshakePriority:
+		default:
+			select {
+			case elem, ok = <-device.queue.handshakePriority:
+			case elem, ok = <-device.queue.handshake:
+			case <-device.signals.stop:
+				return
+			}
 		}
 
 		if !ok {
 			return
 		}
+		device.handshakeCaps.release(elem.endpoint.DstIP())
+		if device.spanTracer != nil {
+			_, span = device.spanTracer.Start(context.Background(), "wireguard.handshake.receive",
+				SpanAttribute{Key: SpanKeyMessage, Value: messageTypeName(elem.msgType)},
+				SpanAttribute{Key: SpanKeyEndpoint, Value: device.redactEndpoint(elem.endpoint)})
+		}
 
 		// handle cookie fields and ratelimiting
 
@@ -350,15 +472,20 @@ func (device *Device) RoutineHandshake() {
 			entry := device.indexTable.Lookup(reply.Receiver)
 
 			if entry.peer == nil {
+				device.dropPacket(0, DropUnknownReceiver)
 				continue
 			}
 
 			// consume reply
 
 			if peer := entry.peer; peer.isRunning.Get() {
-				logDebug.Println("Receiving cookie response from ", elem.endpoint.DstToString())
+				logDebug.Println("Receiving cookie response from ", device.redactEndpoint(elem.endpoint))
 				if !peer.cookieGenerator.ConsumeReply(&reply) {
 					logDebug.Println("Could not decrypt invalid cookie response")
+				} else {
+					device.receivedReserved(elem.packet, peer)
+					peer.cookieReplyReceived()
+					spanAccepted(span, peer)
 				}
 			}
 
@@ -370,6 +497,7 @@ func (device *Device) RoutineHandshake() {
 
 			if !device.cookieChecker.CheckMAC1(elem.packet) {
 				logDebug.Println("Received packet with invalid mac1")
+				device.dropPacket(0, DropInvalidMAC)
 				continue
 			}
 
@@ -381,12 +509,14 @@ func (device *Device) RoutineHandshake() {
 
 				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
 					device.SendHandshakeCookie(&elem)
+					device.dropPacket(0, DropCookieRequired)
 					continue
 				}
 
 				// check ratelimiter
 
 				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+					device.dropPacket(0, DropRateLimited)
 					continue
 				}
 			}
@@ -408,20 +538,66 @@ func (device *Device) RoutineHandshake() {
 			err := binary.Read(reader, binary.LittleEndian, &msg)
 			if err != nil {
 				logError.Println("Failed to decode initiation message")
+				device.dropPacket(0, DropInvalidMessage)
 				continue
 			}
+			msg.Type = elem.msgType // without the reserved bytes
 
-			// consume initiation
+			// authenticate initiation; it changes nothing until committed
 
-			peer := device.ConsumeMessageInitiation(&msg)
-			if peer == nil {
+			init := device.authenticateMessageInitiation(&msg)
+			if init == nil {
 				logInfo.Println(
 					"Received invalid initiation message from",
-					elem.endpoint.DstToString(),
+					device.redactEndpoint(elem.endpoint),
 				)
+				device.dropPacket(0, DropInvalidHandshake)
+				continue
+			}
+			peer := init.peer
+
+			if peer.IsQuarantined() {
+				logDebug.Println(peer, "- Ignoring handshake initiation from quarantined peer")
+				device.dropPacket(0, DropQuarantined)
 				continue
 			}
 
+			if peer.disabled.on.Get() {
+				logDebug.Println(peer, "- Ignoring handshake initiation from disabled or expired peer")
+				device.dropPacket(0, DropPeerDisabled)
+				continue
+			}
+
+			if !peer.handshakeSourceAllowed(elem.endpoint.DstIP()) {
+				logDebug.Println(peer, "- Ignoring handshake initiation from", device.redactEndpoint(elem.endpoint))
+				device.dropPacket(0, DropHandshakeSource)
+				continue
+			}
+
+			if !device.authorized(peer, elem.endpoint) {
+				logDebug.Println(peer, "- Handshake initiation from", device.redactEndpoint(elem.endpoint), "not authorized")
+				device.dropPacket(0, DropUnauthorized)
+				continue
+			}
+
+			if !peer.acceptInitiationFrom(elem.endpoint) {
+				peer.noteInitiationFrom(elem.endpoint)
+				logDebug.Println(peer, "- Ignoring handshake initiation from", device.redactEndpoint(elem.endpoint), "of a duplicate key")
+				device.dropPacket(0, DropDuplicateKey)
+				continue
+			}
+
+			// consume initiation
+
+			if device.commitMessageInitiation(init) == nil {
+				device.dropPacket(0, DropInvalidHandshake)
+				continue
+			}
+			peer.noteInitiationFrom(elem.endpoint)
+			device.noteHandshakeSource(elem.endpoint.DstIP())
+
+			device.receivedReserved(elem.packet, peer)
+
 			// update timers
 
 			peer.timersAnyAuthenticatedPacketTraversal()
@@ -431,6 +607,7 @@ func (device *Device) RoutineHandshake() {
 			peer.SetEndpointFromPacket(elem.endpoint)
 
 			logDebug.Println(peer, "- Received handshake initiation")
+			spanAccepted(span, peer)
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
 
 			peer.handshake.mutex.Lock()
@@ -450,24 +627,63 @@ func (device *Device) RoutineHandshake() {
 			err := binary.Read(reader, binary.LittleEndian, &msg)
 			if err != nil {
 				logError.Println("Failed to decode response message")
+				device.dropPacket(0, DropInvalidMessage)
 				continue
 			}
+			msg.Type = elem.msgType // without the reserved bytes
 
-			// consume response
+			// authenticate response; it changes nothing until committed
 
-			peer := device.ConsumeMessageResponse(&msg)
-			if peer == nil {
+			resp := device.authenticateMessageResponse(&msg)
+			if resp == nil {
 				logInfo.Println(
 					"Received invalid response message from",
-					elem.endpoint.DstToString(),
+					device.redactEndpoint(elem.endpoint),
 				)
+				device.dropPacket(0, DropInvalidHandshake)
+				continue
+			}
+			peer := resp.peer
+
+			if peer.IsQuarantined() {
+				logDebug.Println(peer, "- Ignoring handshake response from quarantined peer")
+				device.dropPacket(0, DropQuarantined)
 				continue
 			}
 
+			if peer.disabled.on.Get() {
+				logDebug.Println(peer, "- Ignoring handshake response from disabled or expired peer")
+				device.dropPacket(0, DropPeerDisabled)
+				continue
+			}
+
+			if !peer.handshakeSourceAllowed(elem.endpoint.DstIP()) {
+				logDebug.Println(peer, "- Ignoring handshake response from", device.redactEndpoint(elem.endpoint))
+				device.dropPacket(0, DropHandshakeSource)
+				continue
+			}
+
+			if !device.authorized(peer, elem.endpoint) {
+				logDebug.Println(peer, "- Handshake response from", device.redactEndpoint(elem.endpoint), "not authorized")
+				device.dropPacket(0, DropUnauthorized)
+				continue
+			}
+
+			// consume response
+
+			if device.commitMessageResponse(resp) == nil {
+				device.dropPacket(0, DropInvalidHandshake)
+				continue
+			}
+			device.noteHandshakeSource(elem.endpoint.DstIP())
+
+			device.receivedReserved(elem.packet, peer)
+
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
 
 			logDebug.Println(peer, "- Received handshake response")
+			spanAccepted(span, peer)
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
 
 			// update timers
@@ -491,6 +707,7 @@ func (device *Device) RoutineHandshake() {
 			case peer.signals.newKeypairArrived <- struct{}{}:
 			default:
 			}
+			peer.handshakeDoneCallback(peer.keypairs.Current(), elem.endpoint)
 		}
 	}
 }
@@ -516,6 +733,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 	}()
 
 	logDebug.Println(peer, "- Routine: sequential receiver - started")
+	labelWorker("sequential-receiver")
 
 	for {
 		if elem != nil {
@@ -544,14 +762,34 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			continue
 		}
 
-		// update endpoint
-		peer.SetEndpointFromPacket(elem.endpoint)
+		if peer.IsQuarantined() {
+			device.dropPacket(elem.traceID, DropQuarantined)
+			continue
+		}
 
-		// check for replay
-		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+		// update endpoint, or under RoamingStrict once the packet is
+		// known to be fresh and of the current keypair
+		strictRoaming := device.roaming == RoamingStrict
+		if !strictRoaming {
+			peer.SetEndpointFromPacket(elem.endpoint)
+		}
+
+		// check for replay; once the device is frozen by Snapshot, the
+		// counters belong to the process it was handed to
+		elem.keypair.replayMutex.Lock()
+		frozen := device.frozen.Get()
+		fresh := !frozen && elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages)
+		elem.keypair.replayMutex.Unlock()
+		if frozen {
+			continue
+		}
+		if !fresh {
+			device.dropPacket(elem.traceID, DropReplayed)
 			continue
 		}
 
+		device.receivedReserved(elem.buffer[:MessageTransportHeaderSize], peer)
+
 		// check if using new keypair
 		if peer.ReceivedWithKeypair(elem.keypair) {
 			peer.timersHandshakeComplete()
@@ -559,6 +797,10 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			case peer.signals.newKeypairArrived <- struct{}{}:
 			default:
 			}
+			peer.handshakeDoneCallback(elem.keypair, elem.endpoint)
+		}
+		if strictRoaming && elem.keypair == peer.keypairs.Current() {
+			peer.SetEndpointFromPacket(elem.endpoint)
 		}
 
 		peer.keepKeyFreshReceiving()
@@ -570,6 +812,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 		if len(elem.packet) == 0 {
 			logDebug.Println(peer, "- Receiving keepalive packet")
+			device.tracePacket(elem.traceID, StageKeepalive)
 			continue
 		}
 		peer.timersDataReceived()
@@ -582,12 +825,14 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv4.HeaderLen {
+				device.dropPacket(elem.traceID, DropMalformed)
 				continue
 			}
 
 			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
 			length := binary.BigEndian.Uint16(field)
 			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
+				device.dropPacket(elem.traceID, DropMalformed)
 				continue
 			}
 
@@ -597,13 +842,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 			src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
 			if device.allowedips.LookupIPv4(src) != peer {
-				logInfo.Println(
-					"IPv4 packet with disallowed source address from",
-					peer,
-				)
-				ip := netaddr.IPv4(src[0], src[1], src[2], src[3])
-				key := (*NoisePublicKey)(&peer.handshake.remoteStatic)
-				device.unexpectedip(key, ip)
+				device.dropPacket(elem.traceID, DropDisallowedSource)
+				device.dropUnexpectedIP(peer, elem.packet, ipv4.Version)
 				continue
 			}
 
@@ -612,6 +852,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv6.HeaderLen {
+				device.dropPacket(elem.traceID, DropMalformed)
 				continue
 			}
 
@@ -619,6 +860,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			length := binary.BigEndian.Uint16(field)
 			length += ipv6.HeaderLen
 			if int(length) > len(elem.packet) {
+				device.dropPacket(elem.traceID, DropMalformed)
 				continue
 			}
 
@@ -628,27 +870,34 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 			src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
 			if device.allowedips.LookupIPv6(src) != peer {
-				logInfo.Println(
-					"IPv6 packet with disallowed source address from",
-					peer,
-				)
-				ip := netaddr.IPv4(src[0], src[1], src[2], src[3])
-				key := (*NoisePublicKey)(&peer.handshake.remoteStatic)
-				device.unexpectedip(key, ip)
+				device.dropPacket(elem.traceID, DropDisallowedSource)
+				device.dropUnexpectedIP(peer, elem.packet, ipv6.Version)
 				continue
 			}
 
 		default:
 			logInfo.Println("Packet with invalid IP version from", peer)
+			device.dropPacket(elem.traceID, DropMalformed)
 			continue
 		}
 
-		// write to tun device
+		if mtu := peer.MTU(); mtu != 0 {
+			clampMSS(elem.packet, mtu)
+		}
+
+		// write to tun device, unless relayed to another peer
 
-		offset := MessageTransportOffsetContent
-		_, err := device.tun.device.Write(elem.buffer[:offset+len(elem.packet)], offset)
-		if err != nil && !device.isClosed.Get() {
-			logError.Println("Failed to write packet to TUN device:", err)
+		if !device.relay || !device.relayPacket(peer, elem) {
+			offset := MessageTransportOffsetContent
+			_, err := device.tun.device.Write(elem.buffer[:offset+len(elem.packet)], offset)
+			if err != nil {
+				device.dropPacket(elem.traceID, DropTUNWriteFailed)
+				if !device.isClosed() {
+					logError.Println("Failed to write packet to TUN device:", err)
+				}
+			} else {
+				device.tracePacket(elem.traceID, StageTUNWritten)
+			}
 		}
 		if len(peer.queue.inbound) == 0 {
 			err := device.tun.device.Flush()
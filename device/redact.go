@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/blake2s"
+	"inet.af/netaddr"
+)
+
+// Redaction keeps public keys and IP addresses out of the device's logs
+// and the errors it returns, for deployments whose logs may not hold
+// personal data. It also applies to the endpoints recorded in the event
+// log and to spans, which tend to end up in the same places. It does not
+// apply to UAPI get or to StatsSnapshot, which report the configuration
+// as it is.
+type Redaction struct {
+	// Keys replaces public keys with a short hash of them, as in
+	// "peer(#1a2b3c4d)", which tells peers apart without revealing
+	// their keys.
+	Keys bool
+
+	// IPs truncates the addresses of endpoints and packets to their
+	// network, of RedactPrefixIPv4 or RedactPrefixIPv6 bits, and
+	// drops ports.
+	IPs bool
+}
+
+// The lengths of the networks that Redaction.IPs truncates addresses to.
+const (
+	RedactPrefixIPv4 = 24
+	RedactPrefixIPv6 = 48
+)
+
+// redactKey formats a public key for a log line or error.
+func (device *Device) redactKey(key [32]byte) string {
+	if !device.redaction.Keys {
+		k := wgcfg.Key(key)
+		return k.ShortString()
+	}
+	return redactedKey(key)
+}
+
+func redactedKey(key [32]byte) string {
+	sum := blake2s.Sum256(append([]byte("wireguard-go redacted key"), key[:]...))
+	return "#" + hex.EncodeToString(sum[:4])
+}
+
+// redactIP formats an address for a log line or error.
+func (device *Device) redactIP(ip net.IP) string {
+	if !device.redaction.IPs {
+		return ip.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(RedactPrefixIPv4, 32)).String() + "/24"
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16.Mask(net.CIDRMask(RedactPrefixIPv6, 128)).String() + "/48"
+	}
+	return "[redacted]"
+}
+
+func (device *Device) redactNetaddr(ip netaddr.IP) string {
+	if !device.redaction.IPs {
+		return ip.String()
+	}
+	return device.redactIP(net.ParseIP(ip.String()))
+}
+
+// redactEndpoint formats the destination of ep for a log line or error.
+func (device *Device) redactEndpoint(ep conn.Endpoint) string {
+	if !device.redaction.IPs {
+		return ep.DstToString()
+	}
+	return device.redactIP(ep.DstIP())
+}
+
+// redactAddrs formats a configured endpoint, a comma-separated list of
+// host:port pairs, for a log line or error.
+func (device *Device) redactAddrs(addrs string) string {
+	if !device.redaction.IPs {
+		return addrs
+	}
+	parts := strings.Split(addrs, ",")
+	for i, part := range parts {
+		host, _, err := net.SplitHostPort(part)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			parts[i] = "[redacted]"
+			continue
+		}
+		parts[i] = device.redactIP(ip)
+	}
+	return strings.Join(parts, ",")
+}
+
+// redactAddrErr returns err, an error creating an endpoint, for a log
+// line or error, unless addresses are redacted: such errors tend to
+// repeat the address.
+func (device *Device) redactAddrErr(err error) interface{} {
+	if !device.redaction.IPs {
+		return err
+	}
+	return "invalid endpoint"
+}
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+)
+
+func TestRedactAddrs(t *testing.T) {
+	dev := &Device{redaction: Redaction{IPs: true}}
+	for _, tt := range []struct{ in, want string }{
+		{"192.168.17.42:51820", "192.168.17.0/24"},
+		{"[2001:db8:1:2::7]:51820,10.1.2.3:1", "2001:db8:1::/48,10.1.2.0/24"},
+		{"example.com:51820", "[redacted]"},
+	} {
+		if got := dev.redactAddrs(tt.in); got != tt.want {
+			t.Errorf("redactAddrs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := dev.redactIP(net.ParseIP("::ffff:1.2.3.4")); got != "1.2.3.0/24" {
+		t.Errorf("mapped address redacted to %q", got)
+	}
+
+	dev.redaction.IPs = false
+	if got := dev.redactAddrs("192.168.17.42:51820"); got != "192.168.17.42:51820" {
+		t.Errorf("redactAddrs without redaction = %q", got)
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	privateKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := privateKey.Public()
+	dev := randDevice(t)
+	defer dev.Close()
+	dev.redaction.Keys = true
+	peer, err := dev.NewPeer(NoisePublicKey(pk))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	short := dev.redactKey(pk)
+	if !strings.HasPrefix(short, "#") || len(short) != 9 {
+		t.Errorf("redacted key %q, want # and 8 hex digits", short)
+	}
+	if short != dev.redactKey(pk) {
+		t.Error("key redacted differently twice")
+	}
+	if got, want := peer.String(), "peer("+short+")"; got != want {
+		t.Errorf("peer %q, want %q", got, want)
+	}
+	if strings.Contains(peer.String(), pk.Base64()[:4]) {
+		t.Errorf("peer %q shows its key", peer)
+	}
+}
+
+func TestRedactedErrors(t *testing.T) {
+	privateKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := privateKey.Public()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:    NewLogger(LogLevelError, "dev: "),
+		Redaction: Redaction{Keys: true, IPs: true},
+	})
+	defer dev.Close()
+
+	cfg := &wgcfg.Config{
+		PrivateKey: privateKey,
+		Peers:      []wgcfg.Peer{{PublicKey: pk, Endpoints: "192.168.17.42:x"}},
+	}
+	err = dev.ValidateConfig(cfg)
+	if err == nil {
+		t.Fatal("no error for a bad endpoint")
+	}
+	for _, leak := range []string{pk.ShortString(), "192.168.17.42"} {
+		if strings.Contains(err.Error(), leak) {
+			t.Errorf("error %q shows %q", err, leak)
+		}
+	}
+}
+
+func TestRedactedUnexpectedIPLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{
+		Debug: log.New(&bytes.Buffer{}, "", 0),
+		Info:  log.New(&buf, "", 0),
+		Error: log.New(&buf, "", 0),
+	}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:    logger,
+		Redaction: Redaction{Keys: true, IPs: true},
+	})
+	defer dev.Close()
+
+	var key NoisePublicKey
+	key[0] = 1
+	dev.unexpectedip(&key, UnexpectedIPPacket{
+		Version: 4,
+		Src:     netaddr.MustParseIP("203.0.113.77"),
+		Dst:     netaddr.MustParseIP("10.0.0.9"),
+	})
+	line := buf.String()
+	for _, want := range []string{"203.0.113.0/24", "10.0.0.0/24", dev.redactKey(key)} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log %q lacks %q", line, want)
+		}
+	}
+	for _, leak := range []string{"203.0.113.77", (*wgcfg.Key)(&key).ShortString()} {
+		if strings.Contains(line, leak) {
+			t.Errorf("log %q shows %q", line, leak)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* With DeviceOptions.Relay, a packet from one peer to an address another
+ * peer is allowed is queued for that peer as if read from the TUN device,
+ * sparing it the trip through the system's routing and back. The device
+ * then does what the router it bypasses would: it decrements the TTL or
+ * hop limit. Packets needing more than that, those whose TTL runs out or
+ * that exceed the other peer's MTU, are left to the system, as are those
+ * RelayPolicy refuses.
+ */
+
+// relayPacket queues elem's packet, received from peer, for the peer
+// allowed its destination, if it is to be relayed, reporting whether it
+// was. elem itself stays with the caller.
+func (device *Device) relayPacket(peer *Peer, elem *QueueInboundElement) bool {
+	pkt := elem.packet
+	var to *Peer
+	switch pkt[0] >> 4 {
+	case ipv4.Version:
+		if pkt[IPv4offsetTTL] <= 1 {
+			return false
+		}
+		to = device.allowedips.LookupIPv4(pkt[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+	case ipv6.Version:
+		if pkt[IPv6offsetHopLimit] <= 1 {
+			return false
+		}
+		to = device.allowedips.LookupIPv6(pkt[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+	}
+	if to == nil || to == peer {
+		return false
+	}
+	mtu := to.MTU()
+	if mtu != 0 && len(pkt) > mtu {
+		return false
+	}
+	if policy := device.relayPolicy; policy != nil && !policy(peer, to) {
+		return false
+	}
+
+	out := device.NewOutboundElement()
+	out.packet = out.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+len(pkt)]
+	copy(out.packet, pkt)
+	decrementTTL(out.packet)
+	if mtu != 0 {
+		clampMSS(out.packet, mtu)
+	}
+	device.tracePacket(elem.traceID, StageRelayed)
+	out.traceID = device.newPacketID()
+	if !to.queueOutbound(out) {
+		device.PutMessageBuffer(out.buffer)
+		device.PutOutboundElement(out)
+		return true
+	}
+	device.relayStats.count(peer, to, len(pkt))
+	return true
+}
+
+// decrementTTL decrements the TTL or hop limit of pkt, a well-formed IP
+// packet whose TTL is above 1, updating the IPv4 header checksum.
+func decrementTTL(pkt []byte) {
+	switch pkt[0] >> 4 {
+	case ipv4.Version:
+		pkt[IPv4offsetTTL]--
+		// RFC 1624: the 16-bit word holding the TTL went down by 0x0100.
+		sum := uint32(binary.BigEndian.Uint16(pkt[IPv4offsetChecksum:])) + 0x0100
+		if sum >= 0xffff {
+			sum++
+		}
+		binary.BigEndian.PutUint16(pkt[IPv4offsetChecksum:], uint16(sum))
+	case ipv6.Version:
+		pkt[IPv6offsetHopLimit]--
+	}
+}
+
+// DefaultRelayStatsPairs is how many pairs of peers the device keeps
+// relay statistics for if DeviceOptions.RelayStatsPairs is zero.
+const DefaultRelayStatsPairs = 1024
+
+// RelayPairStats counts the packets relayed from one peer to another.
+type RelayPairStats struct {
+	From, To NoisePublicKey
+	Packets  uint64
+	Bytes    uint64 // of the inner packets
+}
+
+// RelayStats counts the packets the device relayed between its peers.
+type RelayStats struct {
+	// Pairs are the pairs of peers packets were relayed between, in the
+	// order they were first seen.
+	Pairs []RelayPairStats
+
+	// OtherPackets and OtherBytes count the packets between pairs seen
+	// once Pairs had reached its limit.
+	OtherPackets uint64
+	OtherBytes   uint64
+}
+
+type relayPair struct {
+	from, to NoisePublicKey
+}
+
+type relayCounters struct {
+	packets uint64
+	bytes   uint64
+}
+
+/* Relay statistics are kept for a bounded number of pairs, so that a
+ * hub's memory does not grow with the square of its peers. The counters
+ * of a pair are added to atomically under the read lock; only a new pair
+ * takes the write lock.
+ */
+type relayStats struct {
+	sync.RWMutex
+	limit int
+	pairs map[relayPair]*relayCounters
+	order []relayPair
+	other relayCounters
+}
+
+// count counts a packet of n bytes relayed from one peer to another.
+func (st *relayStats) count(from, to *Peer, n int) {
+	pair := relayPair{from.handshake.remoteStatic, to.handshake.remoteStatic}
+	st.RLock()
+	c := st.pairs[pair]
+	st.RUnlock()
+	if c == nil {
+		st.Lock()
+		c = st.pairs[pair]
+		if c == nil {
+			if len(st.order) < st.limit {
+				if st.pairs == nil {
+					st.pairs = make(map[relayPair]*relayCounters)
+				}
+				c = new(relayCounters)
+				st.pairs[pair] = c
+				st.order = append(st.order, pair)
+			} else {
+				c = &st.other
+			}
+		}
+		st.Unlock()
+	}
+	atomic.AddUint64(&c.packets, 1)
+	atomic.AddUint64(&c.bytes, uint64(n))
+}
+
+// RelayStats returns how many packets the device relayed between each
+// pair of its peers, as set up by DeviceOptions.Relay. Statistics are
+// kept for at most DeviceOptions.RelayStatsPairs pairs, and outlive the
+// peers.
+func (device *Device) RelayStats() RelayStats {
+	st := &device.relayStats
+	st.RLock()
+	defer st.RUnlock()
+	stats := RelayStats{
+		Pairs:        make([]RelayPairStats, len(st.order)),
+		OtherPackets: atomic.LoadUint64(&st.other.packets),
+		OtherBytes:   atomic.LoadUint64(&st.other.bytes),
+	}
+	for i, pair := range st.order {
+		c := st.pairs[pair]
+		stats.Pairs[i] = RelayPairStats{
+			From:    pair.from,
+			To:      pair.to,
+			Packets: atomic.LoadUint64(&c.packets),
+			Bytes:   atomic.LoadUint64(&c.bytes),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"golang.org/x/net/ipv4"
+)
+
+func TestRelay(t *testing.T) {
+	var refuse int32
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		if i == 0 {
+			opts.Relay = true
+			opts.RelayPolicy = func(from, to *Peer) bool {
+				return atomic.LoadInt32(&refuse) == 0
+			}
+		}
+	})
+	hub, spoke := pair[0], pair[1]
+
+	// A second spoke, 1.0.0.3, reached by the first through the hub.
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := tuntest.NewChannelTUN()
+	other := NewDevice(tun.TUN(), &DeviceOptions{Logger: NewLogger(LogLevelDebug, "dev2: ")})
+	t.Cleanup(other.Close)
+	if err := other.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.IpcSetOperation(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"listen_port", "0",
+		"public_key", hub.dev.staticIdentity.publicKey.ToHex(),
+		"allowed_ip", "1.0.0.0/24",
+		"endpoint", "127.0.0.1:"+strconv.Itoa(int(hub.dev.net.port)),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	if err := hub.dev.IpcSetOperation(uapiCfg(
+		"public_key", pk.ToHex(),
+		"allowed_ip", "1.0.0.3/32",
+		"endpoint", "127.0.0.1:"+strconv.Itoa(int(other.net.port)),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := spoke.dev.IpcSetOperation(uapiCfg(
+		"public_key", hub.dev.staticIdentity.publicKey.ToHex(),
+		"allowed_ip", "1.0.0.3/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(tun *tuntest.ChannelTUN) []byte {
+		t.Helper()
+		select {
+		case pkt := <-tun.Inbound:
+			return pkt
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet did not transit")
+			return nil
+		}
+	}
+
+	msg := tuntest.Ping(net.IPv4(1, 0, 0, 3), spoke.ip)
+	binary.BigEndian.PutUint16(msg[IPv4offsetChecksum:], 0)
+	binary.BigEndian.PutUint16(msg[IPv4offsetChecksum:], checksum(msg[:ipv4.HeaderLen], 0))
+	spoke.tun.Outbound <- msg
+	got := receive(tun)
+	if got[IPv4offsetTTL] != msg[IPv4offsetTTL]-1 {
+		t.Errorf("relayed TTL %d, want %d", got[IPv4offsetTTL], msg[IPv4offsetTTL]-1)
+	}
+	if checksum(got[:ipv4.HeaderLen], 0) != 0 {
+		t.Error("relayed packet has a bad header checksum")
+	}
+	if got[IPv4offsetProtocol] != msg[IPv4offsetProtocol] ||
+		!bytes.Equal(got[:IPv4offsetTTL], msg[:IPv4offsetTTL]) ||
+		!bytes.Equal(got[IPv4offsetChecksum+2:], msg[IPv4offsetChecksum+2:]) {
+		t.Error("relayed packet changed beyond its TTL and checksum")
+	}
+	waitFor(t, "the relayed packet to be counted", func() bool {
+		return len(hub.dev.RelayStats().Pairs) > 0
+	})
+	want := RelayPairStats{
+		From:    spoke.dev.staticIdentity.publicKey,
+		To:      pk,
+		Packets: 1,
+		Bytes:   uint64(len(msg)),
+	}
+	if stats := hub.dev.RelayStats(); len(stats.Pairs) != 1 || stats.Pairs[0] != want {
+		t.Errorf("RelayStats = %+v, want one pair %+v", stats, want)
+	}
+	select {
+	case pkt := <-hub.tun.Inbound:
+		t.Errorf("relayed packet also written to the hub's TUN device: %x", pkt)
+	default:
+	}
+
+	// Refused by the policy, the packet goes to the hub's TUN device.
+	atomic.StoreInt32(&refuse, 1)
+	spoke.tun.Outbound <- msg
+	if got := receive(hub.tun); !bytes.Equal(got, msg) {
+		t.Errorf("hub received %x, want %x", got, msg)
+	}
+}
+
+func TestRelayStatsLimit(t *testing.T) {
+	peers := make([]*Peer, 3)
+	for i := range peers {
+		peers[i] = new(Peer)
+		peers[i].handshake.remoteStatic[0] = byte(i + 1)
+	}
+	dev := new(Device)
+	dev.relayStats.limit = 1
+	dev.relayStats.count(peers[0], peers[1], 100)
+	dev.relayStats.count(peers[0], peers[1], 50)
+	dev.relayStats.count(peers[1], peers[0], 10)
+	dev.relayStats.count(peers[0], peers[2], 20)
+
+	got := dev.RelayStats()
+	want := RelayStats{
+		Pairs: []RelayPairStats{{
+			From:    peers[0].handshake.remoteStatic,
+			To:      peers[1].handshake.remoteStatic,
+			Packets: 2,
+			Bytes:   150,
+		}},
+		OtherPackets: 2,
+		OtherBytes:   30,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RelayStats = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+)
+
+/* Every message begins with its type in a little-endian uint32, the three
+ * bytes after the type's being reserved and zero. Some deployments carry
+ * data of their own in them, which HeaderReserved lets the device take
+ * part in. By default the device sends zeros and drops the messages whose
+ * reserved bytes are not zero, which are of no type it knows.
+ *
+ * The reserved bytes of handshake messages are covered by their MACs;
+ * those of transport messages are not authenticated at all.
+ */
+
+// HeaderReserved are the hooks through which a device sends and
+// receives the three reserved bytes of the message header. They are
+// called back as the DeviceOptions functions are.
+type HeaderReserved struct {
+	// Set, if non-nil, returns the reserved bytes of a message of type
+	// msgType sent to peer. peer is nil for cookie replies, which are
+	// sent before the peer is known.
+	Set func(peer *Peer, msgType uint8) [3]byte
+
+	// Received, if non-nil, makes the device accept messages whose
+	// reserved bytes are not zero, and is called with those of each
+	// such message once it is authenticated as from peer; transport
+	// messages, once they are decrypted.
+	Received func(peer *Peer, msgType uint8, reserved [3]byte)
+}
+
+// messageType returns the type of msg, ignoring its reserved bytes if
+// the device accepts them.
+func (device *Device) messageType(msg []byte) uint32 {
+	if device.reserved.Received != nil {
+		return uint32(msg[0])
+	}
+	return binary.LittleEndian.Uint32(msg[:4])
+}
+
+// putReserved writes the reserved bytes of msg, going to peer.
+func (device *Device) putReserved(msg []byte, peer *Peer) {
+	if set := device.reserved.Set; set != nil {
+		reserved := set(peer, msg[0])
+		copy(msg[1:4], reserved[:])
+	}
+}
+
+// receivedReserved passes on the reserved bytes of msg, from peer, if
+// they are not zero.
+func (device *Device) receivedReserved(msg []byte, peer *Peer) {
+	if received := device.reserved.Received; received != nil && msg[1]|msg[2]|msg[3] != 0 {
+		var reserved [3]byte
+		copy(reserved[:], msg[1:4])
+		received(peer, msg[0], reserved)
+	}
+}
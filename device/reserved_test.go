@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestHeaderReserved(t *testing.T) {
+	var mu sync.Mutex
+	received := [2]map[uint8][3]byte{{}, {}}
+	pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+		opts.Reserved = HeaderReserved{
+			Set: func(peer *Peer, msgType uint8) [3]byte {
+				return [3]byte{byte(i), msgType, 0xff}
+			},
+			Received: func(peer *Peer, msgType uint8, reserved [3]byte) {
+				mu.Lock()
+				received[i][msgType] = reserved
+				mu.Unlock()
+			},
+		}
+	})
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range pair {
+		from := byte(1 - i)
+		for _, msgType := range []uint8{MessageInitiationType, MessageResponseType, MessageTransportType} {
+			want := [3]byte{from, msgType, 0xff}
+			got, ok := received[i][msgType]
+			if msgType != MessageTransportType && !ok {
+				// Only one of the devices initiated.
+				continue
+			}
+			if got != want {
+				t.Errorf("device %d received reserved bytes %x in a message of type %d, want %x", i, got, msgType, want)
+			}
+		}
+	}
+	if len(received[0])+len(received[1]) != 4 {
+		t.Errorf("reserved bytes received: %v", received)
+	}
+}
+
+func TestHeaderReservedStrict(t *testing.T) {
+	pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+		if i == 1 {
+			opts.Reserved.Set = func(peer *Peer, msgType uint8) [3]byte {
+				return [3]byte{1, 2, 3}
+			}
+		}
+	})
+	// By default, a device drops messages whose reserved bytes are set.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	waitFor(t, "the initiation to be dropped", func() bool {
+		return pair[0].dev.DropCounts()[DropInvalidMessage] > 0
+	})
+	if pair[0].dev.Peers()[0].LastHandshake() != (time.Time{}) {
+		t.Error("handshake completed")
+	}
+}
@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// HandshakeRetry is the schedule on which an unanswered handshake
+// initiation is sent again. The zero value is the default schedule: the
+// first retry follows the initiation by a second and the nth retry
+// follows the one before by n-1 seconds, up to RekeyTimeout, and the
+// device gives up
+// after MaxTimerHandshakes+2 initiations, about RekeyAttemptTime. Each
+// wait is jittered by up to RekeyTimeoutJitterMaxMs.
+//
+// A device gives up until there is data for the peer again, which
+// starts a new schedule; giving up sooner and backing off saves the
+// battery of a mobile device with a peer out of reach.
+type HandshakeRetry struct {
+	// Initial is the wait before the first retry. Zero means one second.
+	Initial time.Duration
+
+	// Multiplier, if greater than one, multiplies the wait after each
+	// retry, backing off exponentially. Otherwise the wait grows by
+	// Initial after each retry but the first.
+	Multiplier float64
+
+	// Max caps the wait. Zero means RekeyTimeout.
+	Max time.Duration
+
+	// MaxAttempts is how many initiations are sent before giving up.
+	// Zero means MaxTimerHandshakes+2.
+	MaxAttempts int
+}
+
+// wait returns how long to wait for a response after an initiation sent
+// when attempts retries had already been.
+func (r *HandshakeRetry) wait(attempts uint32) time.Duration {
+	initial, max := r.Initial, r.Max
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if max <= 0 {
+		max = RekeyTimeout
+	}
+	var wait float64
+	if r.Multiplier > 1 {
+		wait = float64(initial) * math.Pow(r.Multiplier, float64(attempts))
+	} else if attempts > 0 {
+		wait = float64(initial) * float64(attempts)
+	} else {
+		wait = float64(initial)
+	}
+	if wait >= float64(max) {
+		return max
+	}
+	return time.Duration(wait)
+}
+
+// exhausted reports whether no more initiations are to be sent after
+// attempts retries.
+func (r *HandshakeRetry) exhausted(attempts uint32) bool {
+	max := r.MaxAttempts
+	if max <= 0 {
+		max = MaxTimerHandshakes + 2
+	}
+	return int64(attempts)+1 >= int64(max)
+}
+
+// SetHandshakeRetry sets the schedule of handshake retries to peer,
+// overriding DeviceOptions.HandshakeRetry. A nil r restores the device's.
+// It takes effect from the next initiation.
+func (peer *Peer) SetHandshakeRetry(r *HandshakeRetry) {
+	if r != nil {
+		c := *r
+		r = &c
+	}
+	atomic.StorePointer((*unsafe.Pointer)((unsafe.Pointer)(&peer.handshakeRetry)), unsafe.Pointer(r))
+}
+
+// HandshakeRetry returns the schedule of handshake retries to peer.
+func (peer *Peer) HandshakeRetry() HandshakeRetry {
+	return *peer.loadHandshakeRetry()
+}
+
+func (peer *Peer) loadHandshakeRetry() *HandshakeRetry {
+	r := (*HandshakeRetry)(atomic.LoadPointer((*unsafe.Pointer)((unsafe.Pointer)(&peer.handshakeRetry))))
+	if r == nil {
+		r = &peer.device.handshakeRetry
+	}
+	return r
+}
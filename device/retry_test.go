@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandshakeRetrySchedule(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry HandshakeRetry
+		waits []time.Duration // after each initiation, until giving up
+	}{
+		{
+			name:  "default",
+			waits: []time.Duration{1, 1, 2, 3, 4, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5},
+		},
+		{
+			name:  "exponential",
+			retry: HandshakeRetry{Initial: time.Second, Multiplier: 2, Max: 30 * time.Second, MaxAttempts: 7},
+			waits: []time.Duration{1, 2, 4, 8, 16, 30, 30},
+		},
+		{
+			name:  "once",
+			retry: HandshakeRetry{MaxAttempts: 1},
+			waits: []time.Duration{1},
+		},
+	}
+	for _, tt := range tests {
+		var attempts uint32
+		for ; !tt.retry.exhausted(attempts); attempts++ {
+			if int(attempts) >= len(tt.waits) {
+				t.Fatalf("%s: still retrying after %d attempts", tt.name, attempts+1)
+			}
+			if got, want := tt.retry.wait(attempts), tt.waits[attempts]*time.Second; got != want {
+				t.Errorf("%s: wait after attempt %d is %v, want %v", tt.name, attempts+1, got, want)
+			}
+		}
+		if int(attempts)+1 != len(tt.waits) {
+			t.Errorf("%s: gave up after %d attempts, want %d", tt.name, attempts+1, len(tt.waits))
+		}
+	}
+}
+
+func TestHandshakeGaveUp(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	pair := genSimPair(t, clock, 1)
+	peer := pair[0].dev.Peers()[0]
+	gaveUp := make(chan *Peer, 1)
+	pair[0].dev.gaveUp = func(p *Peer) { gaveUp <- p }
+	peer.SetHandshakeRetry(&HandshakeRetry{Multiplier: 2, MaxAttempts: 3})
+
+	// With the other end gone, every initiation goes unanswered.
+	pair[1].dev.Close()
+	if err := peer.TriggerHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	step(clock, 10*time.Second, 10*time.Millisecond)
+	select {
+	case p := <-gaveUp:
+		if p != peer {
+			t.Errorf("gave up on %v, want %v", p, peer)
+		}
+	default:
+		t.Fatal("did not give up")
+	}
+	if n := atomic.LoadUint64(&peer.stats.txBytes) / MessageInitiationSize; n != 3 {
+		t.Errorf("sent %d initiations, want 3", n)
+	}
+}
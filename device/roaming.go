@@ -0,0 +1,38 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "fmt"
+
+// Roaming is the policy by which a peer's endpoint follows the source
+// of the packets it sends.
+type Roaming int
+
+const (
+	// RoamingAny moves the endpoint to the source of any authenticated
+	// packet, before its counter is checked against replay, and
+	// whichever of the peer's keypairs it was sent with.
+	RoamingAny Roaming = iota
+
+	// RoamingStrict moves it only for a handshake, or for a transport
+	// packet that passed the replay check and was sent with the current
+	// keypair. An attacker who captured the peer's packets cannot then
+	// redirect its traffic by replaying them from another address, or
+	// by sending those of a previous session it held back.
+	RoamingStrict
+)
+
+var roamingNames = [...]string{
+	RoamingAny:    "any",
+	RoamingStrict: "strict",
+}
+
+func (r Roaming) String() string {
+	if r < 0 || int(r) >= len(roamingNames) {
+		return fmt.Sprintf("Roaming(%d)", int(r))
+	}
+	return roamingNames[r]
+}
@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+)
+
+// spoofBind is a Bind that remembers the last transport packet it sent,
+// and makes chosen packets it receives seem to come from elsewhere.
+type spoofBind struct {
+	conn.Bind
+	mu       sync.Mutex
+	lastSent []byte
+	spoofed  []byte // received from spoofSrc, if non-nil
+	spoofAll bool   // every packet is received from spoofSrc
+}
+
+const spoofSrc = bindtest.ChannelEndpoint(9)
+
+func (b *spoofBind) Send(pkt []byte, ep conn.Endpoint) error {
+	if len(pkt) > 0 && pkt[0] == MessageTransportType {
+		b.mu.Lock()
+		b.lastSent = append([]byte(nil), pkt...)
+		b.mu.Unlock()
+	}
+	return b.Bind.Send(pkt, ep)
+}
+
+func (b *spoofBind) ReceiveIPv4(buf []byte) (int, conn.Endpoint, error) {
+	n, ep, err := b.Bind.ReceiveIPv4(buf)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil && (b.spoofAll || b.spoofed != nil && bytes.Equal(buf[:n], b.spoofed)) {
+		ep = spoofSrc
+	}
+	return n, ep, err
+}
+
+func TestStrictRoaming(t *testing.T) {
+	for _, policy := range []Roaming{RoamingAny, RoamingStrict} {
+		t.Run(policy.String(), func(t *testing.T) {
+			var binds [2]*spoofBind
+			pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+				opts.Roaming = policy
+				create := opts.CreateBind
+				opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+					bind, port, err := create(port)
+					binds[i] = &spoofBind{Bind: bind}
+					return binds[i], port, err
+				}
+			})
+			pair.Send(t, Ping, nil)
+			peer := pair[0].dev.Peers()[0]
+			endpoint := func() string { return peer.Endpoint().DstToString() }
+			orig := endpoint()
+
+			// dev1's last packet, replayed from elsewhere.
+			binds[1].mu.Lock()
+			replay := binds[1].lastSent
+			binds[1].mu.Unlock()
+			binds[0].mu.Lock()
+			binds[0].spoofed = replay
+			binds[0].mu.Unlock()
+			replayed := pair[0].dev.DropCounts()[DropReplayed]
+			if err := binds[1].Bind.Send(replay, bindtest.ChannelEndpoint(1)); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the replay to be dropped", func() bool {
+				return pair[0].dev.DropCounts()[DropReplayed] > replayed
+			})
+			if policy == RoamingStrict && endpoint() != orig {
+				t.Errorf("endpoint moved to %s by a replayed packet", endpoint())
+			}
+			if policy == RoamingAny && endpoint() != spoofSrc.DstToString() {
+				t.Errorf("endpoint %s, want %s", endpoint(), spoofSrc.DstToString())
+			}
+
+			// A fresh packet from elsewhere moves it under either policy.
+			binds[0].mu.Lock()
+			binds[0].spoofAll = true
+			binds[0].mu.Unlock()
+			pair.Send(t, Ping, nil)
+			if endpoint() != spoofSrc.DstToString() {
+				t.Errorf("endpoint %s after a fresh packet, want %s", endpoint(), spoofSrc.DstToString())
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"inet.af/netaddr"
+)
+
+// RouteSetter is told the complete set of allowed IPs after every
+// reconfiguration. It is implemented by *routes.Manager, which installs a
+// matching OS route for each prefix.
+type RouteSetter interface {
+	Set(prefixes []netaddr.IPPrefix) error
+}
+
+// routesSynced is what the device's RouteSetter was last told.
+type routesSynced struct {
+	sync.Mutex
+	roots    *allowedIPsRoots // the version of the allowed IPs
+	prefixes []netaddr.IPPrefix
+}
+
+// A RouteAnnouncer is told the allowed IPs of a peer when the peer goes
+// down under DeviceOptions.DeadPeer, and again when it comes back up, so
+// that a dynamic routing daemon can withdraw and re-announce them. Its
+// methods are called back as the DeviceOptions functions are.
+type RouteAnnouncer interface {
+	Announce(peer NoisePublicKey, prefixes []netaddr.IPPrefix)
+	Withdraw(peer NoisePublicKey, prefixes []netaddr.IPPrefix)
+}
+
+// A RouteAnnouncement is a call to a RouteAnnouncer.
+type RouteAnnouncement struct {
+	Peer     NoisePublicKey
+	Prefixes []netaddr.IPPrefix
+	Withdraw bool // rather than Announce
+}
+
+// RouteAnnouncements is a RouteAnnouncer that sends each call down C
+// without blocking. A call made while C is full is dropped and counted,
+// see Dropped, so C should be buffered for the peers that can go down at
+// once and its reader keep up.
+type RouteAnnouncements struct {
+	dropped uint64 // accessed atomically; first for 64-bit alignment
+	C       chan RouteAnnouncement
+}
+
+// NewRouteAnnouncements returns RouteAnnouncements whose C buffers n calls.
+func NewRouteAnnouncements(n int) *RouteAnnouncements {
+	return &RouteAnnouncements{C: make(chan RouteAnnouncement, n)}
+}
+
+func (a *RouteAnnouncements) Announce(peer NoisePublicKey, prefixes []netaddr.IPPrefix) {
+	a.send(RouteAnnouncement{Peer: peer, Prefixes: prefixes})
+}
+
+func (a *RouteAnnouncements) Withdraw(peer NoisePublicKey, prefixes []netaddr.IPPrefix) {
+	a.send(RouteAnnouncement{Peer: peer, Prefixes: prefixes, Withdraw: true})
+}
+
+func (a *RouteAnnouncements) send(announcement RouteAnnouncement) {
+	select {
+	case a.C <- announcement:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// Dropped reports how many calls were dropped because C was full.
+func (a *RouteAnnouncements) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+func (device *Device) announceRoutes(peer *Peer, up bool) {
+	if device.routeAnnouncer == nil {
+		return
+	}
+	if up {
+		device.routeAnnouncer.Announce(peer.PublicKey(), peer.AllowedIPs())
+	} else {
+		device.routeAnnouncer.Withdraw(peer.PublicKey(), peer.AllowedIPs())
+	}
+}
+
+// syncRoutes tells the RouteSetter the allowed IPs of all peers, if
+// they changed since it was last told. Every change to the table stores
+// a new version of it, so an unchanged version means unchanged routes;
+// a new one is walked once and compared with the routes last told, as
+// many changes re-insert the prefixes that were there.
+func (device *Device) syncRoutes() {
+	if device.routes == nil {
+		return
+	}
+
+	synced := &device.routesSynced
+	synced.Lock()
+	defer synced.Unlock()
+	roots := device.allowedips.load()
+	if roots == synced.roots {
+		return
+	}
+
+	var prefixes []netaddr.IPPrefix
+	roots.walk(func(prefix netaddr.IPPrefix, peer *Peer) bool {
+		prefixes = append(prefixes, prefix)
+		return true
+	})
+	if synced.roots != nil && cidrsEqual(prefixes, synced.prefixes) {
+		synced.roots = roots
+		return
+	}
+	if err := device.routes.Set(prefixes); err != nil {
+		device.log.Error.Println("Failed to update routes:", err)
+		return
+	}
+	synced.roots, synced.prefixes = roots, prefixes
+}
@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// runningRoutines counts the long-lived goroutines the device and its
+// peers have started and not yet seen return, by name, so that any left
+// running once a peer stops or the device closes can be named.
+type runningRoutines struct {
+	sync.Mutex
+	count map[string]int
+}
+
+func (r *runningRoutines) add(name string, delta int) {
+	r.Lock()
+	defer r.Unlock()
+	if r.count == nil {
+		r.count = make(map[string]int)
+	}
+	r.count[name] += delta
+	if r.count[name] == 0 {
+		delete(r.count, name)
+	}
+}
+
+// goRoutine runs f in a goroutine, counted under name until f returns.
+// The goroutine is counted before it starts, so that one started before
+// a Stop or Close is accounted for even if it has yet to run.
+func (device *Device) goRoutine(name string, f func()) {
+	device.running.add(name, 1)
+	go func() {
+		defer device.running.add(name, -1)
+		f()
+	}()
+}
+
+// Routines returns how many of each long-lived goroutine the device and
+// its peers have started are still running, by name. A peer's routines
+// are named after it, as in "peer(AbCd…WxYz) sequential sender".
+//
+// Shortly after a peer is stopped none of its routines is listed, and
+// shortly after the device is closed none at all. Embedders sampling
+// Routines across reconnects can see which routine, if any, grows.
+func (device *Device) Routines() map[string]int {
+	device.running.Lock()
+	defer device.running.Unlock()
+	routines := make(map[string]int, len(device.running.count))
+	for name, n := range device.running.count {
+		routines[name] = n
+	}
+	return routines
+}
+
+// formatRoutines lists routines, as Routines returns them, one per line
+// in order of name.
+func formatRoutines(routines map[string]int) string {
+	names := make([]string, 0, len(routines))
+	for name := range routines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("\n\t")
+		b.WriteString(name)
+		if n := routines[name]; n != 1 {
+			b.WriteString(" ×")
+			b.WriteString(strconv.Itoa(n))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// checkRoutinesStopped fails t, naming the routines, unless every routine
+// of dev whose name begins with prefix returns within a few seconds. An
+// empty prefix checks them all.
+func checkRoutinesStopped(t testing.TB, dev *Device, prefix string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leaked := make(map[string]int)
+		for name, n := range dev.Routines() {
+			if strings.HasPrefix(name, prefix) {
+				leaked[name] = n
+			}
+		}
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("routines still running:%s", formatRoutines(leaked))
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// closeAndCheckRoutines closes dev and checks that all its routines
+// return.
+func closeAndCheckRoutines(t testing.TB, dev *Device) {
+	t.Helper()
+	dev.Close()
+	checkRoutinesStopped(t, dev, "")
+}
+
+func TestRoutinesClose(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	if len(dev.Routines()) == 0 {
+		t.Fatal("no routines counted")
+	}
+	closeAndCheckRoutines(t, dev)
+}
+
+func TestRoutinesPeerStopStart(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.Peers()[0]
+
+	want := []string{
+		peer.String() + " nonce",
+		peer.String() + " sequential sender",
+		peer.String() + " sequential receiver",
+	}
+	for _, name := range want {
+		if n := dev.Routines()[name]; n != 1 {
+			t.Errorf("%d of %q running, want 1", n, name)
+		}
+	}
+
+	peer.Stop()
+	checkRoutinesStopped(t, dev, peer.String())
+	if err := peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range want {
+		if n := dev.Routines()[name]; n != 1 {
+			t.Errorf("%d of %q running after restart, want 1", n, name)
+		}
+	}
+}
+
+// TestRoutinesReconnect takes a device down and up repeatedly, as an
+// embedder does on network changes, and checks that it runs no more
+// routines than it did before.
+func TestRoutinesReconnect(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	before := dev.Routines()
+
+	for i := 0; i < 10; i++ {
+		if err := dev.Down(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		grown := make(map[string]int)
+		for name, n := range dev.Routines() {
+			if n > before[name] {
+				grown[name] = n
+			}
+		}
+		if len(grown) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routines grew across reconnects:%s", formatRoutines(grown))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/bits"
+	"time"
+)
+
+/* Handshake round-trip times are counted in buckets laid out as HDR
+ * histograms lay theirs out: each power of two from RTTHistogramMin up
+ * is split into RTTSubBuckets buckets of equal width, so that a bucket
+ * is never wider than a quarter of its lower bound, whether it holds
+ * LAN or satellite times, and a fixed array of counters covers them all.
+ * Times below RTTHistogramMin share the first bucket; handshakes slower
+ * than RekeyTimeout are not counted, as they were raced by a retry.
+ */
+
+const (
+	rttMinShift   = 17 // RTTHistogramMin is 2^17ns, about 131µs
+	rttSubBits    = 2
+	rttOctaves    = 16 // up to 2^33ns, about 8.6s, past RekeyTimeout
+	RTTSubBuckets = 1 << rttSubBits
+
+	// RTTHistogramMin is the upper bound of the first bucket of an
+	// RTTHistogram.
+	RTTHistogramMin = time.Duration(1) << rttMinShift
+
+	// NumRTTBuckets is the number of buckets of an RTTHistogram.
+	NumRTTBuckets = 1 + rttOctaves*RTTSubBuckets
+)
+
+// An RTTHistogram counts the round-trip times of a peer's handshakes;
+// see RTTBucketBounds for its buckets.
+type RTTHistogram struct {
+	Counts [NumRTTBuckets]uint64
+	Total  uint64
+	Sum    time.Duration
+	Min    time.Duration // zero if Total is
+	Max    time.Duration
+}
+
+// rttBucket returns the index of the bucket that holds rtt.
+func rttBucket(rtt time.Duration) int {
+	if rtt < RTTHistogramMin {
+		return 0
+	}
+	v := uint64(rtt)
+	octave := bits.Len64(v>>rttMinShift) - 1
+	if octave >= rttOctaves {
+		return NumRTTBuckets - 1
+	}
+	sub := int(v>>uint(rttMinShift+octave-rttSubBits)) & (RTTSubBuckets - 1)
+	return 1 + octave*RTTSubBuckets + sub
+}
+
+// RTTBucketBounds returns the bounds of bucket i of an RTTHistogram: it
+// counts times from lo up to but excluding hi.
+func RTTBucketBounds(i int) (lo, hi time.Duration) {
+	if i <= 0 {
+		return 0, RTTHistogramMin
+	}
+	octave, sub := (i-1)/RTTSubBuckets, (i-1)%RTTSubBuckets
+	base := RTTHistogramMin << uint(octave)
+	width := base / RTTSubBuckets
+	return base + time.Duration(sub)*width, base + time.Duration(sub+1)*width
+}
+
+func (h *RTTHistogram) add(rtt time.Duration) {
+	h.Counts[rttBucket(rtt)]++
+	if h.Total == 0 || rtt < h.Min {
+		h.Min = rtt
+	}
+	if rtt > h.Max {
+		h.Max = rtt
+	}
+	h.Total++
+	h.Sum += rtt
+}
+
+// Mean returns the mean of the times counted, or zero if there are none.
+func (h *RTTHistogram) Mean() time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Total)
+}
+
+// Quantile returns the upper bound of the bucket holding the q-quantile
+// of the times counted, 0 < q <= 1, capped at Max; zero if there are
+// none. Quantile(0.5) is thus an upper bound on the median, within the
+// width of its bucket.
+func (h *RTTHistogram) Quantile(q float64) time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.Total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= rank {
+			_, hi := RTTBucketBounds(i)
+			if hi > h.Max {
+				hi = h.Max
+			}
+			return hi
+		}
+	}
+	return h.Max
+}
+
+// RTTHistogram returns the round-trip times of the handshakes the device
+// has initiated with peer, from sending the initiation to receiving the
+// response; see PeerQuality.
+func (peer *Peer) RTTHistogram() RTTHistogram {
+	q := &peer.quality
+	q.Lock()
+	defer q.Unlock()
+	return q.rtts
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTBuckets(t *testing.T) {
+	// The buckets tile the range without gaps, each no wider than a
+	// quarter of its lower bound, and hold the times within them.
+	_, prev := RTTBucketBounds(0)
+	for i := 1; i < NumRTTBuckets; i++ {
+		lo, hi := RTTBucketBounds(i)
+		if lo != prev {
+			t.Fatalf("bucket %d starts at %v, want %v", i, lo, prev)
+		}
+		if hi-lo > lo/RTTSubBuckets {
+			t.Errorf("bucket %d, [%v, %v), too wide", i, lo, hi)
+		}
+		for _, rtt := range []time.Duration{lo, (lo + hi) / 2, hi - 1} {
+			if got := rttBucket(rtt); got != i {
+				t.Errorf("%v in bucket %d, want %d", rtt, got, i)
+			}
+		}
+		prev = hi
+	}
+	if prev <= RekeyTimeout {
+		t.Errorf("buckets end at %v, short of RekeyTimeout", prev)
+	}
+	if got := rttBucket(RTTHistogramMin - 1); got != 0 {
+		t.Errorf("%v in bucket %d, want 0", RTTHistogramMin-1, got)
+	}
+}
+
+func TestRTTHistogram(t *testing.T) {
+	var peer Peer
+	if h := peer.RTTHistogram(); h.Total != 0 || h.Quantile(0.5) != 0 {
+		t.Errorf("histogram %+v with nothing measured", h)
+	}
+
+	for i := 0; i < 90; i++ {
+		peer.qualityRTT(10 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		peer.qualityRTT(300 * time.Millisecond)
+	}
+	peer.qualityRTT(RekeyTimeout) // raced by a retry; ignored
+
+	h := peer.RTTHistogram()
+	if h.Total != 100 || h.Min != 10*time.Millisecond || h.Max != 300*time.Millisecond {
+		t.Fatalf("%d samples from %v to %v, want 100 from 10ms to 300ms", h.Total, h.Min, h.Max)
+	}
+	if mean := h.Mean(); mean != 39*time.Millisecond {
+		t.Errorf("mean %v, want 39ms", mean)
+	}
+	if p50 := h.Quantile(0.5); p50 < 10*time.Millisecond || p50 > 10*time.Millisecond*5/4 {
+		t.Errorf("p50 %v, want within a bucket of 10ms", p50)
+	}
+	if p99 := h.Quantile(0.99); p99 != 300*time.Millisecond {
+		t.Errorf("p99 %v, want 300ms, the maximum", p99)
+	}
+}
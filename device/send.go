@@ -12,8 +12,8 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
-	"time"
 
+	"github.com/tailscale/wireguard-go/conn"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -46,11 +46,12 @@ import (
 type QueueOutboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
-	packet  []byte                // slice of "buffer" (always!)
-	nonce   uint64                // nonce for encryption
-	keypair *Keypair              // keypair for encryption
-	peer    *Peer                 // related peer
+	buffer  []byte   // slice holding the packet data
+	packet  []byte   // slice of "buffer" (always!)
+	nonce   uint64   // nonce for encryption
+	keypair *Keypair // keypair for encryption
+	peer    *Peer    // related peer
+	traceID uint64   // see Device.newPacketID
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -59,6 +60,7 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.buffer = device.GetMessageBuffer()
 	elem.Mutex = sync.Mutex{}
 	elem.nonce = 0
+	elem.traceID = 0
 	// keypair and peer were cleared (if necessary) by clearPointers.
 	return elem
 }
@@ -90,6 +92,7 @@ func addToNonceQueue(queue chan *QueueOutboundElement, elem *QueueOutboundElemen
 		default:
 			select {
 			case old := <-queue:
+				device.dropPacket(old.traceID, DropQueueFull)
 				device.PutMessageBuffer(old.buffer)
 				device.PutOutboundElement(old)
 			default:
@@ -105,55 +108,129 @@ func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement,
 		case encryptionQueue <- elem:
 			return
 		default:
+			elem.peer.device.dropPacket(elem.traceID, DropQueueFull)
 			elem.Drop()
 			elem.peer.device.PutMessageBuffer(elem.buffer)
 			elem.Unlock()
 		}
 	default:
+		elem.peer.device.dropPacket(elem.traceID, DropQueueFull)
 		elem.peer.device.PutMessageBuffer(elem.buffer)
 		elem.peer.device.PutOutboundElement(elem)
 	}
 }
 
-/* Queues a keepalive if no packets are queued for peer
+/* Asks the nonce routine to send a keepalive. Keepalives, like handshake
+ * messages, do not wait behind data: the nonce routine takes them ahead of
+ * the packets in its queue and sends them itself, rather than through the
+ * encryption and outbound queues, which may be full of data, so that a
+ * saturated device does not let its sessions expire.
  */
 func (peer *Peer) SendKeepalive() bool {
 	peer.queue.RLock()
 	defer peer.queue.RUnlock()
-	if len(peer.queue.nonce) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() || peer.passive.Get() {
 		return false
 	}
-	elem := peer.device.NewOutboundElement()
-	elem.packet = nil
 	select {
-	case peer.queue.nonce <- elem:
+	case peer.signals.sendKeepalive <- struct{}{}:
 		peer.device.log.Debug.Println(peer, "- Sending keepalive packet")
 		return true
 	default:
-		peer.device.PutMessageBuffer(elem.buffer)
-		peer.device.PutOutboundElement(elem)
-		return false
+		return false // one is already pending
+	}
+}
+
+/* Sends a keepalive on the current keypair, or asks for a handshake if
+ * there is none, the keepalive then being redundant: the initiator sends
+ * one once the handshake completes.
+ *
+ * Obs. Only called by the nonce routine
+ */
+func (peer *Peer) sendKeepaliveNow() {
+	device := peer.device
+	if device.frozen.Get() {
+		return
+	}
+
+	keypair := peer.keypairs.Current()
+	if keypair == nil || device.since(keypair.created) >= RejectAfterTime {
+		peer.SendHandshakeInitiation(false)
+		return
+	}
+	nonce := atomic.AddUint64(&keypair.sendNonce, 1) - 1
+	if nonce >= RejectAfterMessages {
+		atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+		peer.SendHandshakeInitiation(false)
+		return
+	}
+
+	var buff [MessageKeepaliveSize]byte
+	var nonceBytes [chacha20poly1305.NonceSize]byte
+	header := buff[:MessageTransportHeaderSize]
+	binary.LittleEndian.PutUint32(header[0:4], MessageTransportType)
+	device.putReserved(header, peer)
+	binary.LittleEndian.PutUint32(header[4:8], keypair.remoteIndex)
+	binary.LittleEndian.PutUint64(header[8:16], nonce)
+	binary.LittleEndian.PutUint64(nonceBytes[4:], nonce)
+	packet := keypair.send.Seal(header, nonceBytes[:], nil, nil)
+
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketSent()
+
+	if err := peer.SendBuffer(packet); err != nil {
+		device.dropPacket(0, DropSendFailed)
+		device.log.Error.Println(peer, "- Failed to send keepalive packet", err)
+		return
+	}
+	peer.keepKeyFreshSending()
+}
+
+// TriggerHandshake sends a handshake initiation to the peer now, rather
+// than waiting for an outgoing packet to need one, so a control plane can
+// establish a session as soon as it learns the peer's endpoint. Like any
+// initiation, it does nothing if one was sent less than RekeyTimeout ago.
+func (peer *Peer) TriggerHandshake() error {
+	if !peer.isRunning.Get() {
+		return errors.New("peer is not running")
+	}
+	if peer.passive.Get() {
+		return errors.New("peer is passive")
 	}
+	return peer.SendHandshakeInitiation(false)
 }
 
 func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
+	if peer.passive.Get() {
+		return nil
+	}
+
 	if !isRetry {
 		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	}
 
 	peer.handshake.mutex.RLock()
-	if !isRetry && time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if !isRetry && peer.device.since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if !isRetry && time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if !isRetry && peer.device.since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+		peer.handshake.mutex.Unlock()
+		return nil
+	}
+	/* An initiation from the peer has just been consumed and is about to
+	 * be answered. Initiating now would discard it, and the peer, which
+	 * has seen its initiation through, may then ignore ours as crossing
+	 * its own.
+	 */
+	if peer.handshake.state == handshakeInitiationConsumed && peer.device.since(peer.handshake.lastInitiationConsumption) < RekeyTimeout {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
 	peer.device.log.Debug.Println(peer, "- Sending handshake initiation")
@@ -175,6 +252,7 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, msg)
 	packet := writer.Bytes()
+	device.putReserved(packet, peer)
 	peer.cookieGenerator.AddMacs(packet)
 
 	peer.timersAnyAuthenticatedPacketTraversal()
@@ -183,6 +261,12 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	err = peer.SendBuffer(packet)
 	if err != nil {
 		device.log.Error.Println(peer, "- Failed to send handshake initiation:", err)
+	} else if isRetry {
+		device.logEvent(EventHandshakeInitiated, peer, "retry")
+		peer.spanInitiationSent()
+	} else {
+		device.logEvent(EventHandshakeInitiated, peer, "")
+		peer.spanInitiationSent()
 	}
 	peer.timersHandshakeInitiated()
 
@@ -191,7 +275,7 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 
 func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
 	peer.device.log.Debug.Println(peer, "- Sending handshake response")
@@ -209,6 +293,7 @@ func (peer *Peer) SendHandshakeResponse() error {
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, response)
 	packet := writer.Bytes()
+	device.putReserved(packet, peer)
 	peer.cookieGenerator.AddMacs(packet)
 
 	err = peer.BeginSymmetricSession()
@@ -230,7 +315,7 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
 
-	device.log.Debug.Println("Sending cookie response for denied handshake message for", initiatingElem.endpoint.DstToString())
+	device.log.Debug.Println("Sending cookie response for denied handshake message for", device.redactEndpoint(initiatingElem.endpoint))
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
 	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
@@ -242,8 +327,9 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
-	return nil
+	packet := writer.Bytes()
+	device.putReserved(packet, nil)
+	return device.sendOnBind(packet, initiatingElem.endpoint)
 }
 
 func (peer *Peer) keepKeyFreshSending() {
@@ -252,7 +338,7 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := atomic.LoadUint64(&keypair.sendNonce)
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages || (keypair.isInitiator && peer.device.since(keypair.created) > RekeyAfterTime) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -273,6 +359,7 @@ func (device *Device) RoutineReadFromTUN() {
 	}()
 
 	logDebug.Println("Routine: TUN reader - started")
+	labelWorker("tun-reader")
 
 	var elem *QueueOutboundElement
 
@@ -285,11 +372,14 @@ func (device *Device) RoutineReadFromTUN() {
 
 		// read packet
 
+		// Not held while reading, which may block for good.
+		device.untrackElement(elem)
 		offset := MessageTransportHeaderSize
 		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		device.trackElement(elem, 0)
 
 		if err != nil {
-			if !device.isClosed.Get() {
+			if !device.isClosed() {
 				logError.Println("Failed to read packet from TUN device:", err)
 				device.Close()
 			}
@@ -298,11 +388,13 @@ func (device *Device) RoutineReadFromTUN() {
 			return
 		}
 
-		if size == 0 || size > MaxContentSize {
+		if size == 0 || size > len(elem.buffer)-MessageTransportSize {
 			continue
 		}
 
 		elem.packet = elem.buffer[offset : offset+size]
+		elem.traceID = device.newPacketID()
+		device.tracePacket(elem.traceID, StageTUNRead)
 
 		// lookup peer
 
@@ -327,23 +419,56 @@ func (device *Device) RoutineReadFromTUN() {
 		}
 
 		if peer == nil {
+			device.dropPacket(elem.traceID, DropNoPeer)
 			continue
 		}
 
-		// insert into nonce/pre-handshake queue
-
-		peer.queue.RLock()
-		if peer.isRunning.Get() {
-			if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
-				peer.SendHandshakeInitiation(false)
+		if mtu := peer.MTU(); mtu != 0 {
+			if len(elem.packet) > mtu {
+				if device.fragmentIPv4Packets && mayFragment(elem.packet) {
+					if fragments := device.fragmentIPv4(elem.packet, mtu); fragments != nil {
+						device.tracePacket(elem.traceID, StageFragmented)
+						for _, fragment := range fragments {
+							if !peer.queueOutbound(fragment) {
+								device.PutMessageBuffer(fragment.buffer)
+								device.PutOutboundElement(fragment)
+							}
+						}
+						continue
+					}
+				}
+				device.packetTooBig(elem.packet, mtu)
+				device.dropPacket(elem.traceID, DropTooBig)
+				continue
 			}
-			addToNonceQueue(peer.queue.nonce, elem, device)
+			clampMSS(elem.packet, mtu)
+		}
+
+		if peer.queueOutbound(elem) {
 			elem = nil
 		}
-		peer.queue.RUnlock()
 	}
 }
 
+// queueOutbound inserts elem, read from the TUN device, into the peer's
+// nonce/pre-handshake queue, reporting whether it did.
+func (peer *Peer) queueOutbound(elem *QueueOutboundElement) bool {
+	device := peer.device
+	peer.queue.RLock()
+	defer peer.queue.RUnlock()
+	if !peer.isRunning.Get() {
+		device.dropPacket(elem.traceID, DropPeerDown)
+		return false
+	}
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.SendHandshakeInitiation(false)
+	}
+	device.tracePacket(elem.traceID, StageQueued)
+	peer.queueHighWater.staged.note(queuedDepth(len(peer.queue.nonce), cap(peer.queue.nonce)))
+	addToNonceQueue(peer.queue.nonce, elem, device)
+	return true
+}
+
 func (peer *Peer) FlushNonceQueue() {
 	select {
 	case peer.signals.flushNonceQueue <- struct{}{}:
@@ -351,8 +476,14 @@ func (peer *Peer) FlushNonceQueue() {
 	}
 }
 
-func (peer *Peer) handshakeDoneCallback() {
-	if peer.device.handshakeDone == nil {
+func (peer *Peer) handshakeDoneCallback(keypair *Keypair, endpoint conn.Endpoint) {
+	device := peer.device
+	if keypair == nil {
+		return
+	}
+	peer.logSession(keypair)
+	peer.spanHandshakeEnded(nil, SpanAttribute{Key: SpanKeyInitiator, Value: keypair.isInitiator})
+	if device.handshakeDone == nil {
 		return
 	}
 
@@ -360,7 +491,16 @@ func (peer *Peer) handshakeDoneCallback() {
 	key := peer.handshake.remoteStatic
 	peer.RUnlock()
 
-	peer.device.handshakeDone(key, peer, &peer.device.allowedips)
+	device.handshakeDone(HandshakeInfo{
+		PublicKey:   key,
+		Peer:        peer,
+		AllowedIPs:  &device.allowedips,
+		Initiator:   keypair.isInitiator,
+		Endpoint:    endpoint,
+		LocalIndex:  keypair.localIndex,
+		RemoteIndex: keypair.remoteIndex,
+		Time:        keypair.created,
+	})
 }
 
 /* Queues packets when there is no handshake.
@@ -379,6 +519,7 @@ func (peer *Peer) RoutineNonce() {
 		for {
 			select {
 			case elem := <-peer.queue.nonce:
+				device.dropPacket(elem.traceID, DropFlushed)
 				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
 			default:
@@ -397,15 +538,28 @@ func (peer *Peer) RoutineNonce() {
 	}()
 
 	logDebug.Println(peer, "- Routine: nonce worker - started")
+	labelWorker("nonce")
 
 NextPacket:
 	for {
 		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
+		// keepalives go ahead of queued packets
+
+		select {
+		case <-peer.signals.sendKeepalive:
+			peer.sendKeepaliveNow()
+		default:
+		}
+
 		select {
 		case <-peer.routines.stop:
 			return
 
+		case <-peer.signals.sendKeepalive:
+			peer.sendKeepaliveNow()
+			continue NextPacket
+
 		case <-peer.signals.flushNonceQueue:
 			flush()
 			continue NextPacket
@@ -424,7 +578,7 @@ NextPacket:
 
 				keypair = peer.keypairs.Current()
 				if keypair != nil && atomic.LoadUint64(&keypair.sendNonce) < RejectAfterMessages {
-					if time.Since(keypair.created) < RejectAfterTime {
+					if device.since(keypair.created) < RejectAfterTime {
 						break
 					}
 				}
@@ -446,15 +600,16 @@ NextPacket:
 				select {
 				case <-peer.signals.newKeypairArrived:
 					logDebug.Println(peer, "- Obtained awaited keypair")
-					peer.handshakeDoneCallback()
 
 				case <-peer.signals.flushNonceQueue:
+					device.dropPacket(elem.traceID, DropFlushed)
 					device.PutMessageBuffer(elem.buffer)
 					device.PutOutboundElement(elem)
 					flush()
 					continue NextPacket
 
 				case <-peer.routines.stop:
+					device.dropPacket(elem.traceID, DropPeerDown)
 					device.PutMessageBuffer(elem.buffer)
 					device.PutOutboundElement(elem)
 					return
@@ -471,6 +626,7 @@ NextPacket:
 
 			if elem.nonce >= RejectAfterMessages {
 				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+				device.dropPacket(elem.traceID, DropNonceExhausted)
 				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
 				continue NextPacket
@@ -481,6 +637,8 @@ NextPacket:
 			elem.Lock()
 
 			// add to parallel and sequential queue
+			device.queueHighWater.encryption.note(queuedDepth(len(device.queue.encryption.c), cap(device.queue.encryption.c)))
+			peer.queueHighWater.outbound.note(queuedDepth(len(peer.queue.outbound), cap(peer.queue.outbound)))
 			addToOutboundAndEncryptionQueues(peer.queue.outbound, device.queue.encryption.c, elem)
 		}
 	}
@@ -501,6 +659,49 @@ func calculatePaddingSize(packetSize, mtu int) int {
 	return paddedSize - lastUnit
 }
 
+/* Turns elem.packet into a transport message, in the buffer it was read
+ * into: the header is written to the headroom RoutineReadFromTUN leaves
+ * before the packet, and the padded packet is sealed where it lies, with
+ * the tag after it. The outbound path has always worked this way; seal
+ * only gathers it in one place, so that it can be tested and benchmarked,
+ * and zeroes the padding in place rather than appending it byte by byte.
+ *
+ * The nonce array is scratch space, kept by the caller so that it does
+ * not escape to the heap once per packet.
+ */
+func (elem *QueueOutboundElement) seal(nonce *[chacha20poly1305.NonceSize]byte, mtu int) {
+
+	// populate header fields
+
+	header := elem.buffer[:MessageTransportHeaderSize]
+
+	fieldType := header[0:4]
+	fieldReceiver := header[4:8]
+	fieldNonce := header[8:16]
+
+	binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
+	binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
+	binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
+
+	// pad content to multiple of 16
+
+	size := len(elem.packet)
+	elem.packet = elem.packet[:size+calculatePaddingSize(size, mtu)]
+	for i := size; i < len(elem.packet); i++ {
+		elem.packet[i] = 0
+	}
+
+	// encrypt content
+
+	binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
+	elem.packet = elem.keypair.send.Seal(
+		header,
+		nonce[:],
+		elem.packet,
+		nil,
+	)
+}
+
 /* Encrypts the elements in the queue
  * and marks them for sequential consumption (by releasing the mutex)
  *
@@ -514,6 +715,7 @@ func (device *Device) RoutineEncryption() {
 
 	defer logDebug.Println("Routine: encryption worker - stopped")
 	logDebug.Println("Routine: encryption worker - started")
+	labelWorker("encryption")
 
 	for elem := range device.queue.encryption.c {
 
@@ -523,34 +725,9 @@ func (device *Device) RoutineEncryption() {
 			continue
 		}
 
-		// populate header fields
-
-		header := elem.buffer[:MessageTransportHeaderSize]
-
-		fieldType := header[0:4]
-		fieldReceiver := header[4:8]
-		fieldNonce := header[8:16]
-
-		binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
-		binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
-		binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
-
-		// pad content to multiple of 16
-
-		paddingSize := calculatePaddingSize(len(elem.packet), int(atomic.LoadInt32(&device.tun.mtu)))
-		for i := 0; i < paddingSize; i++ {
-			elem.packet = append(elem.packet, 0)
-		}
-
-		// encrypt content and release to consumer
-
-		binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
-		elem.packet = elem.keypair.send.Seal(
-			header,
-			nonce[:],
-			elem.packet,
-			nil,
-		)
+		elem.seal(&nonce, elem.peer.effectiveMTU())
+		device.putReserved(elem.buffer[:MessageTransportHeaderSize], elem.peer)
+		device.tracePacket(elem.traceID, StageEncrypted)
 		elem.Unlock()
 	}
 }
@@ -567,8 +744,16 @@ func (peer *Peer) RoutineSequentialSender() {
 	logDebug := device.log.Debug
 	logError := device.log.Error
 
-	defer logDebug.Println(peer, "- Routine: sequential sender - stopped")
+	/* Counted in routines.stopping, so that a Start following a Stop,
+	 * as a Down and Up do, waits for this to drain the old outbound
+	 * queue before replacing it.
+	 */
+	defer func() {
+		logDebug.Println(peer, "- Routine: sequential sender - stopped")
+		peer.routines.stopping.Done()
+	}()
 	logDebug.Println(peer, "- Routine: sequential sender - started")
+	labelWorker("sequential-sender")
 
 	for elem := range peer.queue.outbound {
 		elem.Lock()
@@ -583,6 +768,7 @@ func (peer *Peer) RoutineSequentialSender() {
 			// The timers and SendBuffer code are resilient to a few stragglers.
 			// TODO(josharian): rework peer shutdown order to ensure
 			// that we never accidentally keep timers alive longer than necessary.
+			device.dropPacket(elem.traceID, DropPeerDown)
 			device.PutMessageBuffer(elem.buffer)
 			device.PutOutboundElement(elem)
 			continue
@@ -597,6 +783,11 @@ func (peer *Peer) RoutineSequentialSender() {
 		if len(elem.packet) != MessageKeepaliveSize {
 			peer.timersDataSent()
 		}
+		if err != nil {
+			device.dropPacket(elem.traceID, DropSendFailed)
+		} else {
+			device.tracePacket(elem.traceID, StageSent)
+		}
 		device.PutMessageBuffer(elem.buffer)
 		device.PutOutboundElement(elem)
 		if err != nil {
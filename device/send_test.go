@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newSealElement(t testing.TB, size int) (*QueueOutboundElement, *Keypair) {
+	var key [chacha20poly1305.KeySize]byte
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keypair := &Keypair{send: aead, receive: aead, remoteIndex: 7}
+	elem := &QueueOutboundElement{
+		buffer:  make([]byte, MaxMessageSize),
+		keypair: keypair,
+	}
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+	for i := range elem.packet {
+		elem.packet[i] = byte(i)
+	}
+	return elem, keypair
+}
+
+func TestSealInPlace(t *testing.T) {
+	const mtu = 1420
+	for _, size := range []int{1, 16, 100, mtu} {
+		elem, keypair := newSealElement(t, size)
+		plain := append([]byte{}, elem.packet...)
+		elem.nonce = 42
+
+		var nonce [chacha20poly1305.NonceSize]byte
+		elem.seal(&nonce, mtu)
+
+		if &elem.packet[0] != &elem.buffer[0] {
+			t.Fatalf("size %d: message not built in the packet's buffer", size)
+		}
+		padded := size + calculatePaddingSize(size, mtu)
+		if want := MessageTransportHeaderSize + padded + chacha20poly1305.Overhead; len(elem.packet) != want {
+			t.Fatalf("size %d: message length %d, want %d", size, len(elem.packet), want)
+		}
+		if typ := binary.LittleEndian.Uint32(elem.packet[0:4]); typ != MessageTransportType {
+			t.Errorf("size %d: type %d", size, typ)
+		}
+		if n := binary.LittleEndian.Uint64(elem.packet[8:16]); n != 42 {
+			t.Errorf("size %d: nonce %d", size, n)
+		}
+
+		opened, err := keypair.receive.Open(nil, nonce[:], elem.packet[MessageTransportHeaderSize:], nil)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(opened[:size], plain) || !bytes.Equal(opened[size:], make([]byte, padded-size)) {
+			t.Errorf("size %d: decrypted packet differs", size)
+		}
+	}
+}
+
+func TestSealAllocs(t *testing.T) {
+	elem, _ := newSealElement(t, 1420)
+	packet := elem.packet
+	var nonce [chacha20poly1305.NonceSize]byte
+	allocs := testing.AllocsPerRun(100, func() {
+		elem.packet = packet
+		elem.seal(&nonce, 1420)
+	})
+	if allocs != 0 {
+		t.Errorf("seal allocates %v times per packet", allocs)
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	for _, size := range []int{64, 512, 1420} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			elem, _ := newSealElement(b, size)
+			packet := elem.packet
+			var nonce [chacha20poly1305.NonceSize]byte
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				elem.packet = packet
+				elem.nonce = uint64(i)
+				elem.seal(&nonce, 1420)
+			}
+		})
+	}
+}
+
+func TestKeepaliveAheadOfData(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	peer0 := pair[0].dev.Peers()[0]
+	peer1 := pair[1].dev.Peers()[0]
+	rx := peer1.RxBytes()
+
+	// Hold up the nonce routine at the keypair, with packets queued
+	// behind it.
+	const n = 16
+	msg := tuntest.Ping(pair[1].ip, pair[0].ip)
+	peer0.keypairs.Lock()
+	for i := 0; i < n; i++ {
+		pair[0].tun.Outbound <- msg
+	}
+	for len(peer0.queue.nonce) < n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	if !peer0.SendKeepalive() {
+		peer0.keypairs.Unlock()
+		t.Fatal("keepalive not sent while packets were queued")
+	}
+	peer0.keypairs.Unlock()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-pair[1].tun.Inbound:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d did not transit", i)
+		}
+	}
+	mtu := int(atomic.LoadInt32(&pair[0].dev.tun.mtu))
+	want := rx + n*uint64(MessageTransportSize+len(msg)+calculatePaddingSize(len(msg), mtu)) + MessageKeepaliveSize
+	deadline := time.Now().Add(5 * time.Second)
+	for peer1.RxBytes() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d bytes, want %d: keepalive lost", peer1.RxBytes()-rx, want-rx)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
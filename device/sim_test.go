@@ -0,0 +1,207 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// seededRand is a reproducible source for DeviceOptions.Rand.
+type seededRand struct {
+	sync.Mutex
+	*rand.Rand
+}
+
+func newSeededRand(seed int64) *seededRand {
+	return &seededRand{Rand: rand.New(rand.NewSource(seed))}
+}
+
+func (r *seededRand) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.Rand.Read(p)
+}
+
+// genSimPair creates a testPair whose devices run on clock, draw their
+// random numbers from sources seeded with seed, and talk over in-memory
+// binds.
+func genSimPair(t *testing.T, clock *ManualClock, seed int64) (pair testPair) {
+	return genSimPairWithOptions(t, clock, seed, nil)
+}
+
+// genSimPairWithOptions is genSimPair, but lets configure change the
+// options of the devices, if it is non-nil.
+func genSimPairWithOptions(t *testing.T, clock *ManualClock, seed int64, configure func(i int, opts *DeviceOptions)) (pair testPair) {
+	binds, endpoints := bindtest.NewChannelBinds()
+	keys := [2][2]string{{
+		"481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58",
+		"f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725",
+	}, {
+		"98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768",
+		"49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427",
+	}}
+	for i := range pair {
+		p := &pair[i]
+		p.tun = tuntest.NewChannelTUN()
+		p.ip = net.IPv4(1, 0, 0, byte(i+1))
+		bind := binds[i]
+		opts := &DeviceOptions{
+			Logger: NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i)),
+			Clock:  clock,
+			Rand:   newSeededRand(seed + int64(i)),
+			CreateBind: func(uint16) (conn.Bind, uint16, error) {
+				return bind, 0, nil
+			},
+			CreateEndpoint: func(_ [32]byte, s string) (conn.Endpoint, error) {
+				return bindtest.ParseEndpoint(s)
+			},
+			SkipBindUpdate: true,
+		}
+		if configure != nil {
+			configure(i, opts)
+		}
+		p.dev = NewDevice(p.tun.TUN(), opts)
+		t.Cleanup(p.dev.Close)
+		err := p.dev.IpcSetOperation(uapiCfg(
+			"private_key", keys[i][0],
+			"replace_peers", "true",
+			"public_key", keys[i][1],
+			"protocol_version", "1",
+			"replace_allowed_ips", "true",
+			"allowed_ip", fmt.Sprintf("1.0.0.%d/32", 2-i),
+			"endpoint", endpoints[1-i].DstToString(),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pair
+}
+
+// waitFor waits for cond to hold, as the devices' routines do their work
+// while the simulated clock stands still.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// step advances clock by d in increments of inc, letting the devices
+// handle what each increment's timers sent before taking the next.
+func step(clock *ManualClock, d, inc time.Duration) {
+	for ; d > 0; d -= inc {
+		clock.Advance(inc)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSimulationReproducible(t *testing.T) {
+	type session struct {
+		localIndex, remoteIndex uint32
+		sendKey                 [32]byte
+	}
+	run := func() session {
+		pair := genSimPair(t, NewManualClock(time.Unix(1e9, 0)), 1)
+		pair.Send(t, Ping, nil)
+		keypair := pair[1].dev.Peers()[0].keypairs.Current()
+		s := session{keypair.localIndex, keypair.remoteIndex, keypair.sendKey}
+		pair[0].dev.Close()
+		pair[1].dev.Close()
+		return s
+	}
+	first, second := run(), run()
+	if first != second {
+		t.Errorf("sessions differ between runs with the same seed:\n%+v\n%+v", first, second)
+	}
+}
+
+func TestSimulationRekey(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	pair := genSimPair(t, clock, 1)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	peer1 := pair[1].dev.Peers()[0]
+	first := peer1.keypairs.Current()
+
+	// Past RekeyAfterTime, the initiator's next packet starts a new
+	// handshake; the old session carries on until it completes.
+	step(clock, RekeyAfterTime+time.Second, time.Second)
+	pair.Send(t, Ping, nil)
+	waitFor(t, "rekey", func() bool {
+		return peer1.keypairs.Current() != first
+	})
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// With no traffic, the key material is zeroed after three times
+	// RejectAfterTime.
+	step(clock, 3*RejectAfterTime+RekeyTimeout, time.Second)
+	for i := range pair {
+		peer := pair[i].dev.Peers()[0]
+		waitFor(t, fmt.Sprintf("dev%d to zero its keys", i), func() bool {
+			keypairs := &peer.keypairs
+			keypairs.RLock()
+			defer keypairs.RUnlock()
+			return keypairs.current == nil && keypairs.previous == nil && keypairs.loadNext() == nil
+		})
+	}
+}
+
+func TestSimulationSimultaneousInitiation(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	pair := genSimPair(t, clock, 1)
+	peers := [2]*Peer{pair[0].dev.Peers()[0], pair[1].dev.Peers()[0]}
+	for _, peer := range peers {
+		if err := peer.TriggerHandshake(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// However the initiations cross, one session comes out of them
+	// without the clock moving, so without waiting for a retransmission.
+	for i, peer := range peers {
+		waitFor(t, fmt.Sprintf("dev%d to confirm a session", i), func() bool {
+			return peer.keypairs.Current() != nil
+		})
+	}
+	k0, k1 := peers[0].keypairs.Current(), peers[1].keypairs.Current()
+	if k0.localIndex != k1.remoteIndex || k0.remoteIndex != k1.localIndex {
+		t.Fatal("the devices confirmed different sessions")
+	}
+	if c0, c1 := pair[0].dev.HandshakeCrossings(), pair[1].dev.HandshakeCrossings(); c0 != c1 {
+		t.Errorf("only one side saw the initiations cross: %d, %d", c0, c1)
+	}
+	for i := range pair {
+		msg := tuntest.Ping(pair[1-i].ip, pair[i].ip)
+		pair[i].tun.Outbound <- msg
+		select {
+		case got := <-pair[1-i].tun.Inbound:
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("dev%d: packet did not transit correctly", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("dev%d: no session after simultaneous initiation", i)
+		}
+	}
+}
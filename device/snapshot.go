@@ -0,0 +1,250 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A Snapshot is the runtime state of a device: its configuration and,
+// for each peer, the sessions it has established, so that another
+// process can carry on from where the device left off without new
+// handshakes. A Snapshot holds the device's private key and session
+// keys; it must be kept as secret as they are.
+type Snapshot struct {
+	// Config is the device's configuration, in the form read by
+	// IpcSetOperation.
+	Config string
+	Peers  []PeerSnapshot
+}
+
+// A PeerSnapshot is the runtime state of a peer.
+type PeerSnapshot struct {
+	PublicKey        wgcfg.Key
+	LastHandshake    time.Time
+	TxBytes, RxBytes uint64
+
+	// The peer's sessions, if it has them.
+	Current, Previous, Next *KeypairSnapshot
+}
+
+// A KeypairSnapshot is the state of a session.
+type KeypairSnapshot struct {
+	SendKey, ReceiveKey     []byte
+	SendNonce               uint64 // the next nonce to send with
+	Replay                  []byte // the replay filter; see replay.Filter.MarshalBinary
+	Initiator               bool
+	Created                 time.Time
+	LocalIndex, RemoteIndex uint32
+}
+
+// ipcGetOnlyKeys are the keys of IpcGetOperation's output that
+// IpcSetOperation does not accept.
+var ipcGetOnlyKeys = map[string]bool{
+	"last_handshake_time_sec":  true,
+	"last_handshake_time_nsec": true,
+	"tx_bytes":                 true,
+	"rx_bytes":                 true,
+}
+
+// Snapshot freezes the device and returns its state. A frozen device
+// stops sending and receiving packets, so that its sessions cannot
+// move on from the state captured: the process restoring it takes over
+// the nonces and replay windows, and the two must never both use them.
+// Only a failed Handover thaws the device again. The device must have
+// been created with DeviceOptions.Snapshots.
+func (device *Device) Snapshot() (*Snapshot, error) {
+	if !device.snapshots {
+		return nil, errors.New("device does not keep session keys for snapshots")
+	}
+	device.frozen.Set(true)
+
+	get, err := device.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+	var cfg strings.Builder
+	inPeers := false
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key := line
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			key = line[:i]
+		}
+		if ipcGetOnlyKeys[key] {
+			continue
+		}
+		if key == "public_key" && !inPeers {
+			cfg.WriteString("replace_peers=true\n")
+			inPeers = true
+		}
+		cfg.WriteString(line + "\n")
+	}
+
+	snap := &Snapshot{Config: cfg.String()}
+	for _, peer := range device.Peers() {
+		ps := PeerSnapshot{
+			PublicKey:     wgcfg.Key(peer.handshake.remoteStatic),
+			LastHandshake: peer.LastHandshake(),
+			TxBytes:       peer.TxBytes(),
+			RxBytes:       peer.RxBytes(),
+		}
+		keypairs := &peer.keypairs
+		keypairs.RLock()
+		ps.Current = keypairs.current.snapshot()
+		ps.Previous = keypairs.previous.snapshot()
+		ps.Next = keypairs.loadNext().snapshot()
+		keypairs.RUnlock()
+		snap.Peers = append(snap.Peers, ps)
+	}
+	return snap, nil
+}
+
+// frozenPollInterval is how often a receive routine of a frozen device
+// checks whether it has been thawed, or its socket is closing.
+const frozenPollInterval = 50 * time.Millisecond
+
+// waitThawed waits, without reading from the socket, until the device is
+// thawed, reporting true, or closing is set or the device closed,
+// reporting false.
+func (device *Device) waitThawed(closing *AtomicBool) bool {
+	for device.frozen.Get() {
+		if closing.Get() || device.isClosed() {
+			return false
+		}
+		time.Sleep(frozenPollInterval)
+	}
+	return true
+}
+
+func (keypair *Keypair) snapshot() *KeypairSnapshot {
+	if keypair == nil {
+		return nil
+	}
+	keypair.replayMutex.Lock()
+	replay, _ := keypair.replayFilter.MarshalBinary()
+	keypair.replayMutex.Unlock()
+	return &KeypairSnapshot{
+		SendKey:     append([]byte(nil), keypair.sendKey[:]...),
+		ReceiveKey:  append([]byte(nil), keypair.receiveKey[:]...),
+		SendNonce:   atomic.LoadUint64(&keypair.sendNonce),
+		Replay:      replay,
+		Initiator:   keypair.isInitiator,
+		Created:     keypair.created,
+		LocalIndex:  keypair.localIndex,
+		RemoteIndex: keypair.remoteIndex,
+	}
+}
+
+// Restore configures the device as snap describes and resumes the
+// sessions it records. The device must not be up yet: peers would
+// otherwise start handshakes of their own before their sessions are
+// restored. If the device has a NonceStore, every session resumes
+// NonceRestoreJump past the later of its nonce in snap and the one saved
+// in the store, and Restore saves the nonces resumed at, so that
+// restoring the same snapshot again skips past them too. Without a
+// NonceStore, sessions resume at the nonces snap records, which is only
+// safe if the device snap was taken from sent nothing since.
+func (device *Device) Restore(snap *Snapshot) error {
+	if device.isUp() {
+		return errors.New("Restore called on a device that is up")
+	}
+	marks, err := device.loadNonceMarks()
+	if err != nil {
+		return fmt.Errorf("loading nonces: %v", err)
+	}
+	if err := device.IpcSetOperation(strings.NewReader(snap.Config)); err != nil {
+		return err
+	}
+	for i := range snap.Peers {
+		ps := &snap.Peers[i]
+		peer := device.LookupPeer(NoisePublicKey(ps.PublicKey))
+		if peer == nil {
+			return fmt.Errorf("snapshot has sessions of unknown peer %s", device.redactKey(ps.PublicKey))
+		}
+		if err := peer.restore(ps, marks); err != nil {
+			return err
+		}
+	}
+	if err := device.SaveNonces(); err != nil {
+		return fmt.Errorf("saving nonces: %v", err)
+	}
+	return nil
+}
+
+func (peer *Peer) restore(ps *PeerSnapshot, marks map[nonceMarkKey]uint64) error {
+	device := peer.device
+
+	if !ps.LastHandshake.IsZero() {
+		atomic.StoreInt64(&peer.stats.lastHandshakeNano, ps.LastHandshake.UnixNano())
+	}
+	atomic.StoreUint64(&peer.stats.txBytes, ps.TxBytes)
+	atomic.StoreUint64(&peer.stats.rxBytes, ps.RxBytes)
+
+	var restored [3]*Keypair
+	for i, ks := range []*KeypairSnapshot{ps.Current, ps.Previous, ps.Next} {
+		if ks == nil {
+			continue
+		}
+		keypair, err := device.restoreKeypair(ks)
+		if err == nil && marks != nil {
+			keypair.sendNonce = restoredNonce(ks.SendNonce, marks[nonceMarkKey{ps.PublicKey, ks.LocalIndex}])
+		}
+		if err == nil && !device.indexTable.insertKeypair(keypair.localIndex, peer, keypair) {
+			err = fmt.Errorf("index %d already in use", keypair.localIndex)
+		}
+		if err != nil {
+			for _, keypair := range restored {
+				device.DeleteKeypair(keypair)
+			}
+			return fmt.Errorf("%v: invalid session in snapshot: %v", peer, err)
+		}
+		restored[i] = keypair
+	}
+
+	keypairs := &peer.keypairs
+	keypairs.Lock()
+	defer keypairs.Unlock()
+	device.DeleteKeypair(keypairs.current)
+	device.DeleteKeypair(keypairs.previous)
+	device.DeleteKeypair(keypairs.loadNext())
+	keypairs.current = restored[0]
+	keypairs.previous = restored[1]
+	keypairs.storeNext(restored[2])
+	return nil
+}
+
+func (device *Device) restoreKeypair(ks *KeypairSnapshot) (*Keypair, error) {
+	if len(ks.SendKey) != chacha20poly1305.KeySize || len(ks.ReceiveKey) != chacha20poly1305.KeySize {
+		return nil, errors.New("invalid key length")
+	}
+	keypair := &Keypair{
+		sendNonce:   ks.SendNonce,
+		isInitiator: ks.Initiator,
+		created:     ks.Created,
+		localIndex:  ks.LocalIndex,
+		remoteIndex: ks.RemoteIndex,
+	}
+	if err := keypair.replayFilter.UnmarshalBinary(ks.Replay); err != nil {
+		return nil, err
+	}
+	keypair.send, _ = chacha20poly1305.New(ks.SendKey)
+	keypair.receive, _ = chacha20poly1305.New(ks.ReceiveKey)
+	if device.snapshots {
+		copy(keypair.sendKey[:], ks.SendKey)
+		copy(keypair.receiveKey[:], ks.ReceiveKey)
+	}
+	return keypair, nil
+}
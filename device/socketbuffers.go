@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+const (
+	// SocketBufferCheckInterval is how often a device autotuning its
+	// socket buffers checks them for drops.
+	SocketBufferCheckInterval = 10 * time.Second
+
+	// MaxAutotunedSocketBuffer caps the receive buffer autotuning asks
+	// for: at 10Gbps, about 25ms of datagrams.
+	MaxAutotunedSocketBuffer = 32 << 20
+)
+
+// SocketStats reports on the buffers of the device's UDP sockets. It
+// fails if the device has no sockets open or its Bind is not a
+// conn.SocketBufferBind.
+//
+// A rising Drops count means datagrams arrive faster in bursts than the
+// receive routines take them: the receive buffer, set with
+// DeviceOptions.BindOptions.ReceiveBuffer, should be raised until Drops
+// stays put under load. DeviceOptions.AutotuneSocketBuffers does so
+// itself.
+func (device *Device) SocketStats() (conn.SocketStats, error) {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	bind, ok := device.net.bind.(conn.SocketBufferBind)
+	if !ok {
+		return conn.SocketStats{}, errors.New("socket stats not supported")
+	}
+	return bind.SocketStats()
+}
+
+// autotunedReceiveBuffer returns the receive buffer size autotuning last
+// asked for, or zero.
+func (device *Device) autotunedReceiveBuffer() int {
+	return int(atomic.LoadInt32(&device.socketBuffers.receive))
+}
+
+// nextReceiveBuffer returns the receive buffer size to ask for after
+// drops with a buffer of size, or zero if it is already at the cap or
+// of unknown size.
+func nextReceiveBuffer(size int) int {
+	if size <= 0 || size >= MaxAutotunedSocketBuffer {
+		return 0
+	}
+	if size *= 2; size > MaxAutotunedSocketBuffer {
+		size = MaxAutotunedSocketBuffer
+	}
+	return size
+}
+
+// autotuneSocketBuffers grows the receive buffer if the sockets dropped
+// datagrams since lastDrops, returning the drop count to compare the
+// next check with.
+func (device *Device) autotuneSocketBuffers(lastDrops uint64, haveLast bool) (uint64, bool) {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	bind, ok := device.net.bind.(conn.SocketBufferBind)
+	if !ok {
+		return 0, false
+	}
+	stats, err := bind.SocketStats()
+	if err != nil {
+		return 0, false
+	}
+	// The counter starts over with new sockets.
+	if !haveLast || stats.Drops <= lastDrops {
+		return stats.Drops, true
+	}
+	size := nextReceiveBuffer(stats.ReceiveBuffer)
+	if size == 0 {
+		return stats.Drops, true
+	}
+	if err := bind.SetSocketBuffers(size, 0); err != nil {
+		device.log.Error.Println("Failed to grow the UDP receive buffer:", err)
+		return stats.Drops, true
+	}
+	atomic.StoreInt32(&device.socketBuffers.receive, int32(size))
+	if got, err := bind.SocketStats(); err == nil && got.ReceiveBuffer < size {
+		device.log.Info.Printf("UDP sockets dropped %d datagrams; the system capped the receive buffer at %d bytes of the %d asked for (raise net.core.rmem_max)",
+			stats.Drops-lastDrops, got.ReceiveBuffer, size)
+	} else {
+		device.log.Info.Printf("UDP sockets dropped %d datagrams; receive buffer grown to %d bytes (set BindOptions.ReceiveBuffer to start there)",
+			stats.Drops-lastDrops, size)
+	}
+	return stats.Drops, true
+}
+
+func (device *Device) RoutineAutotuneSocketBuffers() {
+	ticker := time.NewTicker(SocketBufferCheckInterval)
+	defer ticker.Stop()
+	var lastDrops uint64
+	var haveLast bool
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+		}
+		lastDrops, haveLast = device.autotuneSocketBuffers(lastDrops, haveLast)
+	}
+}
@@ -0,0 +1,31 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+func TestSocketStats(t *testing.T) {
+	// Below the usual net.core.rmem_max and wmem_max, so that the sizes
+	// are granted without CAP_NET_ADMIN.
+	const size = 128 << 10
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.BindOptions = conn.BindOptions{ReceiveBuffer: size, SendBuffer: size}
+	})
+	pair.Send(t, Ping, nil)
+	stats, err := pair[0].dev.SocketStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ReceiveBuffer != size || stats.SendBuffer != size {
+		t.Errorf("buffers %d and %d, want %d", stats.ReceiveBuffer, stats.SendBuffer, size)
+	}
+}
@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+)
+
+// bufferBind is a ChannelBind that pretends to have socket buffers.
+type bufferBind struct {
+	*bindtest.ChannelBind
+	mu    sync.Mutex
+	stats conn.SocketStats
+	cap   int // the largest receive buffer the "system" allows
+}
+
+func (b *bufferBind) SetSocketBuffers(receive, send int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if receive > b.cap {
+		receive = b.cap
+	}
+	if receive > 0 {
+		b.stats.ReceiveBuffer = receive
+	}
+	if send > 0 {
+		b.stats.SendBuffer = send
+	}
+	return nil
+}
+
+func (b *bufferBind) SocketStats() (conn.SocketStats, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats, nil
+}
+
+func (b *bufferBind) drop(n uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.Drops += n
+}
+
+func TestAutotuneSocketBuffers(t *testing.T) {
+	var bind *bufferBind
+	pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+		if i != 0 {
+			return
+		}
+		createBind := opts.CreateBind
+		opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+			b, port, err := createBind(port)
+			bind = &bufferBind{
+				ChannelBind: b.(*bindtest.ChannelBind),
+				stats:       conn.SocketStats{ReceiveBuffer: 1 << 20, SendBuffer: 1 << 20},
+				cap:         6 << 20,
+			}
+			return bind, port, err
+		}
+	})
+	dev := pair[0].dev
+
+	drops, ok := dev.autotuneSocketBuffers(0, false)
+	if !ok || drops != 0 {
+		t.Fatalf("first check = %d, %v; want 0, true", drops, ok)
+	}
+	drops, _ = dev.autotuneSocketBuffers(drops, true)
+	if stats, _ := dev.SocketStats(); stats.ReceiveBuffer != 1<<20 {
+		t.Fatalf("receive buffer grown to %d without drops", stats.ReceiveBuffer)
+	}
+
+	for _, want := range []int{2 << 20, 4 << 20, 6 << 20} {
+		bind.drop(10)
+		drops, _ = dev.autotuneSocketBuffers(drops, true)
+		stats, err := dev.SocketStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.ReceiveBuffer != want {
+			t.Errorf("receive buffer %d after drops, want %d", stats.ReceiveBuffer, want)
+		}
+		if stats.SendBuffer != 1<<20 {
+			t.Errorf("send buffer changed to %d", stats.SendBuffer)
+		}
+	}
+	if got, want := dev.autotunedReceiveBuffer(), 8<<20; got != want {
+		t.Errorf("autotuned size %d, want %d as asked for", got, want)
+	}
+}
+
+func TestNextReceiveBuffer(t *testing.T) {
+	tests := []struct{ size, want int }{
+		{0, 0},
+		{212992, 425984},
+		{MaxAutotunedSocketBuffer / 2, MaxAutotunedSocketBuffer},
+		{MaxAutotunedSocketBuffer/2 + 1, MaxAutotunedSocketBuffer},
+		{MaxAutotunedSocketBuffer, 0},
+	}
+	for _, tt := range tests {
+		if got := nextReceiveBuffer(tt.size); got != tt.want {
+			t.Errorf("nextReceiveBuffer(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+)
+
+// A SocketError is a kind of error the device's UDP sockets returned.
+// Device.SocketErrorCounts reports how many of each there were. Most
+// show up otherwise only as handshakes that go unanswered.
+type SocketError int
+
+const (
+	SocketErrorPermission  SocketError = iota // EPERM or EACCES sending: a firewall rule rejected the datagram
+	SocketErrorUnreachable                    // ENETUNREACH or EHOSTUNREACH sending: no route to the endpoint
+	SocketErrorTooLarge                       // EMSGSIZE sending: the datagram exceeds the path MTU
+	SocketErrorNoBuffers                      // ENOBUFS or EAGAIN sending: the send buffer or queue was full
+	SocketErrorOther                          // any other error sending
+	SocketErrorReceive                        // a receive routine stopped on an error; see DeviceOptions.BindFailed
+
+	numSocketErrors
+)
+
+var socketErrorNames = [numSocketErrors]string{
+	SocketErrorPermission:  "permission",
+	SocketErrorUnreachable: "unreachable",
+	SocketErrorTooLarge:    "too-large",
+	SocketErrorNoBuffers:   "no-buffers",
+	SocketErrorOther:       "other",
+	SocketErrorReceive:     "receive",
+}
+
+func (e SocketError) String() string {
+	if e < 0 || e >= numSocketErrors {
+		return "unknown"
+	}
+	return socketErrorNames[e]
+}
+
+// classifySendError returns the kind of err, returned sending a datagram.
+func classifySendError(err error) SocketError {
+	switch {
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return SocketErrorPermission
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return SocketErrorUnreachable
+	case errors.Is(err, syscall.EMSGSIZE):
+		return SocketErrorTooLarge
+	case errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.EAGAIN):
+		return SocketErrorNoBuffers
+	}
+	return SocketErrorOther
+}
+
+// countSendError counts err, if it is not nil, and returns it.
+func (device *Device) countSendError(err error) error {
+	if err != nil {
+		atomic.AddUint64(&device.socketErrors[classifySendError(err)], 1)
+	}
+	return err
+}
+
+// SocketErrorCounts returns the number of errors of each kind the device's
+// UDP sockets returned, omitting kinds with none. Datagrams the system
+// dropped on receipt, for want of room in the receive buffer, are
+// counted by SocketStats instead.
+func (device *Device) SocketErrorCounts() map[SocketError]uint64 {
+	counts := make(map[SocketError]uint64)
+	for e := SocketError(0); e < numSocketErrors; e++ {
+		if n := atomic.LoadUint64(&device.socketErrors[e]); n != 0 {
+			counts[e] = n
+		}
+	}
+	return counts
+}
+
+// receiveFailed reports whether err, which stopped a receive routine, was
+// not of the device's making: not from closing the socket, which closing
+// reports, nor from the socket's address family being unavailable.
+func (device *Device) receiveFailed(err error, closing *AtomicBool) bool {
+	if err == nil || closing.Get() || device.isClosed() || device.frozen.Get() {
+		return false
+	}
+	if errors.Is(err, syscall.EAFNOSUPPORT) {
+		return false
+	}
+	atomic.AddUint64(&device.socketErrors[SocketErrorReceive], 1)
+	return true
+}
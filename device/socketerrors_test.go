@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+)
+
+func TestClassifySendError(t *testing.T) {
+	wrap := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendmsg", errno)}
+	}
+	tests := []struct {
+		err  error
+		want SocketError
+	}{
+		{syscall.EPERM, SocketErrorPermission},
+		{wrap(syscall.EPERM), SocketErrorPermission},
+		{wrap(syscall.EACCES), SocketErrorPermission},
+		{wrap(syscall.ENETUNREACH), SocketErrorUnreachable},
+		{syscall.EHOSTUNREACH, SocketErrorUnreachable},
+		{wrap(syscall.EMSGSIZE), SocketErrorTooLarge},
+		{wrap(syscall.ENOBUFS), SocketErrorNoBuffers},
+		{wrap(syscall.ECONNREFUSED), SocketErrorOther},
+		{errors.New("no route to 127.0.0.1:2"), SocketErrorOther},
+	}
+	for _, tt := range tests {
+		if got := classifySendError(tt.err); got != tt.want {
+			t.Errorf("classifySendError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// sendErrBind is a ChannelBind whose sends fail with err.
+type sendErrBind struct {
+	*bindtest.ChannelBind
+	err error
+}
+
+func (b *sendErrBind) Send(pkt []byte, ep conn.Endpoint) error { return b.err }
+
+func TestSocketErrorCounts(t *testing.T) {
+	pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+		createBind := opts.CreateBind
+		opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := createBind(port)
+			if i == 1 {
+				bind = &sendErrBind{bind.(*bindtest.ChannelBind), os.NewSyscallError("sendmsg", syscall.EPERM)}
+			}
+			return bind, port, err
+		}
+	})
+	peer := pair[1].dev.Peers()[0]
+	if err := peer.TriggerHandshake(); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("TriggerHandshake = %v, want EPERM", err)
+	}
+	if got := pair[1].dev.SocketErrorCounts()[SocketErrorPermission]; got != 1 {
+		t.Errorf("counted %d permission errors, want 1", got)
+	}
+	if counts := pair[0].dev.SocketErrorCounts(); len(counts) != 0 {
+		t.Errorf("errors counted without any: %v", counts)
+	}
+}
+
+func TestBindFailed(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		binds  [2]*bindtest.ChannelBind
+		failed [2][]error
+	)
+	pair := genSimPairWithOptions(t, NewManualClock(time.Unix(1e9, 0)), 1, func(i int, opts *DeviceOptions) {
+		createBind := opts.CreateBind
+		opts.CreateBind = func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := createBind(port)
+			binds[i] = bind.(*bindtest.ChannelBind)
+			return bind, port, err
+		}
+		opts.BindFailed = func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed[i] = append(failed[i], err)
+		}
+	})
+
+	// Closed behind the device's back, the bind stops both receive
+	// routines.
+	binds[0].Close()
+	waitFor(t, "BindFailed", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(failed[0]) == 2
+	})
+	if got := pair[0].dev.SocketErrorCounts()[SocketErrorReceive]; got != 2 {
+		t.Errorf("counted %d receive errors, want 2", got)
+	}
+
+	// The device closing its bind is not a failure.
+	pair[1].dev.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed[1]) != 0 {
+		t.Errorf("BindFailed called on closing: %v", failed[1])
+	}
+}
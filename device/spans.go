@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+)
+
+/* Span tracing reports the device's slower operations as spans to a
+ * SpanTracer: Up, Down, Reconfig and BindUpdate, adding and removing
+ * peers, the handshakes a peer initiates, from the first initiation to
+ * the session, and the processing of each handshake message received.
+ * Operators of fleets can then line tunnel setup latency up with the
+ * traces of their control plane, by passing the contexts of its
+ * requests to ReconfigContext, UpContext and BindUpdateContext.
+ *
+ * SpanTracer and Span are shaped after OpenTelemetry's trace.Tracer and
+ * trace.Span, so that an adapter of a few lines connects them, without
+ * the device depending on OpenTelemetry:
+ *
+ *	func (t otelTracer) Start(ctx context.Context, name string, attrs ...device.SpanAttribute) (context.Context, device.Span) {
+ *		ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(otelAttributes(attrs)...))
+ *		return ctx, otelSpan{span}
+ *	}
+ */
+
+// A SpanTracer starts spans for the device's operations; see
+// DeviceOptions.SpanTracer.
+type SpanTracer interface {
+	// Start starts a span called name, a child of any span in ctx, and
+	// returns a context holding it.
+	Start(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span)
+}
+
+// A Span is an operation started by a SpanTracer.
+type Span interface {
+	SetAttributes(attrs ...SpanAttribute)
+	RecordError(err error)
+	End()
+}
+
+// A SpanAttribute is a key and value describing a span. Value is a
+// string, an int64 or a bool.
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// The keys of the attributes the device sets.
+const (
+	SpanKeyPeer         = "wireguard.peer"          // the peer's public key, in base64
+	SpanKeyPeers        = "wireguard.peers"         // the number of peers configured
+	SpanKeyPeersAdded   = "wireguard.peers_added"   // the number of peers a Reconfig adds
+	SpanKeyPeersRemoved = "wireguard.peers_removed" // the number of peers a Reconfig removes
+	SpanKeyPeersChanged = "wireguard.peers_changed" // the number of peers a Reconfig changes
+	SpanKeyListenPort   = "wireguard.listen_port"   // the port bound
+	SpanKeyMessage      = "wireguard.message"       // "initiation", "response" or "cookie-reply"
+	SpanKeyEndpoint     = "wireguard.endpoint"      // the address a message came from
+	SpanKeyAccepted     = "wireguard.accepted"      // whether a message was accepted
+	SpanKeyAttempts     = "wireguard.attempts"      // the initiations a handshake took
+	SpanKeyInitiator    = "wireguard.initiator"     // whether the device initiated the session
+)
+
+var (
+	errSpanHandshakeGaveUp = errors.New("handshake did not complete")
+	errSpanPeerStopped     = errors.New("peer stopped")
+)
+
+// noopSpan is the span of a device without a SpanTracer.
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...SpanAttribute) {}
+func (noopSpan) RecordError(error)              {}
+func (noopSpan) End()                           {}
+
+// startSpan starts a span with the device's SpanTracer, if it has one.
+func (device *Device) startSpan(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span) {
+	if device.spanTracer == nil {
+		return ctx, noopSpan{}
+	}
+	return device.spanTracer.Start(ctx, name, attrs...)
+}
+
+// endSpan records err on span, unless it is nil, and ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (device *Device) peerAttribute(pk NoisePublicKey) SpanAttribute {
+	if device.redaction.Keys {
+		return SpanAttribute{Key: SpanKeyPeer, Value: redactedKey(pk)}
+	}
+	return SpanAttribute{Key: SpanKeyPeer, Value: base64.StdEncoding.EncodeToString(pk[:])}
+}
+
+func messageTypeName(msgType uint32) string {
+	switch msgType {
+	case MessageInitiationType:
+		return "initiation"
+	case MessageResponseType:
+		return "response"
+	case MessageCookieReplyType:
+		return "cookie-reply"
+	}
+	return "unknown"
+}
+
+// A handshakeSpan is the span of the handshake a peer initiates, open
+// from its first initiation until the session is established or the
+// peer gives up or stops.
+type handshakeSpan struct {
+	sync.Mutex
+	span     Span // nil if none is open
+	attempts int64
+}
+
+// spanInitiationSent opens the peer's handshake span, unless one is
+// open, and counts an initiation sent.
+func (peer *Peer) spanInitiationSent() {
+	device := peer.device
+	if device.spanTracer == nil {
+		return
+	}
+	hs := &peer.handshakeSpan
+	hs.Lock()
+	defer hs.Unlock()
+	if hs.span == nil {
+		_, hs.span = device.spanTracer.Start(context.Background(), "wireguard.handshake", device.peerAttribute(peer.handshake.remoteStatic))
+		hs.attempts = 0
+	}
+	hs.attempts++
+}
+
+// spanHandshakeEnded ends the peer's handshake span, if one is open,
+// recording err unless it is nil.
+func (peer *Peer) spanHandshakeEnded(err error, attrs ...SpanAttribute) {
+	hs := &peer.handshakeSpan
+	hs.Lock()
+	span, attempts := hs.span, hs.attempts
+	hs.span = nil
+	hs.Unlock()
+	if span == nil {
+		return
+	}
+	span.SetAttributes(append(attrs, SpanAttribute{Key: SpanKeyAttempts, Value: attempts})...)
+	endSpan(span, err)
+}
+
+// spanAccepted marks the handshake message of span, unless span is nil,
+// as accepted from peer.
+func spanAccepted(span Span, peer *Peer) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(peer.device.peerAttribute(peer.handshake.remoteStatic), SpanAttribute{Key: SpanKeyAccepted, Value: true})
+}
@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// A spanRecorder is a SpanTracer that keeps the spans it starts.
+type spanRecorder struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	rec    *spanRecorder
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+type recordedSpanKey struct{}
+
+func (r *spanRecorder) Start(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span) {
+	s := &recordedSpan{rec: r, name: name, attrs: make(map[string]interface{})}
+	s.parent, _ = ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	s.SetAttributes(attrs...)
+	r.Lock()
+	r.spans = append(r.spans, s)
+	r.Unlock()
+	return context.WithValue(ctx, recordedSpanKey{}, s), s
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...SpanAttribute) {
+	s.rec.Lock()
+	defer s.rec.Unlock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.rec.Lock()
+	defer s.rec.Unlock()
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.rec.Lock()
+	defer s.rec.Unlock()
+	s.ended = true
+}
+
+// find returns the spans called name.
+func (r *spanRecorder) find(name string) []*recordedSpan {
+	r.Lock()
+	defer r.Unlock()
+	var spans []*recordedSpan
+	for _, s := range r.spans {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestSpansReconfig(t *testing.T) {
+	rec := new(spanRecorder)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:     NewLogger(LogLevelError, "dev: "),
+		SpanTracer: rec,
+	})
+	defer dev.Close()
+
+	privateKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &wgcfg.Config{
+		PrivateKey: privateKey,
+		Peers:      []wgcfg.Peer{{PublicKey: peerKey.Public()}},
+	}
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Reconfig(&wgcfg.Config{PrivateKey: privateKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	reconfigs := rec.find("wireguard.Reconfig")
+	if len(reconfigs) != 2 {
+		t.Fatalf("%d Reconfig spans, want 2", len(reconfigs))
+	}
+	if n := reconfigs[0].attrs[SpanKeyPeers]; n != int64(1) {
+		t.Errorf("Reconfig span with %v peers, want 1", n)
+	}
+	for _, c := range []struct {
+		name   string
+		parent *recordedSpan
+	}{
+		{"wireguard.NewPeer", reconfigs[0]},
+		{"wireguard.RemovePeer", reconfigs[1]},
+	} {
+		spans := rec.find(c.name)
+		if len(spans) != 1 {
+			t.Errorf("%d %s spans, want 1", len(spans), c.name)
+			continue
+		}
+		s := spans[0]
+		if s.parent != c.parent || !s.ended {
+			t.Errorf("%s span not an ended child of Reconfig", c.name)
+		}
+		if s.attrs[SpanKeyPeer] != peerKey.Public().Base64() {
+			t.Errorf("%s span for peer %v", c.name, s.attrs[SpanKeyPeer])
+		}
+	}
+
+	// The ChannelTUN's EventUp has RoutineTUNEventReader call Up too,
+	// concurrently, so there may be a second Up, possibly with its own
+	// BindUpdate. Whichever did the work, there is a BindUpdate, and every
+	// one is a child of an Up.
+	ups := rec.find("wireguard.Up")
+	binds := rec.find("wireguard.BindUpdate")
+	if len(ups) == 0 || len(binds) == 0 {
+		t.Fatalf("%d Up and %d BindUpdate spans, want at least 1 each", len(ups), len(binds))
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	for _, b := range binds {
+		if b.parent == nil || b.parent.name != "wireguard.Up" {
+			t.Error("BindUpdate span not a child of Up")
+		}
+		if port, _ := b.attrs[SpanKeyListenPort].(int64); b.ended && port == 0 {
+			t.Error("BindUpdate span without a listen port")
+		}
+	}
+}
+
+func TestSpansHandshake(t *testing.T) {
+	var recs [2]spanRecorder
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.SpanTracer = &recs[i]
+	})
+	pair.Send(t, Ping, nil) // from the second device, which initiates
+
+	handshakes := recs[1].find("wireguard.handshake")
+	if len(handshakes) != 1 {
+		t.Fatalf("%d handshake spans, want 1", len(handshakes))
+	}
+	hs := handshakes[0]
+	recs[1].Lock()
+	if !hs.ended || hs.err != nil || hs.attrs[SpanKeyInitiator] != true || hs.attrs[SpanKeyAttempts] != int64(1) {
+		t.Errorf("handshake span %+v", hs)
+	}
+	recs[1].Unlock()
+
+	accepted := false
+	for _, s := range recs[0].find("wireguard.handshake.receive") {
+		recs[0].Lock()
+		if s.attrs[SpanKeyMessage] == "initiation" && s.attrs[SpanKeyAccepted] == true {
+			accepted = true
+		}
+		recs[0].Unlock()
+	}
+	if !accepted {
+		t.Error("no span for the accepted initiation")
+	}
+}
@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DeviceState is the state of a device: down until Up, up until Down,
+// and closing, then closed, from the moment Close is called.
+type DeviceState uint32
+
+const (
+	DeviceDown DeviceState = iota
+	DeviceUp
+	DeviceClosing
+	DeviceClosed
+)
+
+var deviceStateNames = [...]string{
+	DeviceDown:    "down",
+	DeviceUp:      "up",
+	DeviceClosing: "closing",
+	DeviceClosed:  "closed",
+}
+
+func (s DeviceState) String() string {
+	if int(s) >= len(deviceStateNames) {
+		return fmt.Sprintf("DeviceState(%d)", uint32(s))
+	}
+	return deviceStateNames[s]
+}
+
+// legalDeviceTransitions are the transitions a device may make.
+var legalDeviceTransitions = [...][]DeviceState{
+	DeviceDown:    {DeviceUp, DeviceClosing},
+	DeviceUp:      {DeviceDown, DeviceClosing},
+	DeviceClosing: {DeviceClosed},
+	DeviceClosed:  nil,
+}
+
+func legalDeviceTransition(from, to DeviceState) bool {
+	if int(from) >= len(legalDeviceTransitions) {
+		return false
+	}
+	for _, s := range legalDeviceTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the state of the device. Up and Down change it only
+// once they hold the state lock; Close makes it DeviceClosing at once,
+// so that transitions waiting for the lock fail with ErrDeviceClosed.
+func (device *Device) State() DeviceState {
+	return DeviceState(atomic.LoadUint32(&device.state.state))
+}
+
+// transition moves the device from one state to another, reporting
+// whether it was in from. It panics if the transition is not legal,
+// which is a bug in the device.
+func (device *Device) transition(from, to DeviceState) bool {
+	if !legalDeviceTransition(from, to) {
+		panic(fmt.Sprintf("wireguard: illegal device state transition from %v to %v", from, to))
+	}
+	return atomic.CompareAndSwapUint32(&device.state.state, uint32(from), uint32(to))
+}
+
+// isUp reports whether the device is up, or going up under the state
+// lock.
+func (device *Device) isUp() bool {
+	return device.State() == DeviceUp
+}
+
+// isClosed reports whether Close has been called.
+func (device *Device) isClosed() bool {
+	return device.State() >= DeviceClosing
+}
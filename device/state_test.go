@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeviceState(t *testing.T) {
+	dev := randDevice(t)
+	check := func(want DeviceState) {
+		t.Helper()
+		if s := dev.State(); s != want {
+			t.Fatalf("state %v, want %v", s, want)
+		}
+	}
+	check(DeviceDown)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	check(DeviceUp)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	check(DeviceUp)
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	check(DeviceDown)
+	dev.Close()
+	check(DeviceClosed)
+	if err := dev.Up(); !errors.Is(err, ErrDeviceClosed) {
+		t.Errorf("Up after Close: %v", err)
+	}
+	check(DeviceClosed)
+	dev.Close()
+	check(DeviceClosed)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("illegal transition did not panic")
+		}
+	}()
+	dev.transition(DeviceClosed, DeviceUp)
+}
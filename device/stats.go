@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"inet.af/netaddr"
+)
+
+// A StatsSnapshot holds the device's counters and a summary of each of
+// its peers, as StatsSnapshot found them. It is plain data, depending on
+// nothing beyond the device's own types, so that embedders can poll it
+// without a metrics library and exporters, such as the debug package's,
+// can build on it.
+//
+// The counters are read one at a time rather than under one lock, so
+// that a snapshot never stalls the data path; counters that move
+// together may be a few packets apart.
+type StatsSnapshot struct {
+	Time  time.Time // when the snapshot was taken, by the device's clock
+	State DeviceState
+
+	Drops          map[DropReason]uint64  // reasons with none are omitted
+	SocketErrors   map[SocketError]uint64 // kinds with none are omitted
+	UnexpectedIPv4 uint64                 // see UnexpectedIPCounts
+	UnexpectedIPv6 uint64
+
+	// Socket reports on the UDP socket buffers, or is nil if the
+	// device's Bind cannot.
+	Socket *conn.SocketStats
+
+	Queues         QueueDepths
+	QueueHighWater QueueDepths
+	AllowedIPs     AllowedIPsStats
+	IndexTable     IndexTableStats
+	Relay          RelayStats
+
+	Peers []PeerStats // in the order of Device.Peers
+}
+
+// PeerStats summarizes a peer in a StatsSnapshot.
+type PeerStats struct {
+	PublicKey  NoisePublicKey
+	Endpoint   string // empty if unknown
+	LocalAddr  string // see Peer.SetLocalAddr
+	AllowedIPs []netaddr.IPPrefix
+
+	LastHandshake      time.Time // zero if none
+	TxBytes            uint64
+	RxBytes            uint64
+	HandshakeCrossings uint64
+	CookieReplies      uint64
+	UnexpectedIPs      uint64
+	EndpointFlaps      uint64
+	DuplicateKeys      uint64
+
+	Passive     bool
+	Disabled    bool
+	Expired     bool
+	Quarantined bool
+	Down        bool // see Peer.IsDown
+	MTU         int  // zero if the device's
+
+	Quality        PeerQuality
+	RTTHistogram   RTTHistogram
+	Queues         PeerQueueDepths
+	QueueHighWater PeerQueueDepths
+}
+
+// StatsSnapshot returns the device's counters and a summary of each of
+// its peers.
+func (device *Device) StatsSnapshot() StatsSnapshot {
+	s := StatsSnapshot{
+		Time:           device.now(),
+		State:          device.State(),
+		Drops:          device.DropCounts(),
+		SocketErrors:   device.SocketErrorCounts(),
+		Queues:         device.QueueDepths(),
+		QueueHighWater: device.QueueHighWater(),
+		AllowedIPs:     device.allowedips.Stats(),
+		IndexTable:     device.IndexTableStats(),
+		Relay:          device.RelayStats(),
+	}
+	s.UnexpectedIPv4, s.UnexpectedIPv6 = device.UnexpectedIPCounts()
+	if stats, err := device.SocketStats(); err == nil {
+		s.Socket = &stats
+	}
+	for _, peer := range device.Peers() {
+		s.Peers = append(s.Peers, peer.statsSnapshot())
+	}
+	return s
+}
+
+func (peer *Peer) statsSnapshot() PeerStats {
+	ps := PeerStats{
+		PublicKey:          peer.PublicKey(),
+		LocalAddr:          peer.LocalAddr(),
+		AllowedIPs:         peer.AllowedIPs(),
+		LastHandshake:      peer.LastHandshake(),
+		TxBytes:            peer.TxBytes(),
+		RxBytes:            peer.RxBytes(),
+		HandshakeCrossings: peer.HandshakeCrossings(),
+		CookieReplies:      peer.CookieReplies(),
+		UnexpectedIPs:      peer.UnexpectedIPCount(),
+		EndpointFlaps:      peer.EndpointFlaps(),
+		DuplicateKeys:      peer.DuplicateKeys(),
+		Passive:            peer.Passive(),
+		Disabled:           peer.Disabled(),
+		Expired:            peer.Expired(),
+		Quarantined:        peer.IsQuarantined(),
+		Down:               peer.IsDown(),
+		MTU:                peer.MTU(),
+		Quality:            peer.Quality(),
+		RTTHistogram:       peer.RTTHistogram(),
+		Queues:             peer.QueueDepths(),
+		QueueHighWater:     peer.QueueHighWater(),
+	}
+	if ep := peer.Endpoint(); ep != nil {
+		ps.Endpoint = ep.DstToString()
+	}
+	return ps
+}
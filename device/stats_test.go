@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestStatsSnapshot(t *testing.T) {
+	pair := genTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	s := pair[0].dev.StatsSnapshot()
+	if s.State != DeviceUp {
+		t.Errorf("state %v, want up", s.State)
+	}
+	if s.Time.IsZero() {
+		t.Error("no time")
+	}
+	if s.Drops == nil || s.SocketErrors == nil {
+		t.Error("no drop or socket error counters")
+	}
+	if s.IndexTable.Handshakes+s.IndexTable.Keypairs == 0 {
+		t.Errorf("index table %+v holds no session", s.IndexTable)
+	}
+	if len(s.Peers) != 1 {
+		t.Fatalf("%d peers, want 1", len(s.Peers))
+	}
+	p := s.Peers[0]
+	if p.PublicKey != pair[0].dev.Peers()[0].PublicKey() {
+		t.Errorf("public key %v", p.PublicKey)
+	}
+	if p.TxBytes == 0 || p.RxBytes == 0 {
+		t.Errorf("tx %d, rx %d bytes; want both", p.TxBytes, p.RxBytes)
+	}
+	if p.LastHandshake.IsZero() {
+		t.Error("no handshake")
+	}
+	if p.Endpoint == "" {
+		t.Error("no endpoint")
+	}
+	if len(p.AllowedIPs) != 1 || p.AllowedIPs[0].String() != "1.0.0.2/32" {
+		t.Errorf("allowed IPs %v", p.AllowedIPs)
+	}
+}
@@ -36,7 +36,7 @@ func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, er
 		return nil, err
 	}
 
-	go device.routineRouteListener(bind, netlinkSock, netlinkCancel)
+	device.goRoutine("route listener", func() { device.routineRouteListener(bind, netlinkSock, netlinkCancel) })
 
 	return netlinkCancel, nil
 }
@@ -0,0 +1,172 @@
+// +build stress
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+/* The stress test races the device's configuration paths against each
+ * other and against traffic, for the race detector to find accesses that
+ * break the locking rules in the struct comments. It is slow, so it is
+ * built with the stress tag:
+ *
+ *	go test -race -tags stress -run Stress -stress.duration 1m ./device
+ */
+
+var stressDuration = flag.Duration("stress.duration", 10*time.Second, "how long TestStress runs")
+
+func TestStress(t *testing.T) {
+	pair := genSimPairWithOptions(t, nil, 1, func(i int, opts *DeviceOptions) {
+		opts.Clock = nil // real timers, for retransmissions
+	})
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	orig, err := dev.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var seed int64
+	run := func(op func(rnd *rand.Rand)) {
+		wg.Add(1)
+		seed++
+		rnd := rand.New(rand.NewSource(seed))
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				op(rnd)
+			}
+		}()
+	}
+
+	// Traffic both ways, not waiting for it to arrive.
+	for i := range pair {
+		src, dst := pair[i], pair[1-i]
+		run(func(*rand.Rand) {
+			select {
+			case src.tun.Outbound <- tuntest.Ping(dst.ip, src.ip):
+			case <-done:
+			}
+		})
+		go func() {
+			for {
+				select {
+				case <-dst.tun.Inbound:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var removed struct {
+		sync.Mutex
+		peers []*Peer
+	}
+	run(func(*rand.Rand) {
+		dev.Reconfig(orig)
+	})
+	run(func(rnd *rand.Rand) {
+		dev.Down()
+		time.Sleep(time.Duration(rnd.Intn(5)) * time.Millisecond)
+		dev.Up()
+	})
+	run(func(*rand.Rand) {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pk := sk.publicKey()
+		err = dev.IpcSetOperation(uapiCfg(
+			"public_key", pk.ToHex(),
+			"allowed_ip", "10.99.0.1/32",
+		))
+		if err != nil {
+			return // raced with Reconfig replacing the peers
+		}
+		if peer := dev.LookupPeer(pk); peer != nil {
+			dev.RemovePeer(pk)
+			removed.Lock()
+			removed.peers = append(removed.peers, peer)
+			removed.Unlock()
+		}
+	})
+	run(func(rnd *rand.Rand) {
+		if rnd.Intn(2) == 0 {
+			dev.SetPrivateKey(other)
+		} else {
+			dev.SetPrivateKey(NoisePrivateKey(orig.PrivateKey))
+		}
+	})
+	run(func(*rand.Rand) {
+		dev.IpcGetOperation(ioutil.Discard)
+	})
+	run(func(rnd *rand.Rand) {
+		dev.IpcSetOperation(uapiCfg(
+			"public_key", NoisePublicKey(orig.Peers[0].PublicKey).ToHex(),
+			"persistent_keepalive_interval", fmt.Sprint(rnd.Intn(30)),
+		))
+	})
+
+	time.Sleep(*stressDuration)
+	close(done)
+	wg.Wait()
+
+	// Once restored, the device carries traffic again, and the state
+	// the locks guard is consistent.
+	if err := dev.Reconfig(orig); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	dev.peers.RLock()
+	if empty := dev.peers.empty.Get(); empty != (len(dev.peers.keyMap) == 0) {
+		t.Errorf("peers.empty = %v with %d peers", empty, len(dev.peers.keyMap))
+	}
+	for pk, peer := range dev.peers.keyMap {
+		if peer.handshake.remoteStatic != pk {
+			t.Errorf("peer %v is in keyMap under %v", peer, pk.ToHex())
+		}
+	}
+	dev.peers.RUnlock()
+	removed.Lock()
+	for _, peer := range removed.peers {
+		if entries := dev.allowedips.EntriesForPeer(peer); len(entries) != 0 {
+			t.Errorf("removed peer %v still has allowed IPs %v", peer, entries)
+		}
+		if peer.isRunning.Get() {
+			t.Errorf("removed peer %v still running", peer)
+		}
+	}
+	removed.Unlock()
+}
@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+)
+
+/* A strict device puts nothing on the wire that upstream WireGuard would
+ * not, and accepts nothing it would drop: the extensions that change the
+ * wire protocol are refused, with an error logged, so that a deployment
+ * that must interoperate with other implementations cannot turn one on
+ * by accident. Extensions that only change what the device does locally,
+ * such as relaying or peer MTUs, are unaffected.
+ */
+
+// errStrict is returned by the operations a strict device refuses.
+var errStrict = errors.New("not allowed in strict mode")
+
+// applyStrict turns off the wire protocol extensions set in opts.
+func (device *Device) applyStrict(opts *DeviceOptions) {
+	device.strict = true
+	if opts.Reserved.Set != nil || opts.Reserved.Received != nil {
+		device.log.Error.Println("Strict mode: ignoring the reserved header bytes hooks")
+		device.reserved = HeaderReserved{}
+	}
+	if opts.ForeignDatagram != nil {
+		device.log.Error.Println("Strict mode: ignoring ForeignDatagram")
+		device.foreignDatagram = nil
+	}
+}
+
+// Strict reports whether the device was created with
+// DeviceOptions.Strict, keeping to the wire protocol of upstream
+// WireGuard.
+func (device *Device) Strict() bool {
+	return device.strict
+}
@@ -8,7 +8,6 @@
 package device
 
 import (
-	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,7 +18,7 @@ import (
  */
 
 type Timer struct {
-	*time.Timer
+	ClockTimer
 	modifyingLock sync.RWMutex
 	runningLock   sync.Mutex
 	isPending     bool
@@ -27,7 +26,7 @@ type Timer struct {
 
 func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
 	timer := &Timer{}
-	timer.Timer = time.AfterFunc(time.Hour, func() {
+	timer.ClockTimer = peer.device.clock.AfterFunc(time.Hour, func() {
 		timer.runningLock.Lock()
 		defer timer.runningLock.Unlock()
 
@@ -73,12 +72,13 @@ func (timer *Timer) IsPending() bool {
 }
 
 func (peer *Peer) timersActive() bool {
-	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && !peer.device.peers.empty.Get()
+	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp() && !peer.device.peers.empty.Get()
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
-	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes {
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
+	attempts := atomic.LoadUint32(&peer.timers.handshakeAttempts)
+	if peer.loadHandshakeRetry().exhausted(attempts) {
+		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, attempts+1)
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -95,9 +95,15 @@ func expiredRetransmitHandshake(peer *Peer) {
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
 			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
 		}
+
+		peer.device.logEvent(EventHandshakeGaveUp, peer, "")
+		peer.spanHandshakeEnded(errSpanHandshakeGaveUp)
+		if gaveUp := peer.device.gaveUp; gaveUp != nil {
+			gaveUp(peer)
+		}
 	} else {
 		atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
+		peer.device.log.Debug.Printf("%s - Handshake did not complete, retrying (try %d)\n", peer, attempts+2)
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.Lock()
@@ -121,6 +127,7 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
+	peer.qualityLost()
 	peer.device.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
@@ -145,8 +152,10 @@ func expiredPersistentKeepalive(peer *Peer) {
 
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
+	peer.deadPeerDataSent()
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
-		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		peer.qualityProbe()
+		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + peer.device.jitter(RekeyTimeoutJitterMaxMs))
 	}
 }
 
@@ -170,6 +179,8 @@ func (peer *Peer) timersAnyAuthenticatedPacketSent() {
 
 /* Should be called after any type of authenticated packet is received -- keepalive, data, or handshake. */
 func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
+	peer.qualityAnswered()
+	peer.deadPeerAnswered()
 	if peer.timersActive() {
 		peer.timers.newHandshake.Del()
 	}
@@ -177,16 +188,12 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
+	peer.deadPeerHandshakeInitiated()
 	if peer.timersActive() {
-		timeout := RekeyTimeout
 		attempts := atomic.LoadUint32(&peer.timers.handshakeAttempts)
-		if attempts == 0 {
-			attempts = 1
-		}
-		if t := time.Duration(attempts) * time.Second; t < timeout {
-			timeout = t
-		}
-		peer.timers.retransmitHandshake.Mod(timeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		timeout := peer.loadHandshakeRetry().wait(attempts) + peer.device.jitter(RekeyTimeoutJitterMaxMs)
+		atomic.StoreInt64(&peer.cookie.retryAtNano, peer.device.now().Add(timeout).UnixNano())
+		peer.timers.retransmitHandshake.Mod(timeout)
 	}
 }
 
@@ -197,7 +204,7 @@ func (peer *Peer) timersHandshakeComplete() {
 	}
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
-	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, peer.device.now().UnixNano())
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A PacketStage is a point in the packet pipeline recorded by packet
+// tracing. Stages other than the first of each direction either hand
+// the packet on or name the reason it was dropped.
+type PacketStage string
+
+const (
+	// Outbound, from the TUN device to a peer.
+	StageTUNRead        PacketStage = "tun-read"        // read from the TUN device
+	StageNoPeer         PacketStage = "no-peer"         // dropped: no peer is allowed the destination
+	StagePeerDown       PacketStage = "peer-down"       // dropped: the peer is not running
+	StageTooBig         PacketStage = "too-big"         // dropped: the packet exceeds the peer's MTU
+	StageFragmented     PacketStage = "fragmented"      // consumed: split into fragments, traced anew
+	StageQueued         PacketStage = "queued"          // waiting for a session in the peer's queue
+	StageQueueFull      PacketStage = "queue-full"      // dropped: a queue was full
+	StageFlushed        PacketStage = "flushed"         // dropped: the peer's queue was flushed
+	StageNonceExhausted PacketStage = "nonce-exhausted" // dropped: the session's nonces are used up
+	StageEncrypted      PacketStage = "encrypted"       // sealed, waiting to be sent in order
+	StageSent           PacketStage = "sent"            // handed to the UDP socket
+	StageSendFailed     PacketStage = "send-failed"     // dropped: the UDP socket failed
+
+	// Inbound, from a peer to the TUN device.
+	StageReceived         PacketStage = "received"          // read from a UDP socket
+	StageNoKeypair        PacketStage = "no-keypair"        // dropped: no session has the receiver index
+	StageKeypairExpired   PacketStage = "keypair-expired"   // dropped: the session is too old
+	StageOverQuota        PacketStage = "over-quota"        // dropped: the peer has its share of a full decryption queue
+	StageDecrypted        PacketStage = "decrypted"         // opened, waiting to be handled in order
+	StageDecryptFailed    PacketStage = "decrypt-failed"    // dropped: authentication failed
+	StageQuarantined      PacketStage = "quarantined"       // dropped: the peer is quarantined
+	StageReplayed         PacketStage = "replayed"          // dropped: the counter was seen before
+	StageKeepalive        PacketStage = "keepalive"         // consumed: an empty keepalive
+	StageMalformed        PacketStage = "malformed"         // dropped: not a well-formed IP packet
+	StageDisallowedSource PacketStage = "disallowed-source" // dropped: the source is not allowed for the peer
+	StageTUNWritten       PacketStage = "tun-written"       // written to the TUN device
+	StageRelayed          PacketStage = "relayed"           // consumed: queued for another peer, traced anew
+	StageTUNWriteFailed   PacketStage = "tun-write-failed"  // dropped: the TUN device failed
+)
+
+// A PacketTraceEvent records a packet reaching a stage.
+type PacketTraceEvent struct {
+	// Packet identifies the packet. IDs are assigned in order as
+	// packets are read from the TUN device or a UDP socket, starting
+	// from 1; the two directions share one sequence.
+	Packet uint64
+	Time   time.Time
+	Stage  PacketStage
+}
+
+// A packetTracer keeps the latest events in a ring.
+type packetTracer struct {
+	lastID uint64 // accessed atomically
+
+	sync.Mutex
+	events []PacketTraceEvent
+	next   int
+	full   bool
+}
+
+func newPacketTracer(size int) *packetTracer {
+	return &packetTracer{events: make([]PacketTraceEvent, size)}
+}
+
+// newPacketID returns the ID for a packet entering the pipeline, or
+// zero if tracing is off.
+func (device *Device) newPacketID() uint64 {
+	if device.tracer == nil {
+		return 0
+	}
+	return atomic.AddUint64(&device.tracer.lastID, 1)
+}
+
+// tracePacket records that the packet with ID id reached stage.
+// It does nothing for an ID of zero.
+func (device *Device) tracePacket(id uint64, stage PacketStage) {
+	if id == 0 {
+		return
+	}
+	t := device.tracer
+	ev := PacketTraceEvent{Packet: id, Time: time.Now(), Stage: stage}
+	t.Lock()
+	t.events[t.next] = ev
+	t.next++
+	if t.next == len(t.events) {
+		t.next = 0
+		t.full = true
+	}
+	t.Unlock()
+}
+
+// PacketTrace returns the trace buffer: the latest events recorded,
+// oldest first, up to DeviceOptions.PacketTraceSize of them. It
+// returns nil if tracing is off.
+func (device *Device) PacketTrace() []PacketTraceEvent {
+	t := device.tracer
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	if !t.full {
+		return append([]PacketTraceEvent(nil), t.events[:t.next]...)
+	}
+	events := make([]PacketTraceEvent, 0, len(t.events))
+	events = append(events, t.events[t.next:]...)
+	return append(events, t.events[:t.next]...)
+}
+
+// PacketHistory returns the recorded events of the packet with ID id.
+func (device *Device) PacketHistory(id uint64) []PacketTraceEvent {
+	var events []PacketTraceEvent
+	for _, ev := range device.PacketTrace() {
+		if ev.Packet == id {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
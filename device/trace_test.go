@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+// stagesOf returns the stages of the first packet in dev's trace to
+// reach last.
+func stagesOf(dev *Device, last PacketStage) []PacketStage {
+	for _, ev := range dev.PacketTrace() {
+		if ev.Stage != last {
+			continue
+		}
+		var stages []PacketStage
+		for _, ev := range dev.PacketHistory(ev.Packet) {
+			stages = append(stages, ev.Stage)
+		}
+		return stages
+	}
+	return nil
+}
+
+func TestPacketTrace(t *testing.T) {
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.PacketTraceSize = 64
+	})
+	pair.Send(t, Ping, nil)
+
+	// dev1 sent the ping, and dev0 received it.
+	want := []PacketStage{StageTUNRead, StageQueued, StageEncrypted, StageSent}
+	if got := stagesOf(pair[1].dev, StageSent); !reflect.DeepEqual(got, want) {
+		t.Errorf("sender stages = %v, want %v", got, want)
+	}
+	want = []PacketStage{StageReceived, StageDecrypted, StageTUNWritten}
+	if got := stagesOf(pair[0].dev, StageTUNWritten); !reflect.DeepEqual(got, want) {
+		t.Errorf("receiver stages = %v, want %v", got, want)
+	}
+
+	// A packet no peer is allowed to receive.
+	pair[1].tun.Outbound <- tuntest.Ping(net.ParseIP("9.9.9.9"), pair[1].ip)
+	deadline := time.Now().Add(5 * time.Second)
+	want = []PacketStage{StageTUNRead, StageNoPeer}
+	for {
+		got := stagesOf(pair[1].dev, StageNoPeer)
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unroutable packet stages = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := range pair {
+		trace := pair[i].dev.PacketTrace()
+		for j := 1; j < len(trace); j++ {
+			if trace[j].Time.Before(trace[j-1].Time) {
+				t.Errorf("dev%d: trace out of order at %d", i, j)
+			}
+		}
+	}
+}
+
+func TestPacketTraceRing(t *testing.T) {
+	dev := &Device{tracer: newPacketTracer(3)}
+	if got := dev.PacketTrace(); len(got) != 0 {
+		t.Fatalf("empty trace has %d events", len(got))
+	}
+	for id := uint64(1); id <= 5; id++ {
+		dev.tracePacket(id, StageReceived)
+	}
+	dev.tracePacket(0, StageReceived) // untraced
+	var ids []uint64
+	for _, ev := range dev.PacketTrace() {
+		ids = append(ids, ev.Packet)
+	}
+	if want := []uint64{3, 4, 5}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("trace holds packets %v, want %v", ids, want)
+	}
+	if (&Device{}).PacketTrace() != nil {
+		t.Error("trace without tracing is non-nil")
+	}
+}
@@ -20,6 +20,7 @@ func (device *Device) RoutineTUNEventReader() {
 	logError := device.log.Error
 
 	logDebug.Println("Routine: event worker - started")
+	labelWorker("tun-events")
 
 	for event := range device.tun.device.Events() {
 		if event&tun.EventMTUUpdate != 0 {
@@ -34,6 +35,7 @@ func (device *Device) RoutineTUNEventReader() {
 					logInfo.Println("MTU updated:", mtu)
 				}
 				atomic.StoreInt32(&device.tun.mtu, int32(mtu))
+				device.resizeMessageBuffers(mtu)
 			}
 		}
 
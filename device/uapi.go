@@ -7,6 +7,8 @@ package device
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -17,6 +19,7 @@ import (
 	"time"
 
 	"github.com/tailscale/wireguard-go/ipc"
+	"inet.af/netaddr"
 )
 
 type IPCError struct {
@@ -35,22 +38,88 @@ func (s IPCError) ErrorCode() int64 {
 type IPCGetFilter struct {
 	// FilterAllowedIPs controls whether AllowedIPs are omitted in the output.
 	FilterAllowedIPs bool
+
+	// Peer, if non-nil, restricts the output to the device fields and the
+	// peer with this public key, if there is one.
+	Peer *NoisePublicKey
+
+	// UAPIVersion, if non-zero, is the highest version of the UAPI
+	// extensions the client speaks. The device fields then begin with
+	// the version in common, as uapi_version, and the extension keys the
+	// device knows, as extension and peer_extension.
+	UAPIVersion int
+
+	// Events, if positive, adds to the device fields the events of the
+	// event log from the last Events, oldest first, as event keys; see
+	// Event.String. A client asks for them with events, in seconds, in
+	// the get request.
+	Events time.Duration
 }
 
 func (device *Device) IpcGetOperation(w io.Writer) error {
 	return device.IpcGetOperationFiltered(w, IPCGetFilter{})
 }
 
-func (device *Device) IpcGetOperationFiltered(w io.Writer, filter IPCGetFilter) error {
-	lines := make([]string, 0, 100)
-	send := func(line string) {
-		lines = append(lines, line)
+/* ipcGetBuffer accumulates one record (the device fields or a single peer)
+ * of the get response. Records are encoded under the locks they need and
+ * written out after those are released, so neither memory use nor lock
+ * hold times grow with the number of peers, and a slow reader holds no
+ * locks at all.
+ */
+type ipcGetBuffer struct {
+	bytes.Buffer
+	scratch [64]byte
+}
+
+func (b *ipcGetBuffer) key(key string) {
+	b.WriteString(key)
+	b.WriteByte('=')
+}
+
+func (b *ipcGetBuffer) hex(key string, value []byte) {
+	b.key(key)
+	n := hex.Encode(b.scratch[:], value)
+	b.Write(b.scratch[:n])
+	b.WriteByte('\n')
+}
+
+func (b *ipcGetBuffer) uint(key string, value uint64) {
+	b.key(key)
+	b.Write(strconv.AppendUint(b.scratch[:0], value, 10))
+	b.WriteByte('\n')
+}
+
+func (b *ipcGetBuffer) int(key string, value int64) {
+	b.key(key)
+	b.Write(strconv.AppendInt(b.scratch[:0], value, 10))
+	b.WriteByte('\n')
+}
+
+func (b *ipcGetBuffer) string(key, value string) {
+	b.key(key)
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func (b *ipcGetBuffer) flushTo(w io.Writer) error {
+	_, err := b.WriteTo(w)
+	b.Reset()
+	if err != nil {
+		return &IPCError{ipc.IpcErrorIO}
 	}
+	return nil
+}
 
-	func() {
+func (device *Device) IpcGetOperationFiltered(w io.Writer, filter IPCGetFilter) error {
+	var buf ipcGetBuffer
 
-		// lock required resources
+	// serialize device related values
 
+	if filter.UAPIVersion > 0 {
+		ipcGetCapabilities(&buf, filter.UAPIVersion)
+	}
+	var peers []*Peer
+	func() {
 		device.net.RLock()
 		defer device.net.RUnlock()
 
@@ -60,64 +129,138 @@ func (device *Device) IpcGetOperationFiltered(w io.Writer, filter IPCGetFilter)
 		device.peers.RLock()
 		defer device.peers.RUnlock()
 
-		// serialize device related values
-
 		if !device.staticIdentity.privateKey.IsZero() {
-			send("private_key=" + device.staticIdentity.privateKey.ToHex())
+			buf.hex("private_key", device.staticIdentity.privateKey[:])
 		}
 
 		if device.net.port != 0 {
-			send(fmt.Sprintf("listen_port=%d", device.net.port))
+			buf.uint("listen_port", uint64(device.net.port))
 		}
 
 		if device.net.fwmark != 0 {
-			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
+			buf.uint("fwmark", uint64(device.net.fwmark))
 		}
 
-		// serialize each peer state
-
-		for _, peer := range device.peers.keyMap {
-			peer.RLock()
-			defer peer.RUnlock()
-
-			send("public_key=" + peer.handshake.remoteStatic.ToHex())
-			send("preshared_key=" + peer.handshake.presharedKey.ToHex())
-			send("protocol_version=1")
-			if peer.endpoint != nil {
-				send("endpoint=" + peer.endpoint.DstToString())
+		if filter.Peer != nil {
+			if peer := device.peers.keyMap[*filter.Peer]; peer != nil {
+				peers = []*Peer{peer}
 			}
+			return
+		}
+		peers = make([]*Peer, 0, len(device.peers.keyMap))
+		for _, peer := range device.peers.keyMap {
+			peers = append(peers, peer)
+		}
+	}()
+	device.ipcGetExtensions(&buf, nil)
+	if filter.Events > 0 {
+		for _, ev := range device.Events(device.now().Add(-filter.Events)) {
+			buf.string("event", ev.String())
+		}
+	}
+	if err := buf.flushTo(w); err != nil {
+		return err
+	}
 
-			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+	// serialize each peer state, skipping those removed while the
+	// reader was catching up
 
-			send(fmt.Sprintf("last_handshake_time_sec=%d", secs))
-			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
-			send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
-			send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
-			send(fmt.Sprintf("persistent_keepalive_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval)))
+	for _, peer := range peers {
+		if !device.isCurrentPeer(peer) {
+			continue
+		}
+		device.ipcGetPeer(&buf, peer, filter)
+		if err := buf.flushTo(w); err != nil {
+			return err
+		}
+	}
 
-			if !filter.FilterAllowedIPs {
-				for _, ip := range device.allowedips.EntriesForPeer(peer) {
-					send("allowed_ip=" + ip.String())
-				}
+	return nil
+}
+
+func (device *Device) ipcGetPeer(buf *ipcGetBuffer, peer *Peer, filter IPCGetFilter) {
+	device.ipcGetPeerLocked(buf, peer)
+	// Outside the peer's lock, as withholding the peer takes it; only
+	// written when set, like the other extensions.
+	notBefore, notAfter := peer.Validity()
+	if !notBefore.IsZero() {
+		buf.int("not_before", notBefore.Unix())
+	}
+	if !notAfter.IsZero() {
+		buf.int("not_after", notAfter.Unix())
+	}
+	// Outside the peer's lock, as extensions may take it.
+	device.ipcGetExtensions(buf, peer)
+
+	if !filter.FilterAllowedIPs {
+		if prefixes, disabled := peer.disabledRoutes(); disabled {
+			for _, prefix := range prefixes {
+				buf.string("allowed_ip", prefix.String())
 			}
+			return
 		}
-	}()
+		device.allowedips.EntriesForPeerFunc(peer, func(prefix netaddr.IPPrefix) bool {
+			buf.string("allowed_ip", prefix.String())
+			return true
+		})
+	}
+}
 
-	// send lines (does not require resource locks)
+func (device *Device) ipcGetPeerLocked(buf *ipcGetBuffer, peer *Peer) {
+	peer.RLock()
+	defer peer.RUnlock()
 
-	for _, line := range lines {
-		_, err := io.WriteString(w, line+"\n")
-		if err != nil {
-			return &IPCError{ipc.IpcErrorIO}
-		}
+	buf.hex("public_key", peer.handshake.remoteStatic[:])
+	buf.hex("preshared_key", peer.handshake.presharedKey[:])
+	buf.string("protocol_version", "1")
+	if peer.endpoint != nil {
+		buf.string("endpoint", peer.endpoint.DstToString())
 	}
 
-	return nil
+	nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+	secs := nano / time.Second.Nanoseconds()
+	nano %= time.Second.Nanoseconds()
+
+	buf.int("last_handshake_time_sec", secs)
+	buf.int("last_handshake_time_nsec", nano)
+	buf.uint("tx_bytes", atomic.LoadUint64(&peer.stats.txBytes))
+	buf.uint("rx_bytes", atomic.LoadUint64(&peer.stats.rxBytes))
+	buf.uint("persistent_keepalive_interval", uint64(atomic.LoadUint32(&peer.persistentKeepaliveInterval)))
+	if peer.passive.Get() {
+		// Only written when set, so that standard parsers never see it.
+		buf.string("passive", "true")
+	}
+	if mtu := peer.MTU(); mtu != 0 {
+		// Likewise an extension, only written when set.
+		buf.int("mtu", int64(mtu))
+	}
+	if addr := peer.LocalAddr(); addr != "" {
+		// Likewise.
+		buf.string("local_addr", addr)
+	}
+	if len(peer.handshakeSources) > 0 {
+		// Likewise.
+		buf.string("handshake_sources", joinPrefixes(peer.handshakeSources))
+	}
+	if peer.Disabled() {
+		// Likewise.
+		buf.string("disabled", "true")
+	}
 }
 
 func (device *Device) IpcSetOperation(r io.Reader) error {
+	return device.auditConfigChange(ConfigSourceUAPI, func() error {
+		return device.ipcSetOperation(r)
+	})
+}
+
+func (device *Device) ipcSetOperation(r io.Reader) (err error) {
+	defer func() {
+		if err == nil {
+			device.syncRoutes()
+		}
+	}()
+
 	scanner := bufio.NewScanner(r)
 	logError := device.log.Error
 	logDebug := device.log.Debug
@@ -153,7 +296,7 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 				err := sk.FromMaybeZeroHex(value)
 				if err != nil {
 					logError.Println("Failed to set private_key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return fmt.Errorf("%w: private_key: %v", ErrInvalidKey, err)
 				}
 				logDebug.Println("UAPI: Updating private key")
 				device.SetPrivateKey(sk)
@@ -205,6 +348,18 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 					return &IPCError{ipc.IpcErrorPortInUse}
 				}
 
+			case "log_level":
+
+				// extension: change verbosity at runtime
+
+				level, err := ParseLogLevel(value)
+				if err != nil {
+					logError.Println("Failed to set log_level:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+				logDebug.Println("UAPI: Updating log level")
+				device.SetLogLevel(level)
+
 			case "public_key":
 				// switch to peer configuration
 				logDebug.Println("UAPI: Transition to peer configuration")
@@ -219,8 +374,9 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 				device.RemoveAllPeers()
 
 			default:
-				logError.Println("Invalid UAPI device key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
+				if err := device.setUAPIExtension(nil, key, value); err != nil {
+					return err
+				}
 			}
 		}
 
@@ -235,7 +391,7 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 				err := publicKey.FromHex(value)
 				if err != nil {
 					logError.Println("Failed to get peer by public key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return fmt.Errorf("%w: public_key: %v", ErrInvalidKey, err)
 				}
 
 				// ignore peer with public key of device
@@ -306,7 +462,7 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 
 				if err != nil {
 					logError.Println("Failed to set preshared key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return fmt.Errorf("%w: preshared_key: %v", ErrInvalidKey, err)
 				}
 
 			case "endpoint":
@@ -330,8 +486,11 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 				}()
 
 				if err != nil {
-					logError.Println("Failed to set endpoint:", err, ":", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					logError.Println("Failed to set endpoint:", device.redactAddrErr(err), ":", device.redactAddrs(value))
+					return fmt.Errorf("%w: %q: %v", ErrEndpointParse, device.redactAddrs(value), device.redactAddrErr(err))
+				}
+				if !dummy {
+					device.logEvent(EventEndpoint, peer, device.redactAddrs(value)+" set")
 				}
 
 			case "persistent_keepalive_interval":
@@ -355,11 +514,115 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 						logError.Println("Failed to get tun device status:", err)
 						return &IPCError{ipc.IpcErrorIO}
 					}
-					if device.isUp.Get() && !dummy {
+					if device.isUp() && !dummy {
 						peer.SendKeepalive()
 					}
 				}
 
+			case "passive":
+
+				// extension: never initiate handshakes or send keepalives
+
+				logDebug.Println(peer, "- UAPI: Updating passive mode")
+
+				passive, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set passive, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+				peer.SetPassive(passive)
+
+			case "disabled":
+
+				// extension: suspend the peer, keeping its configuration
+
+				logDebug.Println(peer, "- UAPI: Updating disabled")
+
+				disabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set disabled, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+				if !dummy {
+					peer.SetDisabled(disabled)
+				}
+
+			case "not_before", "not_after":
+
+				// extension: a window of time outside which the peer is withheld
+
+				logDebug.Println(peer, "- UAPI: Updating validity window")
+
+				secs, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					logError.Println("Failed to set", key+", invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+				if !dummy {
+					var t time.Time
+					if secs != 0 {
+						t = time.Unix(secs, 0)
+					}
+					notBefore, notAfter := peer.Validity()
+					if key == "not_before" {
+						notBefore = t
+					} else {
+						notAfter = t
+					}
+					peer.SetValidity(notBefore, notAfter)
+				}
+
+			case "mtu":
+
+				// extension: a smaller MTU for the peer than the TUN device's
+
+				logDebug.Println(peer, "- UAPI: Updating MTU")
+
+				mtu, err := strconv.ParseUint(value, 10, 16)
+				if err == nil {
+					err = peer.SetMTU(int(mtu))
+				}
+				if err != nil {
+					logError.Println("Failed to set MTU:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+			case "local_addr":
+
+				// extension: send from a socket of the peer's own
+
+				logDebug.Println(peer, "- UAPI: Updating local address")
+
+				if value != "" {
+					if _, _, err := parseLocalAddr(value); err != nil {
+						logError.Println("Failed to set local_addr:", err)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+				if err := peer.SetLocalAddr(value); err != nil {
+					logError.Println("Failed to set local_addr:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
+			case "handshake_sources":
+
+				// extension: only accept handshakes from these prefixes
+
+				logDebug.Println(peer, "- UAPI: Updating handshake sources")
+
+				var sources []netaddr.IPPrefix
+				if value != "" {
+					for _, s := range strings.Split(value, ",") {
+						prefix, err := netaddr.ParseIPPrefix(s)
+						if err != nil {
+							logError.Println("Failed to set handshake_sources:", err)
+							return &IPCError{ipc.IpcErrorInvalid}
+						}
+						sources = append(sources, prefix)
+					}
+				}
+				peer.SetHandshakeSources(sources)
+
 			case "replace_allowed_ips":
 
 				logDebug.Println(peer, "- UAPI: Removing all allowedips")
@@ -373,7 +636,9 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 					continue
 				}
 
-				device.allowedips.RemoveByPeer(peer)
+				if !peer.setDisabledRoutes(nil) {
+					device.allowedips.RemoveByPeer(peer)
+				}
 
 			case "allowed_ip":
 
@@ -389,6 +654,22 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 					continue
 				}
 
+				if prefix, ok := netaddr.FromStdIPNet(network); ok {
+					if peer.addDisabledRoute(prefix) {
+						continue
+					}
+					if owner := device.allowedips.Owner(prefix); owner != nil && owner != peer {
+						if device.allowedIPConflict != nil {
+							device.allowedIPConflict(AllowedIPConflict{Prefix: prefix, Owner: owner, Claimant: peer})
+						}
+						if device.rejectAllowedIPConflicts {
+							logError.Println(peer, "- UAPI: Allowed IP", prefix, "is already routed to", owner)
+							return &IPCError{ipc.IpcErrorInvalid}
+						}
+						logDebug.Println(peer, "- UAPI: Taking allowed IP", prefix, "from", owner)
+					}
+				}
+
 				ones, _ := network.Mask.Size()
 				device.allowedips.Insert(network.IP, uint(ones), peer)
 
@@ -400,8 +681,12 @@ func (device *Device) IpcSetOperation(r io.Reader) error {
 				}
 
 			default:
-				logError.Println("Invalid UAPI peer key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
+				if dummy {
+					break
+				}
+				if err := device.setUAPIExtension(peer, key, value); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -454,7 +739,25 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		}
 
 	case "get=1\n":
-		err = device.IpcGetOperation(buffered.Writer)
+		/* The request runs to a blank line; a client that knows the
+		 * extensions says which version of them it speaks there.
+		 */
+		var filter IPCGetFilter
+		for {
+			line, rerr := buffered.ReadString('\n')
+			line = strings.TrimSuffix(line, "\n")
+			if rerr != nil || line == "" {
+				break
+			}
+			if v := strings.TrimPrefix(line, "uapi_version="); v != line {
+				filter.UAPIVersion, _ = strconv.Atoi(v)
+			}
+			if v := strings.TrimPrefix(line, "events="); v != line {
+				secs, _ := strconv.Atoi(v)
+				filter.Events = time.Duration(secs) * time.Second
+			}
+		}
+		err = device.IpcGetOperationFiltered(buffered.Writer, filter)
 		if err != nil && !errors.As(err, &status) {
 			// should never happen
 			device.log.Error.Println("Invalid UAPI error:", err)
@@ -0,0 +1,261 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/ipc"
+)
+
+// UAPIVersion is the version of the device's extensions to the UAPI
+// protocol. A client that knows them sends the highest version it
+// speaks as uapi_version with a get operation, and the device answers
+// with the version they have in common and the extension keys it knows;
+// see IPCGetFilter.UAPIVersion. Clients that do not, like wg(8), get the
+// standard answer.
+const UAPIVersion = 1
+
+// A UAPIExtension adds a key to the UAPI protocol. Like the extensions
+// the device has built in, such as passive and mtu, the key is only
+// reported when it has a value, so that clients that do not know it
+// never see it.
+type UAPIExtension struct {
+	Key  string
+	Peer bool // the key configures a peer rather than the device
+
+	// Set applies value. peer is nil for a device key.
+	Set func(device *Device, peer *Peer, value string) error
+
+	// Get, if non-nil, returns the value to report, if there is one.
+	Get func(device *Device, peer *Peer) (value string, ok bool)
+}
+
+// standardUAPIKeys are the keys the device handles itself, standard or
+// extensions, which a UAPIExtension cannot take over.
+var standardUAPIKeys = map[string]bool{
+	"private_key": true, "listen_port": true, "fwmark": true, "replace_peers": true,
+	"public_key": true, "update_only": true, "remove": true, "preshared_key": true,
+	"endpoint": true, "persistent_keepalive_interval": true, "replace_allowed_ips": true,
+	"allowed_ip": true, "protocol_version": true, "last_handshake_time_sec": true,
+	"last_handshake_time_nsec": true, "tx_bytes": true, "rx_bytes": true, "errno": true,
+	"uapi_version": true, "extension": true, "peer_extension": true,
+	"log_level": true, "passive": true, "mtu": true, "local_addr": true, "handshake_sources": true,
+	"disabled": true, "not_before": true, "not_after": true,
+}
+
+// builtinUAPIExtensions are the extension keys the device handles
+// itself, reported with those registered.
+var builtinUAPIExtensions = []UAPIExtension{
+	{Key: "log_level"},
+	{Key: "passive", Peer: true},
+	{Key: "mtu", Peer: true},
+	{Key: "local_addr", Peer: true},
+	{Key: "handshake_sources", Peer: true},
+	{Key: "disabled", Peer: true},
+	{Key: "not_before", Peer: true},
+	{Key: "not_after", Peer: true},
+}
+
+var uapiExtensions struct {
+	sync.RWMutex
+	device, peer map[string]UAPIExtension
+}
+
+// RegisterUAPIExtension makes every device accept ext.Key in
+// IpcSetOperation and report it in IpcGetOperation, replacing any
+// extension registered for the key before. It panics if ext has no Key
+// or Set, or if the key is one the device handles itself.
+func RegisterUAPIExtension(ext UAPIExtension) {
+	if ext.Key == "" || ext.Set == nil {
+		panic("wireguard: UAPI extension without a key or Set")
+	}
+	if standardUAPIKeys[ext.Key] {
+		panic(fmt.Sprintf("wireguard: UAPI extension for built-in key %q", ext.Key))
+	}
+	uapiExtensions.Lock()
+	defer uapiExtensions.Unlock()
+	if uapiExtensions.device == nil {
+		uapiExtensions.device = make(map[string]UAPIExtension)
+		uapiExtensions.peer = make(map[string]UAPIExtension)
+	}
+	if ext.Peer {
+		uapiExtensions.peer[ext.Key] = ext
+	} else {
+		uapiExtensions.device[ext.Key] = ext
+	}
+}
+
+func lookupUAPIExtension(key string, peer bool) (UAPIExtension, bool) {
+	uapiExtensions.RLock()
+	defer uapiExtensions.RUnlock()
+	m := uapiExtensions.device
+	if peer {
+		m = uapiExtensions.peer
+	}
+	ext, ok := m[key]
+	return ext, ok
+}
+
+// sortedUAPIExtensions returns the registered extensions of the device
+// or of peers, in order of their keys.
+func sortedUAPIExtensions(peer bool) []UAPIExtension {
+	uapiExtensions.RLock()
+	defer uapiExtensions.RUnlock()
+	m := uapiExtensions.device
+	if peer {
+		m = uapiExtensions.peer
+	}
+	exts := make([]UAPIExtension, 0, len(m))
+	for _, ext := range m {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool { return exts[i].Key < exts[j].Key })
+	return exts
+}
+
+// UnknownUAPIKeys controls what IpcSetOperation and Reconfig do with
+// keys that are neither standard nor extensions the device knows, as
+// sent by clients of a newer version.
+type UnknownUAPIKeys int
+
+const (
+	UnknownUAPIKeysReject   UnknownUAPIKeys = iota // fail the operation
+	UnknownUAPIKeysIgnore                          // log and skip them
+	UnknownUAPIKeysPreserve                        // keep them, and report them back in IpcGetOperation
+)
+
+var unknownUAPIKeysNames = [...]string{
+	UnknownUAPIKeysReject:   "reject",
+	UnknownUAPIKeysIgnore:   "ignore",
+	UnknownUAPIKeysPreserve: "preserve",
+}
+
+func (u UnknownUAPIKeys) String() string {
+	if u < 0 || int(u) >= len(unknownUAPIKeysNames) {
+		return fmt.Sprintf("UnknownUAPIKeys(%d)", int(u))
+	}
+	return unknownUAPIKeysNames[u]
+}
+
+// uapiPreserved holds the values of unknown keys kept under
+// UnknownUAPIKeysPreserve.
+type uapiPreserved struct {
+	sync.Mutex
+	m map[string]string
+}
+
+func (p *uapiPreserved) set(key, value string) {
+	p.Lock()
+	defer p.Unlock()
+	if p.m == nil {
+		p.m = make(map[string]string)
+	}
+	p.m[key] = value
+}
+
+func (p *uapiPreserved) writeTo(buf *ipcGetBuffer) {
+	p.Lock()
+	defer p.Unlock()
+	keys := make([]string, 0, len(p.m))
+	for key := range p.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.string(key, p.m[key])
+	}
+}
+
+// setUAPIExtension applies a key that is not standard to the device, or
+// to peer if it is non-nil, through the extension registered for it or
+// else as DeviceOptions.UnknownUAPIKeys says. Errors are IPCErrors.
+func (device *Device) setUAPIExtension(peer *Peer, key, value string) error {
+	if ext, ok := lookupUAPIExtension(key, peer != nil); ok {
+		if err := ext.Set(device, peer, value); err != nil {
+			device.log.Error.Printf("Failed to set %s: %v\n", key, err)
+			return fmt.Errorf("%s: %v: %w", key, err, &IPCError{ipc.IpcErrorInvalid})
+		}
+		return nil
+	}
+	switch device.unknownUAPIKeys {
+	case UnknownUAPIKeysIgnore:
+		device.log.Info.Println("Ignoring unknown UAPI key:", key)
+	case UnknownUAPIKeysPreserve:
+		if peer != nil {
+			peer.uapiPreserved.set(key, value)
+		} else {
+			device.uapiPreserved.set(key, value)
+		}
+	default:
+		if peer != nil {
+			device.log.Error.Println("Invalid UAPI peer key:", key)
+		} else {
+			device.log.Error.Println("Invalid UAPI device key:", key)
+		}
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+	return nil
+}
+
+// setUAPIExtensions applies the keys of wgcfg's Extensions, as
+// setUAPIExtension does, in order.
+func (device *Device) setUAPIExtensions(peer *Peer, m map[string]string) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := device.setUAPIExtension(peer, key, m[key]); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// ipcGetExtensions adds the values of registered and preserved keys of
+// the device, or of peer if it is non-nil.
+func (device *Device) ipcGetExtensions(buf *ipcGetBuffer, peer *Peer) {
+	for _, ext := range sortedUAPIExtensions(peer != nil) {
+		if ext.Get == nil {
+			continue
+		}
+		if value, ok := ext.Get(device, peer); ok {
+			buf.string(ext.Key, value)
+		}
+	}
+	if peer != nil {
+		peer.uapiPreserved.writeTo(buf)
+	} else {
+		device.uapiPreserved.writeTo(buf)
+	}
+}
+
+// ipcGetCapabilities adds the UAPI version the device and a client
+// speaking version have in common, and the extension keys it knows.
+func ipcGetCapabilities(buf *ipcGetBuffer, version int) {
+	if version > UAPIVersion {
+		version = UAPIVersion
+	}
+	buf.int("uapi_version", int64(version))
+	for _, peer := range []bool{false, true} {
+		key := "extension"
+		if peer {
+			key = "peer_extension"
+		}
+		for _, ext := range builtinUAPIExtensions {
+			if ext.Peer == peer {
+				buf.string(key, ext.Key)
+			}
+		}
+		for _, ext := range sortedUAPIExtensions(peer) {
+			buf.string(key, ext.Key)
+		}
+	}
+}
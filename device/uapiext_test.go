@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testTags sync.Map // *Peer to its tag
+
+func init() {
+	RegisterUAPIExtension(UAPIExtension{
+		Key:  "test_tag",
+		Peer: true,
+		Set: func(_ *Device, peer *Peer, value string) error {
+			if strings.ContainsRune(value, ' ') {
+				return errors.New("tags have no spaces")
+			}
+			testTags.Store(peer, value)
+			return nil
+		},
+		Get: func(_ *Device, peer *Peer) (string, bool) {
+			tag, ok := testTags.Load(peer)
+			if !ok {
+				return "", false
+			}
+			return tag.(string), true
+		},
+	})
+}
+
+const testPeerKey = "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"
+
+func TestUAPIExtension(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "test_tag", "office")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := dev.Config()
+	if tag := cfg.Peers[0].Extensions["test_tag"]; tag != "office" {
+		t.Errorf("test_tag is %q, want office", tag)
+	}
+	if err := dev.IpcSetOperation(uapiCfg("public_key", testPeerKey, "test_tag", "home office")); err == nil {
+		t.Error("IpcSetOperation took a value the extension rejects")
+	}
+
+	// Reconfig applies the extension too.
+	cfg.Peers[0].Extensions["test_tag"] = "home"
+	if err := dev.Reconfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if tag, _ := testTags.Load(dev.Peers()[0]); tag != "home" {
+		t.Errorf("test_tag is %q after Reconfig, want home", tag)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a built-in key did not panic")
+		}
+	}()
+	RegisterUAPIExtension(UAPIExtension{Key: "mtu", Set: func(*Device, *Peer, string) error { return nil }})
+}
+
+func TestUnknownUAPIKeys(t *testing.T) {
+	for _, policy := range []UnknownUAPIKeys{UnknownUAPIKeysReject, UnknownUAPIKeysIgnore, UnknownUAPIKeysPreserve} {
+		dev := randDevice(t)
+		dev.unknownUAPIKeys = policy
+		err := dev.IpcSetOperation(uapiCfg("rate_limit", "100", "public_key", testPeerKey, "color", "blue"))
+		if (err != nil) != (policy == UnknownUAPIKeysReject) {
+			t.Errorf("%v: IpcSetOperation: %v", policy, err)
+		}
+		get, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		preserved := strings.Contains(get, "rate_limit=100\n") && strings.Contains(get, "color=blue\n")
+		if preserved != (policy == UnknownUAPIKeysPreserve) {
+			t.Errorf("%v: unknown keys preserved is %v:\n%s", policy, preserved, get)
+		}
+		dev.Close()
+	}
+}
+
+func TestUAPICapabilities(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	get := func(request string) string {
+		client, server := net.Pipe()
+		defer client.Close()
+		go dev.IpcHandle(server)
+		if _, err := client.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		var resp strings.Builder
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.WriteString(line)
+			if strings.HasPrefix(line, "errno=") {
+				return resp.String()
+			}
+		}
+	}
+
+	if resp := get("get=1\n\n"); strings.Contains(resp, "uapi_version") {
+		t.Errorf("capabilities sent to a client that did not ask:\n%s", resp)
+	}
+	resp := get("get=1\nuapi_version=7\n\n")
+	for _, line := range []string{"uapi_version=1\n", "extension=log_level\n", "peer_extension=mtu\n", "peer_extension=test_tag\n"} {
+		if !strings.Contains(resp, line) {
+			t.Errorf("capabilities lack %q:\n%s", line, resp)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
+
+// UnexpectedIPPacket describes a packet received from a validated peer
+// whose inner source address is not within that peer's AllowedIPs.
+type UnexpectedIPPacket struct {
+	Version  int        // IP version, 4 or 6
+	Protocol uint8      // IPv4 protocol or IPv6 next header
+	Src      netaddr.IP // the disallowed source address
+	Dst      netaddr.IP
+
+	// Suppressed is the number of disallowed packets from the same peer
+	// that were dropped without being reported since the previous report,
+	// because of UnexpectedIPPolicy.SampleInterval.
+	Suppressed uint64
+}
+
+// UnexpectedIPPolicy controls how a Device reacts to packets from validated
+// peers that carry disallowed inner source addresses.
+// The zero value reports every packet and never quarantines.
+type UnexpectedIPPolicy struct {
+	// SampleInterval, if non-zero, limits UnexpectedIP calls to at most one
+	// per peer per interval. Packets are counted whether or not they are
+	// reported, so that a flood of spoofed packets cannot flood the log.
+	SampleInterval time.Duration
+
+	// QuarantineThreshold, if non-zero, is the number of disallowed packets
+	// after which a peer is quarantined. A quarantined peer has all of its
+	// inbound transport packets and handshake initiations dropped until
+	// QuarantineDuration has elapsed.
+	QuarantineThreshold uint64
+
+	// QuarantineDuration is how long a quarantine lasts.
+	// If zero, RejectAfterTime is used.
+	QuarantineDuration time.Duration
+}
+
+/* Accounts for and reports a packet from peer whose inner source address
+ * is not in the AllowedIPs of that peer, applying the device policy.
+ *
+ * The packet must already be validated as being at least a full IP header.
+ *
+ * Obs. Called by the sequential receiver of peer.
+ */
+func (device *Device) dropUnexpectedIP(peer *Peer, packet []byte, version int) {
+	switch version {
+	case ipv4.Version:
+		atomic.AddUint64(&device.stats.unexpectedIPv4, 1)
+	case ipv6.Version:
+		atomic.AddUint64(&device.stats.unexpectedIPv6, 1)
+	}
+	atomic.AddUint64(&peer.stats.unexpectedIP, 1)
+
+	policy := &device.unexpectedIPPolicy
+
+	if policy.QuarantineThreshold > 0 && atomic.AddUint64(&peer.spoof.strikes, 1) >= policy.QuarantineThreshold {
+		atomic.StoreUint64(&peer.spoof.strikes, 0)
+		duration := policy.QuarantineDuration
+		if duration == 0 {
+			duration = RejectAfterTime
+		}
+		atomic.StoreInt64(&peer.spoof.quarantinedUntilNano, time.Now().Add(duration).UnixNano())
+		device.log.Info.Printf("%v - Quarantined for %v after %d packets with disallowed source addresses\n", peer, duration, policy.QuarantineThreshold)
+	}
+
+	if policy.SampleInterval > 0 {
+		now := time.Now().UnixNano()
+		if now-atomic.LoadInt64(&peer.spoof.lastReportNano) < int64(policy.SampleInterval) {
+			atomic.AddUint64(&peer.spoof.suppressed, 1)
+			return
+		}
+		atomic.StoreInt64(&peer.spoof.lastReportNano, now)
+	}
+
+	pkt := UnexpectedIPPacket{
+		Version:    version,
+		Suppressed: atomic.SwapUint64(&peer.spoof.suppressed, 0),
+	}
+	switch version {
+	case ipv4.Version:
+		pkt.Protocol = packet[IPv4offsetProtocol]
+		pkt.Src, _ = netaddr.FromStdIP(packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len])
+		pkt.Dst, _ = netaddr.FromStdIP(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+	case ipv6.Version:
+		pkt.Protocol = packet[IPv6offsetNextHeader]
+		pkt.Src, _ = netaddr.FromStdIP(packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len])
+		pkt.Dst, _ = netaddr.FromStdIP(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+	}
+	key := (*NoisePublicKey)(&peer.handshake.remoteStatic)
+	device.unexpectedip(key, pkt)
+}
+
+// UnexpectedIPCount reports how many packets from peer have been dropped
+// because their inner source address was not in the peer's AllowedIPs.
+func (peer *Peer) UnexpectedIPCount() uint64 {
+	return atomic.LoadUint64(&peer.stats.unexpectedIP)
+}
+
+// IsQuarantined reports whether peer is currently quarantined
+// under the device's UnexpectedIPPolicy.
+func (peer *Peer) IsQuarantined() bool {
+	until := atomic.LoadInt64(&peer.spoof.quarantinedUntilNano)
+	return until != 0 && time.Now().UnixNano() < until
+}
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+func TestUnixBind(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no AF_UNIX datagram sockets")
+	}
+	dir := t.TempDir()
+	var paths [2]string
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("dev%d.sock", i))
+	}
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.CreateBind = func(uint16) (conn.Bind, uint16, error) {
+			bind, err := conn.CreateUnixBind(paths[i])
+			return bind, 0, err
+		}
+	})
+	for i := range pair {
+		endpoint := conn.UnixEndpointPrefix + paths[1-i]
+		if err := pair[i].dev.IpcSetOperation(uapiCfg(
+			"public_key", pair[1-i].dev.staticIdentity.publicKey.ToHex(),
+			"endpoint", endpoint,
+		)); err != nil {
+			t.Fatal(err)
+		}
+		if cfg := pair[i].dev.Config(); cfg.Peers[0].Endpoints != endpoint {
+			t.Errorf("device %d reports endpoint %q, want %q", i, cfg.Peers[0].Endpoints, endpoint)
+		}
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	pair[0].dev.Close()
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind after closing: %v", err)
+	}
+}
+
+func TestUnixEndpoint(t *testing.T) {
+	if _, err := conn.CreateEndpoint("unix://relative.sock"); err == nil {
+		t.Error("relative path accepted")
+	}
+	end, err := conn.CreateEndpoint("unix:///run/wg.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := end.DstToString(); got != "unix:///run/wg.sock" {
+		t.Errorf("DstToString() = %q", got)
+	}
+}
+
+func TestEndpointScheme(t *testing.T) {
+	end, err := conn.CreateEndpoint("udp://127.0.0.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := end.DstToString(); got != "127.0.0.1:51820" {
+		t.Errorf("udp:// endpoint is %q, want 127.0.0.1:51820", got)
+	}
+	if _, err := conn.CreateEndpoint("tcp://127.0.0.1:443"); err == nil {
+		t.Error("endpoint of an unregistered scheme accepted")
+	}
+
+	conn.RegisterEndpointScheme("test", func(s string) (conn.Endpoint, error) {
+		return &conn.UnixEndpoint{Path: "/" + s}, nil
+	})
+	end, err = conn.CreateEndpoint("TEST://sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := end.(*conn.UnixEndpoint).Path; got != "/sock" {
+		t.Errorf("registered scheme parsed %q, want /sock", got)
+	}
+
+	// An IPv6 address is not a scheme.
+	if _, err := conn.CreateEndpoint("[::1]:51820"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+/* A peer may be given a validity window, for time-limited access without
+ * something outside the device removing it when the time is up. A timer
+ * on the device's clock fires at each end of the window; outside it the
+ * peer is withheld like a disabled one, and its handshakes are refused.
+ */
+type peerValidity struct {
+	sync.Mutex
+	notBefore time.Time // zero for no lower bound
+	notAfter  time.Time // zero for no upper bound
+	timer     ClockTimer
+}
+
+// SetValidity limits peer to the window from notBefore until notAfter,
+// either of which may be zero to leave that end open. Outside the window
+// the peer is stopped, its allowed IPs are withdrawn from routing and
+// handshakes with its key are refused, as if it were disabled; its
+// configuration is kept, and it is restored when the window opens.
+func (peer *Peer) SetValidity(notBefore, notAfter time.Time) {
+	pv := &peer.validity
+	pv.Lock()
+	defer pv.Unlock()
+	if pv.notBefore.Equal(notBefore) && pv.notAfter.Equal(notAfter) {
+		return
+	}
+	pv.notBefore, pv.notAfter = notBefore, notAfter
+	peer.checkValidityLocked()
+}
+
+// Validity returns the window set by SetValidity.
+func (peer *Peer) Validity() (notBefore, notAfter time.Time) {
+	pv := &peer.validity
+	pv.Lock()
+	defer pv.Unlock()
+	return pv.notBefore, pv.notAfter
+}
+
+// Expired reports whether peer is outside its validity window.
+func (peer *Peer) Expired() bool {
+	return peer.disabled.expired.Get()
+}
+
+func (peer *Peer) checkValidity() {
+	peer.validity.Lock()
+	defer peer.validity.Unlock()
+	peer.checkValidityLocked()
+}
+
+// checkValidityLocked withholds or restores peer for the time now, and
+// sets the timer for the next end of its window. The validity lock is
+// held throughout, so that checks are applied in the order they are made.
+func (peer *Peer) checkValidityLocked() {
+	device := peer.device
+	pv := &peer.validity
+	if pv.timer != nil {
+		pv.timer.Stop()
+		pv.timer = nil
+	}
+	if !device.isCurrentPeer(peer) {
+		return
+	}
+	now := device.now()
+	var next time.Time
+	expired := false
+	switch {
+	case !pv.notBefore.IsZero() && now.Before(pv.notBefore):
+		expired, next = true, pv.notBefore
+	case !pv.notAfter.IsZero() && !now.Before(pv.notAfter):
+		expired = true
+	case !pv.notAfter.IsZero():
+		next = pv.notAfter
+	}
+	if !next.IsZero() {
+		pv.timer = device.clock.AfterFunc(next.Sub(now), peer.checkValidity)
+	}
+	peer.withhold(&peer.disabled.expired, expired)
+}
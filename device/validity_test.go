@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestPeerValidity(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	pair := genSimPair(t, clock, 1)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.Peers()[0]
+	routed := netaddr.MustParseIP("1.0.0.2")
+
+	notAfter := clock.Now().Add(10 * time.Second)
+	peer.SetValidity(time.Time{}, notAfter)
+	if peer.Expired() {
+		t.Fatal("peer expired before the end of its window")
+	}
+	get, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "not_after=" + strconv.FormatInt(notAfter.Unix(), 10) + "\n"; !strings.Contains(get, want) {
+		t.Errorf("IpcGet lacks %q:\n%s", want, get)
+	}
+	if cfg := dev.Config(); !cfg.Peers[0].NotAfter.Equal(notAfter) {
+		t.Errorf("Config NotAfter = %v, want %v", cfg.Peers[0].NotAfter, notAfter)
+	}
+
+	// At the end of the window, the peer is withheld and its handshakes
+	// are refused.
+	clock.Advance(10 * time.Second)
+	if !peer.Expired() || peer.Disabled() || peer.isRunning.Get() {
+		t.Fatal("peer still running after its window")
+	}
+	if owner := dev.allowedips.Lookup(routed); owner != nil {
+		t.Errorf("%v still routed to the expired peer", routed)
+	}
+	other := pair[1].dev.Peers()[0]
+	other.ExpireCurrentKeypairs()
+	if err := other.SendHandshakeInitiation(false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the initiation to be refused", func() bool {
+		return dev.DropCounts()[DropPeerDisabled] > 0
+	})
+
+	// A window opening in the future restores the peer when it opens.
+	notBefore := clock.Now().Add(time.Minute)
+	if err := dev.IpcSetOperation(uapiCfg(
+		"public_key", testPeerKey,
+		"not_before", strconv.FormatInt(notBefore.Unix(), 10),
+		"not_after", "0",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Expired() {
+		t.Fatal("peer not expired before its window")
+	}
+	clock.Advance(time.Minute)
+	if peer.Expired() || !peer.isRunning.Get() {
+		t.Fatal("peer not restored when its window opened")
+	}
+	if owner := dev.allowedips.Lookup(routed); owner != peer {
+		t.Errorf("%v routed to %v, want the peer", routed, owner)
+	}
+	pair.Send(t, Ping, nil)
+}
@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// A handshakeVector fixes everything random in a handshake, and the
+// time, and gives the messages it must produce.
+type handshakeVector struct {
+	initiatorKey, responderKey             string // private keys, hex
+	presharedKey                           string // hex
+	initiatorEphemeral, responderEphemeral string // private keys, hex
+	initiatorIndex, responderIndex         uint32
+	time                                   time.Time
+
+	// The responder answers the initiation, from source, with a cookie
+	// reply under cookieSecret and cookieNonce.
+	cookieSecret, cookieNonce string // hex
+	source                    []byte
+
+	initiation, response, cookieReply  string // hex
+	initiatorSendKey, responderSendKey string // hex
+}
+
+// handshakeMessages are the messages of a handshake, and the sending
+// keys of the session it made.
+type handshakeMessages struct {
+	initiation, response, cookieReply  []byte
+	initiatorSendKey, responderSendKey []byte
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// vectorDevice returns a device of the private key hexKey, whose clock
+// stands still at now.
+func vectorDevice(t *testing.T, hexKey string, now time.Time) *Device {
+	t.Helper()
+	var sk NoisePrivateKey
+	if err := sk.FromHex(hexKey); err != nil {
+		t.Fatal(err)
+	}
+	dev := NewDevice(newDummyTUN("dummy"), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, ""),
+		Clock:  NewManualClock(now),
+		// Keep the session keys, for the vectors to check.
+		Snapshots: true,
+	})
+	t.Cleanup(dev.Close)
+	if err := dev.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	return dev
+}
+
+// randomness returns what a device must draw to get the private key
+// hexKey as an ephemeral key and index as an index, in the order given.
+func randomness(t *testing.T, indexFirst bool, hexKey string, index uint32) *bytes.Reader {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], index)
+	if indexFirst {
+		return bytes.NewReader(append(b[:], mustHex(t, hexKey)...))
+	}
+	return bytes.NewReader(append(mustHex(t, hexKey), b[:]...))
+}
+
+// runHandshakeVector runs the handshake of v, checking that each side
+// accepts the other's messages, and returns what it produced.
+func runHandshakeVector(t *testing.T, v handshakeVector) handshakeMessages {
+	t.Helper()
+	initiator := vectorDevice(t, v.initiatorKey, v.time)
+	responder := vectorDevice(t, v.responderKey, v.time)
+	var psk NoiseSymmetricKey
+	if err := psk.FromHex(v.presharedKey); err != nil {
+		t.Fatal(err)
+	}
+	toResponder, err := initiator.NewPeer(responder.staticIdentity.publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toInitiator, err := responder.NewPeer(initiator.staticIdentity.publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toResponder.handshake.presharedKey = psk
+	toInitiator.handshake.presharedKey = psk
+
+	marshal := func(msg interface{}, peer *Peer) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, msg)
+		packet := buf.Bytes()
+		if peer != nil {
+			peer.cookieGenerator.AddMacs(packet)
+		}
+		return packet
+	}
+	var out handshakeMessages
+
+	initiator.rand = randomness(t, false, v.initiatorEphemeral, v.initiatorIndex)
+	initiation, err := initiator.CreateMessageInitiation(toResponder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.initiation = marshal(initiation, toResponder)
+	if !responder.cookieChecker.CheckMAC1(out.initiation) {
+		t.Fatal("initiation has an invalid mac1")
+	}
+
+	checker := &responder.cookieChecker
+	checker.Lock()
+	copy(checker.mac2.secret[:], mustHex(t, v.cookieSecret))
+	checker.mac2.secretSet = time.Now()
+	checker.Unlock()
+	var nonce [24]byte
+	copy(nonce[:], mustHex(t, v.cookieNonce))
+	reply, err := checker.createReply(out.initiation, initiation.Sender, v.source, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.cookieReply = marshal(reply, nil)
+	if !toResponder.cookieGenerator.ConsumeReply(reply) {
+		t.Fatal("cookie reply not accepted")
+	}
+
+	if responder.ConsumeMessageInitiation(initiation) != toInitiator {
+		t.Fatal("initiation not accepted")
+	}
+	responder.rand = randomness(t, true, v.responderEphemeral, v.responderIndex)
+	response, err := responder.CreateMessageResponse(toInitiator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.response = marshal(response, toInitiator)
+	if initiator.ConsumeMessageResponse(response) != toResponder {
+		t.Fatal("response not accepted")
+	}
+
+	if err := toResponder.BeginSymmetricSession(); err != nil {
+		t.Fatal(err)
+	}
+	if err := toInitiator.BeginSymmetricSession(); err != nil {
+		t.Fatal(err)
+	}
+	i, r := toResponder.keypairs.Current(), toInitiator.keypairs.loadNext()
+	if i.sendKey != r.receiveKey || r.sendKey != i.receiveKey {
+		t.Fatal("the two sides derived different session keys")
+	}
+	out.initiatorSendKey = i.sendKey[:]
+	out.responderSendKey = r.sendKey[:]
+	return out
+}
+
+/* The vectors pin the bytes of each message, so that a change to the
+ * construction, however slight, fails the test rather than only breaking
+ * interoperability. Each is also checked by having the other side accept
+ * it. Vectors from other implementations can be added as they are, given
+ * the same inputs.
+ */
+var handshakeVectors = []handshakeVector{{
+	initiatorKey:       "481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58",
+	responderKey:       "98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768",
+	presharedKey:       "0000000000000000000000000000000000000000000000000000000000000000",
+	initiatorEphemeral: "10ffd5a2af9a5a1f3ee7dc1a8aa9a4b0d1ea3b29e4c8a8ba8c0dc4f0f4b97f58",
+	responderEphemeral: "a82a0aa7e4cdc76f1a1a7f9d3a3a5e4f3bfbc9bd5b0a56b1a9ae3cc2d4a0d86a",
+	initiatorIndex:     0x01020304,
+	responderIndex:     0x0a0b0c0d,
+	time:               time.Unix(1e9, 0),
+	cookieSecret:       "0101010101010101010101010101010101010101010101010101010101010101",
+	cookieNonce:        "020202020202020202020202020202020202020202020202",
+	source:             []byte{192, 0, 2, 1, 0xca, 0x6c},
+
+	initiation:  "010000000403020189b65e275550f8b008cb7ab5f0581bf21e7000b03642cd38e6929c78edcb5e150cc1a71aec813ec1c640eff59aaeb96b2449eeeef45f9353422d9306ef11113a668d45b53db91df1e2019d5fc0012990a790f515063a6df022703ac1bf93b4376a00ce85637fc4c26b855b61e4a632ce21de53603187f50d24c91f2700000000000000000000000000000000",
+	response:    "020000000d0c0b0a040302018443f7b91ab85d4c9d0f0089dbe6258c333cccd0c0dc025a4dd9b2b00723d1078ffa93930fa0305f19e6e4acc4fefcd628f80aac1d0118f084d351bc0fad9ddd00000000000000000000000000000000",
+	cookieReply: "03000000040302010202020202020202020202020202020202020202020202021426f99d0c6ff8225fb19e8ccf712a6aaf5c835954de94cf1674d4a38b418378",
+
+	initiatorSendKey: "438d455b426ff2b95792adfa1b7dce0faedaf5448186ed8e5495e47b49087b74",
+	responderSendKey: "4d1b4921969fa447a70c295c073076ae2e48c9ebd12d8fcca6a98e30c778ec38",
+}}
+
+func TestHandshakeVectors(t *testing.T) {
+	for i, v := range handshakeVectors {
+		out := runHandshakeVector(t, v)
+		for _, c := range []struct {
+			name      string
+			got, want string
+		}{
+			{"initiation", hex.EncodeToString(out.initiation), v.initiation},
+			{"response", hex.EncodeToString(out.response), v.response},
+			{"cookie reply", hex.EncodeToString(out.cookieReply), v.cookieReply},
+			{"initiator send key", hex.EncodeToString(out.initiatorSendKey), v.initiatorSendKey},
+			{"responder send key", hex.EncodeToString(out.responderSendKey), v.responderSendKey},
+		} {
+			if c.got != c.want {
+				t.Errorf("vector %d: %s\n got %s\nwant %s", i, c.name, c.got, c.want)
+			}
+		}
+	}
+}
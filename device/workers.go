@@ -0,0 +1,197 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Workers sizes the device's pools of worker routines and places them
+// on CPUs. The zero Workers starts runtime.NumCPU() routines of each
+// kind and leaves them to the scheduler.
+type Workers struct {
+	// Encryption, Decryption and Handshake are the number of routines
+	// of each kind. Zero means runtime.NumCPU().
+	Encryption, Decryption, Handshake int
+
+	// EncryptionCPUs, DecryptionCPUs and ReceiveCPUs, if non-empty,
+	// pin the encryption workers, the decryption workers and the
+	// routines receiving from UDP sockets to CPUs: the i-th routine of
+	// a kind runs on the i-th CPU of its list, modulo its length. A
+	// pinned routine keeps an OS thread to itself. Pinning is only
+	// supported on Linux; elsewhere it is logged and ignored.
+	EncryptionCPUs, DecryptionCPUs, ReceiveCPUs []int
+
+	// Adaptive starts a single encryption and a single decryption
+	// worker, and adds more, up to Encryption and Decryption in all,
+	// while their queues stay backed up. A worker added this way exits
+	// again after WorkerIdleTimeout without work.
+	Adaptive bool
+}
+
+const (
+	// WorkerScaleInterval is how often an adaptive device looks at
+	// the depth of its queues.
+	WorkerScaleInterval = 50 * time.Millisecond
+
+	// WorkerScaleDepth is the number of queued packets at which an
+	// adaptive device adds a worker.
+	WorkerScaleDepth = 64
+
+	// WorkerIdleTimeout is how long an added worker waits for work
+	// before it exits.
+	WorkerIdleTimeout = 5 * time.Second
+)
+
+// WorkerLabel is the pprof label key set on the device's routines. Its
+// value names the kind of routine, such as "encryption", "decryption",
+// "handshake" or "receive", so that CPU and goroutine profiles can be
+// broken down by stage of the pipeline.
+const WorkerLabel = "wireguard"
+
+// labelWorker sets the calling routine's WorkerLabel to kind.
+func labelWorker(kind string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels(WorkerLabel, kind)))
+}
+
+func workerCount(n int) int {
+	if n <= 0 {
+		return runtime.NumCPU()
+	}
+	return n
+}
+
+// pinWorker pins the calling routine, the i-th of its kind, to the
+// CPU cpus assigns it, if any.
+func (device *Device) pinWorker(cpus []int, i int) {
+	if len(cpus) == 0 {
+		return
+	}
+	cpu := cpus[i%len(cpus)]
+	runtime.LockOSThread()
+	if err := setAffinity(cpu); err != nil {
+		device.log.Error.Println("Failed to pin routine to CPU", cpu, ":", err)
+	}
+}
+
+// RoutineScaleWorkers adds encryption and decryption workers while
+// their queues are backed up. The workers it adds are its own: they
+// stop with it, when the device closes.
+func (device *Device) RoutineScaleWorkers() {
+
+	logDebug := device.log.Debug
+
+	var extra sync.WaitGroup
+	defer func() {
+		extra.Wait()
+		logDebug.Println("Routine: worker scaler - stopped")
+		device.state.stopping.Done()
+	}()
+	logDebug.Println("Routine: worker scaler - started")
+
+	ticker := time.NewTicker(WorkerScaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n := int(atomic.LoadInt32(&device.workers.runningEncryption))
+		if len(device.queue.encryption.c) >= WorkerScaleDepth && n < workerCount(device.workers.Encryption) {
+			atomic.AddInt32(&device.workers.runningEncryption, 1)
+			extra.Add(1)
+			device.goRoutine("extra encryption worker", func() {
+				defer extra.Done()
+				device.pinWorker(device.workers.EncryptionCPUs, n)
+				device.routineExtraEncryption()
+			})
+		}
+
+		n = int(atomic.LoadInt32(&device.workers.runningDecryption))
+		if len(device.queue.decryption) >= WorkerScaleDepth && n < workerCount(device.workers.Decryption) {
+			atomic.AddInt32(&device.workers.runningDecryption, 1)
+			extra.Add(1)
+			device.goRoutine("extra decryption worker", func() {
+				defer extra.Done()
+				device.pinWorker(device.workers.DecryptionCPUs, n)
+				device.routineExtraDecryption()
+			})
+		}
+	}
+}
+
+// routineExtraEncryption is an encryption worker added by
+// RoutineScaleWorkers.
+func (device *Device) routineExtraEncryption() {
+	var nonce [chacha20poly1305.NonceSize]byte
+	labelWorker("encryption")
+	defer atomic.AddInt32(&device.workers.runningEncryption, -1)
+
+	idle := time.NewTimer(WorkerIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-idle.C:
+			return
+		case elem, ok := <-device.queue.encryption.c:
+			if !ok {
+				return
+			}
+			if !elem.IsDropped() {
+				elem.seal(&nonce, elem.peer.effectiveMTU())
+				device.tracePacket(elem.traceID, StageEncrypted)
+				elem.Unlock()
+			}
+		}
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(WorkerIdleTimeout)
+	}
+}
+
+// routineExtraDecryption is a decryption worker added by
+// RoutineScaleWorkers.
+func (device *Device) routineExtraDecryption() {
+	var nonce [chacha20poly1305.NonceSize]byte
+	labelWorker("decryption")
+	defer atomic.AddInt32(&device.workers.runningDecryption, -1)
+
+	idle := time.NewTimer(WorkerIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-idle.C:
+			return
+		case elem, ok := <-device.queue.decryption:
+			if !ok {
+				return
+			}
+			elem.peer.decryptionDequeued()
+			if !elem.IsDropped() {
+				device.open(elem, &nonce)
+			}
+		}
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(WorkerIdleTimeout)
+	}
+}
@@ -0,0 +1,43 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestWorkers(t *testing.T) {
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.Workers = Workers{
+			Encryption:     1,
+			Decryption:     2,
+			Handshake:      1,
+			EncryptionCPUs: []int{0},
+			DecryptionCPUs: []int{0},
+			ReceiveCPUs:    []int{0},
+		}
+	})
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func TestAdaptiveWorkers(t *testing.T) {
+	pair := genTestPairWithOptions(t, func(i int, opts *DeviceOptions) {
+		opts.Workers = Workers{Encryption: 4, Decryption: 4, Adaptive: true}
+	})
+	for i := range pair {
+		dev := pair[i].dev
+		if n := atomic.LoadInt32(&dev.workers.runningEncryption); n != 1 {
+			t.Errorf("dev%d: %d encryption workers at start, want 1", i, n)
+		}
+		if n := atomic.LoadInt32(&dev.workers.runningDecryption); n != 1 {
+			t.Errorf("dev%d: %d decryption workers at start, want 1", i, n)
+		}
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
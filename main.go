@@ -14,6 +14,7 @@ import (
 	"runtime"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/ipc"
@@ -91,6 +92,16 @@ func main() {
 		foreground = os.Getenv(ENV_WG_PROCESS_FOREGROUND) == "1"
 	}
 
+	// systemd tracks the process it started, so never daemonize under it
+
+	if !foreground {
+		foreground = os.Getenv("NOTIFY_SOCKET") != ""
+	}
+
+	// collect file descriptors passed by systemd
+
+	activated := sdListenFds()
+
 	// get log level (default: info)
 
 	logLevel := func() int {
@@ -110,6 +121,13 @@ func main() {
 	// open TUN device (or use supplied fd)
 
 	tun, err := func() (tun.Device, error) {
+		if file := activated[sdNameTUN]; file != nil {
+			if err := syscall.SetNonblock(int(file.Fd()), true); err != nil {
+				return nil, err
+			}
+			return tun.CreateTUNFromFile(file, device.DefaultMTU)
+		}
+
 		tunFdStr := os.Getenv(ENV_WG_TUN_FD)
 		if tunFdStr == "" {
 			return tun.CreateTUN(interfaceName, device.DefaultMTU)
@@ -155,6 +173,10 @@ func main() {
 	// open UAPI file (or use supplied fd)
 
 	fileUAPI, err := func() (*os.File, error) {
+		if file := activated[sdNameUAPI]; file != nil {
+			return file, nil
+		}
+
 		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
 		if uapiFdStr == "" {
 			return ipc.UAPIOpen(interfaceName)
@@ -251,6 +273,24 @@ func main() {
 
 	logger.Info.Println("UAPI listener started")
 
+	// notify systemd, if we were started by it
+
+	if activated[sdNameTUN] == nil && sdFdStoreEnabled() {
+		if err := sdNotify("FDSTORE=1\nFDNAME="+sdNameTUN, tun.File()); err != nil {
+			logger.Error.Println("Failed to store TUN fd with systemd:", err)
+		}
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Error.Println("Failed to notify systemd:", err)
+	}
+	if interval := sdWatchdogInterval(); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				sdNotify("WATCHDOG=1")
+			}
+		}()
+	}
+
 	// wait for program to terminate
 
 	signal.Notify(term, syscall.SIGTERM)
@@ -264,7 +304,13 @@ func main() {
 
 	// clean up
 
-	uapi.Close()
+	sdNotify("STOPPING=1")
+
+	// A socket-activated UAPI socket belongs to systemd, and closing
+	// the listener would unlink its path, so leave that to exit.
+	if activated[sdNameUAPI] == nil {
+		uapi.Close()
+	}
 	device.Close()
 
 	logger.Info.Println("Shutting down")
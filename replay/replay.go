@@ -6,6 +6,11 @@
 // Package replay implements an efficient anti-replay algorithm as specified in RFC 6479.
 package replay
 
+import (
+	"encoding/binary"
+	"errors"
+)
+
 type block uint64
 
 const (
@@ -60,3 +65,26 @@ func (f *Filter) ValidateCounter(counter uint64, limit uint64) bool {
 	f.ring[indexBlock] = new
 	return old != new
 }
+
+// MarshalBinary encodes the filter's window, so that a session can be
+// carried on elsewhere without accepting the messages it has seen.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8*(1+ringBlocks))
+	binary.LittleEndian.PutUint64(b, f.last)
+	for i, block := range f.ring {
+		binary.LittleEndian.PutUint64(b[8*(1+i):], uint64(block))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary sets the filter to a window encoded by MarshalBinary.
+func (f *Filter) UnmarshalBinary(b []byte) error {
+	if len(b) != 8*(1+ringBlocks) {
+		return errors.New("replay: invalid filter encoding")
+	}
+	f.last = binary.LittleEndian.Uint64(b)
+	for i := range f.ring {
+		f.ring[i] = block(binary.LittleEndian.Uint64(b[8*(1+i):]))
+	}
+	return nil
+}
@@ -117,3 +117,33 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(windowSize+1, true)
 }
+
+func TestMarshalBinary(t *testing.T) {
+	var filter Filter
+	for _, n := range []uint64{0, 1, 5, 300, 299, 1000} {
+		filter.ValidateCounter(n, RejectAfterMessages)
+	}
+	b, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restored Filter
+	if err := restored.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint64{1000, 300, 299} {
+		if restored.ValidateCounter(n, RejectAfterMessages) {
+			t.Errorf("restored filter accepted replayed counter %d", n)
+		}
+	}
+	for _, n := range []uint64{998, 1001} {
+		if !restored.ValidateCounter(n, RejectAfterMessages) {
+			t.Errorf("restored filter rejected new counter %d", n)
+		}
+	}
+
+	if err := restored.UnmarshalBinary(b[1:]); err == nil {
+		t.Error("short encoding accepted")
+	}
+}
@@ -0,0 +1,116 @@
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/* Minimal systemd integration, following sd_notify(3) and sd_listen_fds(3).
+ *
+ * With Type=notify the daemon reports readiness once the UAPI listener is
+ * up, pings the watchdog if WatchdogSec= is set, and, if the unit has a
+ * file descriptor store (FileDescriptorStoreMax=), hands systemd the TUN
+ * fd under the name "tun". After a restart, systemd passes that fd back,
+ * along with a socket-activated UAPI socket named "uapi", so the interface
+ * survives the restart.
+ */
+
+const (
+	sdListenFdsStart = 3
+
+	sdNameTUN  = "tun"
+	sdNameUAPI = "uapi"
+)
+
+// sdListenFds returns the file descriptors passed by systemd, keyed by
+// their FileDescriptorName=. Unnamed descriptors are keyed "unknown".
+func sdListenFds() map[string]*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	files := make(map[string]*os.File, n)
+	for i := 0; i < n; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return files
+}
+
+// sdNotify sends state to the service manager, along with files, if any.
+// It does nothing if the process was not started by systemd.
+func sdNotify(state string, files ...*os.File) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+
+	// A connected datagram socket cannot carry ancillary data through
+	// package net, so use the socket directly. An address starting with
+	// '@' is in the abstract namespace, which syscall handles for us.
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	syscall.CloseOnExec(fd)
+
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, file := range files {
+			fds[i] = int(file.Fd())
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+	return syscall.Sendmsg(fd, []byte(state), oob, &syscall.SockaddrUnix{Name: socketAddr}, 0)
+}
+
+// sdWatchdogInterval returns how often to ping the watchdog, or zero if
+// the watchdog is disabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	// Ping at half the timeout, as sd_watchdog_enabled(3) recommends.
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdFdStoreEnabled reports whether the unit has a file descriptor store.
+// systemd exports its size as FDSTORE.
+func sdFdStoreEnabled() bool {
+	n, err := strconv.Atoi(os.Getenv("FDSTORE"))
+	return err == nil && n > 0
+}
@@ -30,6 +30,11 @@ func Now() Timestamp {
 	return stamp(time.Now())
 }
 
+// At returns the timestamp of t.
+func At(t time.Time) Timestamp {
+	return stamp(t)
+}
+
 func (t1 Timestamp) After(t2 Timestamp) bool {
 	return bytes.Compare(t1[:], t2[:]) > 0
 }
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package addrconf assigns addresses and an MTU to a TUN interface and
+// brings it up, so that programs embedding the device need not shell out
+// to ip, ifconfig or netsh.
+package addrconf
+
+import (
+	"fmt"
+
+	"inet.af/netaddr"
+)
+
+// Config is the interface configuration applied by Apply.
+type Config struct {
+	// Addresses are assigned to the interface. The prefix length selects
+	// the on-link subnet, e.g. 10.0.0.1/24.
+	Addresses []netaddr.IPPrefix
+
+	// MTU is set on the interface if nonzero.
+	MTU int
+}
+
+// system is the platform specific half of Apply.
+type system interface {
+	addAddress(ifname string, addr netaddr.IPPrefix) error
+	setMTU(ifname string, mtu int) error
+	setUp(ifname string) error
+}
+
+// nativeSystem is the system of the running platform.
+type nativeSystem struct{}
+
+func (nativeSystem) addAddress(ifname string, addr netaddr.IPPrefix) error {
+	return addAddress(ifname, addr)
+}
+func (nativeSystem) setMTU(ifname string, mtu int) error { return setMTU(ifname, mtu) }
+func (nativeSystem) setUp(ifname string) error           { return setUp(ifname) }
+
+// Apply configures the interface named ifname according to cfg and brings
+// it up. Addresses already assigned are left in place; addresses not in
+// cfg are not removed. An invalid address fails Apply before anything
+// is changed.
+func Apply(ifname string, cfg Config) error {
+	return apply(nativeSystem{}, ifname, cfg)
+}
+
+func apply(sys system, ifname string, cfg Config) error {
+	for _, addr := range cfg.Addresses {
+		if !addr.IP.Is4() && !addr.IP.Is6() {
+			return fmt.Errorf("addrconf: invalid address %v", addr)
+		}
+	}
+	if cfg.MTU != 0 {
+		if err := sys.setMTU(ifname, cfg.MTU); err != nil {
+			return fmt.Errorf("addrconf: set MTU %d on %s: %w", cfg.MTU, ifname, err)
+		}
+	}
+	for _, addr := range cfg.Addresses {
+		if err := sys.addAddress(ifname, addr); err != nil {
+			return fmt.Errorf("addrconf: add address %v to %s: %w", addr, ifname, err)
+		}
+	}
+	if err := sys.setUp(ifname); err != nil {
+		return fmt.Errorf("addrconf: bring up %s: %w", ifname, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// +build darwin freebsd openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package addrconf
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+const nd6InfiniteLifetime = 0xffffffff
+
+// Structure for iface flags get/set ioctls
+type ifreqFlags struct {
+	Name  [unix.IFNAMSIZ]byte
+	Flags int16
+	Pad0  [14]byte
+}
+
+// Structure for iface mtu get/set ioctls
+type ifreqMTU struct {
+	Name [unix.IFNAMSIZ]byte
+	MTU  uint32
+	Pad0 [12]byte
+}
+
+func ioctl(family int, req uint, arg unsafe.Pointer) error {
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setMTU(ifname string, mtu int) error {
+	var ifr ifreqMTU
+	copy(ifr.Name[:], ifname)
+	ifr.MTU = uint32(mtu)
+	return ioctl(unix.AF_INET, unix.SIOCSIFMTU, unsafe.Pointer(&ifr))
+}
+
+func setUp(ifname string) error {
+	var ifr ifreqFlags
+	copy(ifr.Name[:], ifname)
+	if err := ioctl(unix.AF_INET, unix.SIOCGIFFLAGS, unsafe.Pointer(&ifr)); err != nil {
+		return err
+	}
+	if ifr.Flags&unix.IFF_UP != 0 {
+		return nil
+	}
+	ifr.Flags |= unix.IFF_UP
+	return ioctl(unix.AF_INET, unix.SIOCSIFFLAGS, unsafe.Pointer(&ifr))
+}
+
+func addAddress(ifname string, addr netaddr.IPPrefix) error {
+	ip := addr.IP.As16()
+	if addr.IP.Is4() {
+		/* TUN interfaces are point-to-point, so the destination address
+		 * is required; use our own address as wg-quick does.
+		 */
+		var req inAliasreq
+		copy(req.Name[:], ifname)
+		req.Addr = sockaddr4(ip[12:])
+		req.Dstaddr = req.Addr
+		req.Mask = sockaddr4(net.CIDRMask(int(addr.Bits), 8*net.IPv4len))
+		return ioctl(unix.AF_INET, siocAIFADDR, unsafe.Pointer(&req))
+	}
+
+	var req in6Aliasreq
+	copy(req.Name[:], ifname)
+	req.Addr = sockaddr6(ip[:])
+	req.Prefixmask = sockaddr6(net.CIDRMask(int(addr.Bits), 8*net.IPv6len))
+	req.Lifetime.Vltime = nd6InfiniteLifetime
+	req.Lifetime.Pltime = nd6InfiniteLifetime
+	return ioctl(unix.AF_INET6, siocAIFADDR_IN6, unsafe.Pointer(&req))
+}
+
+func sockaddr4(b []byte) (sa unix.RawSockaddrInet4) {
+	sa.Len = unix.SizeofSockaddrInet4
+	sa.Family = unix.AF_INET
+	copy(sa.Addr[:], b)
+	return
+}
+
+func sockaddr6(b []byte) (sa unix.RawSockaddrInet6) {
+	sa.Len = unix.SizeofSockaddrInet6
+	sa.Family = unix.AF_INET6
+	copy(sa.Addr[:], b)
+	return
+}
+
+type in6Addrlifetime struct {
+	Expire    int64
+	Preferred int64
+	Vltime    uint32
+	Pltime    uint32
+}
@@ -0,0 +1,21 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package addrconf
+
+import (
+	"errors"
+	"runtime"
+
+	"inet.af/netaddr"
+)
+
+var errUnsupported = errors.New("not supported on " + runtime.GOOS)
+
+func addAddress(ifname string, addr netaddr.IPPrefix) error { return errUnsupported }
+func setMTU(ifname string, mtu int) error                   { return errUnsupported }
+func setUp(ifname string) error                             { return errUnsupported }
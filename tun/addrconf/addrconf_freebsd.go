@@ -0,0 +1,37 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package addrconf
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SIOCAIFADDR_IN6, value derived from sys/netinet6/in6_var.h
+// const SIOCAIFADDR_IN6 = _IOW('i', 27, struct in6_aliasreq)
+const (
+	siocAIFADDR     = unix.SIOCAIFADDR
+	siocAIFADDR_IN6 = 0x8088691b
+)
+
+// struct in_aliasreq
+type inAliasreq struct {
+	Name    [unix.IFNAMSIZ]byte
+	Addr    unix.RawSockaddrInet4
+	Dstaddr unix.RawSockaddrInet4
+	Mask    unix.RawSockaddrInet4
+	Vhid    int32
+}
+
+// struct in6_aliasreq
+type in6Aliasreq struct {
+	Name       [unix.IFNAMSIZ]byte
+	Addr       unix.RawSockaddrInet6
+	Dstaddr    unix.RawSockaddrInet6
+	Prefixmask unix.RawSockaddrInet6
+	Flags      int32
+	Lifetime   in6Addrlifetime
+	Vhid       int32
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package addrconf
+
+import (
+	"net"
+	"unsafe"
+
+	"github.com/tailscale/wireguard-go/tun/internal/netlink"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+func interfaceIndex(ifname string) (int32, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return 0, err
+	}
+	return int32(iface.Index), nil
+}
+
+func addAddress(ifname string, addr netaddr.IPPrefix) error {
+	index, err := interfaceIndex(ifname)
+	if err != nil {
+		return err
+	}
+	ifa := unix.IfAddrmsg{
+		Family:    unix.AF_INET6,
+		Prefixlen: addr.Bits,
+		Index:     uint32(index),
+	}
+	ip := addr.IP.As16()
+	raw := ip[:]
+	if addr.IP.Is4() {
+		ifa.Family = unix.AF_INET
+		raw = ip[12:]
+	}
+	msg := netlink.NewMessage(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, (*[unix.SizeofIfAddrmsg]byte)(unsafe.Pointer(&ifa))[:])
+	msg.AddAttr(unix.IFA_LOCAL, raw)
+	msg.AddAttr(unix.IFA_ADDRESS, raw)
+	return netlink.Do(msg)
+}
+
+func setMTU(ifname string, mtu int) error {
+	index, err := interfaceIndex(ifname)
+	if err != nil {
+		return err
+	}
+	ifi := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  index,
+	}
+	msg := netlink.NewMessage(unix.RTM_NEWLINK, 0, (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&ifi))[:])
+	msg.AddAttr(unix.IFLA_MTU, netlink.Uint32(uint32(mtu)))
+	return netlink.Do(msg)
+}
+
+func setUp(ifname string) error {
+	index, err := interfaceIndex(ifname)
+	if err != nil {
+		return err
+	}
+	ifi := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  index,
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+	}
+	msg := netlink.NewMessage(unix.RTM_NEWLINK, 0, (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&ifi))[:])
+	return netlink.Do(msg)
+}
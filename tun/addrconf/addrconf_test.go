@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package addrconf
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+type fakeSystem struct {
+	ops  []string
+	fail string // the op to fail
+}
+
+func (sys *fakeSystem) do(op string) error {
+	if op == sys.fail {
+		return errors.New("injected failure")
+	}
+	sys.ops = append(sys.ops, op)
+	return nil
+}
+
+func (sys *fakeSystem) addAddress(ifname string, addr netaddr.IPPrefix) error {
+	return sys.do("addr " + ifname + " " + addr.String())
+}
+
+func (sys *fakeSystem) setMTU(ifname string, mtu int) error {
+	return sys.do("mtu " + ifname)
+}
+
+func (sys *fakeSystem) setUp(ifname string) error {
+	return sys.do("up " + ifname)
+}
+
+func TestApply(t *testing.T) {
+	cfg := Config{
+		Addresses: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("10.0.0.1/24"),
+			netaddr.MustParseIPPrefix("fd00::1/64"),
+		},
+		MTU: 1280,
+	}
+	sys := new(fakeSystem)
+	if err := apply(sys, "wg0", cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"mtu wg0", "addr wg0 10.0.0.1/24", "addr wg0 fd00::1/64", "up wg0"}
+	if !reflect.DeepEqual(sys.ops, want) {
+		t.Errorf("ops %q, want %q", sys.ops, want)
+	}
+
+	// Without an MTU, it is left alone.
+	sys = new(fakeSystem)
+	if err := apply(sys, "wg0", Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sys.ops, []string{"up wg0"}) {
+		t.Errorf("ops %q without an MTU or addresses", sys.ops)
+	}
+}
+
+func TestApplyFailure(t *testing.T) {
+	cfg := Config{
+		Addresses: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("10.0.0.1/24"),
+			netaddr.MustParseIPPrefix("10.0.1.1/24"),
+		},
+	}
+	sys := &fakeSystem{fail: "addr wg0 10.0.1.1/24"}
+	err := apply(sys, "wg0", cfg)
+	if err == nil || !strings.Contains(err.Error(), "10.0.1.1/24") {
+		t.Fatalf("error %v, want one naming the failed address", err)
+	}
+	if !reflect.DeepEqual(sys.ops, []string{"addr wg0 10.0.0.1/24"}) {
+		t.Errorf("ops %q; the interface must not be brought up", sys.ops)
+	}
+
+	// An invalid address changes nothing.
+	sys = new(fakeSystem)
+	cfg.Addresses = append(cfg.Addresses, netaddr.IPPrefix{})
+	if err := apply(sys, "wg0", Config{Addresses: cfg.Addresses, MTU: 1280}); err == nil {
+		t.Fatal("no error for an invalid address")
+	}
+	if len(sys.ops) != 0 {
+		t.Errorf("ops %q before rejecting an invalid address", sys.ops)
+	}
+}
@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package addrconf
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+)
+
+var (
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+
+	procConvertInterfaceAliasToLuid     = modiphlpapi.NewProc("ConvertInterfaceAliasToLuid")
+	procInitializeUnicastIpAddressEntry = modiphlpapi.NewProc("InitializeUnicastIpAddressEntry")
+	procCreateUnicastIpAddressEntry     = modiphlpapi.NewProc("CreateUnicastIpAddressEntry")
+	procInitializeIpInterfaceEntry      = modiphlpapi.NewProc("InitializeIpInterfaceEntry")
+	procGetIpInterfaceEntry             = modiphlpapi.NewProc("GetIpInterfaceEntry")
+	procSetIpInterfaceEntry             = modiphlpapi.NewProc("SetIpInterfaceEntry")
+)
+
+const (
+	errorObjectAlreadyExists = windows.Errno(5010)
+	ipDadStatePreferred      = 4
+)
+
+// rawSockaddrInet is SOCKADDR_INET.
+type rawSockaddrInet struct {
+	Family uint16
+	data   [26]byte
+}
+
+// mibUnicastIPAddressRow is MIB_UNICASTIPADDRESS_ROW.
+type mibUnicastIPAddressRow struct {
+	Address            rawSockaddrInet
+	_                  [4]byte
+	InterfaceLUID      uint64
+	InterfaceIndex     uint32
+	PrefixOrigin       uint32
+	SuffixOrigin       uint32
+	ValidLifetime      uint32
+	PreferredLifetime  uint32
+	OnLinkPrefixLength uint8
+	SkipAsSource       bool
+	DadState           uint32
+	ScopeID            uint32
+	CreationTimeStamp  int64
+}
+
+// mibIPInterfaceRow is MIB_IPINTERFACE_ROW.
+type mibIPInterfaceRow struct {
+	Family                               uint16
+	InterfaceLUID                        uint64
+	InterfaceIndex                       uint32
+	MaxReassemblySize                    uint32
+	InterfaceIdentifier                  uint64
+	MinRouterAdvertisementInterval       uint32
+	MaxRouterAdvertisementInterval       uint32
+	AdvertisingEnabled                   bool
+	ForwardingEnabled                    bool
+	WeakHostSend                         bool
+	WeakHostReceive                      bool
+	UseAutomaticMetric                   bool
+	UseNeighborUnreachabilityDetection   bool
+	ManagedAddressConfigurationSupported bool
+	OtherStatefulConfigurationSupported  bool
+	AdvertiseDefaultRoute                bool
+	RouterDiscoveryBehavior              int32
+	DadTransmits                         uint32
+	BaseReachableTime                    uint32
+	RetransmitTime                       uint32
+	PathMTUDiscoveryTimeout              uint32
+	LinkLocalAddressBehavior             int32
+	LinkLocalAddressTimeout              uint32
+	ZoneIndices                          [16]uint32
+	SitePrefixLength                     uint32
+	Metric                               uint32
+	NLMTU                                uint32
+	Connected                            bool
+	SupportsWakeUpPatterns               bool
+	SupportsNeighborDiscovery            bool
+	SupportsRouterDiscovery              bool
+	ReachableTime                        uint32
+	TransmitOffload                      uint8
+	ReceiveOffload                       uint8
+	DisableDefaultRoutes                 bool
+}
+
+func interfaceLUID(ifname string) (luid uint64, err error) {
+	alias, err := windows.UTF16PtrFromString(ifname)
+	if err != nil {
+		return 0, err
+	}
+	r, _, _ := procConvertInterfaceAliasToLuid.Call(uintptr(unsafe.Pointer(alias)), uintptr(unsafe.Pointer(&luid)))
+	if r != 0 {
+		return 0, windows.Errno(r)
+	}
+	return luid, nil
+}
+
+func addAddress(ifname string, addr netaddr.IPPrefix) error {
+	luid, err := interfaceLUID(ifname)
+	if err != nil {
+		return err
+	}
+	row := &mibUnicastIPAddressRow{}
+	procInitializeUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(row)))
+	row.InterfaceLUID = luid
+	row.OnLinkPrefixLength = addr.Bits
+	row.DadState = ipDadStatePreferred
+	b := addr.IP.As16()
+	if addr.IP.Is4() {
+		/* SOCKADDR_IN: family, port, address */
+		row.Address.Family = windows.AF_INET
+		copy(row.Address.data[2:6], b[12:])
+	} else {
+		/* SOCKADDR_IN6: family, port, flow info, address, scope */
+		row.Address.Family = windows.AF_INET6
+		copy(row.Address.data[6:22], b[:])
+	}
+	r, _, _ := procCreateUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(row)))
+	if r != 0 && windows.Errno(r) != errorObjectAlreadyExists {
+		return windows.Errno(r)
+	}
+	return nil
+}
+
+func setMTU(ifname string, mtu int) error {
+	luid, err := interfaceLUID(ifname)
+	if err != nil {
+		return err
+	}
+	for _, family := range []uint16{windows.AF_INET, windows.AF_INET6} {
+		row := &mibIPInterfaceRow{}
+		procInitializeIpInterfaceEntry.Call(uintptr(unsafe.Pointer(row)))
+		row.Family = family
+		row.InterfaceLUID = luid
+		r, _, _ := procGetIpInterfaceEntry.Call(uintptr(unsafe.Pointer(row)))
+		if r == uintptr(windows.ERROR_NOT_FOUND) {
+			// The address family is not enabled on this interface.
+			continue
+		}
+		if r != 0 {
+			return windows.Errno(r)
+		}
+		row.NLMTU = uint32(mtu)
+		if family == windows.AF_INET {
+			// SetIpInterfaceEntry rejects the value that
+			// GetIpInterfaceEntry returns for IPv4.
+			row.SitePrefixLength = 0
+		}
+		r, _, _ = procSetIpInterfaceEntry.Call(uintptr(unsafe.Pointer(row)))
+		if r != 0 {
+			return windows.Errno(r)
+		}
+	}
+	return nil
+}
+
+func setUp(ifname string) error {
+	// Wintun adapters are up once a session is started.
+	return nil
+}
@@ -0,0 +1,8 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package netlink builds rtnetlink requests and sends them to the Linux
+// kernel, for the packages that configure routes and addresses.
+package netlink
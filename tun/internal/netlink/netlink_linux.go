@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netlink
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const recvBufferSize = 1 << 16
+
+// A Message is an rtnetlink request: a header, a fixed body and
+// attributes.
+type Message struct {
+	buf []byte
+}
+
+// NewMessage returns a request of type typ with body, asking for an
+// acknowledgement.
+func NewMessage(typ uint16, flags uint16, body []byte) *Message {
+	msg := &Message{buf: make([]byte, unix.SizeofNlMsghdr, 128)}
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&msg.buf[0]))
+	hdr.Type = typ
+	hdr.Flags = unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags
+	msg.buf = append(msg.buf, body...)
+	return msg
+}
+
+// AddAttr appends an attribute of type typ to msg.
+func (msg *Message) AddAttr(typ uint16, data []byte) {
+	var attr [unix.SizeofRtAttr]byte
+	rta := (*unix.RtAttr)(unsafe.Pointer(&attr[0]))
+	rta.Type = typ
+	rta.Len = uint16(unix.SizeofRtAttr + len(data))
+	msg.buf = append(msg.buf, attr[:]...)
+	msg.buf = append(msg.buf, data...)
+	for len(msg.buf)%4 != 0 {
+		msg.buf = append(msg.buf, 0)
+	}
+}
+
+// Uint32 encodes v as an attribute value, in native byte order.
+func Uint32(v uint32) []byte {
+	var b [4]byte
+	*(*uint32)(unsafe.Pointer(&b[0])) = v
+	return b[:]
+}
+
+// A Conn is a NETLINK_ROUTE socket.
+type Conn struct {
+	fd  int
+	seq uint32
+}
+
+// Dial opens a NETLINK_ROUTE socket.
+func Dial() (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &Conn{fd: fd}, nil
+}
+
+// Close closes the socket.
+func (c *Conn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// Do sends msg and waits for the kernel's acknowledgement, returning the
+// error it reports.
+func (c *Conn) Do(msg *Message) error {
+	c.seq++
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&msg.buf[0]))
+	hdr.Len = uint32(len(msg.buf))
+	hdr.Seq = c.seq
+
+	if err := unix.Sendto(c.fd, msg.buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, recvBufferSize)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != c.seq || reply.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return unix.EPROTO
+			}
+			if code := *(*int32)(unsafe.Pointer(&reply.Data[0])); code != 0 {
+				return unix.Errno(-code)
+			}
+			return nil
+		}
+	}
+}
+
+// Do sends msg on a fresh socket, as Conn.Do.
+func Do(msg *Message) error {
+	c, err := Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Do(msg)
+}
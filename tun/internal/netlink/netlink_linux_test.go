@@ -0,0 +1,37 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netlink
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMessage(t *testing.T) {
+	msg := NewMessage(unix.RTM_NEWADDR, unix.NLM_F_CREATE, []byte{1, 2, 3, 4})
+	msg.AddAttr(unix.IFA_LOCAL, []byte{10, 0, 0, 1})
+	msg.AddAttr(unix.IFA_LABEL, []byte("wg0"))
+
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&msg.buf[0]))
+	if hdr.Type != unix.RTM_NEWADDR || hdr.Flags != unix.NLM_F_REQUEST|unix.NLM_F_ACK|unix.NLM_F_CREATE {
+		t.Errorf("header type %d flags %#x", hdr.Type, hdr.Flags)
+	}
+	body := msg.buf[unix.SizeofNlMsghdr:]
+	want := []byte{
+		1, 2, 3, 4,
+		0, 0, 0, 0, 10, 0, 0, 1, // IFA_LOCAL
+		0, 0, 0, 0, 'w', 'g', '0', 0, // IFA_LABEL, padded to 4 bytes
+	}
+	// The attribute headers are in native byte order.
+	copy(want[4:], Uint32(uint32(unix.IFA_LOCAL)<<16 | 8)[:])
+	copy(want[12:], Uint32(uint32(unix.IFA_LABEL)<<16 | 7)[:])
+	if !bytes.Equal(body, want) {
+		t.Errorf("body % x, want % x", body, want)
+	}
+}
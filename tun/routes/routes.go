@@ -0,0 +1,184 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package routes installs operating system routes pointing the allowed IPs
+// of a WireGuard interface at that interface, replacing the routing half of
+// wg-quick for programs that embed the device.
+//
+// Routes are programmed with netlink on Linux, the routing socket on
+// Darwin, FreeBSD and OpenBSD, and the IP Helper API on Windows.
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+// DefaultTable is the routing table (and firewall mark) used on Linux for
+// default routes when Config.Table is zero, matching wg-quick.
+const DefaultTable = 51820
+
+var ErrClosed = errors.New("routes: manager closed")
+
+// Config controls how default routes are installed. Routes for other
+// prefixes are always added to the main table.
+type Config struct {
+	// Table is the Linux routing table that receives default routes
+	// (0.0.0.0/0 and ::/0). Packets not carrying FwMark are steered into
+	// it with a policy rule, and a second rule keeps more specific routes
+	// in the main table in effect. Zero means DefaultTable.
+	Table uint32
+
+	// FwMark is the firewall mark set on the device's own encrypted
+	// traffic, which must bypass Table to avoid a routing loop. The
+	// caller is responsible for configuring the same mark on the device.
+	// Zero means the value of Table.
+	FwMark uint32
+}
+
+// system is the platform specific half of a Manager.
+type system interface {
+	add(prefix netaddr.IPPrefix) error
+	del(prefix netaddr.IPPrefix) error
+	close() error
+}
+
+// Manager keeps the routes of a single interface in sync with a set of
+// prefixes. It is safe for concurrent use.
+type Manager struct {
+	mutex     sync.Mutex
+	sys       system
+	installed map[netaddr.IPPrefix]bool
+}
+
+// New returns a Manager for the interface named ifname. No routes are
+// installed until Set is called.
+func New(ifname string, cfg Config) (*Manager, error) {
+	if cfg.Table == 0 {
+		cfg.Table = DefaultTable
+	}
+	if cfg.FwMark == 0 {
+		cfg.FwMark = cfg.Table
+	}
+	sys, err := newSystem(ifname, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	return newManager(sys), nil
+}
+
+func newManager(sys system) *Manager {
+	return &Manager{
+		sys:       sys,
+		installed: make(map[netaddr.IPPrefix]bool),
+	}
+}
+
+// Set makes the interface's routes match prefixes, removing routes that are
+// no longer wanted before adding new ones. Prefixes are masked and
+// duplicates ignored. On error, the routes that were successfully changed
+// stay changed and a later Set retries the rest.
+func (m *Manager) Set(prefixes []netaddr.IPPrefix) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.sys == nil {
+		return ErrClosed
+	}
+
+	want := make(map[netaddr.IPPrefix]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		want[prefix.Masked()] = true
+	}
+
+	var errs []error
+	for _, prefix := range sortedPrefixes(m.installed) {
+		if want[prefix] {
+			continue
+		}
+		if err := m.sys.del(prefix); err != nil {
+			errs = append(errs, fmt.Errorf("delete %v: %w", prefix, err))
+			continue
+		}
+		delete(m.installed, prefix)
+	}
+	for _, prefix := range sortedPrefixes(want) {
+		if m.installed[prefix] {
+			continue
+		}
+		if err := m.sys.add(prefix); err != nil {
+			errs = append(errs, fmt.Errorf("add %v: %w", prefix, err))
+			continue
+		}
+		m.installed[prefix] = true
+	}
+	return joinErrors(errs)
+}
+
+// Routes returns the prefixes currently installed by m.
+func (m *Manager) Routes() []netaddr.IPPrefix {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return sortedPrefixes(m.installed)
+}
+
+// Close removes all routes installed by m and releases its resources.
+func (m *Manager) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.sys == nil {
+		return ErrClosed
+	}
+
+	var errs []error
+	for _, prefix := range sortedPrefixes(m.installed) {
+		if err := m.sys.del(prefix); err != nil {
+			errs = append(errs, fmt.Errorf("delete %v: %w", prefix, err))
+		}
+	}
+	if err := m.sys.close(); err != nil {
+		errs = append(errs, err)
+	}
+	m.sys = nil
+	m.installed = nil
+	return joinErrors(errs)
+}
+
+func sortedPrefixes(set map[netaddr.IPPrefix]bool) []netaddr.IPPrefix {
+	prefixes := make([]netaddr.IPPrefix, 0, len(set))
+	for prefix := range set {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := prefixes[i], prefixes[j]
+		if a.IP.Is4() != b.IP.Is4() {
+			return a.IP.Is4()
+		}
+		if a.Bits != b.Bits {
+			return a.Bits < b.Bits
+		}
+		return a.IP.Less(b.IP)
+	})
+	return prefixes
+}
+
+func isDefault(prefix netaddr.IPPrefix) bool {
+	return prefix.Bits == 0
+}
+
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("routes: %w", errs[0])
+	}
+	return fmt.Errorf("routes: %w (and %d more errors)", errs[0], len(errs)-1)
+}
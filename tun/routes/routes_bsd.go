@@ -0,0 +1,129 @@
+// +build darwin freebsd openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"net"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+/* The BSD kernels have no policy routing, so default routes are split into
+ * two halves that take precedence over the system default route, as
+ * wg-quick does on these platforms. Keeping the device's encrypted traffic
+ * off the tunnel (for instance with a host route to each peer endpoint) is
+ * left to the caller.
+ */
+
+type bsdSystem struct {
+	fd      int
+	ifindex int
+	seq     int
+}
+
+func newSystem(ifname string, cfg Config) (system, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	// We only write to the routing socket; don't queue the kernel's
+	// broadcast of every routing change.
+	unix.Shutdown(fd, unix.SHUT_RD)
+	return &bsdSystem{fd: fd, ifindex: iface.Index}, nil
+}
+
+func splitDefault(prefix netaddr.IPPrefix) []netaddr.IPPrefix {
+	if !isDefault(prefix) {
+		return []netaddr.IPPrefix{prefix}
+	}
+	if prefix.IP.Is4() {
+		return []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("0.0.0.0/1"),
+			netaddr.MustParseIPPrefix("128.0.0.0/1"),
+		}
+	}
+	return []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("::/1"),
+		netaddr.MustParseIPPrefix("8000::/1"),
+	}
+}
+
+func (sys *bsdSystem) add(prefix netaddr.IPPrefix) error {
+	for _, p := range splitDefault(prefix) {
+		err := sys.route(unix.RTM_ADD, p)
+		if err == unix.EEXIST {
+			err = sys.route(unix.RTM_CHANGE, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sys *bsdSystem) del(prefix netaddr.IPPrefix) error {
+	for _, p := range splitDefault(prefix) {
+		if err := sys.route(unix.RTM_DELETE, p); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sys *bsdSystem) close() error {
+	return unix.Close(sys.fd)
+}
+
+func sockaddr(ip netaddr.IP) route.Addr {
+	b := ip.As16()
+	if ip.Is4() {
+		a := &route.Inet4Addr{}
+		copy(a.IP[:], b[12:])
+		return a
+	}
+	return &route.Inet6Addr{IP: b}
+}
+
+func netmask(prefix netaddr.IPPrefix) route.Addr {
+	if prefix.IP.Is4() {
+		a := &route.Inet4Addr{}
+		copy(a.IP[:], net.CIDRMask(int(prefix.Bits), 8*net.IPv4len))
+		return a
+	}
+	a := &route.Inet6Addr{}
+	copy(a.IP[:], net.CIDRMask(int(prefix.Bits), 8*net.IPv6len))
+	return a
+}
+
+func (sys *bsdSystem) route(typ int, prefix netaddr.IPPrefix) error {
+	sys.seq++
+	msg := route.RouteMessage{
+		Version: unix.RTM_VERSION,
+		Type:    typ,
+		Flags:   unix.RTF_UP | unix.RTF_STATIC,
+		Index:   sys.ifindex,
+		Seq:     sys.seq,
+		Addrs: []route.Addr{
+			unix.RTAX_DST:     sockaddr(prefix.IP),
+			unix.RTAX_GATEWAY: &route.LinkAddr{Index: sys.ifindex},
+			unix.RTAX_NETMASK: netmask(prefix),
+		},
+	}
+	b, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = unix.Write(sys.fd, b)
+	return err
+}
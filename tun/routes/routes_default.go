@@ -0,0 +1,17 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"errors"
+	"runtime"
+)
+
+func newSystem(ifname string, cfg Config) (system, error) {
+	return nil, errors.New("not supported on " + runtime.GOOS)
+}
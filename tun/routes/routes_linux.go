@@ -0,0 +1,193 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"unsafe"
+
+	"github.com/tailscale/wireguard-go/tun/internal/netlink"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+/* Policy routing for default routes follows wg-quick:
+ *
+ *   ip route add 0.0.0.0/0 dev wg0 table $table
+ *   ip rule add not fwmark $fwmark table $table
+ *   ip rule add table main suppress_prefixlength 0
+ *
+ * The rules are installed with the first default route of a family and
+ * removed with the last one.
+ */
+
+// Netlink rule definitions from linux/fib_rules.h.
+const (
+	fraFwmark            = 10
+	fraSuppressPrefixlen = 14
+	fraTable             = 15
+	frActToTbl           = 1
+	fibRuleInvert        = 0x2
+	sizeofFibRuleHdr     = 12
+)
+
+type fibRuleHdr struct {
+	Family uint8
+	DstLen uint8
+	SrcLen uint8
+	Tos    uint8
+	Table  uint8
+	Res1   uint8
+	Res2   uint8
+	Action uint8
+	Flags  uint32
+}
+
+type linuxSystem struct {
+	conn    *netlink.Conn
+	ifindex uint32
+	cfg     Config
+	rules   map[int]bool // address families with policy rules installed
+}
+
+func newSystem(ifname string, cfg Config) (system, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := netlink.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &linuxSystem{
+		conn:    conn,
+		ifindex: uint32(iface.Index),
+		cfg:     cfg,
+		rules:   make(map[int]bool),
+	}, nil
+}
+
+func family(prefix netaddr.IPPrefix) int {
+	if prefix.IP.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func addrBytes(ip netaddr.IP) []byte {
+	b := ip.As16()
+	if ip.Is4() {
+		return b[12:]
+	}
+	return b[:]
+}
+
+func (sys *linuxSystem) add(prefix netaddr.IPPrefix) error {
+	err := sys.route(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, prefix)
+	if err != nil || !isDefault(prefix) {
+		return err
+	}
+	return sys.addRules(family(prefix))
+}
+
+func (sys *linuxSystem) del(prefix netaddr.IPPrefix) error {
+	if isDefault(prefix) {
+		if err := sys.delRules(family(prefix)); err != nil {
+			return err
+		}
+	}
+	err := sys.route(unix.RTM_DELROUTE, 0, prefix)
+	if err == unix.ESRCH {
+		// Already gone, e.g. the interface was deleted.
+		err = nil
+	}
+	return err
+}
+
+func (sys *linuxSystem) close() error {
+	return sys.conn.Close()
+}
+
+func (sys *linuxSystem) route(typ uint16, flags uint16, prefix netaddr.IPPrefix) error {
+	table := uint32(unix.RT_TABLE_MAIN)
+	if isDefault(prefix) {
+		table = sys.cfg.Table
+	}
+	rtm := unix.RtMsg{
+		Family:   uint8(family(prefix)),
+		Dst_len:  prefix.Bits,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+	if prefix.IP.Is6() {
+		rtm.Scope = unix.RT_SCOPE_UNIVERSE
+	}
+	if table < 256 {
+		rtm.Table = uint8(table)
+	}
+	msg := netlink.NewMessage(typ, flags, (*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&rtm))[:])
+	if prefix.Bits > 0 {
+		msg.AddAttr(unix.RTA_DST, addrBytes(prefix.IP))
+	}
+	msg.AddAttr(unix.RTA_OIF, netlink.Uint32(sys.ifindex))
+	msg.AddAttr(unix.RTA_TABLE, netlink.Uint32(table))
+	return sys.conn.Do(msg)
+}
+
+func (sys *linuxSystem) addRules(family int) error {
+	if sys.rules[family] {
+		return nil
+	}
+	if family == unix.AF_INET {
+		// Let reverse path filtering see the fwmark, as wg-quick does.
+		// Best effort: the sysctl may be read-only in a container.
+		ioutil.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0)
+	}
+	for _, rule := range sys.ruleMessages(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, family) {
+		if err := sys.conn.Do(rule); err != nil && err != unix.EEXIST {
+			return fmt.Errorf("add policy rule: %w", err)
+		}
+	}
+	sys.rules[family] = true
+	return nil
+}
+
+func (sys *linuxSystem) delRules(family int) error {
+	if !sys.rules[family] {
+		return nil
+	}
+	for _, rule := range sys.ruleMessages(unix.RTM_DELRULE, 0, family) {
+		if err := sys.conn.Do(rule); err != nil && err != unix.ENOENT {
+			return fmt.Errorf("delete policy rule: %w", err)
+		}
+	}
+	delete(sys.rules, family)
+	return nil
+}
+
+func (sys *linuxSystem) ruleMessages(typ uint16, flags uint16, family int) []*netlink.Message {
+	notMarked := fibRuleHdr{
+		Family: uint8(family),
+		Action: frActToTbl,
+		Flags:  fibRuleInvert,
+	}
+	rule1 := netlink.NewMessage(typ, flags, (*[sizeofFibRuleHdr]byte)(unsafe.Pointer(&notMarked))[:])
+	rule1.AddAttr(fraFwmark, netlink.Uint32(sys.cfg.FwMark))
+	rule1.AddAttr(fraTable, netlink.Uint32(sys.cfg.Table))
+
+	suppress := fibRuleHdr{
+		Family: uint8(family),
+		Table:  unix.RT_TABLE_MAIN,
+		Action: frActToTbl,
+	}
+	rule2 := netlink.NewMessage(typ, flags, (*[sizeofFibRuleHdr]byte)(unsafe.Pointer(&suppress))[:])
+	rule2.AddAttr(fraSuppressPrefixlen, netlink.Uint32(0))
+
+	return []*netlink.Message{rule1, rule2}
+}
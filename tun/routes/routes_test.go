@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+type fakeSystem struct {
+	ops    []string
+	fail   map[netaddr.IPPrefix]bool
+	closed bool
+}
+
+func (sys *fakeSystem) add(prefix netaddr.IPPrefix) error {
+	if sys.fail[prefix] {
+		return errors.New("injected failure")
+	}
+	sys.ops = append(sys.ops, "add "+prefix.String())
+	return nil
+}
+
+func (sys *fakeSystem) del(prefix netaddr.IPPrefix) error {
+	sys.ops = append(sys.ops, "del "+prefix.String())
+	return nil
+}
+
+func (sys *fakeSystem) close() error {
+	sys.closed = true
+	return nil
+}
+
+func prefixes(s ...string) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	for _, p := range s {
+		ret = append(ret, netaddr.MustParseIPPrefix(p))
+	}
+	return ret
+}
+
+func TestManagerSet(t *testing.T) {
+	sys := &fakeSystem{fail: make(map[netaddr.IPPrefix]bool)}
+	m := newManager(sys)
+
+	check := func(wantOps ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(sys.ops, wantOps) {
+			t.Errorf("ops = %q, want %q", sys.ops, wantOps)
+		}
+		sys.ops = nil
+	}
+
+	if err := m.Set(prefixes("10.0.0.0/24", "10.0.0.5/24", "fd00::/64", "0.0.0.0/0")); err != nil {
+		t.Fatal(err)
+	}
+	check("add 0.0.0.0/0", "add 10.0.0.0/24", "add fd00::/64")
+
+	if err := m.Set(prefixes("10.0.0.0/24", "192.168.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	check("del 0.0.0.0/0", "del fd00::/64", "add 192.168.0.0/16")
+
+	sys.fail[netaddr.MustParseIPPrefix("172.16.0.0/12")] = true
+	if err := m.Set(prefixes("10.0.0.0/24", "192.168.0.0/16", "172.16.0.0/12")); err == nil {
+		t.Error("Set succeeded despite failing route")
+	}
+	if got, want := m.Routes(), prefixes("192.168.0.0/16", "10.0.0.0/24"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Routes() = %v, want %v", got, want)
+	}
+	delete(sys.fail, netaddr.MustParseIPPrefix("172.16.0.0/12"))
+	if err := m.Set(prefixes("10.0.0.0/24", "192.168.0.0/16", "172.16.0.0/12")); err != nil {
+		t.Fatal(err)
+	}
+	check("add 172.16.0.0/12")
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check("del 172.16.0.0/12", "del 192.168.0.0/16", "del 10.0.0.0/24")
+	if !sys.closed {
+		t.Error("system not closed")
+	}
+	if err := m.Set(nil); err != ErrClosed {
+		t.Errorf("Set after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+)
+
+/* Default routes are installed as is. Windows prefers them over the system
+ * default route by metric, and the device's own sockets stay off the tunnel
+ * by being bound to the default interface (see conn.BindSocketToInterface).
+ */
+
+var (
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+
+	procConvertInterfaceAliasToLuid = modiphlpapi.NewProc("ConvertInterfaceAliasToLuid")
+	procInitializeIpForwardEntry    = modiphlpapi.NewProc("InitializeIpForwardEntry")
+	procCreateIpForwardEntry2       = modiphlpapi.NewProc("CreateIpForwardEntry2")
+	procDeleteIpForwardEntry2       = modiphlpapi.NewProc("DeleteIpForwardEntry2")
+)
+
+const (
+	errorNotFound            = windows.ERROR_NOT_FOUND
+	errorObjectAlreadyExists = windows.Errno(5010)
+)
+
+// rawSockaddrInet is SOCKADDR_INET.
+type rawSockaddrInet struct {
+	Family uint16
+	data   [26]byte
+}
+
+// mibIPforwardRow2 is MIB_IPFORWARD_ROW2.
+type mibIPforwardRow2 struct {
+	InterfaceLUID        uint64
+	InterfaceIndex       uint32
+	DestinationPrefix    rawSockaddrInet
+	PrefixLength         uint8
+	_                    [2]byte
+	NextHop              rawSockaddrInet
+	SitePrefixLength     uint8
+	ValidLifetime        uint32
+	PreferredLifetime    uint32
+	Metric               uint32
+	Protocol             uint32
+	Loopback             bool
+	AutoconfigureAddress bool
+	Publish              bool
+	Immortal             bool
+	Age                  uint32
+	Origin               uint32
+}
+
+type windowsSystem struct {
+	luid uint64
+}
+
+func newSystem(ifname string, cfg Config) (system, error) {
+	alias, err := windows.UTF16PtrFromString(ifname)
+	if err != nil {
+		return nil, err
+	}
+	sys := &windowsSystem{}
+	r, _, _ := procConvertInterfaceAliasToLuid.Call(uintptr(unsafe.Pointer(alias)), uintptr(unsafe.Pointer(&sys.luid)))
+	if r != 0 {
+		return nil, windows.Errno(r)
+	}
+	return sys, nil
+}
+
+func (sys *windowsSystem) row(prefix netaddr.IPPrefix) *mibIPforwardRow2 {
+	row := &mibIPforwardRow2{}
+	procInitializeIpForwardEntry.Call(uintptr(unsafe.Pointer(row)))
+	row.InterfaceLUID = sys.luid
+	row.PrefixLength = prefix.Bits
+	b := prefix.IP.As16()
+	if prefix.IP.Is4() {
+		/* SOCKADDR_IN: family, port, address */
+		row.DestinationPrefix.Family = windows.AF_INET
+		copy(row.DestinationPrefix.data[2:6], b[12:])
+		row.NextHop.Family = windows.AF_INET
+	} else {
+		/* SOCKADDR_IN6: family, port, flow info, address, scope */
+		row.DestinationPrefix.Family = windows.AF_INET6
+		copy(row.DestinationPrefix.data[6:22], b[:])
+		row.NextHop.Family = windows.AF_INET6
+	}
+	return row
+}
+
+func (sys *windowsSystem) add(prefix netaddr.IPPrefix) error {
+	r, _, _ := procCreateIpForwardEntry2.Call(uintptr(unsafe.Pointer(sys.row(prefix))))
+	if r != 0 && windows.Errno(r) != errorObjectAlreadyExists {
+		return windows.Errno(r)
+	}
+	return nil
+}
+
+func (sys *windowsSystem) del(prefix netaddr.IPPrefix) error {
+	r, _, _ := procDeleteIpForwardEntry2.Call(uintptr(unsafe.Pointer(sys.row(prefix))))
+	if r != 0 && windows.Errno(r) != errorNotFound {
+		return windows.Errno(r)
+	}
+	return nil
+}
+
+func (sys *windowsSystem) close() error {
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package watcher
+
+import (
+	"errors"
+)
+
+// newNotifier fails, so that the file is polled instead.
+func newNotifier(path string) (notifier, error) {
+	return nil, errors.New("file change notification not supported")
+}
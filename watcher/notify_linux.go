@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package watcher
+
+import (
+	"bytes"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/tailscale/wireguard-go/rwcancel"
+	"golang.org/x/sys/unix"
+)
+
+type inotifier struct {
+	fd     int
+	cancel *rwcancel.RWCancel
+	c      chan struct{}
+	done   chan struct{}
+}
+
+// newNotifier watches the directory containing path rather than path
+// itself, so that editors and tools that replace the file by renaming a
+// new one over it are noticed too.
+func newNotifier(path string) (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	_, err = unix.InotifyAddWatch(fd, filepath.Dir(path),
+		unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE|unix.IN_DELETE)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	cancel, err := rwcancel.NewRWCancel(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	n := &inotifier{
+		fd:     fd,
+		cancel: cancel,
+		c:      make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go n.run([]byte(filepath.Base(path)))
+	return n, nil
+}
+
+func (n *inotifier) run(name []byte) {
+	defer close(n.done)
+	var buf [4096]byte
+	for {
+		count, err := n.cancel.Read(buf[:])
+		if err != nil {
+			return
+		}
+		for event := buf[:count]; len(event) >= unix.SizeofInotifyEvent; {
+			hdr := (*unix.InotifyEvent)(unsafe.Pointer(&event[0]))
+			end := unix.SizeofInotifyEvent + int(hdr.Len)
+			if end > len(event) {
+				break
+			}
+			eventName := bytes.TrimRight(event[unix.SizeofInotifyEvent:end], "\x00")
+			event = event[end:]
+			if !bytes.Equal(eventName, name) {
+				continue
+			}
+			select {
+			case n.c <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (n *inotifier) events() <-chan struct{} { return n.c }
+
+func (n *inotifier) close() error {
+	err := n.cancel.Cancel()
+	<-n.done
+	unix.Close(n.fd)
+	return err
+}
@@ -0,0 +1,253 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package watcher keeps a device configured from a file, reapplying the
+// file whenever it changes.
+package watcher
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// Format is the syntax of a watched configuration file.
+type Format int
+
+const (
+	// FormatAuto treats files with an [Interface] section as wg-quick
+	// configuration and anything else as UAPI.
+	FormatAuto Format = iota
+	// FormatWgQuick is the wg-quick(8) configuration file syntax.
+	FormatWgQuick
+	// FormatUAPI is the key=value syntax written by wgcfg.Config.ToUAPI
+	// and device.IpcGetOperation.
+	FormatUAPI
+)
+
+const (
+	// DefaultPollInterval is how often the file is checked when the
+	// platform offers no change notification.
+	DefaultPollInterval = time.Second
+
+	// settleDelay lets a burst of writes to the file finish before it is
+	// read, so an editor's save is applied once.
+	settleDelay = 100 * time.Millisecond
+)
+
+var ErrClosed = errors.New("watcher: closed")
+
+// Reconfigurer is implemented by *device.Device.
+type Reconfigurer interface {
+	Reconfig(cfg *wgcfg.Config, opts ...device.ReconfigOption) error
+}
+
+// Options configures a Watcher.
+type Options struct {
+	Format Format
+
+	// PollInterval is used if the platform has no change notification.
+	// Zero means DefaultPollInterval.
+	PollInterval time.Duration
+
+	// OnApply, if non-nil, is called after every attempt to apply a
+	// changed file, with the parsed configuration (nil if parsing failed)
+	// and the parse, validation or Reconfig error, if any. A file that
+	// parses to the configuration already applied is not reapplied.
+	OnApply func(cfg *wgcfg.Config, err error)
+}
+
+// Watcher applies a configuration file to a device whenever it changes.
+type Watcher struct {
+	path string
+	dev  Reconfigurer
+	opts Options
+
+	mutex   sync.Mutex
+	applied *wgcfg.Config
+
+	stop    chan struct{}
+	stopped chan struct{}
+	notify  notifier
+}
+
+// notifier reports possible changes to a file.
+type notifier interface {
+	events() <-chan struct{}
+	close() error
+}
+
+// New applies the configuration file at path to dev and starts watching it
+// for changes. If the initial configuration cannot be applied, New returns
+// the error and watches nothing.
+func New(path string, dev Reconfigurer, opts Options) (*Watcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	w := &Watcher{
+		path:    path,
+		dev:     dev,
+		opts:    opts,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	w.notify, err = newNotifier(path)
+	if err != nil {
+		w.notify = newPoller(path, opts.PollInterval)
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Watcher) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.notify.events():
+		}
+
+		// Coalesce the rest of the burst.
+		timer := time.NewTimer(settleDelay)
+	Settle:
+		for {
+			select {
+			case <-w.stop:
+				timer.Stop()
+				return
+			case <-w.notify.events():
+			case <-timer.C:
+				break Settle
+			}
+		}
+		w.Reload()
+	}
+}
+
+// Reload reads and applies the file now, as if it had changed.
+func (w *Watcher) Reload() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	cfg, err := w.load()
+	if err == nil && w.applied != nil && reflect.DeepEqual(cfg, w.applied) {
+		return nil
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err == nil {
+		err = w.dev.Reconfig(cfg)
+	}
+	if err == nil {
+		w.applied = cfg
+	} else {
+		err = fmt.Errorf("watcher: %s: %w", w.path, err)
+	}
+	if w.opts.OnApply != nil {
+		w.opts.OnApply(cfg, err)
+	}
+	return err
+}
+
+func (w *Watcher) load() (*wgcfg.Config, error) {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	format := w.opts.Format
+	if format == FormatAuto {
+		format = FormatUAPI
+		if bytes.Contains(bytes.ToLower(data), []byte("[interface]")) {
+			format = FormatWgQuick
+		}
+	}
+	if format == FormatWgQuick {
+		name := strings.TrimSuffix(filepath.Base(w.path), filepath.Ext(w.path))
+		return wgcfg.FromWgQuick(bytes.NewReader(data), name)
+	}
+	return wgcfg.FromUAPI(bytes.NewReader(data))
+}
+
+// Close stops watching the file. The device keeps its last configuration.
+func (w *Watcher) Close() error {
+	select {
+	case <-w.stop:
+		return ErrClosed
+	default:
+	}
+	close(w.stop)
+	err := w.notify.close()
+	<-w.stopped
+	return err
+}
+
+// poller is the notifier used where the platform offers none: it reports
+// a change whenever the file's size or modification time changes.
+type poller struct {
+	c    chan struct{}
+	stop chan struct{}
+}
+
+func newPoller(path string, interval time.Duration) *poller {
+	p := &poller{
+		c:    make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	lastMod, lastSize := stat()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+			mod, size := stat()
+			if mod.Equal(lastMod) && size == lastSize {
+				continue
+			}
+			lastMod, lastSize = mod, size
+			select {
+			case p.c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return p
+}
+
+func (p *poller) events() <-chan struct{} { return p.c }
+
+func (p *poller) close() error {
+	close(p.stop)
+	return nil
+}
@@ -0,0 +1,162 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package watcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+type fakeDevice struct {
+	configs chan *wgcfg.Config
+}
+
+func (d *fakeDevice) Reconfig(cfg *wgcfg.Config, opts ...device.ReconfigOption) error {
+	d.configs <- cfg
+	return nil
+}
+
+func confWithPort(port int) string {
+	return fmt.Sprintf(`[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = %d
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.2/32
+`, port)
+}
+
+// replaceFile writes a new version of path the way editors do, by
+// renaming a temporary file over it.
+func replaceFile(t *testing.T, path, contents string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wg0.conf")
+	if err := ioutil.WriteFile(path, []byte(confWithPort(1000)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dev := &fakeDevice{configs: make(chan *wgcfg.Config, 10)}
+	errs := make(chan error, 10)
+	w, err := New(path, dev, Options{
+		PollInterval: 10 * time.Millisecond,
+		OnApply: func(cfg *wgcfg.Config, err error) {
+			if err != nil {
+				errs <- err
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	expectPort := func(port uint16) {
+		t.Helper()
+		select {
+		case cfg := <-dev.configs:
+			if cfg.ListenPort != port || cfg.Name != "wg0" {
+				t.Errorf("applied port %d name %q, want %d %q", cfg.ListenPort, cfg.Name, port, "wg0")
+			}
+		case err := <-errs:
+			t.Fatalf("unexpected error: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for port %d", port)
+		}
+	}
+	expectPort(1000)
+
+	replaceFile(t, path, confWithPort(2000))
+	expectPort(2000)
+
+	if err := ioutil.WriteFile(path, []byte(confWithPort(3000)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectPort(3000)
+
+	replaceFile(t, path, "[Interface]\nListenPort = 4000\n")
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "missing private key") {
+			t.Errorf("got error %v, want missing private key", err)
+		}
+	case cfg := <-dev.configs:
+		t.Fatalf("invalid config applied: %+v", cfg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for validation error")
+	}
+
+	// Going back to the configuration already applied changes nothing.
+	replaceFile(t, path, confWithPort(3000))
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cfg := <-dev.configs:
+		t.Errorf("unchanged config reapplied: %+v", cfg)
+	case err := <-errs:
+		t.Errorf("unexpected error: %v", err)
+	case <-time.After(3 * settleDelay):
+	}
+
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := w.Close(); err != ErrClosed {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestPoller(t *testing.T) {
+	f, err := ioutil.TempFile("", "wgpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	p := newPoller(f.Name(), 5*time.Millisecond)
+	defer p.close()
+
+	if err := ioutil.WriteFile(f.Name(), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.events():
+	case <-time.After(5 * time.Second):
+		t.Fatal("poller did not report change")
+	}
+}
+
+func TestNewFailsOnBadInitialConfig(t *testing.T) {
+	dev := &fakeDevice{configs: make(chan *wgcfg.Config, 1)}
+	if _, err := New(filepath.Join(os.TempDir(), "does-not-exist.conf"), dev, Options{}); err == nil {
+		t.Error("New succeeded for missing file")
+	}
+}
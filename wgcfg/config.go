@@ -7,6 +7,8 @@
 package wgcfg
 
 import (
+	"time"
+
 	"inet.af/netaddr"
 )
 
@@ -17,16 +19,68 @@ type Config struct {
 	PrivateKey PrivateKey
 	Addresses  []netaddr.IPPrefix
 	ListenPort uint16
+	FwMark     uint32
 	MTU        uint16
 	DNS        []netaddr.IP
 	Peers      []Peer
+
+	// Extensions holds the values of UAPI keys of the device that are
+	// neither standard nor known to this package, such as those of a
+	// device.UAPIExtension.
+	Extensions map[string]string
+
+	// The remaining fields come from wg-quick(8) configuration files.
+	// The device ignores them; they are carried for the layers that
+	// set up the interface around it.
+
+	DNSSearch  []string // search domains, from non-address DNS entries
+	Table      string   // routing table: "off", "auto" or a number; empty means auto
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
 }
 
 type Peer struct {
 	PublicKey           Key
 	AllowedIPs          []netaddr.IPPrefix
-	Endpoints           string // comma-separated host/port pairs: "1.2.3.4:56,[::]:80"
+	Endpoints           string // comma-separated host/port pairs, or transport URIs: "1.2.3.4:56,[::]:80,unix:///path"
 	PersistentKeepalive uint16
+
+	// Passive peers are never sent handshake initiations or keepalives;
+	// see device.Peer.SetPassive. This is a wireguard-go extension.
+	Passive bool
+
+	// Disabled peers keep their configuration but get no traffic, and
+	// their allowed IPs are not routed; see device.Peer.SetDisabled.
+	// This is a wireguard-go extension.
+	Disabled bool
+
+	// NotBefore and NotAfter, if non-zero, bound the time the peer is
+	// valid for; outside it the peer is treated as disabled. See
+	// device.Peer.SetValidity. This is a wireguard-go extension.
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// MTU, if non-zero, is the largest inner packet sent to the peer, if
+	// smaller than the interface's; see device.Peer.SetMTU. This is a
+	// wireguard-go extension.
+	MTU uint16
+
+	// LocalAddr, if non-empty, is the "host:port" of a socket of the
+	// peer's own to send from; see device.Peer.SetLocalAddr. This is a
+	// wireguard-go extension.
+	LocalAddr string
+
+	// HandshakeSources, if non-empty, are the only prefixes the peer's
+	// handshakes are accepted from; see device.Peer.SetHandshakeSources.
+	// This is a wireguard-go extension.
+	HandshakeSources []netaddr.IPPrefix
+
+	// Extensions holds the values of UAPI keys of the peer that are
+	// neither standard nor known to this package; see Config.Extensions.
+	Extensions map[string]string
 }
 
 // Copy makes a deep copy of Config.
@@ -39,6 +93,12 @@ func (cfg Config) Copy() Config {
 	if res.DNS != nil {
 		res.DNS = append([]netaddr.IP{}, res.DNS...)
 	}
+	for _, ss := range []*[]string{&res.DNSSearch, &res.PreUp, &res.PostUp, &res.PreDown, &res.PostDown} {
+		if *ss != nil {
+			*ss = append([]string{}, *ss...)
+		}
+	}
+	res.Extensions = copyExtensions(res.Extensions)
 	peers := make([]Peer, 0, len(res.Peers))
 	for _, peer := range res.Peers {
 		peers = append(peers, peer.Copy())
@@ -54,5 +114,20 @@ func (peer Peer) Copy() Peer {
 	if res.AllowedIPs != nil {
 		res.AllowedIPs = append([]netaddr.IPPrefix{}, res.AllowedIPs...)
 	}
+	if res.HandshakeSources != nil {
+		res.HandshakeSources = append([]netaddr.IPPrefix{}, res.HandshakeSources...)
+	}
+	res.Extensions = copyExtensions(res.Extensions)
+	return res
+}
+
+func copyExtensions(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
 	return res
 }
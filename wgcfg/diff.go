@@ -0,0 +1,244 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package wgcfg
+
+import (
+	"sort"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// ConfigDiff describes how one Config differs from another; see Diff.
+// Fields are named as in Config and Peer.
+type ConfigDiff struct {
+	// Fields names the interface fields, those of Config other than
+	// Peers, that differ.
+	Fields []string
+
+	// Added are the peers only in the new config, and Removed those only
+	// in the old one, each in the order of its config.
+	Added   []Key
+	Removed []Key
+
+	// Changed are the peers in both configs that differ, in the order
+	// of the new config.
+	Changed []PeerDiff
+}
+
+// PeerDiff describes how a peer differs between two configs.
+type PeerDiff struct {
+	PublicKey Key
+	Fields    []string // names of the Peer fields that differ
+}
+
+// Diff reports how new differs from old. A nil config is taken to be
+// empty. The order of the peers does not matter, nor does that of
+// their allowed IPs, handshake sources or endpoints, nor whether an
+// empty list is nil; the device treats them all alike.
+func Diff(old, new *Config) *ConfigDiff {
+	if old == nil {
+		old = &Config{}
+	}
+	if new == nil {
+		new = &Config{}
+	}
+	d := &ConfigDiff{Fields: diffInterface(old, new)}
+
+	oldPeers := make(map[Key]*Peer, len(old.Peers))
+	for i := range old.Peers {
+		oldPeers[old.Peers[i].PublicKey] = &old.Peers[i]
+	}
+	newPeers := make(map[Key]bool, len(new.Peers))
+	for i := range new.Peers {
+		p := &new.Peers[i]
+		newPeers[p.PublicKey] = true
+		op := oldPeers[p.PublicKey]
+		if op == nil {
+			d.Added = append(d.Added, p.PublicKey)
+			continue
+		}
+		if fields := diffPeer(op, p); len(fields) > 0 {
+			d.Changed = append(d.Changed, PeerDiff{PublicKey: p.PublicKey, Fields: fields})
+		}
+	}
+	for _, p := range old.Peers {
+		if !newPeers[p.PublicKey] {
+			d.Removed = append(d.Removed, p.PublicKey)
+		}
+	}
+	return d
+}
+
+func diffInterface(old, new *Config) []string {
+	var fields []string
+	add := func(field string, differ bool) {
+		if differ {
+			fields = append(fields, field)
+		}
+	}
+	add("Name", old.Name != new.Name)
+	add("PrivateKey", !old.PrivateKey.Equal(new.PrivateKey))
+	add("Addresses", !prefixesEqual(old.Addresses, new.Addresses))
+	add("ListenPort", old.ListenPort != new.ListenPort)
+	add("FwMark", old.FwMark != new.FwMark)
+	add("MTU", old.MTU != new.MTU)
+	add("DNS", !ipsEqual(old.DNS, new.DNS))
+	add("Extensions", !extensionsEqual(old.Extensions, new.Extensions))
+	add("DNSSearch", !stringsEqual(old.DNSSearch, new.DNSSearch))
+	add("Table", old.Table != new.Table)
+	add("PreUp", !stringsEqual(old.PreUp, new.PreUp))
+	add("PostUp", !stringsEqual(old.PostUp, new.PostUp))
+	add("PreDown", !stringsEqual(old.PreDown, new.PreDown))
+	add("PostDown", !stringsEqual(old.PostDown, new.PostDown))
+	add("SaveConfig", old.SaveConfig != new.SaveConfig)
+	return fields
+}
+
+func diffPeer(old, new *Peer) []string {
+	var fields []string
+	add := func(field string, differ bool) {
+		if differ {
+			fields = append(fields, field)
+		}
+	}
+	add("AllowedIPs", !prefixSetsEqual(old.AllowedIPs, new.AllowedIPs))
+	add("Endpoints", !endpointsEqual(old.Endpoints, new.Endpoints))
+	add("PersistentKeepalive", old.PersistentKeepalive != new.PersistentKeepalive)
+	add("Passive", old.Passive != new.Passive)
+	add("Disabled", old.Disabled != new.Disabled)
+	add("NotBefore", !old.NotBefore.Equal(new.NotBefore))
+	add("NotAfter", !old.NotAfter.Equal(new.NotAfter))
+	add("MTU", old.MTU != new.MTU)
+	add("LocalAddr", old.LocalAddr != new.LocalAddr)
+	add("HandshakeSources", !prefixSetsEqual(old.HandshakeSources, new.HandshakeSources))
+	add("Extensions", !extensionsEqual(old.Extensions, new.Extensions))
+	return fields
+}
+
+// Empty reports whether d records no differences.
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Fields) == 0 && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String summarizes d in one line for logs, with keys shortened as by
+// Key.ShortString.
+func (d *ConfigDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var parts []string
+	if len(d.Fields) > 0 {
+		parts = append(parts, "interface: "+strings.Join(d.Fields, ","))
+	}
+	keys := func(ks []Key) string {
+		s := make([]string, len(ks))
+		for i, k := range ks {
+			s[i] = k.ShortString()
+		}
+		return strings.Join(s, " ")
+	}
+	if len(d.Added) > 0 {
+		parts = append(parts, "added: "+keys(d.Added))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, "removed: "+keys(d.Removed))
+	}
+	if len(d.Changed) > 0 {
+		s := make([]string, len(d.Changed))
+		for i, pd := range d.Changed {
+			s[i] = pd.PublicKey.ShortString() + " (" + strings.Join(pd.Fields, ",") + ")"
+		}
+		parts = append(parts, "changed: "+strings.Join(s, " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func prefixesEqual(x, y []netaddr.IPPrefix) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixSetsEqual reports whether x and y hold the same prefixes, in
+// any order.
+func prefixSetsEqual(x, y []netaddr.IPPrefix) bool {
+	if prefixesEqual(x, y) {
+		return true
+	}
+	if len(x) != len(y) {
+		return false
+	}
+	m := make(map[netaddr.IPPrefix]int, len(x))
+	for _, p := range x {
+		m[p]++
+	}
+	for _, p := range y {
+		if m[p] == 0 {
+			return false
+		}
+		m[p]--
+	}
+	return true
+}
+
+func ipsEqual(x, y []netaddr.IP) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func stringsEqual(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// endpointsEqual reports whether x and y list the same endpoints, in
+// any order.
+func endpointsEqual(x, y string) bool {
+	if x == y {
+		return true
+	}
+	xs := strings.Split(x, ",")
+	ys := strings.Split(y, ",")
+	if len(xs) != len(ys) {
+		return false
+	}
+	sort.Strings(xs)
+	sort.Strings(ys)
+	return stringsEqual(xs, ys)
+}
+
+func extensionsEqual(x, y map[string]string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for k, v := range x {
+		if w, ok := y[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package wgcfg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestDiff(t *testing.T) {
+	priv, _ := NewPrivateKey()
+	other1, _ := NewPrivateKey()
+	other2, _ := NewPrivateKey()
+	other3, _ := NewPrivateKey()
+	pub1, pub2, pub3 := other1.Public(), other2.Public(), other3.Public()
+	prefixes := func(ss ...string) []netaddr.IPPrefix {
+		var res []netaddr.IPPrefix
+		for _, s := range ss {
+			res = append(res, netaddr.MustParseIPPrefix(s))
+		}
+		return res
+	}
+
+	old := &Config{
+		PrivateKey: priv,
+		ListenPort: 51820,
+		Peers: []Peer{
+			{PublicKey: pub1, AllowedIPs: prefixes("10.0.0.1/32", "10.1.0.0/16"), Endpoints: "1.2.3.4:5,[::1]:6"},
+			{PublicKey: pub2, AllowedIPs: prefixes("10.0.0.2/32")},
+		},
+	}
+	same := old.Copy()
+	same.Peers[0].AllowedIPs = prefixes("10.1.0.0/16", "10.0.0.1/32")
+	same.Peers[0].Endpoints = "[::1]:6,1.2.3.4:5"
+	same.Peers[0], same.Peers[1] = same.Peers[1], same.Peers[0]
+	same.Extensions = map[string]string{}
+	if d := Diff(old, &same); !d.Empty() {
+		t.Errorf("reordered config differs: %v", d)
+	}
+
+	new := old.Copy()
+	new.ListenPort = 0
+	new.MTU = 1280
+	new.Peers[0].Endpoints = "1.2.3.4:5"
+	new.Peers[0].NotAfter = time.Unix(2e9, 0)
+	new.Peers[1] = Peer{PublicKey: pub3}
+	d := Diff(old, &new)
+	want := &ConfigDiff{
+		Fields:  []string{"ListenPort", "MTU"},
+		Added:   []Key{pub3},
+		Removed: []Key{pub2},
+		Changed: []PeerDiff{{PublicKey: pub1, Fields: []string{"Endpoints", "NotAfter"}}},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("diff %+v, want %+v", d, want)
+	}
+	s := d.String()
+	for _, part := range []string{"interface: ListenPort,MTU", "added: " + pub3.ShortString(), "(Endpoints,NotAfter)"} {
+		if !strings.Contains(s, part) {
+			t.Errorf("%q lacks %q", s, part)
+		}
+	}
+
+	d = Diff(nil, old)
+	if len(d.Added) != 2 || len(d.Removed) != 0 || !reflect.DeepEqual(d.Fields, []string{"PrivateKey", "ListenPort"}) {
+		t.Errorf("diff from nil %+v", d)
+	}
+}
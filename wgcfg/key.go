@@ -30,16 +30,18 @@ func NewPresharedKey() (*Key, error) {
 	return (*Key)(&k), nil
 }
 
+// ParseKey parses a base64-encoded public key, as written by wg pubkey.
 func ParseKey(b64 string) (*Key, error) { return parseKeyBase64(base64.StdEncoding, b64) }
 
+// ParseHexKey parses a hex-encoded key, as used by the UAPI.
 func ParseHexKey(s string) (Key, error) {
+	if len(s) != hex.EncodedLen(KeySize) {
+		return Key{}, &ParseError{fmt.Sprintf("invalid hex key length: %d", len(s)), s}
+	}
 	b, err := hex.DecodeString(s)
 	if err != nil {
 		return Key{}, &ParseError{"invalid hex key: " + err.Error(), s}
 	}
-	if len(b) != KeySize {
-		return Key{}, &ParseError{fmt.Sprintf("invalid hex key length: %d", len(b)), s}
-	}
 
 	var key Key
 	copy(key[:], b)
@@ -127,16 +129,27 @@ func NewPrivateKey() (PrivateKey, error) {
 	if err != nil {
 		return PrivateKey{}, err
 	}
-	k[0] &= 248
-	k[31] = (k[31] & 127) | 64
-	return (PrivateKey)(*k), nil
+	pk := PrivateKey(*k)
+	pk.clamp()
+	return pk, nil
 }
 
+// ParsePrivateKey parses a base64-encoded private key, as written by
+// wg genkey. Like ParsePrivateHexKey, it clamps non-zero keys, so a key
+// compares equal to itself however it was encoded.
 func ParsePrivateKey(b64 string) (*PrivateKey, error) {
 	k, err := parseKeyBase64(base64.StdEncoding, b64)
-	return (*PrivateKey)(k), err
+	if err != nil {
+		return nil, err
+	}
+	pk := (*PrivateKey)(k)
+	if !pk.IsZero() {
+		pk.clamp()
+	}
+	return pk, nil
 }
 
+func (k PrivateKey) Base64() string            { return base64.StdEncoding.EncodeToString(k[:]) }
 func (k *PrivateKey) String() string           { return base64.StdEncoding.EncodeToString(k[:]) }
 func (k *PrivateKey) HexString() string        { return hex.EncodeToString(k[:]) }
 func (k *PrivateKey) Equal(k2 PrivateKey) bool { return subtle.ConstantTimeCompare(k[:], k2[:]) == 1 }
@@ -190,7 +203,14 @@ func (k PrivateKey) SharedSecret(pub Key) (ss [KeySize]byte) {
 }
 
 func parseKeyBase64(enc *base64.Encoding, s string) (*Key, error) {
-	k, err := enc.DecodeString(s)
+	// Check the length first, so that a huge string costs nothing to
+	// reject. The decoder would skip embedded newlines, and accept
+	// non-zero padding bits unless strict, letting several strings
+	// stand for the same key.
+	if len(s) != enc.EncodedLen(KeySize) {
+		return nil, &ParseError{"Keys must decode to exactly 32 bytes", s}
+	}
+	k, err := enc.Strict().DecodeString(s)
 	if err != nil {
 		return nil, &ParseError{"Invalid key: " + err.Error(), s}
 	}
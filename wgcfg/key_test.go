@@ -2,6 +2,8 @@ package wgcfg
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"testing"
 )
 
@@ -105,3 +107,57 @@ func TestPrivateKeyBasics(t *testing.T) {
 		}
 	})
 }
+
+func TestPrivateKeyEncodings(t *testing.T) {
+	// An unclamped key parses to the same clamped key from either encoding.
+	var raw [KeySize]byte
+	for i := range raw {
+		raw[i] = 0xff
+	}
+	fromB64, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(raw[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromHex, err := ParsePrivateHexKey(hex.EncodeToString(raw[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromB64.Equal(fromHex) {
+		t.Errorf("base64 key %x != hex key %x", fromB64[:], fromHex[:])
+	}
+	if fromB64[0] != 248 || fromB64[31] != 127 {
+		t.Errorf("key not clamped: %x", fromB64[:])
+	}
+
+	pri, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pri2, err := ParsePrivateKey(pri.Base64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pri.Equal(*pri2) || !pri.Public().Equal(pri2.Public()) {
+		t.Error("base64 round trip changed the key")
+	}
+	pub, err := ParseKey(pri.Public().Base64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubHex, err := ParseHexKey(pri.Public().HexString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(pubHex) {
+		t.Error("base64 and hex public keys differ")
+	}
+
+	// The zero key stays zero, so IsZero still works.
+	zero, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(make([]byte, KeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !zero.IsZero() {
+		t.Error("zero key was clamped")
+	}
+}
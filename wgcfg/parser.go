@@ -7,12 +7,12 @@ package wgcfg
 
 import (
 	"bufio"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"inet.af/netaddr"
 )
@@ -29,14 +29,59 @@ func (e *ParseError) Error() string {
 func validateEndpoints(s string) error {
 	vals := strings.Split(s, ",")
 	for _, val := range vals {
-		_, _, err := parseEndpoint(val)
-		if err != nil {
-			return err
+		scheme, rest, ok := splitScheme(val)
+		switch {
+		case !ok || scheme == "udp":
+			_, _, err := parseEndpoint(rest)
+			if err != nil {
+				return err
+			}
+		case scheme == "unix":
+			if !strings.HasPrefix(rest, "/") {
+				return &ParseError{"Unix endpoint must have an absolute path", val}
+			}
+		case rest == "":
+			return &ParseError{"Missing address from endpoint", val}
 		}
 	}
 	return nil
 }
 
+// splitScheme splits an endpoint into its scheme, as in
+// "tcp://192.0.2.1:443", and the rest, reporting whether it has one. A
+// scheme other than "udp" names another transport; see
+// conn.RegisterEndpointScheme.
+func splitScheme(s string) (scheme, rest string, ok bool) {
+	i := strings.Index(s, "://")
+	if i < 1 {
+		return "", s, false
+	}
+	for j, c := range s[:i] {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case j > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return "", s, false
+		}
+	}
+	return strings.ToLower(s[:i]), s[i+len("://"):], true
+}
+
+// trimUDPScheme removes the scheme from the "udp://" endpoints in s,
+// the comma-separated endpoints of a peer, as UDP is the default.
+func trimUDPScheme(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	vals := strings.Split(s, ",")
+	for i, val := range vals {
+		if scheme, rest, ok := splitScheme(val); ok && scheme == "udp" {
+			vals[i] = rest
+		}
+	}
+	return strings.Join(vals, ",")
+}
+
 func parseEndpoint(s string) (host string, port uint16, err error) {
 	i := strings.LastIndexByte(s, ':')
 	if i < 0 {
@@ -54,10 +99,14 @@ func parseEndpoint(s string) (host string, port uint16, err error) {
 	if host[0] == '[' || host[len(host)-1] == ']' || hostColon > 0 {
 		err := &ParseError{"Brackets must contain an IPv6 address", host}
 		if len(host) > 3 && host[0] == '[' && host[len(host)-1] == ']' && hostColon > 0 {
-			maybeV6 := net.ParseIP(host[1 : len(host)-1])
+			addr, zone, hasZone := splitZone(host[1 : len(host)-1])
+			maybeV6 := net.ParseIP(addr)
 			if maybeV6 == nil || len(maybeV6) != net.IPv6len {
 				return "", 0, err
 			}
+			if hasZone && zone == "" {
+				return "", 0, &ParseError{"Empty IPv6 zone", host}
+			}
 		} else {
 			return "", 0, err
 		}
@@ -66,16 +115,21 @@ func parseEndpoint(s string) (host string, port uint16, err error) {
 	return host, uint16(uport), nil
 }
 
+// splitZone splits the zone, if any, off an IPv6 address, as in
+// "fe80::1%eth0", reporting whether there was one.
+func splitZone(s string) (addr, zone string, ok bool) {
+	i := strings.LastIndexByte(s, '%')
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
 func parseKeyHex(s string) (*Key, error) {
-	k, err := hex.DecodeString(s)
+	key, err := ParseHexKey(s)
 	if err != nil {
-		return nil, &ParseError{"Invalid key: " + err.Error(), s}
-	}
-	if len(k) != KeySize {
-		return nil, &ParseError{"Keys must decode to exactly 32 bytes", s}
+		return nil, err
 	}
-	var key Key
-	copy(key[:], k)
 	return &key, nil
 }
 
@@ -108,7 +162,7 @@ func FromUAPI(r io.Reader) (*Config, error) {
 			var err error
 			peer, err = cfg.handlePublicKeyLine(value)
 			if err != nil {
-				return nil, err
+				return nil, uapiError(len(cfg.Peers), key, err)
 			}
 			continue
 		}
@@ -120,7 +174,7 @@ func FromUAPI(r io.Reader) (*Config, error) {
 			err = cfg.handlePeerLine(peer, key, value)
 		}
 		if err != nil {
-			return nil, err
+			return nil, uapiError(len(cfg.Peers)-1, key, err)
 		}
 	}
 
@@ -147,9 +201,15 @@ func (cfg *Config) handleDeviceLine(key, value string) error {
 		}
 		cfg.ListenPort = uint16(port)
 	case "fwmark":
-		// ignore
+		mark, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("failed to parse fwmark: %w", err)
+		}
+		cfg.FwMark = uint32(mark)
+	case "uapi_version", "extension", "peer_extension":
+		// capabilities, asked for by other clients
 	default:
-		return fmt.Errorf("unexpected IpcGetOperation key: %v", key)
+		cfg.Extensions = setExtension(cfg.Extensions, key, value)
 	}
 	return nil
 }
@@ -172,7 +232,7 @@ func (cfg *Config) handlePeerLine(peer *Peer, key, value string) error {
 		if err != nil {
 			return err
 		}
-		peer.Endpoints = value
+		peer.Endpoints = trimUDPScheme(value)
 	case "persistent_keepalive_interval":
 		n, err := strconv.ParseUint(value, 10, 16)
 		if err != nil {
@@ -185,6 +245,55 @@ func (cfg *Config) handlePeerLine(peer *Peer, key, value string) error {
 			return err
 		}
 		peer.AllowedIPs = append(peer.AllowedIPs, ipp)
+	case "passive":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		peer.Passive = b
+	case "disabled":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		peer.Disabled = b
+	case "not_before", "not_after":
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		var t time.Time
+		if secs != 0 {
+			t = time.Unix(secs, 0)
+		}
+		if key == "not_before" {
+			peer.NotBefore = t
+		} else {
+			peer.NotAfter = t
+		}
+	case "mtu":
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		peer.MTU = uint16(n)
+	case "local_addr":
+		if err := validateLocalAddr(value); err != nil {
+			return err
+		}
+		peer.LocalAddr = value
+	case "handshake_sources":
+		peer.HandshakeSources = nil
+		if value == "" {
+			break
+		}
+		for _, s := range strings.Split(value, ",") {
+			ipp, err := netaddr.ParseIPPrefix(s)
+			if err != nil {
+				return err
+			}
+			peer.HandshakeSources = append(peer.HandshakeSources, ipp)
+		}
 	case "protocol_version":
 		if value != "1" {
 			return fmt.Errorf("invalid protocol version: %v", value)
@@ -192,7 +301,17 @@ func (cfg *Config) handlePeerLine(peer *Peer, key, value string) error {
 	case "preshared_key", "last_handshake_time_sec", "last_handshake_time_nsec", "tx_bytes", "rx_bytes":
 		// ignore
 	default:
-		return fmt.Errorf("unexpected IpcGetOperation key: %v", key)
+		peer.Extensions = setExtension(peer.Extensions, key, value)
 	}
 	return nil
 }
+
+// setExtension records the value of a key this package does not know,
+// which the device only reports for an extension.
+func setExtension(m map[string]string, key, value string) map[string]string {
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[key] = value
+	return m
+}
@@ -8,6 +8,7 @@ package wgcfg
 import (
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -49,8 +50,57 @@ func TestParseEndpoint(t *testing.T) {
 		equal(t, "2607:5300:60:6b0::c05f:543", host)
 		equal(t, uint16(2468), port)
 	}
+	host, port, err = parseEndpoint("[fe80::1%eth0]:51820")
+	if noError(t, err) {
+		equal(t, "fe80::1%eth0", host)
+		equal(t, uint16(51820), port)
+	}
+	_, _, err = parseEndpoint("[fe80::1%]:51820")
+	if err == nil {
+		t.Error("Error was expected")
+	}
 	_, _, err = parseEndpoint("[::::::invalid:18981")
 	if err == nil {
 		t.Error("Error was expected")
 	}
 }
+
+func TestTrimUDPScheme(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"192.0.2.1:51820", "192.0.2.1:51820"},
+		{"udp://192.0.2.1:51820,UDP://[::1]:51820", "192.0.2.1:51820,[::1]:51820"},
+		{"udp://192.0.2.1:51820,unix:///run/wg.sock", "192.0.2.1:51820,unix:///run/wg.sock"},
+	}
+	for _, tt := range tests {
+		equal(t, tt.want, trimUDPScheme(tt.in))
+	}
+}
+
+func TestUAPIExtensions(t *testing.T) {
+	const uapi = `uapi_version=1
+extension=log_level
+peer_extension=passive
+private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+rate_limit=100
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+tag=office
+persistent_keepalive_interval=0
+`
+	cfg, err := FromUAPI(strings.NewReader(uapi))
+	if !noError(t, err) {
+		return
+	}
+	equal(t, map[string]string{"rate_limit": "100"}, cfg.Extensions)
+	equal(t, map[string]string{"tag": "office"}, cfg.Peers[0].Extensions)
+
+	out, err := cfg.ToUAPI()
+	if !noError(t, err) {
+		return
+	}
+	for _, line := range []string{"rate_limit=100\n", "tag=office\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("ToUAPI output lacks %q:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package wgcfg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"inet.af/netaddr"
+)
+
+// ValidationError identifies the field of a Config that is invalid.
+type ValidationError struct {
+	// Peer is the index into Config.Peers of the peer at fault,
+	// or -1 if the fault is in the interface fields.
+	Peer int
+	// Field is the name of the Config or Peer field at fault.
+	Field string
+	// Err describes the fault.
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Peer < 0 {
+		return fmt.Sprintf("%s: %v", e.Field, e.Err)
+	}
+	return fmt.Sprintf("peer %d: %s: %v", e.Peer, e.Field, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// minPeerMTU is device.MinPeerMTU.
+const minPeerMTU = 576
+
+// uapiFields maps UAPI keys to the Config and Peer fields they set.
+var uapiFields = map[string]string{
+	"private_key":                   "PrivateKey",
+	"listen_port":                   "ListenPort",
+	"fwmark":                        "FwMark",
+	"public_key":                    "PublicKey",
+	"endpoint":                      "Endpoints",
+	"persistent_keepalive_interval": "PersistentKeepalive",
+	"allowed_ip":                    "AllowedIPs",
+	"passive":                       "Passive",
+	"disabled":                      "Disabled",
+	"not_before":                    "NotBefore",
+	"not_after":                     "NotAfter",
+	"mtu":                           "MTU",
+	"local_addr":                    "LocalAddr",
+	"handshake_sources":             "HandshakeSources",
+}
+
+// uapiError attributes err, from parsing the UAPI key, to its field.
+func uapiError(peer int, key string, err error) error {
+	field, ok := uapiFields[key]
+	if !ok {
+		return err
+	}
+	return &ValidationError{Peer: peer, Field: field, Err: err}
+}
+
+func validPrefix(p netaddr.IPPrefix) bool {
+	if p.IP.Is4() {
+		return p.Bits <= 32
+	}
+	return p.IP.Is6() && p.Bits <= 128
+}
+
+// Validate checks that cfg could be applied to a device: it has a
+// private key, every peer has a distinct public key other than the
+// interface's own, endpoints are well-formed, and no prefix is allowed
+// for more than one peer. It returns the first fault found, as a
+// *ValidationError. device.Reconfig makes the same checks, relaxed as
+// its DeviceOptions require; see ValidateWith.
+func (cfg *Config) Validate() error {
+	return cfg.ValidateWith(ValidateOptions{})
+}
+
+// ValidateOptions relax the checks of Config.ValidateWith.
+type ValidateOptions struct {
+	// NoPrivateKey accepts a config without a private key, as for a
+	// device that is not given one yet.
+	NoPrivateKey bool
+
+	// AnyEndpoints accepts endpoints of any form, for a device whose
+	// DeviceOptions.CreateEndpoint parses its own.
+	AnyEndpoints bool
+
+	// SharedPrefixes accepts a prefix allowed for more than one peer. A
+	// device routes it to only one of them.
+	SharedPrefixes bool
+}
+
+// ValidateWith is Validate with the checks opts relaxes left out.
+// device.Reconfig validates its configurations with it.
+func (cfg *Config) ValidateWith(opts ValidateOptions) error {
+	if cfg.PrivateKey.IsZero() && !opts.NoPrivateKey {
+		return &ValidationError{Peer: -1, Field: "PrivateKey", Err: errors.New("missing private key")}
+	}
+	for _, addr := range cfg.Addresses {
+		if !validPrefix(addr) {
+			return &ValidationError{Peer: -1, Field: "Addresses", Err: fmt.Errorf("invalid address %s", addr)}
+		}
+	}
+
+	var self Key
+	if !cfg.PrivateKey.IsZero() {
+		self = cfg.PrivateKey.Public()
+	}
+	keys := make(map[Key]int, len(cfg.Peers))
+	owners := make(map[netaddr.IPPrefix]int)
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		fail := func(field string, format string, args ...interface{}) error {
+			return &ValidationError{Peer: i, Field: field, Err: fmt.Errorf(format, args...)}
+		}
+
+		if peer.PublicKey.IsZero() {
+			return fail("PublicKey", "missing public key")
+		}
+		if !self.IsZero() && peer.PublicKey.Equal(self) {
+			return fail("PublicKey", "peer has the interface's own public key")
+		}
+		if j, ok := keys[peer.PublicKey]; ok {
+			return fail("PublicKey", "duplicate of peer %d", j)
+		}
+		keys[peer.PublicKey] = i
+
+		if peer.Endpoints != "" && !opts.AnyEndpoints {
+			if err := validateEndpoints(peer.Endpoints); err != nil {
+				return &ValidationError{Peer: i, Field: "Endpoints", Err: err}
+			}
+		}
+
+		if peer.MTU != 0 && peer.MTU < minPeerMTU {
+			return fail("MTU", "%d below the minimum of %d", peer.MTU, minPeerMTU)
+		}
+
+		if peer.LocalAddr != "" {
+			if err := validateLocalAddr(peer.LocalAddr); err != nil {
+				return &ValidationError{Peer: i, Field: "LocalAddr", Err: err}
+			}
+		}
+
+		for _, source := range peer.HandshakeSources {
+			if !validPrefix(source) {
+				return fail("HandshakeSources", "invalid prefix %s", source)
+			}
+		}
+
+		for _, allowedIP := range peer.AllowedIPs {
+			if !validPrefix(allowedIP) {
+				return fail("AllowedIPs", "invalid prefix %s", allowedIP)
+			}
+			prefix := allowedIP.Masked()
+			if j, ok := owners[prefix]; ok && j != i && !opts.SharedPrefixes {
+				return fail("AllowedIPs", "%s is also allowed for peer %d", prefix, j)
+			}
+			owners[prefix] = i
+		}
+	}
+	return nil
+}
+
+// validateLocalAddr checks that s is an IP address, or nothing, and a
+// port, as Peer.LocalAddr must be.
+func validateLocalAddr(s string) error {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid local address %q", host)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid local port %q", port)
+	}
+	return nil
+}
+
+// Canonicalize rewrites each peer's allowed IPs in canonical form, with
+// the host bits cleared, and drops those repeated for the same peer.
+// Interface addresses keep their host bits, which are significant.
+func (cfg *Config) Canonicalize() {
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		seen := make(map[netaddr.IPPrefix]bool, len(peer.AllowedIPs))
+		allowed := peer.AllowedIPs[:0]
+		for _, allowedIP := range peer.AllowedIPs {
+			prefix := allowedIP.Masked()
+			if seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			allowed = append(allowed, prefix)
+		}
+		peer.AllowedIPs = allowed
+	}
+}
@@ -0,0 +1,155 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package wgcfg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestValidate(t *testing.T) {
+	priv, _ := NewPrivateKey()
+	other1, _ := NewPrivateKey()
+	other2, _ := NewPrivateKey()
+	pub1, pub2 := other1.Public(), other2.Public()
+	peer := func(pub Key, prefix string) Peer {
+		return Peer{PublicKey: pub, AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(prefix)}}
+	}
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		peer  int
+		field string
+	}{
+		{"ok", Config{PrivateKey: priv, Peers: []Peer{peer(pub1, "10.0.0.1/32"), peer(pub2, "10.0.0.0/24")}}, 0, ""},
+		{"no private key", Config{}, -1, "PrivateKey"},
+		{"own key", Config{PrivateKey: priv, Peers: []Peer{peer(priv.Public(), "10.0.0.1/32")}}, 0, "PublicKey"},
+		{"no public key", Config{PrivateKey: priv, Peers: []Peer{peer(pub1, "10.0.0.1/32"), {}}}, 1, "PublicKey"},
+		{"duplicate peer", Config{PrivateKey: priv, Peers: []Peer{peer(pub1, "10.0.0.1/32"), peer(pub1, "10.0.0.2/32")}}, 1, "PublicKey"},
+		{"shared prefix", Config{PrivateKey: priv, Peers: []Peer{peer(pub1, "10.0.0.1/24"), peer(pub2, "10.0.0.0/24")}}, 1, "AllowedIPs"},
+		{"bad endpoint", Config{PrivateKey: priv, Peers: []Peer{{PublicKey: pub1, Endpoints: "1.2.3.4"}}}, 0, "Endpoints"},
+		{"transport endpoints", Config{PrivateKey: priv, Peers: []Peer{{PublicKey: pub1, Endpoints: "tcp://192.0.2.1:443,unix:///run/wg.sock"}}}, 0, ""},
+		{"bad allowed IP", Config{PrivateKey: priv, Peers: []Peer{{PublicKey: pub1, AllowedIPs: []netaddr.IPPrefix{{}}}}}, 0, "AllowedIPs"},
+		{"bad local addr", Config{PrivateKey: priv, Peers: []Peer{{PublicKey: pub1, LocalAddr: "eth0:51820"}}}, 0, "LocalAddr"},
+		{"bad handshake source", Config{PrivateKey: priv, Peers: []Peer{{PublicKey: pub1, HandshakeSources: []netaddr.IPPrefix{{}}}}}, 0, "HandshakeSources"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Errorf("%s: got %v, want a ValidationError", tt.name, err)
+			continue
+		}
+		if verr.Peer != tt.peer || verr.Field != tt.field {
+			t.Errorf("%s: fault in peer %d field %s, want peer %d field %s", tt.name, verr.Peer, verr.Field, tt.peer, tt.field)
+		}
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	cfg := Config{Peers: []Peer{{AllowedIPs: []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.1/24"),
+		netaddr.MustParseIPPrefix("10.0.0.0/24"),
+		netaddr.MustParseIPPrefix("fd00::1/128"),
+	}}}}
+	cfg.Canonicalize()
+	equal(t, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.0/24"),
+		netaddr.MustParseIPPrefix("fd00::1/128"),
+	}, cfg.Peers[0].AllowedIPs)
+}
+
+func TestFromUAPIErrors(t *testing.T) {
+	const pub = "public_key=" + "0011223344556677889900112233445566778899001122334455667788990011" + "\n"
+	tests := []struct {
+		uapi  string
+		peer  int
+		field string
+	}{
+		{"listen_port=x\n", -1, "ListenPort"},
+		{"private_key=00\n", -1, "PrivateKey"},
+		{pub + "public_key=zz\n", 1, "PublicKey"},
+		{pub + pub + "allowed_ip=10.0.0.0\n", 1, "AllowedIPs"},
+		{pub + "endpoint=[::1\n", 0, "Endpoints"},
+		{pub + "endpoint=unix://relative.sock\n", 0, "Endpoints"},
+		{pub + "endpoint=tcp://\n", 0, "Endpoints"},
+		{pub + "endpoint=udp://x\n", 0, "Endpoints"},
+		{pub + "mtu=x\n", 0, "MTU"},
+		{pub + "local_addr=10.0.0.1\n", 0, "LocalAddr"},
+		{pub + "handshake_sources=192.0.2.0/24,10.0.0.1\n", 0, "HandshakeSources"},
+	}
+	for _, tt := range tests {
+		_, err := FromUAPI(strings.NewReader(tt.uapi))
+		var verr *ValidationError
+		if !errors.As(err, &verr) || verr.Peer != tt.peer || verr.Field != tt.field {
+			t.Errorf("FromUAPI(%q) = %v, want fault in peer %d field %s", tt.uapi, err, tt.peer, tt.field)
+		}
+	}
+}
+
+func TestParseKeyStrict(t *testing.T) {
+	const valid = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	if _, err := ParseKey(valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dh=", // non-zero padding bits
+		"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8D\ng=",
+		valid + valid,
+		"",
+	} {
+		if _, err := ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", s)
+		}
+	}
+	if _, err := ParseHexKey(strings.Repeat("0", 66)); err == nil {
+		t.Error("ParseHexKey accepted 33 bytes")
+	}
+}
+
+func TestValidateWith(t *testing.T) {
+	priv, _ := NewPrivateKey()
+	other1, _ := NewPrivateKey()
+	other2, _ := NewPrivateKey()
+	prefix := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/24")}
+	cfg := Config{Peers: []Peer{
+		{PublicKey: other1.Public(), AllowedIPs: prefix, Endpoints: "peer1"},
+		{PublicKey: other2.Public(), AllowedIPs: prefix},
+	}}
+
+	all := ValidateOptions{NoPrivateKey: true, AnyEndpoints: true, SharedPrefixes: true}
+	if err := cfg.ValidateWith(all); err != nil {
+		t.Fatalf("relaxed validation failed: %v", err)
+	}
+	for field, opts := range map[string]ValidateOptions{
+		"PrivateKey": {AnyEndpoints: true, SharedPrefixes: true},
+		"Endpoints":  {NoPrivateKey: true, SharedPrefixes: true},
+		"AllowedIPs": {NoPrivateKey: true, AnyEndpoints: true},
+	} {
+		var verr *ValidationError
+		if err := cfg.ValidateWith(opts); !errors.As(err, &verr) || verr.Field != field {
+			t.Errorf("without relaxing %s: got %v", field, err)
+		}
+	}
+
+	// Given a private key, a peer with the interface's own public key is
+	// refused whatever the options.
+	cfg.PrivateKey = priv
+	cfg.Peers[0].PublicKey = priv.Public()
+	if err := cfg.ValidateWith(all); err == nil {
+		t.Error("peer with the interface's own key accepted")
+	}
+}
@@ -0,0 +1,298 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package wgcfg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// FromWgQuick parses a wg-quick(8) configuration file, such as
+// /etc/wireguard/wg0.conf, for the interface called name.
+func FromWgQuick(r io.Reader, name string) (*Config, error) {
+	cfg := &Config{Name: name}
+	var peer *Peer
+	inInterface := false
+	sawInterface := false
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		switch strings.ToLower(line) {
+		case "[interface]":
+			if sawInterface {
+				return nil, fmt.Errorf("line %d: %w", lineNo, &ParseError{"Duplicate section", line})
+			}
+			inInterface, sawInterface = true, true
+			peer = nil
+			continue
+		case "[peer]":
+			inInterface = false
+			cfg.Peers = append(cfg.Peers, Peer{})
+			peer = &cfg.Peers[len(cfg.Peers)-1]
+			continue
+		}
+
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 {
+			return nil, fmt.Errorf("line %d: %w", lineNo, &ParseError{"Config key is missing an equals separator", line})
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:equals]))
+		value := strings.TrimSpace(line[equals+1:])
+
+		var err error
+		switch {
+		case inInterface:
+			err = cfg.handleWgQuickInterfaceLine(key, value)
+		case peer != nil:
+			err = handleWgQuickPeerLine(peer, key, value)
+		default:
+			err = &ParseError{"Line must occur in a section", line}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !sawInterface {
+		return nil, &ParseError{"Missing section", "[Interface]"}
+	}
+	for i := range cfg.Peers {
+		if cfg.Peers[i].PublicKey.IsZero() {
+			return nil, &ParseError{"Peer is missing a public key", strconv.Itoa(i + 1)}
+		}
+	}
+	return cfg, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseWgQuickPrefix parses an address with optional prefix length;
+// a bare address is taken as a single host.
+func parseWgQuickPrefix(s string) (netaddr.IPPrefix, error) {
+	if strings.IndexByte(s, '/') >= 0 {
+		ipp, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			return netaddr.IPPrefix{}, &ParseError{"Invalid IP address with prefix length", s}
+		}
+		return ipp, nil
+	}
+	ip, err := netaddr.ParseIP(s)
+	if err != nil {
+		return netaddr.IPPrefix{}, &ParseError{"Invalid IP address", s}
+	}
+	bits := uint8(128)
+	if ip.Is4() {
+		bits = 32
+	}
+	return netaddr.IPPrefix{IP: ip, Bits: bits}, nil
+}
+
+func (cfg *Config) handleWgQuickInterfaceLine(key, value string) error {
+	switch key {
+	case "privatekey":
+		k, err := ParsePrivateKey(value)
+		if err != nil {
+			return err
+		}
+		cfg.PrivateKey = *k
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return &ParseError{"Invalid listen port", value}
+		}
+		cfg.ListenPort = uint16(port)
+	case "mtu":
+		mtu, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return &ParseError{"Invalid MTU", value}
+		}
+		cfg.MTU = uint16(mtu)
+	case "address":
+		for _, v := range splitList(value) {
+			ipp, err := parseWgQuickPrefix(v)
+			if err != nil {
+				return err
+			}
+			cfg.Addresses = append(cfg.Addresses, ipp)
+		}
+	case "dns":
+		for _, v := range splitList(value) {
+			// Non-address entries are search domains.
+			if ip, err := netaddr.ParseIP(v); err == nil {
+				cfg.DNS = append(cfg.DNS, ip)
+			} else {
+				cfg.DNSSearch = append(cfg.DNSSearch, v)
+			}
+		}
+	case "fwmark":
+		if value == "off" {
+			cfg.FwMark = 0
+			return nil
+		}
+		mark, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return &ParseError{"Invalid fwmark", value}
+		}
+		cfg.FwMark = uint32(mark)
+	case "table":
+		cfg.Table = value
+	case "preup":
+		cfg.PreUp = append(cfg.PreUp, value)
+	case "postup":
+		cfg.PostUp = append(cfg.PostUp, value)
+	case "predown":
+		cfg.PreDown = append(cfg.PreDown, value)
+	case "postdown":
+		cfg.PostDown = append(cfg.PostDown, value)
+	case "saveconfig":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return &ParseError{"Invalid SaveConfig", value}
+		}
+		cfg.SaveConfig = b
+	default:
+		return &ParseError{"Invalid key for [Interface] section", key}
+	}
+	return nil
+}
+
+func handleWgQuickPeerLine(peer *Peer, key, value string) error {
+	switch key {
+	case "publickey":
+		k, err := ParseKey(value)
+		if err != nil {
+			return err
+		}
+		peer.PublicKey = *k
+	case "allowedips":
+		for _, v := range splitList(value) {
+			ipp, err := parseWgQuickPrefix(v)
+			if err != nil {
+				return err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, ipp)
+		}
+	case "endpoint":
+		if err := validateEndpoints(value); err != nil {
+			return err
+		}
+		peer.Endpoints = value
+	case "persistentkeepalive":
+		if value == "off" {
+			peer.PersistentKeepalive = 0
+			return nil
+		}
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return &ParseError{"Invalid persistent keepalive", value}
+		}
+		peer.PersistentKeepalive = uint16(n)
+	case "presharedkey":
+		return &ParseError{"Preshared keys are not supported", "PresharedKey"}
+	default:
+		return &ParseError{"Invalid key for [Peer] section", key}
+	}
+	return nil
+}
+
+// ToWgQuick formats cfg as a wg-quick(8) configuration file, which
+// FromWgQuick parses back to cfg.
+func (cfg *Config) ToWgQuick() string {
+	output := new(strings.Builder)
+	line := func(key, value string) {
+		fmt.Fprintf(output, "%s = %s\n", key, value)
+	}
+	list := func(key string, values []string) {
+		if len(values) > 0 {
+			line(key, strings.Join(values, ", "))
+		}
+	}
+
+	output.WriteString("[Interface]\n")
+	if !cfg.PrivateKey.IsZero() {
+		line("PrivateKey", cfg.PrivateKey.String())
+	}
+	if cfg.ListenPort != 0 {
+		line("ListenPort", strconv.Itoa(int(cfg.ListenPort)))
+	}
+	if cfg.FwMark != 0 {
+		line("FwMark", strconv.FormatUint(uint64(cfg.FwMark), 10))
+	}
+	var addrs []string
+	for _, addr := range cfg.Addresses {
+		addrs = append(addrs, addr.String())
+	}
+	list("Address", addrs)
+	var dns []string
+	for _, ip := range cfg.DNS {
+		dns = append(dns, ip.String())
+	}
+	list("DNS", append(dns, cfg.DNSSearch...))
+	if cfg.MTU != 0 {
+		line("MTU", strconv.Itoa(int(cfg.MTU)))
+	}
+	if cfg.Table != "" {
+		line("Table", cfg.Table)
+	}
+	for _, cmd := range cfg.PreUp {
+		line("PreUp", cmd)
+	}
+	for _, cmd := range cfg.PostUp {
+		line("PostUp", cmd)
+	}
+	for _, cmd := range cfg.PreDown {
+		line("PreDown", cmd)
+	}
+	for _, cmd := range cfg.PostDown {
+		line("PostDown", cmd)
+	}
+	if cfg.SaveConfig {
+		line("SaveConfig", "true")
+	}
+
+	for _, peer := range cfg.Peers {
+		output.WriteString("\n[Peer]\n")
+		line("PublicKey", peer.PublicKey.Base64())
+		var allowed []string
+		for _, ipp := range peer.AllowedIPs {
+			allowed = append(allowed, ipp.String())
+		}
+		list("AllowedIPs", allowed)
+		if peer.Endpoints != "" {
+			line("Endpoint", peer.Endpoints)
+		}
+		if peer.PersistentKeepalive != 0 {
+			line("PersistentKeepalive", strconv.Itoa(int(peer.PersistentKeepalive)))
+		}
+	}
+	return output.String()
+}
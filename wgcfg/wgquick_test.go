@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package wgcfg
+
+import (
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+const testWgQuick = `
+# comment
+[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51820
+Address = 10.192.122.1/24, fd00::1
+DNS = 10.192.122.53, example.com
+MTU = 1380
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.192.122.3/32, 10.192.124.1/24
+Endpoint = 192.95.5.69:51820
+PersistentKeepalive = 25
+
+[peer]
+publickey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+AllowedIPs = 10.10.10.230 # trailing comment
+`
+
+func TestFromWgQuick(t *testing.T) {
+	cfg, err := FromWgQuick(strings.NewReader(testWgQuick), "wg0")
+	if !noError(t, err) {
+		return
+	}
+	priv, _ := ParsePrivateKey("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=")
+	pub1, _ := ParseKey("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	pub2, _ := ParseKey("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	want := &Config{
+		Name:       "wg0",
+		PrivateKey: *priv,
+		ListenPort: 51820,
+		MTU:        1380,
+		Addresses: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("10.192.122.1/24"),
+			netaddr.MustParseIPPrefix("fd00::1/128"),
+		},
+		DNS:       []netaddr.IP{netaddr.MustParseIP("10.192.122.53")},
+		DNSSearch: []string{"example.com"},
+		PostUp:    []string{"iptables -A FORWARD -i %i -j ACCEPT"},
+		Peers: []Peer{{
+			PublicKey: *pub1,
+			AllowedIPs: []netaddr.IPPrefix{
+				netaddr.MustParseIPPrefix("10.192.122.3/32"),
+				netaddr.MustParseIPPrefix("10.192.124.1/24"),
+			},
+			Endpoints:           "192.95.5.69:51820",
+			PersistentKeepalive: 25,
+		}, {
+			PublicKey:  *pub2,
+			AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.10.10.230/32")},
+		}},
+	}
+	equal(t, want, cfg)
+}
+
+func TestFromWgQuickErrors(t *testing.T) {
+	const iface = "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n"
+	tests := []struct {
+		name, conf, want string
+	}{
+		{"no interface", "[Peer]\n", "Missing section"},
+		{"outside section", "ListenPort = 1\n", "line 1: Line must occur in a section"},
+		{"no equals", iface + "ListenPort\n", "line 3: Config key is missing an equals separator"},
+		{"bad key", iface + "Bogus = 1\n", "line 3: Invalid key for [Interface] section"},
+		{"bad port", iface + "ListenPort = 70000\n", "line 3: Invalid listen port"},
+		{"bad allowed ip", iface + "[Peer]\nAllowedIPs = 10.0.0.300/32\n", "line 4: Invalid IP address with prefix length"},
+		{"no public key", iface + "[Peer]\nAllowedIPs = 10.0.0.1/32\n", "Peer is missing a public key"},
+		{"duplicate interface", iface + iface, "line 3: Duplicate section"},
+	}
+	for _, tt := range tests {
+		_, err := FromWgQuick(strings.NewReader(tt.conf), "wg0")
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want prefix %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestWgQuickRoundTrip(t *testing.T) {
+	cfg, err := FromWgQuick(strings.NewReader(testWgQuick), "wg0")
+	if !noError(t, err) {
+		return
+	}
+	cfg.FwMark = 0x1234
+	cfg.Table = "off"
+	cfg.PreDown = []string{"echo one", "echo two"}
+	cfg.SaveConfig = true
+	cfg.Peers[1].Endpoints = "[2607:5300:60:6b0::c05f:543]:2468,192.95.5.70:51820"
+
+	text := cfg.ToWgQuick()
+	got, err := FromWgQuick(strings.NewReader(text), "wg0")
+	if !noError(t, err) {
+		t.Logf("config:\n%s", text)
+		return
+	}
+	equal(t, cfg, got)
+}
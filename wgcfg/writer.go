@@ -8,6 +8,7 @@ package wgcfg
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -20,6 +21,11 @@ func (conf *Config) ToUAPI() (string, error) {
 		fmt.Fprintf(output, "listen_port=%d\n", conf.ListenPort)
 	}
 
+	if conf.FwMark > 0 {
+		fmt.Fprintf(output, "fwmark=%d\n", conf.FwMark)
+	}
+	writeExtensions(output, conf.Extensions)
+
 	output.WriteString("replace_peers=true\n")
 
 	for _, peer := range conf.Peers {
@@ -27,6 +33,35 @@ func (conf *Config) ToUAPI() (string, error) {
 		fmt.Fprintf(output, "protocol_version=1\n")
 		fmt.Fprintf(output, "replace_allowed_ips=true\n")
 
+		// Only written when set, so that other implementations can
+		// read configurations that do not use the extension.
+		if peer.Passive {
+			fmt.Fprintf(output, "passive=true\n")
+		}
+		if peer.Disabled {
+			fmt.Fprintf(output, "disabled=true\n")
+		}
+		if !peer.NotBefore.IsZero() {
+			fmt.Fprintf(output, "not_before=%d\n", peer.NotBefore.Unix())
+		}
+		if !peer.NotAfter.IsZero() {
+			fmt.Fprintf(output, "not_after=%d\n", peer.NotAfter.Unix())
+		}
+		if peer.MTU != 0 {
+			fmt.Fprintf(output, "mtu=%d\n", peer.MTU)
+		}
+		if peer.LocalAddr != "" {
+			fmt.Fprintf(output, "local_addr=%s\n", peer.LocalAddr)
+		}
+		if len(peer.HandshakeSources) > 0 {
+			sources := make([]string, len(peer.HandshakeSources))
+			for i, source := range peer.HandshakeSources {
+				sources[i] = source.String()
+			}
+			fmt.Fprintf(output, "handshake_sources=%s\n", strings.Join(sources, ","))
+		}
+		writeExtensions(output, peer.Extensions)
+
 		if len(peer.AllowedIPs) > 0 {
 			for _, address := range peer.AllowedIPs {
 				fmt.Fprintf(output, "allowed_ip=%s\n", address.String())
@@ -37,10 +72,24 @@ func (conf *Config) ToUAPI() (string, error) {
 		if peer.Endpoints != "" {
 			eps := strings.Split(peer.Endpoints, ",")
 			for _, ep := range eps {
+				if scheme, rest, ok := splitScheme(ep); ok {
+					if scheme != "udp" {
+						// Another transport's, to be parsed by it.
+						reps = append(reps, ep)
+						continue
+					}
+					ep = rest
+				}
 				host, port, err := parseEndpoint(ep)
 				if err != nil {
 					return "", err
 				}
+				if _, _, ok := splitZone(host); ok {
+					// A link-local address, which lookups would
+					// strip of its zone.
+					reps = append(reps, net.JoinHostPort(host, strconv.Itoa(int(port))))
+					continue
+				}
 				ips, err := net.LookupIP(host)
 				if err != nil {
 					return "", err
@@ -70,3 +119,14 @@ func (conf *Config) ToUAPI() (string, error) {
 	}
 	return output.String(), nil
 }
+
+func writeExtensions(output *strings.Builder, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(output, "%s=%s\n", key, m[key])
+	}
+}